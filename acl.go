@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// checkPermissions checks the consul token can create sessions and write key,
+// without changing anything: the session is destroyed right away and the write
+// is a check-and-set on an index the key can not have, so it is always rolled
+// back but consul still checks we are allowed to do it.
+func checkPermissions(client *api.Client, key string) error {
+	sessionID, _, err := client.Session().Create(&api.SessionEntry{Name: "mutex-preflight", TTL: "10s"}, nil)
+	if err != nil {
+		if isPermissionDenied(err.Error()) {
+			return fmt.Errorf("%w: the consul token can not create sessions, it needs session:write on this node: %s", ErrPermissionDenied, err)
+		}
+		return err
+	}
+	client.Session().Destroy(sessionID, nil)
+
+	ops := api.TxnOps{
+		{KV: &api.KVTxnOp{Verb: api.KVCAS, Key: key, Index: math.MaxUint64}},
+	}
+	_, resp, _, err := client.Txn().Txn(ops, nil)
+	if err != nil {
+		if isPermissionDenied(err.Error()) {
+			return fmt.Errorf("%w: the consul token can not write %s, it needs key:write on it: %s", ErrPermissionDenied, key, err)
+		}
+		return err
+	}
+	for _, e := range resp.Errors {
+		if isPermissionDenied(e.What) {
+			return fmt.Errorf("%w: the consul token can not write %s, it needs key:write on it: %s", ErrPermissionDenied, key, e.What)
+		}
+	}
+	return nil
+}
+
+// isPermissionDenied tells if a consul error message is an ACL error
+func isPermissionDenied(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "permission denied") || strings.Contains(msg, "403") || strings.Contains(msg, "acl not found")
+}
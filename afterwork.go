@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// afterWorkPolicy is what we do when the work returns while we are still leader
+type afterWorkPolicy string
+
+const (
+	afterWorkRelease afterWorkPolicy = "release" // Give the lock back right away
+	afterWorkHold    afterWorkPolicy = "hold"    // Keep the lock, idle, until ctx is done or we lose it
+	afterWorkRerun   afterWorkPolicy = "rerun"   // Keep the lock and run the work again after rerunInterval
+)
+
+// checkAfterWork checks an -after-work policy is known
+func checkAfterWork(policy string) error {
+	switch afterWorkPolicy(policy) {
+	case afterWorkRelease, afterWorkHold, afterWorkRerun:
+		return nil
+	}
+	return fmt.Errorf("unknown -after-work policy %q", policy)
+}
+
+// keepLeading wraps fn so it follows the afterWork policy. Only work that finishes
+// fine keeps the leadership, when fn fails we release so someone else can try.
+// Once ctx is done (we lost the lock, resigned or are exiting) it returns nil.
+func (ec *exclusiveWorker) keepLeading(fn func(ctx context.Context) error) func(ctx context.Context) error {
+	switch ec.afterWork {
+	case afterWorkHold, afterWorkRerun:
+	default:
+		return fn
+	}
+
+	return func(ctx context.Context) error {
+		for {
+			if err := fn(ctx); err != nil || ctx.Err() != nil {
+				return err
+			}
+			if ec.afterWork == afterWorkHold {
+				ec.logf("Work done, holding the lock")
+				<-ctx.Done()
+				return nil
+			}
+			ec.logf("Work done, running it again in %s", ec.rerunInterval)
+			select {
+			case <-ec.clock.After(ec.rerunInterval):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
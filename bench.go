@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// benchTransition is a transition of one of the bench contenders
+type benchTransition struct {
+	contender int
+	Transition
+}
+
+// runBench runs a benchmark against consul, failover or scoped, and returns the exit code
+func runBench(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "failover":
+			return runBenchFailover(args[1:])
+		case "scoped":
+			return runBenchScoped(args[1:])
+		}
+	}
+	log.Println("bench: give the benchmark, failover or scoped")
+	return 2
+}
+
+// runBenchFailover measures failovers: two contenders in the process, the session of
+// the leader is destroyed as if its node died, and we measure how long the other one
+// (or the same one, contending again) takes to hold the key, and how long the old
+// leader believed it still held it:
+//
+//	mutual-exclusion-consul bench failover -iterations 20 -ttl 10s -lock-delay 1s
+//
+// With the consul default lock-delay every failover takes at least 15s.
+func runBenchFailover(args []string) int {
+	fs := flag.NewFlagSet("bench failover", flag.ExitOnError)
+	key := fs.String("key", "mutex-bench/failover", "lock key the contenders fight for, nothing else should use it")
+	iterations := fs.Int("iterations", 10, "how many failovers to measure")
+	ttl := fs.String("ttl", "15s", "TTL of the sessions")
+	lockDelay := fs.Duration("lock-delay", 0, "lock-delay of the sessions, 0 keeps the consul default (15s)")
+	timeout := fs.Duration("timeout", 2*time.Minute, "give up on a failover after this long")
+	fs.Parse(args)
+	if err := validateKey(*key); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if err := checkTTL(*ttl); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if *iterations < 1 {
+		log.Println("-iterations must be positive")
+		return 2
+	}
+	client, err := api.NewClient(&api.Config{Address: consulAddress})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transitions := make(chan benchTransition, 64)
+	contenders := make([]*exclusiveWorker, 2)
+	for i := range contenders {
+		i := i
+		contenders[i] = newExclusiveWorker(&exclusiveWorkerConfig{
+			client:          client,
+			key:             *key,
+			sessionTimeout:  *ttl,
+			lockDelay:       *lockDelay,
+			adaptiveRenewal: true,
+			verifyAcquire:   true,
+			onTransition: func(t Transition) {
+				select {
+				case transitions <- benchTransition{contender: i, Transition: t}:
+				default:
+				}
+			},
+		})
+		defer contenders[i].Close()
+		go contenders[i].RunElected(ctx, func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		})
+	}
+
+	// The first leader, nothing to measure
+	if _, err := benchWaitHeld(transitions, -1, time.Time{}, *timeout); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	var takeovers, stale []time.Duration
+	for n := 0; n < *iterations; n++ {
+		leader := -1
+		for i, c := range contenders {
+			if c.State() == StateHeld {
+				leader = i
+			}
+		}
+		if leader < 0 {
+			log.Println("bench: nobody holds the key")
+			return 1
+		}
+
+		killed := time.Now()
+		if _, err := client.Session().Destroy(contenders[leader].currentSession(), nil); err != nil {
+			log.Println(err)
+			return 1
+		}
+		r, err := benchWaitHeld(transitions, leader, killed, *timeout)
+		if err != nil {
+			log.Printf("bench: failover %d: %s", n+1, err)
+			return 1
+		}
+		takeovers = append(takeovers, r.takeover)
+		stale = append(stale, r.stale)
+		fmt.Printf("failover %d/%d: new leader after %s, old leader stepped down after %s\n",
+			n+1, *iterations, r.takeover.Round(time.Millisecond), r.stale.Round(time.Millisecond))
+	}
+
+	printPercentiles(benchMeasure{"time to new leader", takeovers}, benchMeasure{"old leader stepped down", stale})
+	return 0
+}
+
+// runBenchScoped measures AcquireScoped against a session per lock, the cost of
+// creating (and destroying) a session on the critical path of every lock:
+//
+//	mutual-exclusion-consul bench scoped -iterations 500 -concurrency 8 -keys 4
+func runBenchScoped(args []string) int {
+	fs := flag.NewFlagSet("bench scoped", flag.ExitOnError)
+	prefix := fs.String("prefix", "mutex-bench/scoped", "prefix of the keys, nothing else should use it")
+	iterations := fs.Int("iterations", 200, "how many locks to take with each method")
+	concurrency := fs.Int("concurrency", 4, "how many goroutines take locks at the same time")
+	keys := fs.Int("keys", 4, "how many keys the goroutines share, fewer keys is more contention")
+	ttl := fs.String("ttl", "15s", "TTL of the sessions")
+	poolSize := fs.Int("pool-size", defaultScopedPoolSize, "how many sessions the scoped locks share")
+	fs.Parse(args)
+	if err := checkTTL(*ttl); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if *iterations < 1 || *concurrency < 1 || *keys < 1 {
+		log.Println("-iterations, -concurrency and -keys must be positive")
+		return 2
+	}
+	if err := SetScopedPoolSize(*poolSize); err != nil {
+		log.Println(err)
+		return 2
+	}
+	client, err := api.NewClient(&api.Config{Address: consulAddress})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	// Like a service would at startup, so the first locks do not wait for the sessions
+	WarmScoped(client, *ttl)
+
+	methods := []struct {
+		name string
+		lock func(ctx context.Context, key string) (func() error, error)
+	}{
+		{"scoped (session pool)", func(ctx context.Context, key string) (func() error, error) {
+			l, err := AcquireScoped(ctx, client, key, *ttl)
+			if err != nil {
+				return nil, err
+			}
+			return l.Release, nil
+		}},
+		{"session per lock", func(ctx context.Context, key string) (func() error, error) {
+			w := newExclusiveWorker(&exclusiveWorkerConfig{client: client, key: key, sessionTimeout: *ttl})
+			if _, err := w.Acquire(ctx); err != nil {
+				w.Close()
+				return nil, err
+			}
+			return func() error { w.Resign(); return w.Close() }, nil
+		}},
+	}
+	var measures []benchMeasure
+	for _, m := range methods {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		latencies, err := benchLocks(ctx, *iterations, *concurrency, func(n int) (time.Duration, error) {
+			start := time.Now()
+			release, err := m.lock(ctx, fmt.Sprintf("%s/%d", *prefix, n%*keys))
+			if err != nil {
+				return 0, err
+			}
+			took := time.Since(start)
+			return took, release()
+		})
+		cancel()
+		if err != nil {
+			log.Printf("bench: %s: %s", m.name, err)
+			return 1
+		}
+		measures = append(measures, benchMeasure{m.name, latencies})
+	}
+	printPercentiles(measures...)
+	return 0
+}
+
+// benchLocks calls lock iterations times from concurrency goroutines and returns
+// the durations it returned
+func benchLocks(ctx context.Context, iterations, concurrency int, lock func(n int) (time.Duration, error)) ([]time.Duration, error) {
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for n := 0; n < iterations; n++ {
+			select {
+			case next <- n:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				took, err := lock(n)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				latencies = append(latencies, took)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr == nil && len(latencies) < iterations {
+		firstErr = ctx.Err()
+	}
+	return latencies, firstErr
+}
+
+// benchMeasure is a set of durations to print the percentiles of
+type benchMeasure struct {
+	name string
+	d    []time.Duration
+}
+
+// printPercentiles prints a table of the percentiles of measures
+func printPercentiles(measures ...benchMeasure) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nMEASURE\tMIN\tP50\tP90\tP99\tMAX")
+	for _, m := range measures {
+		sort.Slice(m.d, func(i, j int) bool { return m.d[i] < m.d[j] })
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", m.name, m.d[0].Round(time.Millisecond),
+			percentile(m.d, 0.5), percentile(m.d, 0.9), percentile(m.d, 0.99), m.d[len(m.d)-1].Round(time.Millisecond))
+	}
+	tw.Flush()
+}
+
+// failoverResult is what one failover took
+type failoverResult struct {
+	takeover time.Duration // Until someone held the key again
+	stale    time.Duration // Until the old leader stopped believing it held it
+}
+
+// benchWaitHeld waits until the old leader stepped down and someone holds the key
+// again, measured from killed. With no old leader (-1) it only waits for a holder.
+func benchWaitHeld(transitions <-chan benchTransition, old int, killed time.Time, timeout time.Duration) (failoverResult, error) {
+	var r failoverResult
+	steppedDown, held := old < 0, false
+	deadline := time.After(timeout)
+	for !steppedDown || !held {
+		select {
+		case t := <-transitions:
+			switch {
+			case t.contender == old && t.From == StateHeld && !steppedDown:
+				steppedDown, r.stale = true, t.At.Sub(killed)
+			case t.To == StateHeld && (t.contender != old || steppedDown):
+				held, r.takeover = true, t.At.Sub(killed)
+			}
+		case <-deadline:
+			return r, errors.New("timed out waiting for a new leader")
+		}
+	}
+	return r, nil
+}
+
+// percentile returns the q quantile of sorted durations, nearest rank
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	i := int(float64(len(sorted))*q+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i].Round(time.Millisecond)
+}
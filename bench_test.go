@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// The benchmarks run against the memory backend, and against the dev Consul at
+// $MUTEX_TEST_CONSUL with the Consul suffix:
+//
+//	go test -run XXX -bench . -benchmem
+func BenchmarkAcquire(b *testing.B) {
+	_, client := newTestConsul(b)
+	benchAcquire(b, client)
+}
+
+func BenchmarkAcquireConsul(b *testing.B) {
+	benchAcquire(b, devConsul(b))
+}
+
+func BenchmarkRenew(b *testing.B) {
+	_, client := newTestConsul(b)
+	benchRenew(b, client)
+}
+
+func BenchmarkRenewConsul(b *testing.B) {
+	benchRenew(b, devConsul(b))
+}
+
+func BenchmarkWatchLatency(b *testing.B) {
+	_, client := newTestConsul(b)
+	benchWatchLatency(b, client)
+}
+
+func BenchmarkWatchLatencyConsul(b *testing.B) {
+	benchWatchLatency(b, devConsul(b))
+}
+
+// BenchmarkAcquireScoped compares AcquireScoped, whose session comes from the pool,
+// with a session created and destroyed for every lock like runBenchScoped does. Every
+// lock has a key of its own, like the locks of different requests: the lock-delay of
+// a destroyed session does not hold the next lock back.
+func BenchmarkAcquireScoped(b *testing.B) {
+	_, client := newTestConsul(b)
+	const ttl = "10s"
+	if err := WarmScoped(client, ttl); err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+
+	b.Run("pooled", func(b *testing.B) {
+		prefix := benchKey(b)
+		for i := 0; i < b.N; i++ {
+			l, err := AcquireScoped(ctx, client, fmt.Sprintf("%s/%d", prefix, i), ttl)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := l.Release(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "acquisitions/s")
+	})
+	b.Run("session-per-lock", func(b *testing.B) {
+		prefix := benchKey(b)
+		for i := 0; i < b.N; i++ {
+			w := newExclusiveWorker(&exclusiveWorkerConfig{
+				client:         client,
+				key:            fmt.Sprintf("%s/%d", prefix, i),
+				sessionTimeout: ttl,
+				quiet:          true,
+			})
+			l, err := w.Acquire(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := l.Release(); err != nil {
+				b.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "acquisitions/s")
+	})
+}
+
+// benchKey returns a key of its own for the benchmark
+func benchKey(b *testing.B) string {
+	return fmt.Sprintf("test/bench/%s/%d", b.Name(), time.Now().UnixNano())
+}
+
+// benchAcquire measures a whole contention of the acquire loop: check the session,
+// acquire the key and release it. The session is kept like with -keep-session, destroying
+// it would make the next acquisition wait for the lock-delay.
+func benchAcquire(b *testing.B, client *api.Client) {
+	ec := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:         client,
+		key:            benchKey(b),
+		sessionTimeout: "10s",
+		keepSession:    true,
+	})
+	defer ec.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ec.createSession(); err != nil {
+			b.Fatal(err)
+		}
+		if ok, err := ec.acquireSession(); !ok {
+			b.Fatalf("not acquired: %v", err)
+		}
+		if err := ec.destroySession(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "acquisitions/s")
+}
+
+// benchRenew measures one renewal of the session we lead with, and what it costs to
+// move the deadlines of the work contexts following it
+func benchRenew(b *testing.B, client *api.Client) {
+	for _, leases := range []int{0, 100} {
+		b.Run(fmt.Sprintf("leases=%d", leases), func(b *testing.B) {
+			ec := newExclusiveWorker(&exclusiveWorkerConfig{
+				client:         client,
+				key:            benchKey(b),
+				sessionTimeout: "10s",
+				lockDelay:      time.Millisecond,
+			})
+			defer ec.Close()
+			if err := ec.createSession(); err != nil {
+				b.Fatal(err)
+			}
+			if ok, err := ec.acquireSession(); !ok {
+				b.Fatalf("not acquired: %v", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			for i := 0; i < leases; i++ {
+				ec.WorkContext(ctx)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := ec.Extend(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			ec.Resign()
+			ec.destroySession()
+		})
+	}
+}
+
+// benchWatchLatency measures how long a change of a key takes to reach a follower
+// watching it, from the write to the call of its handler
+func benchWatchLatency(b *testing.B, client *api.Client) {
+	key := benchKey(b)
+	seen := make(chan string, 1)
+	f := newFollower(client, map[string]interface{}{"type": "key", "key": key}, func(_ uint64, raw interface{}) {
+		if pair, ok := raw.(*api.KVPair); ok {
+			select {
+			case seen <- string(pair.Value):
+			default:
+			}
+		}
+	})
+	if _, err := client.KV().Put(&api.KVPair{Key: key, Value: []byte("start")}, nil); err != nil {
+		b.Fatal(err)
+	}
+	if err := f.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer f.Stop()
+	defer client.KV().Delete(key, nil)
+	waitFor(b, seen, "start")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		value := strconv.Itoa(i)
+		if _, err := client.KV().Put(&api.KVPair{Key: key, Value: []byte(value)}, nil); err != nil {
+			b.Fatal(err)
+		}
+		waitFor(b, seen, value)
+	}
+}
+
+// waitFor waits until the follower has seen value
+func waitFor(b *testing.B, seen <-chan string, value string) {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case v := <-seen:
+			if v == value {
+				return
+			}
+		case <-timeout:
+			b.Fatalf("the follower did not see %q", value)
+		}
+	}
+}
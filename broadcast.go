@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// leaderEventPrefix is the prefix of the user events fired when the leadership
+// of a key changes, the key follows it: leader-changed:<key>
+const leaderEventPrefix = "leader-changed:"
+
+// leaderEventName returns the name of the user event fired for key
+func leaderEventName(key string) string {
+	return leaderEventPrefix + key
+}
+
+// LeaderChange is the payload of the leader-changed user event. Consul limits
+// the payload size so it only says what happened, ResolveLeader has the rest.
+type LeaderChange struct {
+	Reason       string `json:"reason"` // acquired or released
+	SessionID    string `json:"session_id"`
+	Hostname     string `json:"hostname,omitempty"`
+	LeadershipID string `json:"leadership_id"`
+}
+
+// fireLeaderEventOnTransition fires a consul user event when we get or give back
+// the lock, so agents watching events (consul watch -type=event) can react without
+// polling the KV. A lost leadership is not announced: we can not be sure consul
+// hears from us, the next leader's event tells the story.
+func (ec *exclusiveWorker) fireLeaderEventOnTransition(t Transition) {
+	var reason string
+	switch {
+	case t.To == StateHeld:
+		reason = "acquired"
+	case t.From == StateDraining && t.To == StateReleased:
+		reason = "released"
+	default:
+		return
+	}
+
+	// The session is already gone when we hear about the release, the lock info still has it
+	ec.mu.Lock()
+	sessionID := ec.lockInfo.Session
+	ec.mu.Unlock()
+
+	hostname, _ := os.Hostname()
+	payload, err := json.Marshal(LeaderChange{
+		Reason:       reason,
+		SessionID:    sessionID,
+		Hostname:     hostname,
+		LeadershipID: t.LeadershipID,
+	})
+	if err != nil {
+		return
+	}
+	_, _, err = ec.client.Event().Fire(&api.UserEvent{Name: leaderEventName(ec.key), Payload: payload}, nil)
+	if err != nil {
+		ec.logf("Could not fire %s event: %s", leaderEventName(ec.key), err)
+	}
+}
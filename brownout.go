@@ -0,0 +1,66 @@
+package main
+
+import "time"
+
+const (
+	// minBlockingTime is how long a blocking query that returns without changes
+	// is expected to block at least. Returning sooner means consul is not blocking,
+	// usually because it is overloaded
+	minBlockingTime = time.Second
+	// staleAfter is after how many bad blocking queries in a row we consider what
+	// we know about the leadership stale
+	staleAfter = 3
+)
+
+// brownout watches the blocking queries of a watch. When they fail or return right away
+// without changes (a consul brownout) it backs off more and more instead of spinning,
+// and after staleAfter of them it marks what we know as stale until they behave again.
+type brownout struct {
+	backoff  Backoff
+	failures int
+	stale    bool
+}
+
+func newBrownout() *brownout {
+	return &brownout{backoff: defaultBackoff}
+}
+
+// observe records a blocking query that took elapsed. It returns how long to
+// wait before the next one and whether the stale flag changed.
+func (b *brownout) observe(elapsed time.Duration, changed bool, err error) (time.Duration, bool) {
+	if err == nil && (changed || elapsed >= minBlockingTime) {
+		b.failures = 0
+		if b.stale {
+			b.stale = false
+			return 0, true
+		}
+		return 0, false
+	}
+
+	b.failures++
+	if b.failures >= staleAfter && !b.stale {
+		b.stale = true
+		return b.backoff.next(b.failures), true
+	}
+	return b.backoff.next(b.failures), false
+}
+
+// observeWatch records a blocking query of the worker's elector, updating the metrics
+// and emitting EventStale and EventRecovered. It returns how long to wait.
+func (ec *exclusiveWorker) observeWatch(start time.Time, changed bool, err error) time.Duration {
+	if err != nil {
+		ec.metrics.watchErrors.Add(1)
+	}
+	wait, flipped := ec.watchHealth.observe(ec.since(start), changed, err)
+	if !flipped {
+		return wait
+	}
+	if ec.watchHealth.stale {
+		ec.metrics.watchStale.Set(1)
+		ec.emit(EventStale, "consul blocking queries are failing or not blocking, leadership information may be stale")
+	} else {
+		ec.metrics.watchStale.Set(0)
+		ec.emit(EventRecovered, "consul blocking queries are back to normal")
+	}
+	return wait
+}
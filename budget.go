@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// defaultRetryRate is how many retries per second a shared retry budget allows
+// once its burst is spent
+const defaultRetryRate = 2
+
+// retryBudget is a token bucket shared by the workers of a process that use the same
+// consul client. Every retry after a consul error takes a token, and once the burst
+// is spent the retries queue up at rate per second, so in a consul outage N workers
+// don't all hammer the agent every retryInterval. The waits are jittered so the
+// workers don't come back all at once either.
+type retryBudget struct {
+	mu     sync.Mutex
+	burst  float64
+	rate   float64 // Tokens per second
+	tokens float64 // Negative when retries are queued
+	last   time.Time
+}
+
+// newRetryBudget returns a full budget of burst retries refilling at rate per second
+func newRetryBudget(burst int, rate float64) *retryBudget {
+	return &retryBudget{burst: float64(burst), rate: rate, tokens: float64(burst)}
+}
+
+// reserve takes a token and returns how long to wait until it is ours, 0 if there
+// was one left
+func (b *retryBudget) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// retry waits before trying again after a consul error: retryInterval plus, with a
+// retry budget, the wait for a token and up to retryInterval of jitter.
+// It returns early if ctx is done or the worker is closed.
+func (ec *exclusiveWorker) retry(ctx context.Context) error {
+	wait := retryInterval
+	if ec.retryBudget != nil {
+		if queued := ec.retryBudget.reserve(ec.clock.Now()); queued > 0 {
+			wait += queued + time.Duration(rand.Int63n(int64(retryInterval)))
+		}
+	}
+	return ec.sleep(ctx, wait)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/consul/api"
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+const (
+	// maxValueSize is the default size limit of a consul KV value (kv_max_value_size)
+	maxValueSize = 512 * 1024
+	// chunkSize is the size of the chunks of large shared values. Consul limits
+	// transactions to 512KB too, and values are base64 encoded in them
+	chunkSize = 256 * 1024
+)
+
+// ErrValueTooLarge is returned when writing a value larger than consul accepts
+var ErrValueTooLarge = errors.New("value larger than the consul KV limit")
+
+// checkValueSize fails if value can not be stored in a single KV entry
+func checkValueSize(key string, value []byte) error {
+	if len(value) > maxValueSize {
+		return fmt.Errorf("%w: %s is %d bytes, the limit is %d", ErrValueTooLarge, key, len(value), maxValueSize)
+	}
+	return nil
+}
+
+// chunkRef points the entry of a large shared value to its chunks
+type chunkRef struct {
+	ID     string `json:"id"` // Generation of the chunks, a new one for every Publish
+	Count  int    `json:"count"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// chunkPrefix is where the chunks of the large shared values of key are written,
+// outside of the shared prefix so followers do not see them as values
+func chunkPrefix(key, name string) string {
+	return key + "/shared-chunks/" + name + "/"
+}
+
+// publishChunked writes a value too large for one KV entry in chunks, then the entry
+// itself pointing to them. Consul limits the size of a transaction, so the chunks
+// are written one by one (each checking we are still leader) under a new generation
+// and the entry is switched to it last: followers never see a partial value.
+// The chunks of older generations are deleted afterwards.
+func (ec *exclusiveWorker) publishChunked(key string, sv SharedValue, value []byte) error {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(value)
+	ref := &chunkRef{ID: id, Size: len(value), SHA256: hex.EncodeToString(sum[:])}
+	prefix := chunkPrefix(ec.key, sv.Name)
+
+	for start := 0; start < len(value); start += chunkSize {
+		end := start + chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		if err := ec.KVPutIfHeld(prefix+id+"/"+strconv.Itoa(ref.Count), value[start:end]); err != nil {
+			return err
+		}
+		ref.Count++
+	}
+
+	sv.Data = nil
+	sv.Chunks = ref
+	if err := ec.putShared(key, sv); err != nil {
+		return err
+	}
+
+	generations, _, err := ec.client.KV().Keys(prefix, "/", nil)
+	if err != nil {
+		ec.logf("Could not list old chunks of %s: %s", key, err)
+		return nil
+	}
+	for _, g := range generations {
+		if g != prefix+id+"/" {
+			if err := ec.txnIfHeld(&api.KVTxnOp{Verb: api.KVDeleteTree, Key: g}); err != nil {
+				ec.logf("Could not delete old chunks %s: %s", g, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readChunks reassembles a chunked shared value of key
+func readChunks(client *api.Client, key, name string, ref *chunkRef) ([]byte, error) {
+	var value bytes.Buffer
+	prefix := chunkPrefix(key, name) + ref.ID + "/"
+	for i := 0; i < ref.Count; i++ {
+		pair, _, err := client.KV().Get(prefix+strconv.Itoa(i), &api.QueryOptions{RequireConsistent: true})
+		if err != nil {
+			return nil, err
+		}
+		if pair == nil {
+			// A newer value replaced it while we were reading
+			return nil, fmt.Errorf("chunk %d of %s is gone", i, prefix)
+		}
+		value.Write(pair.Value)
+	}
+	sum := sha256.Sum256(value.Bytes())
+	if value.Len() != ref.Size || hex.EncodeToString(sum[:]) != ref.SHA256 {
+		return nil, fmt.Errorf("chunks of %s are corrupted", prefix)
+	}
+	return value.Bytes(), nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// encryptedPrefix marks encrypted values, so plain values written by older
+// versions (or without a key) can still be read
+var encryptedPrefix = []byte("enc:v1:")
+
+// ErrEncrypted is returned when reading an encrypted value without a Cipher
+var ErrEncrypted = errors.New("value is encrypted and no encryption key is configured")
+
+// Cipher encrypts the values we write to the KV (holder metadata and shared state)
+// with AES-GCM, for KV trees readable by people who should not see what is in them.
+// The KV key is authenticated too, so a value can not be moved to another key.
+// A nil *Cipher leaves values in plain text.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// newCipher creates a Cipher from a base64 AES key of 16, 24 or 32 bytes.
+// An empty key returns a nil Cipher.
+func newCipher(key string) (*Cipher, error) {
+	if key == "" {
+		return nil, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not valid base64: %s", err)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// seal encrypts the value of kvKey
+func (c *Cipher) seal(kvKey string, value []byte) ([]byte, error) {
+	if c == nil {
+		return value, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := c.aead.Seal(nonce, nonce, value, []byte(kvKey))
+	out := make([]byte, len(encryptedPrefix)+base64.StdEncoding.EncodedLen(len(sealed)))
+	copy(out, encryptedPrefix)
+	base64.StdEncoding.Encode(out[len(encryptedPrefix):], sealed)
+	return out, nil
+}
+
+// open decrypts the value of kvKey. Plain values are returned as they are
+func (c *Cipher) open(kvKey string, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	if c == nil {
+		return nil, ErrEncrypted
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(value[len(encryptedPrefix):]))
+	if err != nil {
+		return nil, err
+	}
+	size := c.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, errors.New("encrypted value is too short")
+	}
+	return c.aead.Open(nil, sealed[:size], sealed[size:], []byte(kvKey))
+}
@@ -0,0 +1,53 @@
+package main
+
+import "time"
+
+//go:generate mockgen -source clock.go -destination clock_mock.go -package main
+
+// Clock is where the worker gets the time and its timers from. The renewal
+// cadence, the lease deadlines, the cooldowns and the window all go through it,
+// so they can be driven by a fake clock instead of real sleeps.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is the part of *time.Timer the worker uses
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is the part of *time.Ticker the worker uses
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// systemClock is the real time, the default Clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+func (systemClock) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// since is time.Since with the worker's clock
+func (ec *exclusiveWorker) since(t time.Time) time.Duration {
+	return ec.clock.Now().Sub(t)
+}
+
+// until is time.Until with the worker's clock
+func (ec *exclusiveWorker) until(t time.Time) time.Duration {
+	return t.Sub(ec.clock.Now())
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when the test advances it, so the renewal
+// loop can be stepped one renewal at a time
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+// fakeTimer fires ch or fn once the clock reaches at
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	ch    chan time.Time
+	fn    func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, t)
+	return t.ch
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), fn: f}
+	c.waiters = append(c.waiters, t)
+	return t
+}
+
+// NewTicker is not stepped, the tests using fakeClock do not verify ownership
+func (c *fakeClock) NewTicker(time.Duration) Ticker {
+	return fakeTicker{}
+}
+
+// Advance moves the clock forward by d and fires what is due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	pending := c.waiters[:0]
+	for _, t := range c.waiters {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.waiters = pending
+	now := c.now
+	c.mu.Unlock()
+
+	for _, t := range due {
+		if t.fn != nil {
+			t.fn()
+		} else {
+			t.ch <- now
+		}
+	}
+}
+
+// nextAfter returns how far the earliest channel of After is, false if nothing waits on one
+func (c *fakeClock) nextAfter() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var next time.Time
+	for _, t := range c.waiters {
+		if t.ch != nil && (next.IsZero() || t.at.Before(next)) {
+			next = t.at
+		}
+	}
+	return next.Sub(c.now), !next.IsZero()
+}
+
+// awaitAfter waits until something waits on a channel of After or done is closed.
+// It returns false if done was closed.
+func (c *fakeClock) awaitAfter(tb testing.TB, done <-chan struct{}) bool {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := c.nextAfter(); ok {
+			return true
+		}
+		select {
+		case <-done:
+			return false
+		case <-time.After(time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			tb.Fatal("nothing waits on the clock")
+		}
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.waiters {
+		if other == t {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	active := t.Stop()
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.at = c.now.Add(d)
+	c.waiters = append(c.waiters, t)
+	return active
+}
+
+type fakeTicker struct{}
+
+func (fakeTicker) C() <-chan time.Time { return nil }
+func (fakeTicker) Stop()               {}
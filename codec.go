@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+//go:generate mockgen -source codec.go -destination codec_mock.go -package main
+
+// Codec encodes the values we write to the KV for other processes to read: the
+// holder metadata, the shared state, the handover and the work results. Values
+// written with any codec but JSON are wrapped in an envelope naming the codec, so
+// readers decode them whatever codec they are configured with, as long as it is
+// registered. The user data inside (SharedValue.Data, Handover.Data...) stays JSON.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Built-in codecs
+const (
+	codecJSON     = "json"     // Plain JSON without envelope, what older versions write, the default
+	codecMsgpack  = "msgpack"  // The JSON document in msgpack
+	codecProtobuf = "protobuf" // The JSON document as a google.protobuf.Value
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		codecJSON:     jsonCodec{},
+		codecMsgpack:  msgpackCodec{},
+		codecProtobuf: protobufCodec{},
+	}
+)
+
+// RegisterCodec adds a custom codec, chosen by its name with -codec. Every process
+// reading the values it writes must register it too.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// lookupCodec returns the codec registered as name
+func lookupCodec(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q, use one of %s", name, strings.Join(codecNames(), ", "))
+	}
+	return c, nil
+}
+
+// codecNames lists the registered codecs. codecsMu must be held
+func codecNames() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// envelopeVersion is the version of the envelopes we write. The header is JSON, so
+// a reader ignores the fields added by newer versions
+const envelopeVersion = 1
+
+// envelopePrefix matches the start of an envelope of any version, followed by the
+// header and a newline: mx:v1:{"codec":"msgpack"}\n<value>
+var envelopePrefix = regexp.MustCompile(`^mx:v[0-9]+:`)
+
+// envelopeHeader describes the value of an envelope
+type envelopeHeader struct {
+	Codec string `json:"codec"`
+}
+
+// encodeValue encodes v with c, in an envelope unless c is nil or JSON
+func encodeValue(c Codec, v interface{}) ([]byte, error) {
+	if c == nil || c.Name() == codecJSON {
+		return json.Marshal(v)
+	}
+	value, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	header, err := json.Marshal(envelopeHeader{Codec: c.Name()})
+	if err != nil {
+		return nil, err
+	}
+	out := fmt.Appendf(nil, "mx:v%d:%s\n", envelopeVersion, header)
+	return append(out, value...), nil
+}
+
+// decodeValue decodes a value written by encodeValue with any registered codec
+func decodeValue(data []byte, v interface{}) error {
+	loc := envelopePrefix.FindIndex(data)
+	if loc == nil {
+		return json.Unmarshal(data, v)
+	}
+	header, value, ok := bytes.Cut(data[loc[1]:], []byte("\n"))
+	if !ok {
+		return errors.New("envelope without header")
+	}
+	var h envelopeHeader
+	if err := json.Unmarshal(header, &h); err != nil {
+		return fmt.Errorf("invalid envelope header: %s", err)
+	}
+	c, err := lookupCodec(h.Codec)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(value, v)
+}
+
+// jsonCodec is encoding/json
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return codecJSON }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// toDocument returns v as the generic JSON document the binary codecs encode, so
+// they follow the json tags of our types
+func toDocument(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// fromDocument stores a generic JSON document into v
+func fromDocument(doc interface{}, v interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// msgpackHandle decodes maps with string keys, for fromDocument
+var msgpackHandle = newMsgpackHandle()
+
+// newMsgpackHandle returns msgpackHandle. MapType is promoted from an embedded
+// struct, which composite literals can not set on older Go versions
+func newMsgpackHandle() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{RawToString: true}
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return h
+}
+
+// msgpackCodec encodes the JSON document of a value in msgpack
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return codecMsgpack }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	doc, err := toDocument(v)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	err = codec.NewEncoderBytes(&out, msgpackHandle).Encode(doc)
+	return out, err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	var doc interface{}
+	if err := codec.NewDecoderBytes(data, msgpackHandle).Decode(&doc); err != nil {
+		return err
+	}
+	return fromDocument(doc, v)
+}
+
+// protobufCodec encodes the JSON document of a value as a google.protobuf.Value,
+// for readers that only speak protobuf
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string { return codecProtobuf }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	doc, err := toDocument(v)
+	if err != nil {
+		return nil, err
+	}
+	pv, err := structpb.NewValue(doc)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(pv)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	var pv structpb.Value
+	if err := proto.Unmarshal(data, &pv); err != nil {
+		return err
+	}
+	return fromDocument(pv.AsInterface(), v)
+}
@@ -0,0 +1,83 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: codec.go
+//
+// Generated by this command:
+//
+//	mockgen -source codec.go -destination codec_mock.go -package main
+//
+
+// Package main is a generated GoMock package.
+package main
+
+import (
+	reflect "reflect"
+
+	gomock "go.uber.org/mock/gomock"
+)
+
+// MockCodec is a mock of Codec interface.
+type MockCodec struct {
+	ctrl     *gomock.Controller
+	recorder *MockCodecMockRecorder
+	isgomock struct{}
+}
+
+// MockCodecMockRecorder is the mock recorder for MockCodec.
+type MockCodecMockRecorder struct {
+	mock *MockCodec
+}
+
+// NewMockCodec creates a new mock instance.
+func NewMockCodec(ctrl *gomock.Controller) *MockCodec {
+	mock := &MockCodec{ctrl: ctrl}
+	mock.recorder = &MockCodecMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockCodec) EXPECT() *MockCodecMockRecorder {
+	return m.recorder
+}
+
+// Marshal mocks base method.
+func (m *MockCodec) Marshal(v any) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Marshal", v)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Marshal indicates an expected call of Marshal.
+func (mr *MockCodecMockRecorder) Marshal(v any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Marshal", reflect.TypeOf((*MockCodec)(nil).Marshal), v)
+}
+
+// Name mocks base method.
+func (m *MockCodec) Name() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Name")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// Name indicates an expected call of Name.
+func (mr *MockCodecMockRecorder) Name() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Name", reflect.TypeOf((*MockCodec)(nil).Name))
+}
+
+// Unmarshal mocks base method.
+func (m *MockCodec) Unmarshal(data []byte, v any) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unmarshal", data, v)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Unmarshal indicates an expected call of Unmarshal.
+func (mr *MockCodecMockRecorder) Unmarshal(data, v any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unmarshal", reflect.TypeOf((*MockCodec)(nil).Unmarshal), data, v)
+}
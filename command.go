@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Ways of telling the child process about the leadership state
+const (
+	notifyNone   = ""       // The child is only killed when leadership is lost
+	notifyFD     = "fd"     // The state is written, one per line, to an inherited file descriptor
+	notifySignal = "signal" // SIGUSR1 periodically while leader, SIGUSR2 when leadership is lost
+)
+
+// commandConfig holds the configuration of the run-command mode
+type commandConfig struct {
+	args           []string      // Command and its arguments
+	notify         string        // How to tell the child about the leadership state
+	signalInterval time.Duration // How often SIGUSR1 is sent in notifySignal mode
+	killGrace      time.Duration // How long the child has to stop by itself after leadership is lost
+	output         *outputSink   // Captures the output of the child. If nil it writes to our stdout and stderr
+	env            []string      // Added to the environment of the child, KEY=value
+}
+
+// runCommand runs the command as the work while we are leader. When ctx is
+// cancelled (leadership lost or we are exiting) the child is told according to the notify mode, asked
+// to stop (SIGTERM, or CTRL_BREAK on windows) and killed if it did not exit after killGrace.
+// Stopping and killing applies to the whole process tree, otherwise grandchildren would keep
+// mutating shared state after we lose the lock. Whatever is left of the tree when the child
+// exits is killed too.
+// The child gets MUTEX_KEY and MUTEX_LEADERSHIP_ID in its environment, and
+// MUTEX_LOCAL_FALLBACK=1 when it works under the local fallback. When the worker
+// publishes results it gets them as described in commandResult.
+func runCommand(ctx context.Context, w *exclusiveWorker, cc *commandConfig) (err error) {
+	cmd := exec.Command(cc.args[0], cc.args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	id, _ := LeadershipIDFromContext(ctx)
+	if cc.output != nil {
+		stdout, stderr := cc.output.writer("stdout", id), cc.output.writer("stderr", id)
+		defer stdout.flush()
+		defer stderr.flush()
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		// Grandchildren can keep the pipes open, don't let them block Wait
+		cmd.WaitDelay = time.Second
+	}
+	cmd.Env = append(os.Environ(), "MUTEX_KEY="+w.key, "MUTEX_LEADERSHIP_ID="+id)
+	cmd.Env = append(cmd.Env, cc.env...)
+	if LocalFallbackFromContext(ctx) {
+		cmd.Env = append(cmd.Env, "MUTEX_LOCAL_FALLBACK=1")
+	}
+	resultEnv, collectResult, err := commandResult(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := collectResult(err == nil); cerr != nil {
+			w.logf("could not read the result of %q: %s", cc.args, cerr)
+		}
+	}()
+	cmd.Env = append(cmd.Env, resultEnv...)
+	prepareCommand(cmd)
+
+	var stateW *os.File
+	if cc.notify == notifyFD {
+		r, pw, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		defer pw.Close()
+		// ExtraFiles[0] is fd 3 in the child
+		cmd.ExtraFiles = []*os.File{r}
+		cmd.Env = append(cmd.Env, "MUTEX_LEADERSHIP_FD=3")
+		stateW = pw
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	w.logf("started %q with pid %d", cc.args, cmd.Process.Pid)
+
+	tree, err := newProcessTree(cmd)
+	if err != nil {
+		// We can not guarantee the tree dies with us, don't run the work at all
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("cannot track process tree of %q: %s", cc.args, err)
+	}
+	defer tree.close()
+
+	if stateW != nil {
+		// The child may not read the pipe at all, never block the worker on it.
+		// States are queued and written in order by a single goroutine
+		states := make(chan State, 16)
+		done := make(chan struct{})
+		defer close(done)
+		unwatch := w.watchTransitions(func(t Transition) {
+			select {
+			case states <- t.To:
+			default:
+			}
+		})
+		defer unwatch()
+		go func() {
+			fmt.Fprintln(stateW, w.State())
+			for {
+				select {
+				case s := <-states:
+					fmt.Fprintln(stateW, s)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	var tick <-chan time.Time
+	if cc.notify == notifySignal {
+		ticker := time.NewTicker(cc.signalInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case err := <-exited:
+			return err
+		case <-tick:
+			if err := signalLeader(cmd.Process); err != nil {
+				w.logf("could not signal child: %s", err)
+			}
+		case <-ctx.Done():
+			w.logf("work cancelled, stopping %q", cc.args)
+			if cc.notify == notifySignal {
+				if err := signalLost(cmd.Process); err != nil {
+					w.logf("could not signal child: %s", err)
+				}
+			}
+			if err := tree.stop(); err != nil {
+				w.logf("could not stop child: %s", err)
+			}
+			select {
+			case err := <-exited:
+				return err
+			case <-time.After(cc.killGrace):
+				w.logf("child did not stop after %s, killing it", cc.killGrace)
+				if err := tree.kill(); err != nil {
+					w.logf("could not kill child: %s", err)
+				}
+				return <-exited
+			}
+		}
+	}
+}
+
+// checkNotify checks a -notify mode is known and supported on this platform
+func checkNotify(notify string) error {
+	switch notify {
+	case notifyNone, notifyFD, notifySignal:
+	default:
+		return fmt.Errorf("unknown -notify mode %q", notify)
+	}
+	if notify == notifySignal && !signalNotifySupported {
+		return fmt.Errorf("-notify=signal is not supported on this platform")
+	}
+	return nil
+}
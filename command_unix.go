@@ -0,0 +1,68 @@
+//go:build !windows
+
+package main
+
+import (
+	"log/syslog"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// signalNotifySupported tells if -notify=signal can be used
+const signalNotifySupported = true
+
+// hookShell runs the hook commands
+var hookShell = []string{"/bin/sh", "-c"}
+
+// processTree is the child and everything it started. On unix it is the
+// child's process group, so grandchildren are stopped and killed too.
+type processTree struct {
+	pgid int
+}
+
+// prepareCommand puts the child in its own process group
+func prepareCommand(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// newProcessTree tracks the process group of a started command
+func newProcessTree(cmd *exec.Cmd) (*processTree, error) {
+	return &processTree{pgid: cmd.Process.Pid}, nil
+}
+
+// stop asks the whole process group to stop
+func (t *processTree) stop() error {
+	return syscall.Kill(-t.pgid, syscall.SIGTERM)
+}
+
+// kill terminates the whole process group
+func (t *processTree) kill() error {
+	return syscall.Kill(-t.pgid, syscall.SIGKILL)
+}
+
+// close kills whatever is left of the process group once the child exited
+func (t *processTree) close() {
+	t.kill()
+}
+
+// signalLeader tells the child we are still leader
+func signalLeader(p *os.Process) error {
+	return p.Signal(syscall.SIGUSR1)
+}
+
+// signalLost tells the child we are not leader anymore
+func signalLost(p *os.Process) error {
+	return p.Signal(syscall.SIGUSR2)
+}
+
+// processAlive tells if a process with pid exists
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// openSyslog connects to the local syslog, the output of the command is logged with tag
+func openSyslog(tag string) (syslogSink, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
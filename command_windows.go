@@ -0,0 +1,151 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// signalNotifySupported is false because there is no SIGUSR1/SIGUSR2 on windows
+const signalNotifySupported = false
+
+// hookShell runs the hook commands
+var hookShell = []string{"cmd", "/C"}
+
+var errNoSignals = errors.New("leadership signals are not supported on windows")
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procGenerateConsoleCtrlEvent = kernel32.NewProc("GenerateConsoleCtrlEvent")
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = kernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32.NewProc("TerminateJobObject")
+)
+
+const (
+	processSetQuota                        = 0x0100
+	jobObjectLimitKillOnJobClose           = 0x2000
+	jobObjectExtendedLimitInformationClass = 9
+)
+
+// Same layout as JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+type jobObjectExtendedLimitInformation struct {
+	PerProcessUserTimeLimit int64
+	PerJobUserTimeLimit     int64
+	LimitFlags              uint32
+	MinimumWorkingSetSize   uintptr
+	MaximumWorkingSetSize   uintptr
+	ActiveProcessLimit      uint32
+	Affinity                uintptr
+	PriorityClass           uint32
+	SchedulingClass         uint32
+	IoInfo                  [6]uint64
+	ProcessMemoryLimit      uintptr
+	JobMemoryLimit          uintptr
+	PeakProcessMemoryUsed   uintptr
+	PeakJobMemoryUsed       uintptr
+}
+
+// processTree is the child and everything it started. On windows it is a job
+// object the child is assigned to right after it starts; its children inherit it.
+// Processes the child started before being assigned are not tracked.
+type processTree struct {
+	pid int
+	job syscall.Handle
+}
+
+// prepareCommand starts the child in its own process group so it can get
+// a CTRL_BREAK event without it being sent to us as well
+func prepareCommand(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// newProcessTree creates a job object that kills all its processes when closed
+// and assigns the started command to it
+func newProcessTree(cmd *exec.Cmd) (*processTree, error) {
+	r, _, err := procCreateJobObjectW.Call(0, 0)
+	if r == 0 {
+		return nil, err
+	}
+	t := &processTree{pid: cmd.Process.Pid, job: syscall.Handle(r)}
+
+	info := jobObjectExtendedLimitInformation{LimitFlags: jobObjectLimitKillOnJobClose}
+	r, _, err = procSetInformationJobObject.Call(uintptr(t.job), jobObjectExtendedLimitInformationClass,
+		uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info))
+	if r == 0 {
+		syscall.CloseHandle(t.job)
+		return nil, err
+	}
+
+	process, err := syscall.OpenProcess(processSetQuota|syscall.PROCESS_TERMINATE, false, uint32(t.pid))
+	if err != nil {
+		syscall.CloseHandle(t.job)
+		return nil, err
+	}
+	defer syscall.CloseHandle(process)
+	r, _, err = procAssignProcessToJobObject.Call(uintptr(t.job), uintptr(process))
+	if r == 0 {
+		syscall.CloseHandle(t.job)
+		return nil, err
+	}
+	return t, nil
+}
+
+// stop asks the child to stop by sending CTRL_BREAK to its process group
+func (t *processTree) stop() error {
+	r, _, err := procGenerateConsoleCtrlEvent.Call(syscall.CTRL_BREAK_EVENT, uintptr(t.pid))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// kill terminates every process in the job
+func (t *processTree) kill() error {
+	r, _, err := procTerminateJobObject.Call(uintptr(t.job), 1)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// close releases the job, which kills whatever is left in it
+func (t *processTree) close() {
+	syscall.CloseHandle(t.job)
+}
+
+// signalLeader is not available on windows, there is no SIGUSR1
+func signalLeader(p *os.Process) error {
+	return errNoSignals
+}
+
+// signalLost is not available on windows, there is no SIGUSR2
+func signalLost(p *os.Process) error {
+	return errNoSignals
+}
+
+// processAlive tells if a process with pid exists and has not exited
+func processAlive(pid int) bool {
+	const processQueryLimitedInformation = 0x1000
+	const stillActive = 259
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+// openSyslog fails, there is no syslog on windows
+func openSyslog(tag string) (syslogSink, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// completionProgram is the name of the binary the completions are for
+const completionProgram = "mutual-exclusion-consul"
+
+// subcommands are the subcommands and what follows them, for the shell completions.
+// Keep it in sync with the flag sets of the run* functions. validate takes the flags
+// of the main command.
+var subcommands = map[string][]string{
+	"daemon":     {"-jobs", "-introspect", "-debug-token", "-shared-session", "-event-log", "-max-concurrent", "-renew-timeout"},
+	"status":     {"-key", "-encryption-key", "-watch", "-prefix"},
+	"replay":     {"-key"},
+	"generation": {"-key", "-prefer"},
+	"doctor":     {"-key", "-prefix", "-max-skew", "-encryption-key"},
+	"last-run":   {"-key", "-encryption-key", "-max-age"},
+	"monitor":    {"-keys", "-threshold", "-webhooks", "-listen", "-encryption-key"},
+	"bench":      {"failover", "scoped", "-key", "-prefix", "-iterations", "-concurrency", "-keys", "-pool-size", "-ttl", "-lock-delay", "-timeout"},
+	"validate":   nil,
+	"completion": {"bash", "zsh"},
+}
+
+// completionData is what the completion templates are executed with
+type completionData struct {
+	Program     string
+	Func        string            // Name of the shell function
+	Words       string            // Subcommands and flags of the main command
+	Flags       string            // Of the main command
+	Subcommands map[string]string // What can follow every subcommand
+}
+
+var completions = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Parse(`# bash completion for {{.Program}}, load it with:
+#   source <({{.Program}} completion bash)
+_{{.Func}}() {
+	local cur=${COMP_WORDS[COMP_CWORD]} words="{{.Flags}}"
+	case ${COMP_WORDS[1]} in
+{{- range $cmd, $words := .Subcommands}}
+	{{$cmd}}) words="{{$words}}" ;;
+{{- end}}
+	*) [ "$COMP_CWORD" -eq 1 ] && words="{{.Words}}" ;;
+	esac
+	COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+complete -o default -F _{{.Func}} {{.Program}}
+`)),
+	"zsh": template.Must(template.New("zsh").Parse(`#compdef {{.Program}}
+# zsh completion for {{.Program}}, load it with:
+#   source <({{.Program}} completion zsh)
+_{{.Func}}() {
+	local -a opts
+	opts=({{.Flags}})
+	case $words[2] in
+{{- range $cmd, $words := .Subcommands}}
+	{{$cmd}}) opts=({{$words}}) ;;
+{{- end}}
+	*) (( CURRENT == 2 )) && opts=({{.Words}}) ;;
+	esac
+	compadd -a opts
+	_files
+}
+compdef _{{.Func}} {{.Program}}
+`)),
+}
+
+// runCompletion writes the completion script of a shell, generated from the flags
+// of the main command (main) and subcommands:
+//
+//	source <(mutual-exclusion-consul completion bash)
+func runCompletion(args []string, main *flag.FlagSet) int {
+	if len(args) != 1 || completions[args[0]] == nil {
+		log.Println("completion: give the shell, bash or zsh")
+		return 2
+	}
+
+	var flags []string
+	main.VisitAll(func(f *flag.Flag) { flags = append(flags, "-"+f.Name) })
+	names := make([]string, 0, len(subcommands))
+	following := map[string]string{}
+	for name, words := range subcommands {
+		names = append(names, name)
+		if words == nil {
+			words = flags
+		}
+		following[name] = strings.Join(words, " ")
+	}
+	sort.Strings(names)
+
+	data := completionData{
+		Program:     completionProgram,
+		Func:        strings.ReplaceAll(completionProgram, "-", "_"),
+		Words:       strings.Join(append(names, flags...), " "),
+		Flags:       strings.Join(flags, " "),
+		Subcommands: following,
+	}
+	if err := completions[args[0]].Execute(os.Stdout, data); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
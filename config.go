@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// configSource is where the effective value of a setting comes from
+type configSource string
+
+const (
+	sourceDefault configSource = "default"
+	sourceFile    configSource = "file"
+	sourceEnv     configSource = "env"
+	sourceFlag    configSource = "flag"
+)
+
+// secretSettings are redacted when the configuration is printed
+var secretSettings = map[string]bool{
+	"encryption-key": true,
+	"webhooks":       true, // Slack incoming webhook URLs are credentials
+	"debug-token":    true,
+}
+
+// ConfigError is an invalid setting, with where its value comes from so it can be fixed
+type ConfigError struct {
+	Setting string // Flag name, empty when the check covers several settings
+	Value   string
+	Source  configSource
+	Err     error
+	Hint    string // How to fix it
+}
+
+func (e *ConfigError) Error() string {
+	msg := e.Err.Error()
+	if e.Setting != "" {
+		value := e.Value
+		if secretSettings[e.Setting] {
+			value = "<redacted>"
+		}
+		msg = fmt.Sprintf("invalid %s %q (%s): %s", e.Setting, value, e.describeSource(), msg)
+	}
+	if e.Hint != "" {
+		msg += "; " + e.Hint
+	}
+	return msg
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConfigError) describeSource() string {
+	switch e.Source {
+	case sourceEnv:
+		return "from " + envName(e.Setting)
+	case sourceFlag:
+		return "from -" + e.Setting
+	}
+	return string(e.Source)
+}
+
+// envName is the environment variable of a setting: -kill-grace is MUTEX_KILL_GRACE
+func envName(setting string) string {
+	return "MUTEX_" + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// config is the effective configuration of a flag set and where each value comes from
+type config struct {
+	fs      *flag.FlagSet
+	sources map[string]configSource
+}
+
+// loadConfig parses args into fs and fills in the settings that were not given as flags,
+// from the environment (MUTEX_ and the flag name) and then from the file *file points to,
+// so the precedence is flags > env > file > defaults. The file has MUTEX_*=value lines
+// like an env file, with # comments. Invalid values are returned as *ConfigError.
+func loadConfig(fs *flag.FlagSet, args []string, file *string) (*config, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c := &config{fs: fs, sources: map[string]configSource{}}
+	fs.Visit(func(f *flag.Flag) {
+		c.sources[f.Name] = sourceFlag
+	})
+
+	fromFile := map[string]string{}
+	if file != nil && *file != "" {
+		var err error
+		if fromFile, err = readConfigFile(*file); err != nil {
+			return nil, err
+		}
+	}
+	known := map[string]bool{}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		known[envName(f.Name)] = true
+		if err != nil || c.sources[f.Name] == sourceFlag {
+			return
+		}
+		source := sourceDefault
+		value, ok := os.LookupEnv(envName(f.Name))
+		if ok {
+			source = sourceEnv
+		} else if value, ok = fromFile[envName(f.Name)]; ok {
+			source = sourceFile
+		}
+		if !ok {
+			return
+		}
+		if serr := f.Value.Set(value); serr != nil {
+			err = &ConfigError{Setting: f.Name, Value: value, Source: source, Err: serr}
+			return
+		}
+		c.sources[f.Name] = source
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range fromFile {
+		if !known[name] {
+			return nil, &ConfigError{Value: value, Source: sourceFile, Err: fmt.Errorf("%s: unknown setting %s", *file, name)}
+		}
+	}
+	return c, nil
+}
+
+// readConfigFile reads a file of MUTEX_*=value lines
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		name = strings.TrimSpace(name)
+		if !ok || !strings.HasPrefix(name, "MUTEX_") {
+			return nil, fmt.Errorf("%s:%d: expected MUTEX_NAME=value", path, n)
+		}
+		values[name] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	return values, scanner.Err()
+}
+
+// source returns where the value of a setting comes from
+func (c *config) source(setting string) configSource {
+	if s, ok := c.sources[setting]; ok {
+		return s
+	}
+	return sourceDefault
+}
+
+// checkError turns a failed check into a *ConfigError with the value and source of its setting
+func (c *config) checkError(check configCheck) error {
+	e := &ConfigError{Setting: check.setting, Err: check.err, Hint: check.hint}
+	if f := c.fs.Lookup(check.setting); f != nil {
+		e.Value, e.Source = f.Value.String(), c.source(check.setting)
+	}
+	return e
+}
+
+// dump prints the effective configuration, sorted by name, with secrets redacted.
+// Unless all is set the settings left at their default are omitted.
+func (c *config) dump(all bool) {
+	var lines []string
+	c.fs.VisitAll(func(f *flag.Flag) {
+		source := c.source(f.Name)
+		if source == sourceDefault && !all {
+			return
+		}
+		value := f.Value.String()
+		if secretSettings[f.Name] && value != "" {
+			value = "<redacted>"
+		}
+		lines = append(lines, fmt.Sprintf("  %s = %q (%s)", f.Name, value, source))
+	})
+	fmt.Println("config:")
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+}
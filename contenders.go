@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Contender is a worker with a live session registered for a key
+type Contender struct {
+	SessionID string `json:"session_id"`
+	contenderInfo
+}
+
+// ListContenders returns the contenders registered for key, the leader included,
+// oldest first. Workers register with -register-contender or when their election
+// strategy needs it.
+func ListContenders(client *api.Client, key string) ([]Contender, error) {
+	pairs, _, err := client.KV().List(contenderPrefix(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	contenders := make([]Contender, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair.Session == "" {
+			// Left over, its session is gone
+			continue
+		}
+		ct := Contender{SessionID: pair.Session}
+		json.Unmarshal(pair.Value, &ct.contenderInfo)
+		contenders = append(contenders, ct)
+	}
+	sort.Slice(contenders, func(i, j int) bool { return contenders[i].Since.Before(contenders[j].Since) })
+	return contenders, nil
+}
+
+// runStatus prints who holds a key and who is waiting for it:
+//
+//	mutual-exclusion-consul status -key service/bobruner/leader
+//
+// With -watch it streams the leadership changes of the key instead, until interrupted.
+// With -prefix it prints one line for every lock under the prefix, see StatusAll.
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	key := fs.String("key", envOr("MUTEX_KEY", ""), "lock key")
+	encryptionKey := fs.String("encryption-key", envOr("MUTEX_ENCRYPTION_KEY", ""), "base64 AES key the workers encrypt the lock value with")
+	watch := fs.Bool("watch", false, "stream the leadership changes of the key until interrupted")
+	prefix := fs.String("prefix", "", "print every lock under this prefix, one per line, instead of the details of -key")
+	fs.Parse(args)
+	if *key == "" && *prefix == "" {
+		log.Println("-key or -prefix is required")
+		return 2
+	}
+	cipher, err := newCipher(*encryptionKey)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	client, err := api.NewClient(&api.Config{Address: consulAddress})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if *prefix != "" {
+		statuses, err := StatusAll(client, *prefix, cipher)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		for _, s := range statuses {
+			fmt.Println(s)
+		}
+		return 0
+	}
+	if *watch {
+		return watchStatus(client, *key, cipher)
+	}
+
+	leader, err := ResolveLeader(client, *key, cipher)
+	if err != nil && !errors.Is(err, ErrNoLeader) {
+		log.Println(err)
+		return 1
+	}
+	contenders, err := ListContenders(client, *key)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	fmt.Println("key:", *key)
+	if leader == nil {
+		fmt.Println("leader: none")
+	} else {
+		fmt.Println("leader:", describe(leader.SessionID, leader.Hostname, leader.Address))
+		if leader.Build != nil {
+			fmt.Println("build:", leader.Build)
+		}
+		if hint, err := ReadLeaseHint(client, *key); err != nil {
+			log.Println("Could not read the lease hint:", err)
+		} else if hint != nil && hint.SessionID == leader.SessionID {
+			fmt.Println("lease:", hint.Describe(time.Now()))
+		}
+	}
+	if loss, err := LastLoss(client, *key, cipher); err != nil {
+		log.Println("Could not read the last loss:", err)
+	} else if loss != nil {
+		fmt.Println("last loss:", loss)
+	}
+	fmt.Println("contenders:", len(contenders))
+	for _, ct := range contenders {
+		line := describe(ct.SessionID, ct.Hostname, ct.Address)
+		if !ct.Since.IsZero() {
+			line += ", since " + ct.Since.Format(time.RFC3339)
+		}
+		if leader != nil && ct.SessionID == leader.SessionID {
+			line += " (leader)"
+		}
+		fmt.Println(" ", line)
+	}
+	return 0
+}
+
+// watchStatus prints a timestamped line every time the holder of key changes, with
+// a blocking query on the key, until interrupted
+func watchStatus(client *api.Client, key string, c *Cipher) int {
+	color := isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
+	first, last := true, ""
+	f := WatchLeader(client, key, c, func(h *Holder) {
+		line, session := colorize(color, colorRed, "free"), ""
+		if h != nil {
+			line, session = colorize(color, colorGreen, "held")+" by "+describe(h.SessionID, h.Hostname, h.Address), h.SessionID
+		}
+		if !first && session == last {
+			// The value changed, not the holder
+			return
+		}
+		first, last = false, session
+		fmt.Printf("%s %s %s\n", time.Now().Format("15:04:05.000"), key, line)
+	})
+	if err := f.Start(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer f.Stop()
+
+	signals := signalConfig{}
+	signals.add(defaultExitSignals, actionExit)
+	interrupted := make(chan os.Signal, 1)
+	for sig := range signals {
+		signal.Notify(interrupted, sig)
+	}
+	<-interrupted
+	return 0
+}
+
+// ANSI colors of the status lines
+const (
+	colorRed   = "31"
+	colorGreen = "32"
+)
+
+// colorize wraps s in an ANSI color if enabled
+func colorize(enabled bool, color, s string) string {
+	if !enabled {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// isTerminal returns whether f is a terminal, not a pipe or a file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// describe is a one line description of a leader or contender
+func describe(sessionID, hostname, address string) string {
+	parts := []string{"session " + sessionID}
+	if hostname != "" {
+		parts = append(parts, "host "+hostname)
+	}
+	if address != "" {
+		parts = append(parts, "address "+address)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// TestContention checks the core invariant against the memory backend: with
+// dozens of workers contending for one key, at no instant do two of them
+// believe they are leader. Run it with -race.
+func TestContention(t *testing.T) {
+	m, client := newTestConsul(t)
+	key := testContention(t, client)
+	if n := m.sessionCount(); n != 0 {
+		t.Errorf("%d sessions left after closing the workers", n)
+	}
+	if holder := m.holderOf(key); holder != "" {
+		t.Errorf("session %s still holds the key after closing the workers", holder)
+	}
+}
+
+// TestContentionConsul is TestContention against the dev Consul at $MUTEX_TEST_CONSUL
+func TestContentionConsul(t *testing.T) {
+	testContention(t, devConsul(t))
+}
+
+// testContention runs the contenders until they had enough leaderships and returns their key.
+// Each leadership is counted twice: from the transitions to and from held, delivered before
+// the key is released, and from the work, which must never run concurrently.
+func testContention(t *testing.T, client *api.Client) string {
+	workers, leaderships := 32, 100
+	if testing.Short() {
+		workers, leaderships = 8, 20
+	}
+	key := fmt.Sprintf("test/contention/%d", time.Now().UnixNano())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var leaders, working, done atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		ec := newExclusiveWorker(&exclusiveWorkerConfig{
+			client:         client,
+			key:            key,
+			sessionTimeout: "10s",
+			lockDelay:      time.Millisecond,
+			onTransition: func(tr Transition) {
+				switch {
+				case tr.To == StateHeld:
+					if n := leaders.Add(1); n > 1 {
+						t.Errorf("%d workers believe they are leader", n)
+					}
+				case tr.From == StateHeld && tr.To == StateLost, tr.From == StateDraining:
+					leaders.Add(-1)
+				}
+			},
+		})
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			defer ec.Close()
+			err := ec.RunElected(ctx, func(ctx context.Context) error {
+				if n := working.Add(1); n > 1 {
+					t.Errorf("%d workers run the work", n)
+				}
+				defer working.Add(-1)
+				// Some leaderships return, the others are resigned like on SIGUSR1
+				d := time.Duration(rand.Intn(2000)) * time.Microsecond
+				if worker%2 == 0 {
+					time.Sleep(d)
+				} else {
+					time.AfterFunc(d, ec.Resign)
+					<-ctx.Done()
+				}
+				if done.Add(1) >= int64(leaderships) {
+					cancel()
+				}
+				return nil
+			})
+			if err != nil && ctx.Err() == nil {
+				t.Errorf("worker %d: %s", worker, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := done.Load(); n < int64(leaderships) {
+		t.Errorf("only %d leaderships out of %d", n, leaderships)
+	}
+	return key
+}
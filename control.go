@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// stepDownCommand written to the control key makes the leader step down
+	stepDownCommand = "step-down"
+	// stepDownDelay is how long a leader that stepped down waits before contending
+	// again, so another contender takes over instead of us winning again
+	stepDownDelay = 30 * time.Second
+)
+
+// controlKey is where operators write commands for the leader of key
+func controlKey(key string) string {
+	return key + "/control"
+}
+
+// controlAck replaces the command in the control key once the leader carried it out,
+// so the next leader does not obey it again
+type controlAck struct {
+	Acked        string    `json:"acked"` // The command
+	Session      string    `json:"session"`
+	LeadershipID string    `json:"leadership_id"`
+	At           time.Time `json:"at"`
+}
+
+// watchControlOnTransition watches the control key while we are leader. When an
+// operator writes step-down to it we resign (the work is cancelled and the lock
+// released like on any resignation) and once the lock is released we acknowledge
+// by replacing the command. This gives ops a push-button failover:
+//
+//	consul kv put service/bobruner/leader/control step-down
+func (ec *exclusiveWorker) watchControlOnTransition(t Transition) {
+	switch {
+	case t.To == StateHeld:
+		// A step down interrupted by losing the lock is over
+		ec.mu.Lock()
+		ec.stepDownIndex = 0
+		ec.mu.Unlock()
+		ec.control = newFollower(ec.client, map[string]interface{}{"type": "key", "key": controlKey(ec.key)}, func(_ uint64, raw interface{}) {
+			pair, _ := raw.(*api.KVPair)
+			if pair == nil || strings.TrimSpace(string(pair.Value)) != stepDownCommand {
+				return
+			}
+			ec.mu.Lock()
+			if ec.state != StateHeld || ec.leadershipID != t.LeadershipID || ec.stepDownIndex != 0 {
+				ec.mu.Unlock()
+				return
+			}
+			ec.stepDownIndex = pair.ModifyIndex
+			ec.mu.Unlock()
+			ec.emit(EventStepDown, "asked to step down through "+pair.Key)
+			ec.Resign()
+		})
+		ec.control.OnError = func(err error) {
+			ec.logf("Could not watch %s: %s", controlKey(ec.key), err)
+		}
+		if err := ec.control.Start(); err != nil {
+			ec.logf("Could not watch %s: %s", controlKey(ec.key), err)
+		}
+
+	case t.From == StateHeld:
+		if ec.control != nil {
+			ec.control.Stop()
+			ec.control = nil
+		}
+
+	case t.To == StateReleased:
+		ec.mu.Lock()
+		index, session := ec.stepDownIndex, ec.lockInfo.Session
+		ec.stepDownIndex = 0
+		if index != 0 {
+			ec.steppedDown = true
+		}
+		ec.mu.Unlock()
+		if index == 0 {
+			return
+		}
+		value, _ := json.Marshal(controlAck{Acked: stepDownCommand, Session: session, LeadershipID: t.LeadershipID, At: ec.clock.Now()})
+		// CAS so we don't overwrite a newer command
+		if _, _, err := ec.client.KV().CAS(&api.KVPair{Key: controlKey(ec.key), Value: value, ModifyIndex: index}, nil); err != nil {
+			ec.logf("Could not acknowledge the step down: %s", err)
+		}
+	}
+}
+
+// takeSteppedDown tells if the last leadership ended by stepping down, and forgets it
+func (ec *exclusiveWorker) takeSteppedDown() bool {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	stepped := ec.steppedDown
+	ec.steppedDown = false
+	return stepped
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Restart policies of the daemon jobs
+const (
+	restartAlways    = "always"     // Restart the command whenever it exits
+	restartOnFailure = "on-failure" // Restart the command when it fails
+	restartNever     = "never"      // Run the command once per leadership
+)
+
+// jobDefinition is one job of the daemon jobs file
+type jobDefinition struct {
+	Name             string   `json:"name"`
+	Key              string   `json:"key"`
+	Command          []string `json:"command"`
+	Window           string   `json:"window,omitempty"`             // HH:MM-HH:MM, see Window
+	Restart          string   `json:"restart,omitempty"`            // always, on-failure (default) or never
+	RestartDelay     string   `json:"restart_delay,omitempty"`      // Between restarts, default 5s
+	TTL              string   `json:"ttl,omitempty"`                // Of the session, default 15s
+	KillGrace        string   `json:"kill_grace,omitempty"`         // How long the command has to stop, default 10s
+	Labels           Labels   `json:"labels,omitempty"`             // See Labels
+	WorkerRestart    string   `json:"worker_restart,omitempty"`     // Of the elector when it stops: always, on-failure (default) or never
+	WorkerRestartMax string   `json:"worker_restart_max,omitempty"` // Cap of the backoff between elector restarts, default 1m
+	Weight           int64    `json:"weight,omitempty"`             // Slots of -max-concurrent taken while it runs, default 1
+}
+
+// job is a validated jobDefinition
+type job struct {
+	name         string
+	key          string
+	command      []string
+	window       *Window
+	restart      string
+	restartDelay time.Duration
+	ttl          string
+	killGrace    time.Duration
+	labels       Labels
+	// workerRestart and workerBackoff decide when the elector is restarted, see superviseWorker
+	workerRestart string
+	workerBackoff Backoff
+	weight        int64
+}
+
+// loadJobs reads and validates the jobs file, a JSON list of jobDefinition
+func loadJobs(path string) ([]*job, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var defs []jobDefinition
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("%s: no jobs", path)
+	}
+
+	var jobs []*job
+	keys := map[string]string{}
+	for i, def := range defs {
+		j, err := def.job()
+		if err != nil {
+			return nil, fmt.Errorf("%s: job %d (%s): %s", path, i, def.Name, err)
+		}
+		if other, ok := keys[j.key]; ok {
+			return nil, fmt.Errorf("%s: jobs %s and %s use the same key %s", path, other, j.name, j.key)
+		}
+		keys[j.key] = j.name
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func (def jobDefinition) job() (*job, error) {
+	j := &job{
+		name:          def.Name,
+		key:           def.Key,
+		command:       def.Command,
+		restart:       def.Restart,
+		restartDelay:  5 * time.Second,
+		ttl:           def.TTL,
+		killGrace:     10 * time.Second,
+		labels:        def.Labels,
+		workerRestart: def.WorkerRestart,
+		workerBackoff: Backoff{Base: retryInterval, Max: time.Minute},
+		weight:        def.Weight,
+	}
+	if j.name == "" {
+		return nil, errors.New("name is missing")
+	}
+	if err := validateKey(j.key); err != nil {
+		return nil, err
+	}
+	if len(j.command) == 0 {
+		return nil, errors.New("command is missing")
+	}
+	switch j.restart {
+	case "":
+		j.restart = restartOnFailure
+	case restartAlways, restartOnFailure, restartNever:
+	default:
+		return nil, fmt.Errorf("unknown restart policy %q", j.restart)
+	}
+	switch j.workerRestart {
+	case "":
+		j.workerRestart = restartOnFailure
+	case restartAlways, restartOnFailure, restartNever:
+	default:
+		return nil, fmt.Errorf("unknown worker restart policy %q", j.workerRestart)
+	}
+	switch {
+	case j.weight == 0:
+		j.weight = 1
+	case j.weight < 0:
+		return nil, fmt.Errorf("negative weight %d", j.weight)
+	}
+	if j.ttl == "" {
+		j.ttl = "15s"
+	}
+	if err := checkTTL(j.ttl); err != nil {
+		return nil, err
+	}
+	var err error
+	if j.window, err = parseWindow(def.Window); err != nil {
+		return nil, err
+	}
+	for _, d := range []struct {
+		spec string
+		out  *time.Duration
+	}{{def.RestartDelay, &j.restartDelay}, {def.KillGrace, &j.killGrace}, {def.WorkerRestartMax, &j.workerBackoff.Max}} {
+		if d.spec == "" {
+			continue
+		}
+		if *d.out, err = time.ParseDuration(d.spec); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// runDaemon supervises the jobs of a jobs file: it keeps contending for the lock of
+// every job and runs its command while leader, restarting it according to its
+// restart policy. On an exit signal every job resigns and the daemon exits.
+// With -max-concurrent the jobs run at most that many at a time, counting their
+// weights: a job that gets its lock while the host is full gives it back, see
+// ConcurrencyLimit.
+//
+//	mutual-exclusion-consul daemon -jobs jobs.json
+//
+// It returns the exit code.
+func runDaemon(args []string) int {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	jobsFile := fs.String("jobs", envOr("MUTEX_JOBS", ""), "JSON file with the job definitions")
+	introspect := fs.String("introspect", envOr("MUTEX_INTROSPECT", ""), "unix socket (or tcp:host:port) where co-located processes can ask which jobs we lead")
+	debugToken := fs.String("debug-token", envOr("MUTEX_DEBUG_TOKEN", ""), "with -introspect, serve pprof and the internal state of the jobs on it to requests with this bearer token")
+	shareSession := fs.Bool("shared-session", envOr("MUTEX_SHARED_SESSION", "") == "true", "back the locks of all the jobs with a single session, they must have the same ttl")
+	eventLogPath := fs.String("event-log", envOr("MUTEX_EVENT_LOG", ""), "file where every transition and event of the jobs is appended as JSON, for the replay command")
+	maxConcurrent := fs.Int64("max-concurrent", 0, "how many jobs (counting their weight) run at the same time, the others give their lock back. 0 for no limit")
+	renewTimeout := fs.Duration("renew-timeout", defaultRenewTimeout, "timeout of the session renewals, made on connections of their own. It must be under half the ttl of every job. 0 renews over the connections of the other requests")
+	fs.Parse(args)
+
+	jobs, err := loadJobs(*jobsFile)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	for _, j := range jobs {
+		if err := checkRenewTimeout(*renewTimeout, j.ttl); err != nil {
+			log.Printf("job %s: %s", j.name, err)
+			return 1
+		}
+	}
+	consulConf := api.Config{Address: consulAddress}
+	client, err := api.NewClient(&consulConf)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	renewClient := client
+	if *renewTimeout > 0 {
+		if renewClient, err = newRenewalClient(consulConf, *renewTimeout); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	signals := signalConfig{}
+	signals.add(defaultExitSignals, actionExit)
+	c := make(chan os.Signal, 1)
+	for sig := range signals {
+		signal.Notify(c, sig)
+	}
+	go func() {
+		sig := <-c
+		log.Printf("Got %s. Resigning all the jobs", sig)
+		stop()
+	}()
+
+	var wg sync.WaitGroup
+	failed := false
+	var mu sync.Mutex
+	var events *eventLog
+	if *eventLogPath != "" {
+		if events, err = openEventLog(*eventLogPath); err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer events.Close()
+	}
+	var session *sharedSession
+	if *shareSession {
+		for _, j := range jobs[1:] {
+			if j.ttl != jobs[0].ttl {
+				log.Printf("-shared-session: jobs %s and %s have different ttls", jobs[0].name, j.name)
+				return 1
+			}
+		}
+		session = newSharedSession(client, jobs[0].ttl)
+		session.renewClient = renewClient
+		defer session.Close()
+	}
+	var limit *ConcurrencyLimit
+	if *maxConcurrent > 0 {
+		limit = NewConcurrencyLimit(*maxConcurrent)
+		for _, j := range jobs {
+			if err := limit.checkWeight(j.weight); err != nil {
+				log.Printf("job %s: %s", j.name, err)
+				return 1
+			}
+		}
+	}
+	workers := make([]*exclusiveWorker, len(jobs))
+	budget := newRetryBudget(len(jobs), defaultRetryRate)
+	for i, j := range jobs {
+		j := j
+		workers[i] = newExclusiveWorker(&exclusiveWorkerConfig{
+			client:          client,
+			renewClient:     renewClient,
+			key:             j.key,
+			sessionTimeout:  j.ttl,
+			adaptiveRenewal: true,
+			window:          j.window,
+			preflight:       true,
+			verifyAcquire:   true,
+			maintenanceKey:  defaultMaintenanceKey,
+			retryBudget:     budget,
+			session:         session,
+			eventLog:        events,
+			labels:          j.labels,
+			limit:           limit,
+			limitWeight:     j.weight,
+			onTransition: func(t Transition) {
+				logWithID(j.key, t.LeadershipID, "job %s: %s -> %s", j.name, t.From, t.To)
+			},
+		})
+	}
+	if *introspect != "" {
+		if err := serveIntrospection(*introspect, *debugToken, workers...); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
+	for i, j := range jobs {
+		w, j := workers[i], j
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer w.Close()
+			err := superviseWorker(ctx, w, j)
+			if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, ErrClosed) {
+				logWithID(j.key, "", "job %s stopped: %s", j.name, err)
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// superviseWorker runs the elector of a job until ctx is done, restarting it
+// according to the worker restart policy when it stops (or panics) meanwhile, so a
+// job does not silently disappear from the daemon. A panic of the job itself fails
+// its run like an error (see runHeld), the elector goes on. Restarts back off with the
+// workerBackoff of the job, starting over once the elector ran longer than its Max.
+func superviseWorker(ctx context.Context, w *exclusiveWorker, j *job) error {
+	failures := 0
+	for {
+		start := time.Now()
+		err := runElectedSafely(ctx, w, func(ctx context.Context) error { return superviseJob(ctx, w, j) })
+		if ctx.Err() != nil || errors.Is(err, ErrClosed) {
+			return err
+		}
+		if j.workerRestart == restartNever || (j.workerRestart == restartOnFailure && err == nil) {
+			return err
+		}
+
+		if time.Since(start) > j.workerBackoff.Max {
+			failures = 0
+		}
+		failures++
+		wait := j.workerBackoff.next(failures)
+		logWithID(j.key, "", "job %s elector stopped (%v), restarting it in %s", j.name, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// runElectedSafely is RunElected with its panics turned into errors. The elector
+// stopped halfway, so the worker is reset before returning: the restart would find
+// it Acquiring or Held otherwise.
+func runElectedSafely(ctx context.Context, w *exclusiveWorker, fn func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			w.abandon()
+		}
+	}()
+	return w.RunElected(ctx, fn)
+}
+
+// abandon gives the lock and the session back after the elector stopped halfway,
+// leaving the worker Released (or Lost) so it can contend again
+func (ec *exclusiveWorker) abandon() {
+	if err := ec.destroySession(); err != nil && !errors.Is(err, ErrSessionDestroyed) && !errors.Is(err, ErrNoSession) {
+		ec.logf("Could not destroy session: %s", err)
+	}
+	ec.mu.Lock()
+	defer ec.unlock()
+	// Without a session destroySession leaves the state alone
+	switch ec.state {
+	case StateHeld:
+		ec.transition(StateDraining)
+		ec.transition(StateReleased)
+	case StateAcquiring, StateDraining:
+		ec.transition(StateReleased)
+	}
+}
+
+// superviseJob runs the command of a job while we are leader (ctx is not done),
+// restarting it according to the restart policy. When the command is not to be
+// restarted we keep the leadership until ctx is done, so it does not run again
+// somewhere else right away.
+func superviseJob(ctx context.Context, w *exclusiveWorker, j *job) error {
+	cc := &commandConfig{args: j.command, killGrace: j.killGrace}
+	for {
+		err := runCommand(ctx, w, cc)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			w.logf("job %s failed: %s", j.name, err)
+		}
+
+		if j.restart == restartNever || (j.restart == restartOnFailure && err == nil) {
+			w.logf("job %s done, keeping the lock until we resign", j.name)
+			<-ctx.Done()
+			return nil
+		}
+		w.logf("restarting job %s in %s", j.name, j.restartDelay)
+		select {
+		case <-time.After(j.restartDelay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/mock/gomock"
+)
+
+// TestRunElectedSafelyWorkPanic checks a panic of the work ends its leadership like
+// an error, without taking the elector down
+func TestRunElectedSafelyWorkPanic(t *testing.T) {
+	_, client := newTestConsul(t)
+	w := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:         client,
+		key:            "test/work-panic",
+		sessionTimeout: "10s",
+		quiet:          true,
+		lockDelay:      time.Millisecond,
+	})
+	defer w.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var runs atomic.Int32
+	err := runElectedSafely(ctx, w, func(ctx context.Context) error {
+		if runs.Add(1) == 1 {
+			panic("boom")
+		}
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunElected returned %v", err)
+	}
+	if n := runs.Load(); n != 2 {
+		t.Fatalf("the work ran %d times", n)
+	}
+}
+
+// TestRunElectedSafelyElectorPanic checks the worker can contend again after a panic
+// of the elector left it halfway through an election
+func TestRunElectedSafelyElectorPanic(t *testing.T) {
+	m, client := newTestConsul(t)
+	strategy := NewMockStrategy(gomock.NewController(t))
+	strategy.EXPECT().Name().Return("mock").AnyTimes()
+	strategy.EXPECT().Prepare(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	strategy.EXPECT().ShouldContend(gomock.Any(), gomock.Any()).Return(true, nil).AnyTimes()
+	gomock.InOrder(
+		strategy.EXPECT().Elected(gomock.Any(), gomock.Any()).Do(func(*exclusiveWorker, string) { panic("boom") }),
+		strategy.EXPECT().Elected(gomock.Any(), gomock.Any()).Return(nil),
+	)
+	w := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:         client,
+		key:            "test/elector-panic",
+		sessionTimeout: "10s",
+		quiet:          true,
+		strategy:       strategy,
+		lockDelay:      time.Millisecond,
+	})
+	defer w.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	work := func(ctx context.Context) error {
+		cancel()
+		return nil
+	}
+	err := runElectedSafely(ctx, w, work)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("RunElected returned %v", err)
+	}
+	if s := w.State(); s != StateReleased {
+		t.Fatalf("worker is %s after the panic", s)
+	}
+	if holder := m.holderOf("test/elector-panic"); holder != "" {
+		t.Fatalf("%s still holds the key", holder)
+	}
+	if err := runElectedSafely(ctx, w, work); !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunElected returned %v after the restart", err)
+	}
+}
+
+// TestRunTasks checks Run stops the elector when a task fails or calls stop, stops the
+// tasks once the elector returned, and returns after all of them
+func TestRunTasks(t *testing.T) {
+	failed := errors.New("config watch failed")
+	var taskDone atomic.Bool
+	err := Run(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	}, func(ctx context.Context, _ func()) error {
+		return failed
+	}, func(ctx context.Context, _ func()) error {
+		<-ctx.Done()
+		taskDone.Store(true)
+		return nil
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("Run returned %v, not the error of the task", err)
+	}
+	if !taskDone.Load() {
+		t.Error("Run returned before the other task")
+	}
+
+	// A stop (the exit signal) ends the elector, the task outlives it until it returned
+	var stoppedAfterElector atomic.Bool
+	electorDone := make(chan struct{})
+	err = Run(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		close(electorDone)
+		return ctx.Err()
+	}, func(ctx context.Context, stop func()) error {
+		stop()
+		<-ctx.Done()
+		select {
+		case <-electorDone:
+			stoppedAfterElector.Store(true)
+		default:
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run returned %v, not the error of the elector", err)
+	}
+	if !stoppedAfterElector.Load() {
+		t.Error("the task was stopped before the elector returned")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// deadmanVars holds the state of the keys watched by the monitor command, keyed by lock key
+var deadmanVars = expvar.NewMap("deadman")
+
+// deadman watches a key for the monitor command and alerts when nobody held it for
+// longer than threshold: a singleton that nobody runs is as bad as one run twice.
+type deadman struct {
+	key       string
+	threshold time.Duration
+	notifier  *webhookNotifier
+	holder    string // Who we are in the notifications
+
+	mu      sync.Mutex
+	free    time.Time // When we saw the key free, zero while it is held or before the first read
+	alerted bool      // The alert for the current free period was sent
+
+	leaderless *expvar.Int // 1 while nobody holds the key
+	alerts     *expvar.Int
+}
+
+func newDeadman(key string, threshold time.Duration, webhooks string) *deadman {
+	holder := notifierHolder("")
+	d := &deadman{
+		key:        key,
+		threshold:  threshold,
+		notifier:   newWebhookNotifier(key, holder, webhooks),
+		holder:     holder,
+		leaderless: new(expvar.Int),
+		alerts:     new(expvar.Int),
+	}
+	vars := new(expvar.Map)
+	vars.Set("leaderless", d.leaderless)
+	vars.Set("leaderless_seconds", expvar.Func(func() interface{} {
+		return d.leaderlessFor(time.Now()).Seconds()
+	}))
+	vars.Set("alerts_total", d.alerts)
+	deadmanVars.Set(key, vars)
+	return d
+}
+
+// leaderlessFor returns for how long nobody held the key, 0 while it is held
+func (d *deadman) leaderlessFor(now time.Time) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.free.IsZero() {
+		return 0
+	}
+	return now.Sub(d.free)
+}
+
+// observe records the holder of the key, nil if it is free. A key found free at
+// the first read counts as free from then on, we can not tell since when it was.
+func (d *deadman) observe(h *Holder, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if h == nil {
+		if d.free.IsZero() {
+			d.free = now
+			d.leaderless.Set(1)
+		}
+		return
+	}
+
+	if d.alerted {
+		log.Printf("[%s] Held again by %s after %s without leader", d.key, describe(h.SessionID, h.Hostname, h.Address), now.Sub(d.free).Round(time.Second))
+		d.notifier.notify(Notification{
+			Text:   fmt.Sprintf("%s is held again after %s without leader", d.key, now.Sub(d.free).Round(time.Second)),
+			Key:    d.key,
+			Reason: "recovered",
+			Holder: d.holder,
+			At:     now,
+		})
+	}
+	d.free, d.alerted = time.Time{}, false
+	d.leaderless.Set(0)
+}
+
+// check alerts once per free period when the key is free for longer than the threshold
+func (d *deadman) check(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.free.IsZero() || d.alerted || now.Sub(d.free) <= d.threshold {
+		return
+	}
+	d.alerted = true
+	d.alerts.Add(1)
+	log.Printf("[%s] Nobody holds the key since %s", d.key, d.free.Format(time.RFC3339))
+	d.notifier.notify(Notification{
+		Text:   fmt.Sprintf("nobody holds %s for %s, the job is not running", d.key, now.Sub(d.free).Round(time.Second)),
+		Key:    d.key,
+		Reason: "leaderless",
+		Holder: d.holder,
+		At:     now,
+	})
+}
+
+// runMonitor watches keys and alerts when one of them has no holder for longer than
+// -threshold, with the deadman metrics and a notification to the webhooks:
+//
+//	mutual-exclusion-consul monitor -keys service/a/leader,service/b/leader -threshold 5m
+//
+// The metrics are served under /debug/vars on -listen, if set. It runs until interrupted.
+func runMonitor(args []string) int {
+	fs := flag.NewFlagSet("monitor", flag.ExitOnError)
+	keys := fs.String("keys", envOr("MUTEX_KEYS", ""), "comma separated lock keys to watch")
+	threshold := fs.Duration("threshold", 5*time.Minute, "alert when a key has no holder for longer than this")
+	webhooks := fs.String("webhooks", envOr("MUTEX_WEBHOOKS", ""), "comma separated URLs notified when a key has no holder for too long and when it is held again")
+	listen := fs.String("listen", envOr("MUTEX_LISTEN", ""), "host:port where the metrics are served under /debug/vars")
+	encryptionKey := fs.String("encryption-key", envOr("MUTEX_ENCRYPTION_KEY", ""), "base64 AES key the workers encrypt the lock value with")
+	fs.Parse(args)
+
+	var list []string
+	for _, k := range strings.Split(*keys, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			list = append(list, k)
+		}
+	}
+	if len(list) == 0 {
+		log.Println("-keys is required")
+		return 2
+	}
+	for _, k := range list {
+		if err := validateKey(k); err != nil {
+			log.Println(err)
+			return 2
+		}
+	}
+	if *threshold <= 0 {
+		log.Println("-threshold must be positive")
+		return 2
+	}
+	cipher, err := newCipher(*encryptionKey)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	client, err := api.NewClient(&api.Config{Address: consulAddress})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if *listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		go func() {
+			if err := http.ListenAndServe(*listen, mux); err != nil {
+				log.Printf("metrics endpoint stopped: %s", err)
+			}
+		}()
+	}
+
+	var deadmen []*deadman
+	for _, k := range list {
+		d := newDeadman(k, *threshold, *webhooks)
+		defer d.notifier.close()
+		f := WatchLeader(client, k, cipher, func(h *Holder) { d.observe(h, time.Now()) })
+		if err := f.Start(); err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer f.Stop()
+		deadmen = append(deadmen, d)
+	}
+	log.Printf("Watching %d keys, alerting after %s without holder", len(list), *threshold)
+
+	// Checking often enough that alerts are late by a fraction of the threshold at most
+	interval := *threshold / 10
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	signals := signalConfig{}
+	signals.add(defaultExitSignals, actionExit)
+	interrupted := make(chan os.Signal, 1)
+	for sig := range signals {
+		signal.Notify(interrupted, sig)
+	}
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, d := range deadmen {
+				d.check(now)
+			}
+		case sig := <-interrupted:
+			log.Printf("Got %s, stopping", sig)
+			return 0
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historySize is how many events a worker remembers for the debug endpoint
+const historySize = 100
+
+// eventTransition is the kind of the state transitions in the event history.
+// They are never sent to onEvent, which only gets the other kinds
+const eventTransition EventKind = "transition"
+
+// eventHistory keeps the last historySize events and transitions of a worker
+type eventHistory struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (h *eventHistory) add(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, e)
+	if len(h.events) > historySize {
+		h.events = h.events[1:]
+	}
+}
+
+func (h *eventHistory) snapshot() []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Event(nil), h.events...)
+}
+
+// recordTransition adds the transitions to the event history
+func (ec *exclusiveWorker) recordTransition(t Transition) {
+	ec.history.add(Event{
+		Kind:         eventTransition,
+		Key:          ec.key,
+		LeadershipID: t.LeadershipID,
+		At:           t.At,
+		Detail:       fmt.Sprintf("%s -> %s", t.From, t.To),
+	})
+}
+
+// debugState is the internal state of a worker, to debug stuck workers
+type debugState struct {
+	Key          string       `json:"key"`
+	State        string       `json:"state"`
+	SessionID    string       `json:"session_id,omitempty"`
+	LeadershipID string       `json:"leadership_id,omitempty"`
+	Renewing     bool         `json:"renewing"`
+	LastRenewal  time.Time    `json:"last_renewal,omitempty"`
+	Renewals     RenewalStats `json:"renewals"`
+	Labels       Labels       `json:"labels,omitempty"`
+	Events       []Event      `json:"events"` // The last historySize, oldest first
+}
+
+func (ec *exclusiveWorker) debugState() debugState {
+	ec.mu.Lock()
+	s := debugState{
+		Key:          ec.key,
+		State:        ec.state.String(),
+		SessionID:    ec.sessionID,
+		LeadershipID: ec.leadershipID,
+		Renewing:     ec.renewing,
+		LastRenewal:  ec.lastRenewal,
+		Labels:       ec.labels,
+	}
+	ec.mu.Unlock()
+	s.Renewals = ec.RenewalStats()
+	s.Events = ec.history.snapshot()
+	return s
+}
+
+// goroutines returns the stacks of every goroutine, the renewal and election loops among them
+func goroutines() string {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// mountDebug adds the debug endpoints to mux, only reachable with the token:
+//
+//	GET /v1/debug     the internal state and last events of every worker, and the goroutine stacks
+//	/debug/pprof/...  net/http/pprof
+//
+// The token goes in an "Authorization: Bearer <token>" header.
+func mountDebug(mux *http.ServeMux, token string, workers []*exclusiveWorker) {
+	guard := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(rw http.ResponseWriter, r *http.Request) {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				writeJSON(rw, http.StatusUnauthorized, map[string]string{"error": "missing or wrong debug token"})
+				return
+			}
+			h(rw, r)
+		}
+	}
+
+	mux.HandleFunc("/v1/debug", guard(func(rw http.ResponseWriter, r *http.Request) {
+		states := make([]debugState, 0, len(workers))
+		for _, w := range workers {
+			states = append(states, w.debugState())
+		}
+		writeJSON(rw, http.StatusOK, map[string]interface{}{"workers": states, "goroutines": goroutines()})
+	}))
+	mux.HandleFunc("/debug/pprof/", guard(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", guard(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", guard(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", guard(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", guard(pprof.Trace))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// degradedPolicy is what the leader does when renewals fail but the session may
+// still be alive, e.g. in a network partition
+type degradedPolicy string
+
+const (
+	degradedFailFast degradedPolicy = "fail-fast" // Stop the work at the first failed renewal
+	degradedGrace    degradedPolicy = "grace"     // Keep working until the lease deadline of the work context
+	degradedReadOnly degradedPolicy = "read-only" // Like grace, but tell the work to degrade (see DegradedFromContext)
+)
+
+// checkDegraded checks a -degraded policy is known
+func checkDegraded(policy string) error {
+	switch degradedPolicy(policy) {
+	case degradedFailFast, degradedGrace, degradedReadOnly:
+		return nil
+	}
+	return fmt.Errorf("unknown -degraded policy %q", policy)
+}
+
+// degradedKey is the context key for the channel closed when the leadership degrades
+type degradedKey struct{}
+
+// DegradedFromContext returns a channel that is closed when renewals start failing
+// under the read-only policy: the work should stop writing. A leadership stays
+// degraded even if the renewals recover, we can not tell what happened meanwhile.
+// It returns nil (never closed) for other policies or outside a work context.
+func DegradedFromContext(ctx context.Context) <-chan struct{} {
+	ch, _ := ctx.Value(degradedKey{}).(chan struct{})
+	return ch
+}
+
+// renewFailed applies the degraded policy to a failed renewal. It returns true if
+// the leadership must end right away.
+func (ec *exclusiveWorker) renewFailed(err error) bool {
+	ec.emit(EventRenewFailure, err.Error())
+	switch ec.degraded {
+	case degradedFailFast:
+		return true
+	case degradedReadOnly:
+		ec.mu.Lock()
+		ch := ec.degradedCh
+		first := ch != nil && !ec.isDegraded
+		ec.isDegraded = true
+		ec.mu.Unlock()
+		if first {
+			close(ch)
+			ec.emit(EventDegraded, "renewals are failing, the work was told to stop writing")
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// destroyTimeout is how long we keep trying to destroy a session. Giving up leaves
+	// the key locked until the session TTL expires (plus the lock-delay)
+	destroyTimeout = 10 * time.Second
+	// destroyAttemptTimeout bounds each attempt, so a hung request does not use up destroyTimeout
+	destroyAttemptTimeout = 3 * time.Second
+)
+
+// destroyBackoff is how long we wait between attempts to destroy a session
+var destroyBackoff = Backoff{Base: 200 * time.Millisecond, Max: 2 * time.Second}
+
+// destroyWithRetries destroys a session, retrying consul errors with destroyBackoff
+// until destroyTimeout. Shutting down on a flaky network a single failed attempt
+// would keep the key locked for the whole TTL. If every attempt failed it logs the
+// session ID so it can be destroyed by hand, and returns the last error.
+// It is called without ec.mu, leadershipID tags the log.
+func (ec *exclusiveWorker) destroyWithRetries(sessionID, leadershipID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), destroyTimeout)
+	defer cancel()
+
+	var err error
+	for failures := 1; ctx.Err() == nil; failures++ {
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, destroyAttemptTimeout)
+		start := ec.clock.Now()
+		_, err = ec.client.Session().Destroy(sessionID, (&api.WriteOptions{}).WithContext(attemptCtx))
+		cancelAttempt()
+		ec.metrics.observeConsul(opDestroy, ec.since(start), err)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ec.clock.After(destroyBackoff.next(failures)):
+		case <-ctx.Done():
+		}
+	}
+	logWithID(ec.key, leadershipID, "Could not destroy session %s, it holds %s until its TTL expires. Destroy it by hand with PUT /v1/session/destroy/%s",
+		sessionID, ec.key, sessionID)
+	return err
+}
+
+// releaseWithHandover writes the handover and releases the key in one transaction
+// guarded by our session, so observers see both or neither. The lock value, value,
+// is kept. It returns ErrNotHeld if our session does not hold the key anymore. It is
+// called without ec.mu.
+func (ec *exclusiveWorker) releaseWithHandover(sessionID string, value []byte, handover *api.KVTxnOp) error {
+	ops := api.TxnOps{
+		{KV: &api.KVTxnOp{Verb: api.KVCheckSession, Key: ec.key, Session: sessionID}},
+		{KV: handover},
+		{KV: &api.KVTxnOp{Verb: api.KVUnlock, Key: ec.key, Session: sessionID, Value: value}},
+	}
+	start := ec.clock.Now()
+	ok, resp, _, err := ec.client.Txn().Txn(ops, nil)
+	ec.metrics.observeConsul(opRelease, ec.since(start), err)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	var reasons []string
+	for _, e := range resp.Errors {
+		if e.OpIndex == 0 {
+			return fmt.Errorf("%w: %s", ErrNotHeld, e.What)
+		}
+		reasons = append(reasons, e.What)
+	}
+	return fmt.Errorf("release of %s with the handover rolled back: %s", ec.key, strings.Join(reasons, ", "))
+}
+
+// releaseKept releases the key of a session kept for the next leadership and takes
+// it out of the contender queue. It is called without ec.mu.
+func (ec *exclusiveWorker) releaseKept(sessionID, leadershipID string) error {
+	if err := ec.releaseKey(sessionID); err != nil {
+		return err
+	}
+	ec.leaveQueue(sessionID, leadershipID)
+	return nil
+}
+
+// leaveQueue deletes the contender entry of a session kept once its leadership ended.
+// Registering again creates a new entry behind the contenders that waited meanwhile:
+// the entry of its first contention would keep the lowest CreateIndex, and the
+// fair-queue strategy would let it jump the queue every time.
+func (ec *exclusiveWorker) leaveQueue(sessionID, leadershipID string) {
+	if _, err := ec.client.KV().Delete(contenderPrefix(ec.key)+sessionID, nil); err != nil {
+		logWithID(ec.key, leadershipID, "Could not leave the contender queue: %s", err)
+	}
+}
+
+// releaseKey gives the key back with a KV release, keeping the session alive for its
+// other uses. It is called without ec.mu.
+func (ec *exclusiveWorker) releaseKey(sessionID string) error {
+	start := ec.clock.Now()
+	released, _, err := ec.client.KV().Release(&api.KVPair{Key: ec.key, Session: sessionID}, nil)
+	ec.metrics.observeConsul(opRelease, ec.since(start), err)
+	if err != nil {
+		return fmt.Errorf("ERROR cannot release key %s: %s", ec.key, err)
+	}
+	if !released {
+		return fmt.Errorf("%w: key %s was not held by session %s anymore", ErrNotHeld, ec.key, sessionID)
+	}
+	return nil
+}
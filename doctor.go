@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// minConsulVersion is the oldest consul agent the doctor command accepts: older ones
+// lack parts of the session and transaction APIs we use
+var minConsulVersion = [2]int{1, 0}
+
+// runDoctor diagnoses the environment of the workers of a key and prints a pass/fail
+// report with hints, for when a lock does not behave:
+//
+//	mutual-exclusion-consul doctor -key service/bobruner/leader
+//
+// It checks consul is reachable, the version of the agent, the ACL permissions on
+// the key, the clock skew with the agent and what the workers left behind under the
+// prefix: holders that stopped renewing, lease hints of sessions that are gone and
+// contention frozen by flapping. It exits with 1 if a check failed.
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	key := fs.String("key", envOr("MUTEX_KEY", ""), "lock key")
+	prefix := fs.String("prefix", "", "where to look for stale sessions and keys, defaults to -key")
+	maxSkew := fs.Duration("max-skew", 2*time.Second, "clock skew with the consul agent above which the check fails. The agent tells the time to the second")
+	encryptionKey := fs.String("encryption-key", envOr("MUTEX_ENCRYPTION_KEY", ""), "base64 AES key the workers encrypt the lock value with")
+	fs.Parse(args)
+	if *key == "" {
+		log.Println("-key is required")
+		return 2
+	}
+	if *prefix == "" {
+		*prefix = *key
+	}
+	cipher, err := newCipher(*encryptionKey)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	client, err := api.NewClient(&api.Config{Address: consulAddress})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	v := &validation{}
+	v.check("lock key "+*key, validateKey(*key), "use a KV path like service/<name>/leader")
+	_, err = client.Status().Leader()
+	if !v.check("consul reachable on "+consulAddress, err, "is the local consul agent running? Start it, or check it listens on "+consulAddress) {
+		return 1
+	}
+	version, err := agentVersion(client)
+	v.check("consul agent version "+version, err, fmt.Sprintf("upgrade the agent to consul %d.%d or newer", minConsulVersion[0], minConsulVersion[1]))
+	v.check("ACL permissions to create sessions and write "+*key, checkPermissions(client, *key), "set CONSUL_HTTP_TOKEN to a token with session:write on this node and key:write on the lock key")
+	v.check("ACL permissions to read "+*prefix, checkReadable(client, *prefix), "give the token key:read on the prefix, the workers and the status command read it")
+	skew, err := clockSkew()
+	v.check(fmt.Sprintf("clock skew with the consul agent %s (at most %s)", skew.Round(time.Millisecond), *maxSkew), checkSkew(skew, *maxSkew, err), "run NTP (chrony, systemd-timesyncd) on this host and the consul agents")
+
+	sessions, _, err := client.Session().List(nil)
+	var pairs api.KVPairs
+	if err == nil {
+		pairs, _, err = client.KV().List(*prefix, nil)
+	}
+	if v.check("sessions and keys under "+*prefix+" listed", err, "give the token session:read and key:read on the prefix") {
+		checkLeftovers(v, pairs, sessions, cipher)
+	}
+
+	if v.failed {
+		return 1
+	}
+	return 0
+}
+
+// agentVersion returns the version of the local consul agent, an error if it is
+// older than minConsulVersion
+func agentVersion(client *api.Client) (string, error) {
+	self, err := client.Agent().Self()
+	if err != nil {
+		return "unknown", err
+	}
+	version, _ := self["Config"]["Version"].(string)
+	if version == "memory" {
+		// -backend memory
+		return version, nil
+	}
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return version, fmt.Errorf("can not parse the version %q", version)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return version, fmt.Errorf("can not parse the version %q", version)
+	}
+	minor, _ := strconv.Atoi(parts[1])
+	if major < minConsulVersion[0] || major == minConsulVersion[0] && minor < minConsulVersion[1] {
+		return version, fmt.Errorf("consul %d.%d or newer is needed", minConsulVersion[0], minConsulVersion[1])
+	}
+	return version, nil
+}
+
+// checkReadable checks the consul token can read the keys under prefix
+func checkReadable(client *api.Client, prefix string) error {
+	_, _, err := client.KV().Keys(prefix, "", nil)
+	if err != nil && isPermissionDenied(err.Error()) {
+		return fmt.Errorf("%w: the consul token can not read %s: %s", ErrPermissionDenied, prefix, err)
+	}
+	return err
+}
+
+// clockSkew returns how far our clock is ahead of the one of the consul agent, from
+// the Date header of one of its responses taken in the middle of the round trip
+func clockSkew() (time.Duration, error) {
+	start := time.Now()
+	resp, err := http.Get("http://" + consulAddress + "/v1/status/leader")
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	rtt := time.Since(start)
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("the agent did not tell its time: %s", err)
+	}
+	// Date is truncated to the second, compare with the middle of that second
+	return start.Add(rtt / 2).Sub(date.Add(500 * time.Millisecond)), nil
+}
+
+// checkSkew fails if the clock skew is above limit
+func checkSkew(skew, limit time.Duration, err error) error {
+	if err != nil {
+		return err
+	}
+	if skew.Abs() > limit {
+		return fmt.Errorf("the clocks are %s apart", skew.Abs().Round(time.Millisecond))
+	}
+	return nil
+}
+
+// checkLeftovers reports what the workers left behind under the prefix: holders
+// whose lease hint says they stopped renewing, which consul frees within their TTL,
+// lease hints of sessions that are gone, only a warning, and contention frozen by
+// flapping
+func checkLeftovers(v *validation, pairs api.KVPairs, sessions []*api.SessionEntry, c *Cipher) {
+	live := make(map[string]bool, len(sessions))
+	for _, s := range sessions {
+		live[s.ID] = true
+	}
+	byKey := make(map[string]*api.KVPair, len(pairs))
+	for _, pair := range pairs {
+		byKey[pair.Key] = pair
+	}
+
+	now := time.Now()
+	stale := 0
+	for _, pair := range pairs {
+		switch {
+		case isLockKey(pair) && pair.Session != "":
+			hint, ok := byKey[leaseHintKey(pair.Key)]
+			if !ok {
+				continue
+			}
+			h, err := decodeLeaseHint(hint)
+			if err != nil || h.SessionID != pair.Session || now.Before(h.ExpiresAt) {
+				continue
+			}
+			stale++
+			holder := decodeHolder(pair, c)
+			v.check("holder of "+pair.Key, errors.New("session "+describe(pair.Session, holder.Hostname, holder.Address)+" stopped renewing, "+h.Describe(now)),
+				"consul frees the key within the TTL. If the holder is gone for good: curl -X PUT http://"+consulAddress+"/v1/session/destroy/"+pair.Session)
+		case path.Base(pair.Key) == "lease" && pair.Session == "":
+			h, err := decodeLeaseHint(pair)
+			if err != nil || h.SessionID == "" || live[h.SessionID] {
+				continue
+			}
+			stale++
+			v.warn("lease hint "+pair.Key, fmt.Errorf("left by session %s, which is gone", h.SessionID),
+				"harmless, the next leader overwrites it. Remove it with: consul kv delete "+pair.Key)
+		case strings.HasSuffix(pair.Key, "/audit/frozen"):
+			stale++
+			v.check("contention of "+strings.TrimSuffix(pair.Key, "/audit/frozen"), fmt.Errorf("frozen: %s", strings.TrimSpace(string(pair.Value))),
+				"find why the leadership flapped, then resume with: consul kv delete "+pair.Key)
+		}
+	}
+	if stale == 0 {
+		v.check("no stale sessions or keys", nil, "")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// retryInterval is how long we wait before trying again after a consul error
+// or when the key is free but we could not get it (e.g. because of lock-delay)
+const retryInterval = time.Second
+
+// RunElected is a long lived elector loop: wait to become leader, run fn, and
+// when fn returns or the leadership is lost (fn's ctx is cancelled) release
+// and go back to waiting. It only returns when ctx is done or the worker is closed.
+// If the leadership was lost it waits lostCooldown before contending again, longer
+// while the leadership flaps (see setFlapping).
+// With exitIfIdle it returns ErrIdle when we are a follower for that long.
+// With localFallback it works with the file lock alone while consul is unreachable
+// (see runLocalFallback). With the api-lock engine consul's api.Lock elects us instead,
+// see runAPILock.
+func (ec *exclusiveWorker) RunElected(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ec.engine == engineAPILock {
+		return ec.runElectedAPILock(ctx, fn)
+	}
+	for {
+		waitCtx, cancel := ctx, context.CancelFunc(func() {})
+		if ec.exitIfIdle > 0 {
+			waitCtx, cancel = context.WithTimeoutCause(ctx, ec.exitIfIdle, ErrIdle)
+		}
+		err := ec.waitForLeadership(waitCtx)
+		cancel()
+		if errors.Is(err, errConsulUnreachable) {
+			if err := ec.runLocalFallback(ctx, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil && context.Cause(waitCtx) == ErrIdle {
+				return ErrIdle
+			}
+			return err
+		}
+
+		if err := ec.runHeld(ctx, fn); errors.Is(err, ErrLeadershipLost) {
+			ec.logf("%s", err)
+		} else if err != nil {
+			ec.logf("Work failed: %s", err)
+		}
+		lost := ec.State() == StateLost
+
+		// Give the lock back (or clean up the lost session) before contending again
+		err = ec.destroySession()
+		if err != nil && !errors.Is(err, ErrSessionDestroyed) && !errors.Is(err, ErrNoSession) {
+			ec.logf("Could not destroy session: %s", err)
+		}
+
+		if ec.takeSteppedDown() {
+			ec.emit(EventCooldown, fmt.Sprintf("stepped down, waiting %s before contending again", stepDownDelay))
+			if err := ec.sleep(ctx, stepDownDelay); err != nil {
+				return err
+			}
+		}
+		if cooldown, reason := ec.cooldownAfter(lost); cooldown > 0 {
+			ec.emit(EventCooldown, fmt.Sprintf("%s, waiting %s before contending again", reason, cooldown))
+			if err := ec.sleep(ctx, cooldown); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// waitForLeadership blocks until we hold the lock, ctx is done or the worker is closed.
+// The election strategy decides when we try to acquire, and only inside the window if there is one
+func (ec *exclusiveWorker) waitForLeadership(ctx context.Context) error {
+	var unreachableSince time.Time
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := ec.waitForWindow(ctx); err != nil {
+			return err
+		}
+		if err := ec.waitForMaintenance(ctx); err != nil {
+			return err
+		}
+		if err := ec.waitForFreeze(ctx); err != nil {
+			return err
+		}
+		if err := ec.waitForGeneration(ctx); err != nil {
+			return err
+		}
+		if s := ec.State(); s != StateAcquiring {
+			err := ec.createSession()
+			if err == nil {
+				if err = ec.strategy.Prepare(ec, ec.currentSession()); err != nil {
+					ec.destroySession()
+				}
+			}
+			if err != nil {
+				if errors.Is(err, ErrClosed) || errors.Is(err, ErrPermissionDenied) {
+					return err
+				}
+				ec.logf("Could not create session: %s", err)
+				if unreachableSince.IsZero() {
+					unreachableSince = ec.clock.Now()
+				}
+				if ec.localFallback != "" && ec.since(unreachableSince) >= ec.fallbackAfter {
+					return fmt.Errorf("%w for %s: %w", errConsulUnreachable, ec.since(unreachableSince).Round(time.Second), err)
+				}
+				if err := ec.retry(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			unreachableSince = time.Time{}
+		}
+
+		contend, err := ec.strategy.ShouldContend(ec, ec.currentSession())
+		if err != nil {
+			ec.logf("Election strategy %s failed: %s", ec.strategy.Name(), err)
+			if err := ec.retry(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		if contend {
+			if err := ec.checkPreconditions(ctx, "before contending"); err != nil {
+				ec.logf("Not contending: %s", err)
+				ec.destroySession()
+				if err := ec.sleep(ctx, preconditionRetry); err != nil {
+					return err
+				}
+				continue
+			}
+			acquired, err := ec.acquireSession()
+			if err != nil {
+				// The session may be gone, start over with a new one
+				ec.logf("Could not acquire: %s", err)
+				if errors.Is(err, ErrSplitBrain) {
+					ec.emit(EventSplitBrain, err.Error())
+				}
+				ec.destroySession()
+				if err := ec.retry(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			if acquired {
+				if err := ec.checkPreconditions(ctx, "after acquiring"); err != nil {
+					ec.logf("Giving the lock back: %s", err)
+					ec.giveBack()
+					if err := ec.sleep(ctx, preconditionRetry); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := ec.strategy.Elected(ec, ec.currentSession()); err != nil {
+					ec.logf("Election strategy %s failed: %s", ec.strategy.Name(), err)
+				}
+				ec.takeOver()
+				return nil
+			}
+		}
+
+		free, err := ec.waitForRelease(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrClosed) {
+				return err
+			}
+			ec.logf("Could not watch key: %s", err)
+			ec.destroySession()
+			if err := ec.retry(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		if free {
+			// The key looked free but we did not get it. Don't spin
+			if err := ec.sleep(ctx, retryInterval); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// waitForRelease watches the key with blocking queries until nobody holds it.
+// While waiting our session is renewed so it does not expire under us.
+// In a consul brownout it backs off instead of spinning (see brownout).
+// It returns true if the key was already free on the first read.
+func (ec *exclusiveWorker) waitForRelease(ctx context.Context) (bool, error) {
+	ttl, err := time.ParseDuration(ec.TTL())
+	if err != nil {
+		return false, err
+	}
+
+	var index uint64
+	for first := true; ; first = false {
+		opts := (&api.QueryOptions{WaitIndex: index, WaitTime: ttl / 2}).WithContext(ctx)
+		start := ec.clock.Now()
+		pair, meta, err := ec.client.KV().Get(ec.key, opts)
+		ec.metrics.observeConsul(opWatch, ec.since(start), err)
+		wait := ec.observeWatch(start, err == nil && (first || meta.LastIndex != index), err)
+		if err != nil {
+			if ctx.Err() == nil && wait > retryInterval {
+				// The caller waits retryInterval, back off the rest
+				ec.sleep(ctx, wait-retryInterval)
+			}
+			return false, err
+		}
+		if pair == nil || pair.Session == "" {
+			return first, nil
+		}
+		if first || meta.LastIndex != index {
+			// Someone else leads, refresh the contenders gauge while we wait
+			if _, err := ec.Contenders(); err != nil {
+				ec.logf("Could not count contenders: %s", err)
+			}
+		}
+		if meta.LastIndex < index {
+			// The index went backwards (e.g. consul was restored), start over
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+
+		select {
+		case <-ec.closed:
+			return false, ErrClosed
+		default:
+		}
+		renewStart := ec.clock.Now()
+		entry, _, err := ec.renewClient.Session().Renew(ec.currentSession(), nil)
+		ec.metrics.observeConsul(opRenew, ec.since(renewStart), err)
+		if err != nil {
+			return false, err
+		}
+		if entry == nil {
+			return false, api.ErrSessionExpired
+		}
+		if wait > 0 {
+			if err := ec.sleep(ctx, wait); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// currentSession returns the ID of the current session, empty if there is none
+func (ec *exclusiveWorker) currentSession() string {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.sessionID
+}
+
+// sleep waits for d unless ctx is done or the worker is closed
+func (ec *exclusiveWorker) sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ec.clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ec.closed:
+		return ErrClosed
+	}
+}
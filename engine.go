@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Lock engines of -engine
+const (
+	engineSession = "session"  // Our own sessions, renewals and checks, the default
+	engineAPILock = "api-lock" // consul's api.Lock, with its own session, renewals and monitor
+)
+
+// checkEngine checks an -engine is known
+func checkEngine(engine string) error {
+	switch engine {
+	case engineSession, engineAPILock:
+		return nil
+	}
+	return fmt.Errorf("unknown -engine %q, use %s or %s", engine, engineSession, engineAPILock)
+}
+
+// runElectedAPILock is RunElected with the api-lock engine
+func (ec *exclusiveWorker) runElectedAPILock(ctx context.Context, fn func(ctx context.Context) error) error {
+	for {
+		held, lost, err := ec.runAPILock(ctx, fn, false)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		select {
+		case <-ec.closed:
+			return ErrClosed
+		default:
+		}
+		switch {
+		case err != nil && !held:
+			ec.logf("Could not acquire: %s", err)
+			if err := ec.retry(ctx); err != nil {
+				return err
+			}
+			continue
+		case err != nil:
+			ec.logf("Work failed: %s", err)
+		}
+
+		if cooldown, reason := ec.cooldownAfter(lost); cooldown > 0 {
+			ec.emit(EventCooldown, fmt.Sprintf("%s, waiting %s before contending again", reason, cooldown))
+			if err := ec.sleep(ctx, cooldown); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// runAPILock runs one leadership with consul's api.Lock instead of our sessions: it
+// waits for the lock (tries once with tryOnce), runs fn and unlocks when fn returns,
+// we resign or the monitor of api.Lock sees the lock is gone, which cancels fn's
+// context. The worker goes through the same states as with the session engine, so
+// the hooks, events and metrics work the same. It returns whether we got the lock,
+// whether it was lost and fn's error, ErrLeadershipLost if it was lost while working.
+//
+// Only the election is delegated: the strategies, preconditions, windows, fencing
+// and the other features built on our sessions are not applied, and every contender
+// of a key must use the same engine (api.Lock flags the key as its own). Like with
+// the session engine we do not contend while another generation is preferred.
+func (ec *exclusiveWorker) runAPILock(ctx context.Context, fn func(ctx context.Context) error, tryOnce bool) (held, lost bool, err error) {
+	if err := ec.waitForGeneration(ctx); err != nil {
+		return false, false, err
+	}
+	ec.mu.Lock()
+	select {
+	case <-ec.closed:
+		ec.unlock()
+		return false, false, ErrClosed
+	default:
+	}
+	if err := ec.transition(StateAcquiring); err != nil {
+		ec.unlock()
+		return false, false, err
+	}
+	// Joined under the lock after checking closed, so Close waits for us
+	ec.wg.Add(1)
+	defer ec.wg.Done()
+	ec.contendAt = ec.clock.Now()
+	ec.leadershipID = ""
+	ec.lockInfo = LockInfo{}
+	opts := &api.LockOptions{
+		Key:         ec.key,
+		Value:       ec.holderValue(""),
+		SessionName: "mutex " + ec.key,
+		SessionTTL:  ec.sessionTimeout,
+		LockTryOnce: tryOnce,
+	}
+	ec.unlock()
+
+	lock, err := ec.client.LockOpts(opts)
+	var leaderCh <-chan struct{}
+	if err == nil {
+		stop := make(chan struct{})
+		acquired := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				close(stop)
+			case <-ec.closed:
+				close(stop)
+			case <-acquired:
+			}
+		}()
+		leaderCh, err = lock.Lock(stop)
+		close(acquired)
+	}
+	if err != nil || leaderCh == nil {
+		ec.mu.Lock()
+		ec.transition(StateReleased)
+		ec.unlock()
+		if err == nil {
+			err = ctx.Err()
+		}
+		return false, false, err
+	}
+
+	info, infoErr := ec.readLockInfo()
+	if infoErr != nil {
+		logWithID(ec.key, "", "could not read epoch: %s", infoErr)
+	}
+	ec.mu.Lock()
+	ec.metrics.acquired.Add(1)
+	ec.metrics.acquireWait.observe(ec.since(ec.contendAt))
+	ec.lockInfo, ec.sessionID = info, info.Session
+	ec.leadershipID, err = newLeadershipID(info.LockIndex)
+	ec.resignCh = make(chan struct{})
+	ec.degradedCh, ec.isDegraded = make(chan struct{}), false
+	resignCh, leadershipID := ec.resignCh, ec.leadershipID
+	ec.transition(StateHeld)
+	ec.unlock()
+	if err != nil {
+		ec.logf("Could not tag the leadership: %s", err)
+	}
+
+	// No lease deadline like WorkContext: api.Lock does not tell us about its renewals
+	workCtx, cancel := context.WithCancel(context.WithValue(ctx, leadershipIDKey{}, leadershipID))
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-leaderCh:
+			lost = true
+		case <-resignCh:
+		case <-ec.closed:
+		case <-workCtx.Done():
+		}
+		cancel()
+	}()
+	err = fn(workCtx)
+	cancel()
+	<-watched
+
+	sessionID := info.Session
+	var reason LossReason
+	if lost {
+		reason = ec.classifyLoss(sessionID, api.ErrSessionExpired)
+		err = errors.Join(err, ErrLeadershipLost)
+	} else {
+		ec.mu.Lock()
+		ec.transition(StateDraining)
+		ec.unlock()
+	}
+	if uerr := lock.Unlock(); uerr != nil && !errors.Is(uerr, api.ErrLockNotHeld) {
+		ec.logf("Could not unlock: %s", uerr)
+	}
+	// Removes the key unless another contender holds or waits for it
+	if derr := lock.Destroy(); derr != nil && !errors.Is(derr, api.ErrLockInUse) {
+		ec.logf("Could not clean up the lock: %s", derr)
+	}
+
+	ec.mu.Lock()
+	ec.sessionID, ec.resignCh = "", nil
+	if lost {
+		ec.lossReason, ec.lossDetail = reason, "the monitor of api.Lock saw the lock lost"
+		ec.transition(StateLost)
+	} else {
+		ec.transition(StateReleased)
+	}
+	ec.unlock()
+	return true, lost, err
+}
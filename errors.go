@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned when the worker methods are used in the wrong order
+var (
+	// ErrNoSession is returned when an operation needs a session and createSession was not called
+	ErrNoSession = errors.New("no session: createSession must be called first")
+	// ErrSessionDestroyed is returned when destroying a session that was already destroyed
+	ErrSessionDestroyed = errors.New("session already destroyed")
+	// ErrAlreadyRenewing is returned when a renewal loop is already running for the worker
+	ErrAlreadyRenewing = errors.New("session renewal already running")
+	// ErrClosed is returned when using a worker after Close()
+	ErrClosed = errors.New("worker is closed")
+	// ErrSplitBrain is returned when we believe we are leader but the key is owned by another session
+	ErrSplitBrain = errors.New("split brain detected")
+	// ErrOutsideWindow is returned when acquiring outside of the configured time window
+	ErrOutsideWindow = errors.New("outside of the acquisition window")
+	// ErrPermissionDenied is returned when the consul token can not create sessions or write the key
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrLeadershipLost is returned when the session renewal failed while working
+	ErrLeadershipLost = errors.New("leadership lost")
+	// ErrPrecondition is returned when a precondition fails, see Precondition
+	ErrPrecondition = errors.New("precondition failed")
+	// ErrIdle is returned by RunElected when we did not become leader within exitIfIdle
+	ErrIdle = errors.New("did not become leader in time")
+)
+
+// StateError is returned when an operation is not allowed in the current state
+type StateError struct {
+	Op    string // Operation that was attempted (e.g. "renew")
+	State State  // State the worker was in
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("cannot %s in state %s", e.Op, e.State)
+}
+
+// TransitionError is returned when the worker is asked to do an illegal state transition
+type TransitionError struct {
+	From State
+	To   State
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("illegal transition from %s to %s", e.From, e.To)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// logRecord is one line of the event log: a transition (From and To are set) or an event
+type logRecord struct {
+	At           time.Time `json:"at"`
+	Key          string    `json:"key"`
+	Kind         EventKind `json:"kind"`
+	From         string    `json:"from,omitempty"`
+	To           string    `json:"to,omitempty"`
+	LeadershipID string    `json:"leadership_id,omitempty"`
+	SessionID    string    `json:"session_id,omitempty"`
+	Detail       string    `json:"detail,omitempty"`
+	Reason       string    `json:"reason,omitempty"` // Why the leadership ended, see LossReason
+	Labels       Labels    `json:"labels,omitempty"`
+}
+
+// eventLog appends the transitions and events of the workers to a file, one JSON
+// record per line, so the replay command can tell what they believed at each moment.
+// It is safe to share between workers.
+type eventLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// openEventLog opens the event log at path for appending, creating it if needed
+func openEventLog(path string) (*eventLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (l *eventLog) write(r logRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(r); err != nil {
+		logWithID(r.Key, r.LeadershipID, "Could not write the event log: %s", err)
+	}
+}
+
+func (l *eventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// logEvent writes an event to the event log, if there is one
+func (ec *exclusiveWorker) logEvent(e Event) {
+	if ec.eventLog == nil {
+		return
+	}
+	ec.eventLog.write(logRecord{
+		At:           e.At,
+		Key:          e.Key,
+		Kind:         e.Kind,
+		LeadershipID: e.LeadershipID,
+		SessionID:    ec.currentSession(),
+		Detail:       e.Detail,
+		Labels:       e.Labels,
+	})
+}
+
+// logTransitionOnTransition writes the transitions to the event log
+func (ec *exclusiveWorker) logTransitionOnTransition(t Transition) {
+	ec.eventLog.write(logRecord{
+		At:           t.At,
+		Key:          ec.key,
+		Kind:         eventTransition,
+		From:         t.From.String(),
+		To:           t.To.String(),
+		LeadershipID: t.LeadershipID,
+		SessionID:    ec.currentSession(),
+		Detail:       t.Detail,
+		Reason:       string(t.Reason),
+		Labels:       ec.Labels(),
+	})
+}
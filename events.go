@@ -0,0 +1,73 @@
+package main
+
+import "time"
+
+// EventKind identifies the kind of an Event
+type EventKind string
+
+// Events that are not state transitions but operators may want to alert on
+const (
+	// EventCooldown is emitted when we lost the leadership and wait before contending again.
+	// Many of these in a short time mean the node is flapping
+	EventCooldown EventKind = "cooldown"
+	// EventSplitBrain is emitted when we think we are leader but the key is held by another session
+	EventSplitBrain EventKind = "split-brain"
+	// EventRenewFailure is emitted when a renewal fails. The session may still be alive
+	// and the next renewal may succeed, StateLost tells when it did not
+	EventRenewFailure EventKind = "renew-failure"
+	// EventStale is emitted when consul blocking queries keep failing or returning right away
+	// (a brownout): what we know about the leadership may be stale and we back off
+	EventStale EventKind = "stale"
+	// EventRecovered is emitted when the blocking queries are back to normal after EventStale
+	EventRecovered EventKind = "recovered"
+	// EventStepDown is emitted when the leader is asked to step down through the control key
+	EventStepDown EventKind = "step-down"
+	// EventMaintenance is emitted when the maintenance flag is set or cleared
+	EventMaintenance EventKind = "maintenance"
+	// EventDegraded is emitted when renewals start failing under the read-only degraded policy
+	EventDegraded EventKind = "degraded"
+	// EventPaused is emitted when a renewal fires much later than planned, the process
+	// was probably paused. Ownership is verified before renewing
+	EventPaused EventKind = "paused"
+	// EventPrecondition is emitted when a precondition fails before contending or right
+	// after getting the lock, which we then give back
+	EventPrecondition EventKind = "precondition-failed"
+	// EventLocalFallback is emitted when consul is unreachable and we start working with
+	// the local file lock alone, and when consul is back and we stop
+	EventLocalFallback EventKind = "local-fallback"
+	// EventPolicy is emitted when the policy script asks the leader to resign
+	EventPolicy EventKind = "policy"
+	// EventFlapping is emitted when the leadership changed more than the flap threshold
+	// allows, when contention is frozen and unfrozen and when it settled again
+	EventFlapping EventKind = "flapping"
+	// EventGeneration is emitted when a deployment controller prefers another generation
+	// of workers than ours, and when ours may contend again
+	EventGeneration EventKind = "generation"
+)
+
+// Event is something that happened to the worker besides a state transition
+type Event struct {
+	Kind         EventKind
+	Key          string
+	LeadershipID string
+	At           time.Time
+	Detail       string // Human readable details
+	Labels       Labels // Of the worker
+}
+
+// emit records an event in the history and sends it to onEvent. It must not be called with ec.mu held
+func (ec *exclusiveWorker) emit(kind EventKind, detail string) {
+	e := Event{
+		Kind:         kind,
+		Key:          ec.key,
+		LeadershipID: ec.LeadershipID(),
+		At:           ec.clock.Now(),
+		Detail:       detail,
+		Labels:       ec.Labels(),
+	}
+	ec.history.add(e)
+	ec.logEvent(e)
+	if ec.onEvent != nil {
+		ec.onEvent(e)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// exampleClient returns a client of consul simulated in the process, like -backend memory.
+// Real programs use api.NewClient(api.DefaultConfig()).
+func exampleClient() *api.Client {
+	address, err := serveMemoryConsul()
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := api.NewClient(&api.Config{Address: address})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return client
+}
+
+// The callback API: RunElected waits to be leader, runs the work with a context
+// cancelled when the leadership ends, gives the lock back when the work returns and
+// contends again, until its context is done.
+func Example_runElected() {
+	w := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:         exampleClient(),
+		key:            "service/reports/leader",
+		sessionTimeout: "15s",
+		quiet:          true,
+		onTransition: func(t Transition) {
+			fmt.Printf("%s -> %s\n", t.From, t.To)
+		},
+	})
+	defer w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := w.RunElected(ctx, func(ctx context.Context) error {
+		if _, ok := LeadershipIDFromContext(ctx); ok {
+			fmt.Println("working as leader")
+		}
+		// Done for good: the lock is given back and RunElected returns
+		cancel()
+		return nil
+	})
+	fmt.Println(err)
+	// Output:
+	// idle -> acquiring
+	// acquiring -> held
+	// working as leader
+	// held -> draining
+	// draining -> released
+	// context canceled
+}
+
+// RunOnce is the cron mode: work if we get the lock, give up if someone else has it.
+func Example_runOnce() {
+	client := exampleClient()
+	newWorker := func() *exclusiveWorker {
+		return newExclusiveWorker(&exclusiveWorkerConfig{
+			client:         client,
+			key:            "service/nightly/leader",
+			sessionTimeout: "15s",
+			quiet:          true,
+		})
+	}
+	first, second := newWorker(), newWorker()
+	defer first.Close()
+	defer second.Close()
+
+	first.RunOnce(context.Background(), func(ctx context.Context) error {
+		held, err := second.RunOnce(ctx, func(context.Context) error {
+			fmt.Println("never runs")
+			return nil
+		})
+		fmt.Println("the second worker worked:", held, err)
+		return nil
+	})
+	// Output:
+	// the second worker worked: false <nil>
+}
+
+// A ConcurrencyLimit is a semaphore shared by the workers of different keys: a host
+// leads only what it can afford, the others are left to hosts with free slots.
+func ExampleNewConcurrencyLimit() {
+	client := exampleClient()
+	limit := NewConcurrencyLimit(1)
+	newWorker := func(key string) *exclusiveWorker {
+		return newExclusiveWorker(&exclusiveWorkerConfig{
+			client:         client,
+			key:            key,
+			sessionTimeout: "15s",
+			quiet:          true,
+			limit:          limit,
+			limitWeight:    1,
+		})
+	}
+	billing, reports := newWorker("service/billing/leader"), newWorker("service/reports/leader")
+	defer billing.Close()
+	defer reports.Close()
+
+	billing.RunOnce(context.Background(), func(ctx context.Context) error {
+		_, err := reports.RunOnce(ctx, func(context.Context) error { return nil })
+		fmt.Println("reports while billing runs:", errors.Is(err, ErrPrecondition))
+		return nil
+	})
+	held, err := reports.RunOnce(context.Background(), func(context.Context) error { return nil })
+	fmt.Println("reports once billing is done:", held, err)
+	// Output:
+	// reports while billing runs: true
+	// reports once billing is done: true <nil>
+}
+
+// Request-scoped locks borrow a session of a pool instead of creating one per request.
+func ExampleAcquireScoped() {
+	client := exampleClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lock, err := AcquireScoped(ctx, client, "orders/42", "15s")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("holding", lock.Key())
+	// The work stops if the session is lost
+	select {
+	case <-lock.Lost():
+		fmt.Println("lost")
+	default:
+	}
+	if err := lock.Release(); err != nil {
+		fmt.Println(err)
+	}
+	// Output:
+	// holding orders/42
+}
+
+// WatchLeader follows who holds a key, e.g. to send the requests to the leader.
+func ExampleWatchLeader() {
+	client := exampleClient()
+	const key = "service/api/leader"
+	leaders := make(chan *Holder, 1)
+	f := WatchLeader(client, key, nil, func(h *Holder) {
+		if h != nil {
+			leaders <- h
+		}
+	})
+	if err := f.Start(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer f.Stop()
+
+	w := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:         client,
+		key:            key,
+		sessionTimeout: "15s",
+		advertiseAddr:  "10.0.0.7:8080",
+		quiet:          true,
+	})
+	defer w.Close()
+	w.RunOnce(context.Background(), func(ctx context.Context) error {
+		fmt.Println("the leader is at", (<-leaders).Address)
+		return nil
+	})
+	// Output:
+	// the leader is at 10.0.0.7:8080
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The run-command mode: the command runs while we are leader, gets the key and the
+// leadership ID in its environment, and is stopped if the leadership is lost.
+func Example_runCommand() {
+	w := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:         exampleClient(),
+		key:            "service/backup/leader",
+		sessionTimeout: "15s",
+		quiet:          true,
+	})
+	defer w.Close()
+
+	held, err := w.RunOnce(context.Background(), func(ctx context.Context) error {
+		return runCommand(ctx, w, &commandConfig{
+			args:      []string{"sh", "-c", `echo "backing up as the leader of $MUTEX_KEY"`},
+			killGrace: time.Second,
+		})
+	})
+	fmt.Println(held, err)
+	// Output:
+	// backing up as the leader of service/backup/leader
+	// true <nil>
+}
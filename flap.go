@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// defaultFlapWindow is how far back the leadership changes are counted by default
+const defaultFlapWindow = 10 * time.Minute
+
+// checkFlapDamping checks the settings of the flap damping
+func checkFlapDamping(threshold int, window time.Duration, freeze bool) error {
+	switch {
+	case threshold < 0:
+		return fmt.Errorf("-flap-threshold must not be negative")
+	case threshold > 0 && window <= 0:
+		return fmt.Errorf("-flap-window must be positive")
+	case threshold == 0 && freeze:
+		return fmt.Errorf("-flap-freeze needs -flap-threshold")
+	}
+	return nil
+}
+
+// leadershipChange is a leadership of the key in the audit of its changes
+type leadershipChange struct {
+	At           time.Time  `json:"at"`
+	LeadershipID string     `json:"leadership_id"`
+	Hostname     string     `json:"hostname,omitempty"`
+	Build        *BuildInfo `json:"build,omitempty"`
+	// Froze is set on the change that froze the contention with flapFreeze. Once the
+	// freeze is lifted it and the changes before it are not counted anymore
+	Froze bool `json:"froze,omitempty"`
+}
+
+// leadershipAuditKey is where the leaders of a key list the recent leadership changes
+func leadershipAuditKey(key string) string {
+	return key + "/audit/leaderships"
+}
+
+// flapFreezeKey is set when the leadership of a key flaps with flapFreeze: nobody
+// contends for the key until an operator deletes it
+func flapFreezeKey(key string) string {
+	return key + "/audit/frozen"
+}
+
+// auditOnTransition adds every leadership we get to the audit of the key and checks
+// whether the leadership flaps
+func (ec *exclusiveWorker) auditOnTransition(t Transition) {
+	if t.To == StateHeld {
+		go ec.auditLeadership(t)
+	}
+}
+
+// auditLeadership adds the leadership of t to the audit, keeping the changes of the
+// last flapWindow. The audit is shared by the contenders, so every leader sees the
+// changes of the others. More than flapThreshold changes in the window is flapping.
+// It is written even if the leadership is already over: flapping leaderships are short.
+func (ec *exclusiveWorker) auditLeadership(t Transition) {
+	key := leadershipAuditKey(ec.key)
+	hostname, _ := os.Hostname()
+	for attempt := 0; attempt < 3; attempt++ {
+		changes, index, err := ec.readLeadershipAudit()
+		if err != nil {
+			ec.logf("Could not read the leadership audit, starting a new one: %s", err)
+		}
+		if changes, err = ec.afterLiftedFreeze(changes); err != nil {
+			ec.logf("Could not read the contention freeze: %s", err)
+		}
+		since := t.At.Add(-ec.flapWindow)
+		recent := []leadershipChange{}
+		for _, c := range changes {
+			if c.At.After(since) && c.LeadershipID != t.LeadershipID {
+				recent = append(recent, c)
+			}
+		}
+		recent = append(recent, leadershipChange{At: t.At, LeadershipID: t.LeadershipID, Hostname: hostname, Build: currentBuild()})
+		// Marked before the freeze is written, so lifting it always forgets these changes
+		recent[len(recent)-1].Froze = ec.flapFreeze && len(recent) > ec.flapThreshold
+
+		value, err := json.Marshal(recent)
+		if err == nil {
+			value, err = ec.cipher.seal(key, value)
+		}
+		written := false
+		if err == nil {
+			written, _, err = ec.client.KV().CAS(&api.KVPair{Key: key, Value: value, ModifyIndex: index}, nil)
+		}
+		if err != nil {
+			ec.logf("Could not write the leadership audit: %s", err)
+			return
+		}
+		if written {
+			ec.setFlapping(len(recent))
+			return
+		}
+		// Another leader wrote it meanwhile, read it again
+	}
+	ec.logf("Could not write the leadership audit, it kept changing")
+}
+
+// afterLiftedFreeze drops the changes up to the last one that froze the contention if
+// the freeze was lifted since: the operator deleting <key>/audit/frozen starts a new
+// audit, or the next leader would freeze the contention again right away. While
+// the freeze is set every change counts.
+func (ec *exclusiveWorker) afterLiftedFreeze(changes []leadershipChange) ([]leadershipChange, error) {
+	last := -1
+	for i, c := range changes {
+		if c.Froze {
+			last = i
+		}
+	}
+	if last < 0 {
+		return changes, nil
+	}
+	pair, _, err := ec.client.KV().Get(flapFreezeKey(ec.key), &api.QueryOptions{RequireConsistent: true})
+	if err != nil || pair != nil {
+		return changes, err
+	}
+	return changes[last+1:], nil
+}
+
+// readLeadershipAudit reads the recent leadership changes of the key and the index to
+// write them back with
+func (ec *exclusiveWorker) readLeadershipAudit() ([]leadershipChange, uint64, error) {
+	pair, _, err := ec.client.KV().Get(leadershipAuditKey(ec.key), &api.QueryOptions{RequireConsistent: true})
+	if err != nil || pair == nil {
+		return nil, 0, err
+	}
+	value, err := ec.cipher.open(pair.Key, pair.Value)
+	if err != nil {
+		return nil, pair.ModifyIndex, err
+	}
+	var changes []leadershipChange
+	err = json.Unmarshal(value, &changes)
+	return changes, pair.ModifyIndex, err
+}
+
+// setFlapping records how many leadership changes there were in the window. Past
+// flapThreshold the cooldown after a leadership doubles with every extra change, from
+// flapWindow/flapThreshold (or lostCooldown if longer) up to flapWindow, and with
+// flapFreeze contention is frozen.
+func (ec *exclusiveWorker) setFlapping(changes int) {
+	flapping := changes > ec.flapThreshold
+	ec.mu.Lock()
+	was := ec.flapping
+	ec.flapping = flapping
+	ec.flapCooldown = 0
+	if flapping {
+		ec.flapCooldown = max(ec.lostCooldown, ec.flapWindow/time.Duration(ec.flapThreshold))
+		for i := ec.flapThreshold; i < changes-1 && ec.flapCooldown < ec.flapWindow; i++ {
+			ec.flapCooldown *= 2
+		}
+		ec.flapCooldown = min(ec.flapCooldown, ec.flapWindow)
+	}
+	cooldown := ec.flapCooldown
+	ec.mu.Unlock()
+
+	if !flapping {
+		ec.metrics.flapping.Set(0)
+		if was {
+			ec.emit(EventFlapping, fmt.Sprintf("%d leadership changes in %s, cooldowns back to normal", changes, ec.flapWindow))
+		}
+		return
+	}
+	ec.metrics.flapping.Set(1)
+	detail := fmt.Sprintf("%d leadership changes in %s, waiting %s before contending again after a leadership", changes, ec.flapWindow, cooldown)
+	if !ec.flapFreeze {
+		ec.emit(EventFlapping, detail)
+		return
+	}
+	value := fmt.Sprintf("%d leadership changes in %s, frozen by %s at %s", changes, ec.flapWindow, ec.LeadershipID(), ec.clock.Now().UTC().Format(time.RFC3339))
+	if _, err := ec.client.KV().Put(&api.KVPair{Key: flapFreezeKey(ec.key), Value: []byte(value)}, nil); err != nil {
+		ec.logf("Could not freeze the contention: %s", err)
+		ec.emit(EventFlapping, detail)
+		return
+	}
+	ec.emit(EventFlapping, fmt.Sprintf("%d leadership changes in %s, contention frozen until %s is deleted", changes, ec.flapWindow, flapFreezeKey(ec.key)))
+}
+
+// cooldownAfter is how long RunElected waits before contending again after a
+// leadership: lostCooldown if it was lost, longer while the leadership flaps. The
+// reason is for the EventCooldown.
+func (ec *exclusiveWorker) cooldownAfter(lost bool) (time.Duration, string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.flapping && (ec.flapCooldown > ec.lostCooldown || !lost) {
+		return ec.flapCooldown, "leadership flapping"
+	}
+	if !lost {
+		return 0, ""
+	}
+	return ec.lostCooldown, "leadership lost"
+}
+
+// waitForFreeze blocks while the contention of the key is frozen because its
+// leadership flapped, see flapFreeze. A session we were contending with is
+// destroyed, it would expire while we wait anyway. If consul can not tell, we
+// contend: being unreachable is for the rest of the elector to handle.
+func (ec *exclusiveWorker) waitForFreeze(ctx context.Context) error {
+	if !ec.flapFreeze {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ec.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	key := flapFreezeKey(ec.key)
+	var index uint64
+	frozen := false
+	for {
+		pair, meta, err := ec.client.KV().Get(key, (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+		select {
+		case <-ec.closed:
+			return ErrClosed
+		default:
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			ec.logf("Could not read the contention freeze %s: %s", key, err)
+			return nil
+		}
+		if pair == nil {
+			if frozen {
+				ec.emit(EventFlapping, "contention unfrozen, contending again")
+			}
+			return nil
+		}
+		if !frozen {
+			frozen = true
+			ec.emit(EventFlapping, fmt.Sprintf("contention frozen (%s), delete %s to contend again", strings.TrimSpace(string(pair.Value)), key))
+			if ec.State() == StateAcquiring {
+				ec.destroySession()
+			}
+		}
+		index = meta.LastIndex
+	}
+}
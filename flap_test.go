@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestFlapFreezeLifted checks deleting the freeze starts a new audit instead of
+// freezing the contention again at the next leadership
+func TestFlapFreezeLifted(t *testing.T) {
+	_, client := newTestConsul(t)
+	ec := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:         client,
+		key:            "test/flap",
+		sessionTimeout: "10s",
+		quiet:          true,
+		flapThreshold:  2,
+		flapWindow:     time.Hour,
+		flapFreeze:     true,
+	})
+	defer ec.Close()
+	frozen := func() bool {
+		t.Helper()
+		pair, _, err := client.KV().Get(flapFreezeKey("test/flap"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pair != nil
+	}
+	leaderships := 0
+	lead := func() {
+		leaderships++
+		ec.auditLeadership(Transition{To: StateHeld, At: time.Now(), LeadershipID: fmt.Sprint(leaderships)})
+	}
+
+	for i := 0; i < 3; i++ {
+		lead()
+	}
+	if !frozen() {
+		t.Fatal("3 leaderships with a threshold of 2 did not freeze the contention")
+	}
+	lead()
+	if !frozen() {
+		t.Fatal("the freeze was lifted by a leadership")
+	}
+
+	if _, err := client.KV().Delete(flapFreezeKey("test/flap"), nil); err != nil {
+		t.Fatal(err)
+	}
+	lead()
+	if frozen() {
+		t.Fatal("the contention froze again right after the freeze was lifted")
+	}
+	lead()
+	lead()
+	if !frozen() {
+		t.Fatal("3 leaderships after the freeze was lifted did not freeze the contention")
+	}
+}
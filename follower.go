@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/api/watch"
+)
+
+// ErrFollowerRunning is returned when starting a follower that is already running
+var ErrFollowerRunning = errors.New("follower already running")
+
+// Backoff is how long a follower waits after consul errors: Base after the first
+// one, doubling up to Max
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// defaultBackoff is used when a follower has no backoff
+var defaultBackoff = Backoff{Base: retryInterval, Max: time.Minute}
+
+// next returns how long to wait after failures consecutive errors
+func (b Backoff) next(failures int) time.Duration {
+	wait := b.Base
+	for i := 1; i < failures && wait < b.Max; i++ {
+		wait *= 2
+	}
+	if wait > b.Max {
+		wait = b.Max
+	}
+	return wait
+}
+
+// Follower runs a consul watch plan for the followers of a key. The plan
+// only calls the handler when the result changed (the watch package dedups
+// on the index and the content), retries consul errors with Backoff and can be
+// stopped and restarted. OnError, if set, is called with every error.
+// In a consul brownout, when blocking queries return right away without changes,
+// it backs off too and calls OnStale, if set, with true, then with false when
+// the queries are back to normal.
+type Follower struct {
+	client  *api.Client
+	params  map[string]interface{}
+	handler watch.HandlerFunc
+	Backoff Backoff
+	OnError func(error)
+	OnStale func(stale bool)
+
+	mu   sync.Mutex
+	plan *watch.Plan
+	stop chan struct{} // Closed by Stop, interrupts the backoff
+	done chan struct{} // Closed when the running plan returns
+}
+
+func newFollower(client *api.Client, params map[string]interface{}, handler watch.HandlerFunc) *Follower {
+	return &Follower{
+		client:  client,
+		params:  params,
+		handler: handler,
+		Backoff: defaultBackoff,
+	}
+}
+
+// WatchLeader returns a follower that calls fn every time the holder of key changes,
+// with nil when the key is free. c decrypts the value, it can be nil. It must be started.
+func WatchLeader(client *api.Client, key string, c *Cipher, fn func(*Holder)) *Follower {
+	return newFollower(client, map[string]interface{}{"type": "key", "key": key}, func(_ uint64, raw interface{}) {
+		pair, _ := raw.(*api.KVPair)
+		if pair == nil || pair.Session == "" {
+			fn(nil)
+			return
+		}
+		h := decodeHolder(pair, c)
+		h.SessionID = pair.Session
+		fn(h)
+	})
+}
+
+// Start runs the plan in the background
+func (f *Follower) Start() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.plan != nil {
+		return ErrFollowerRunning
+	}
+
+	// Parse consumes the params, give it a copy so we can restart
+	params := make(map[string]interface{}, len(f.params))
+	for k, v := range f.params {
+		params[k] = v
+	}
+	plan, err := watch.Parse(params)
+	if err != nil {
+		return err
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	plan.Handler = f.handler
+	plan.Watcher = f.retrying(plan.Watcher, stop)
+	f.plan, f.stop, f.done = plan, stop, done
+	go func() {
+		defer close(done)
+		if err := plan.RunWithClientAndLogger(f.client, log.Default()); err != nil && f.OnError != nil {
+			f.OnError(err)
+		}
+	}()
+	return nil
+}
+
+// Stop stops the plan and waits for it to return. It does nothing if it is not running
+func (f *Follower) Stop() {
+	f.mu.Lock()
+	plan, stop, done := f.plan, f.stop, f.done
+	f.plan, f.stop, f.done = nil, nil, nil
+	f.mu.Unlock()
+	if plan == nil {
+		return
+	}
+	close(stop)
+	plan.Stop()
+	<-done
+}
+
+// Restart stops the plan and starts a new one, e.g. after changing the consul token.
+// The handler is called again with the current result
+func (f *Follower) Restart() error {
+	f.Stop()
+	return f.Start()
+}
+
+// Running tells if the plan is running
+func (f *Follower) Running() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.plan != nil
+}
+
+// retrying wraps the watcher of a plan so errors are retried with our Backoff
+// instead of the fixed backoff of the watch package, and blocking queries that
+// don't block are not retried right away
+func (f *Follower) retrying(watcher watch.WatcherFunc, stop <-chan struct{}) watch.WatcherFunc {
+	health := &brownout{backoff: f.Backoff}
+	var last watch.BlockingParamVal
+	return func(p *watch.Plan) (watch.BlockingParamVal, interface{}, error) {
+		for {
+			start := time.Now()
+			val, result, err := watcher(p)
+			changed := err == nil && (last == nil || !last.Equal(val))
+			wait, flipped := health.observe(time.Since(start), changed, err)
+			if flipped && f.OnStale != nil {
+				f.OnStale(health.stale)
+			}
+			if err == nil {
+				last = val
+				if wait > 0 {
+					// Let the plan see the result, but not ask again right away
+					select {
+					case <-time.After(wait):
+					case <-stop:
+					}
+				}
+				return val, result, nil
+			}
+			select {
+			case <-stop:
+				// Stop cancelled the query, that is not an error
+				return val, result, err
+			default:
+			}
+			if f.OnError != nil {
+				f.OnError(err)
+			}
+			select {
+			case <-time.After(wait):
+			case <-stop:
+				// The plan sees it was stopped and ignores the error
+				return val, result, err
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// generationKey is where a deployment controller writes the preferred generation
+// of the workers of key, see PreferGeneration
+func generationKey(key string) string {
+	return controlKey(key) + "/generation"
+}
+
+// PreferGeneration makes the workers of key of the given generation (e.g. blue or
+// green, a release) the only ones to contend: the others stop contending and their
+// leader resigns after draining, so the leadership follows a deploy. An empty
+// generation clears the preference, every worker contends again.
+func PreferGeneration(client *api.Client, key, generation string) error {
+	if generation == "" {
+		_, err := client.KV().Delete(generationKey(key), nil)
+		return err
+	}
+	_, err := client.KV().Put(&api.KVPair{Key: generationKey(key), Value: []byte(generation)}, nil)
+	return err
+}
+
+// mayContend tells if the workers of generation may contend when preferred is the
+// preferred one
+func mayContend(generation, preferred string) bool {
+	return preferred == "" || preferred == generation
+}
+
+// onPreferredGeneration is called when the value of the generation key changes, it
+// resigns if we are leader of another generation than the preferred one
+func (ec *exclusiveWorker) onPreferredGeneration(old, preferred string) {
+	was, now := mayContend(ec.generation, old), mayContend(ec.generation, preferred)
+	switch {
+	case now && !was:
+		ec.emit(EventGeneration, fmt.Sprintf("%s preferred, contending again", describeGeneration(preferred)))
+	case !now:
+		ec.emit(EventGeneration, fmt.Sprintf("generation %s preferred, ours is %s, not contending", preferred, ec.generation))
+		if ec.State() == StateHeld {
+			ec.logf("Generation %s preferred, resigning", preferred)
+			ec.Resign()
+		}
+	}
+}
+
+// describeGeneration names a preferred generation, "any generation" if empty
+func describeGeneration(generation string) string {
+	if generation == "" {
+		return "any generation"
+	}
+	return "generation " + generation
+}
+
+// waitForGeneration blocks while another generation than ours is preferred, see waitForKey
+func (ec *exclusiveWorker) waitForGeneration(ctx context.Context) error {
+	if ec.generation == "" {
+		return nil
+	}
+	return ec.waitForKey(ctx, ec.preferredGen, func(preferred string) bool {
+		return mayContend(ec.generation, preferred)
+	})
+}
+
+// runGeneration sets the preferred generation of the workers of a key, for
+// deployment controllers:
+//
+//	mutual-exclusion-consul generation -key service/bobruner/leader -prefer green
+//
+// Without -prefer it clears the preference.
+func runGeneration(args []string) int {
+	fs := flag.NewFlagSet("generation", flag.ExitOnError)
+	key := fs.String("key", envOr("MUTEX_KEY", ""), "lock key")
+	generation := fs.String("prefer", "", "generation whose workers contend (their -generation), empty to let every worker contend")
+	fs.Parse(args)
+	if *key == "" {
+		log.Println("-key is required")
+		return 2
+	}
+	client, err := api.NewClient(&api.Config{Address: consulAddress})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := PreferGeneration(client, *key, strings.TrimSpace(*generation)); err != nil {
+		log.Println(err)
+		return 1
+	}
+	fmt.Printf("%s: %s preferred\n", *key, describeGeneration(*generation))
+	return 0
+}
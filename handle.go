@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LeaseHandle is one leadership, returned by Acquire. The worker keeps the session
+// renewed until Release is called or the leadership is lost, and the handle keeps
+// describing that leadership after it ended, so code holding several leases in a
+// row can tell them apart.
+type LeaseHandle struct {
+	ec           *exclusiveWorker
+	leadershipID string
+	epoch        uint64
+	stop         chan struct{} // Closed by Release
+	stopOnce     sync.Once
+	done         chan struct{} // Closed when the session was given back
+
+	mu    sync.Mutex
+	err   error     // Why the leadership ended, nil if it was released
+	ended time.Time // When it ended
+}
+
+// Acquire blocks until we hold the lock, ctx is done or the worker is closed, and
+// returns the handle of the leadership. ctx only bounds the wait: the lease lasts
+// until Release is called or it is lost. Only one lease can be held at a time.
+// The handle needs the epoch of the leadership for its fencing token: without
+// verifyAcquire the key is read back here, and if that fails the lock is given back
+// and the error returned.
+func (ec *exclusiveWorker) Acquire(ctx context.Context) (*LeaseHandle, error) {
+	if err := ec.waitForLeadership(ctx); err != nil {
+		return nil, err
+	}
+	if err := ec.fillLockInfo(); err != nil {
+		if derr := ec.destroySession(); derr != nil && !errors.Is(derr, ErrSessionDestroyed) && !errors.Is(derr, ErrNoSession) {
+			err = errors.Join(err, derr)
+		}
+		return nil, fmt.Errorf("unknown fencing token: %w", err)
+	}
+
+	ec.mu.Lock()
+	l := &LeaseHandle{
+		ec:           ec,
+		leadershipID: ec.leadershipID,
+		epoch:        ec.lockInfo.LockIndex,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	ec.mu.Unlock()
+
+	go func() {
+		err := ec.renewSession(l.stop)
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrLeadershipLost, err)
+		}
+		ec.writeHandover()
+		if derr := ec.destroySession(); derr != nil && !errors.Is(derr, ErrSessionDestroyed) && !errors.Is(derr, ErrNoSession) {
+			err = errors.Join(err, derr)
+		}
+		l.mu.Lock()
+		l.err = err
+		l.ended = ec.clock.Now()
+		l.mu.Unlock()
+		close(l.done)
+	}()
+	return l, nil
+}
+
+// fillLockInfo does the consistent read of the key that verifyAcquire skipped (or
+// failed to do), so the LockInfo and the epoch of the leadership are known
+func (ec *exclusiveWorker) fillLockInfo() error {
+	ec.mu.Lock()
+	known, sessionID := ec.lockInfo.Key != "", ec.sessionID
+	ec.mu.Unlock()
+	if known {
+		return nil
+	}
+
+	info, err := ec.readLockInfo()
+	if err != nil {
+		return err
+	}
+	if info.Session != sessionID {
+		return fmt.Errorf("%w: acquired key %s but it is held by session %q, we are %q", ErrSplitBrain, ec.key, info.Session, sessionID)
+	}
+	ec.mu.Lock()
+	defer ec.unlock()
+	if ec.state != StateHeld || ec.sessionID != sessionID {
+		return &StateError{Op: "acquire", State: ec.state}
+	}
+	ec.lockInfo = info
+	return nil
+}
+
+// Done is closed when the leadership is over and the session was given back
+func (l *LeaseHandle) Done() <-chan struct{} {
+	return l.done
+}
+
+// Err returns why the leadership ended: nil while it lasts or if it was released,
+// ErrLeadershipLost if it was lost
+func (l *LeaseHandle) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// LeadershipID returns the correlation ID of the leadership
+func (l *LeaseHandle) LeadershipID() string {
+	return l.leadershipID
+}
+
+// Epoch returns the LockIndex of the key when we got it
+func (l *LeaseHandle) Epoch() uint64 {
+	return l.epoch
+}
+
+// current tells if the worker is still in this leadership. It must be called with ec.mu held
+func (l *LeaseHandle) current() bool {
+	return l.ec.state == StateHeld && l.ec.leadershipID == l.leadershipID
+}
+
+// FencingToken returns the LockIndex of the key, to pass along with the writes made
+// under this lease so stale leaders can be told apart downstream. It starts at Epoch
+// and moves forward when SetTTL moves the lock to a new session.
+func (l *LeaseHandle) FencingToken() uint64 {
+	l.ec.mu.Lock()
+	defer l.ec.mu.Unlock()
+	if l.current() && l.ec.lockInfo.LockIndex > l.epoch {
+		return l.ec.lockInfo.LockIndex
+	}
+	return l.epoch
+}
+
+// ExpiresAt returns until when we are certain to hold the lock, like the deadline of
+// the work contexts. Once the lease is over it returns when it ended.
+func (l *LeaseHandle) ExpiresAt() time.Time {
+	l.ec.mu.Lock()
+	current := l.current()
+	deadline := l.ec.leaseDeadline(l.ec.lastRenewal)
+	l.ec.mu.Unlock()
+	if current {
+		return deadline
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ended.IsZero() {
+		// Lost, Done is about to be closed
+		return l.ec.clock.Now()
+	}
+	return l.ended
+}
+
+// Release gives the lock back and waits until the session is destroyed. It returns
+// Err, which is nil unless the lease was lost before or the session could not be destroyed.
+func (l *LeaseHandle) Release() error {
+	l.stopOnce.Do(func() { close(l.stop) })
+	<-l.done
+	return l.Err()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Handover is the last state of a leader, written while it drains so the next
+// leader can resume from where it left off. Epoch is the LockIndex of the leadership
+// that wrote it: if that leader was lost before draining, the snapshot is from an
+// older leadership than the one right before ours.
+type Handover struct {
+	Epoch        uint64          `json:"epoch"`
+	LeadershipID string          `json:"leadership_id"`
+	Data         json.RawMessage `json:"data"`
+}
+
+// handoverKey is where the leader of a key leaves its handover
+func handoverKey(key string) string {
+	return key + "/handover"
+}
+
+// pendingHandover is a handover waiting to be written with the release of the key
+type pendingHandover struct {
+	leadershipID string
+	op           *api.KVTxnOp
+}
+
+// writeHandover takes the snapshot of the work for the next leader. It is called once
+// the work returned, before giving the lock back. destroySession writes it in the
+// transaction that releases the key (see releaseWithHandover), so nobody sees the
+// key free without the handover. A lost leader can not write it.
+func (ec *exclusiveWorker) writeHandover() {
+	if ec.snapshot == nil || ec.State() != StateHeld {
+		return
+	}
+	v, err := ec.snapshot()
+	if err != nil {
+		ec.logf("Could not take the handover snapshot: %s", err)
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		ec.logf("Could not encode the handover snapshot: %s", err)
+		return
+	}
+
+	ec.mu.Lock()
+	h := Handover{Epoch: ec.lockInfo.LockIndex, LeadershipID: ec.leadershipID, Data: data}
+	ec.mu.Unlock()
+
+	key := handoverKey(ec.key)
+	value, err := encodeValue(ec.codec, h)
+	if err == nil {
+		value, err = ec.cipher.seal(key, value)
+	}
+	if err == nil {
+		err = checkValueSize(key, value)
+	}
+	if err != nil {
+		ec.logf("Could not write the handover: %s", err)
+		return
+	}
+	ec.mu.Lock()
+	ec.handover = &pendingHandover{leadershipID: h.LeadershipID, op: &api.KVTxnOp{Verb: api.KVSet, Key: key, Value: value}}
+	ec.mu.Unlock()
+}
+
+// readHandover reads the handover left by the previous leaders, nil if there is none
+func (ec *exclusiveWorker) readHandover() (*Handover, error) {
+	key := handoverKey(ec.key)
+	pair, _, err := ec.client.KV().Get(key, &api.QueryOptions{RequireConsistent: true})
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	value, err := ec.cipher.open(key, pair.Value)
+	if err != nil {
+		return nil, err
+	}
+	var h Handover
+	if err := decodeValue(value, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// takeOver calls onElected with the handover of the previous leaders, or nil if
+// there is none or it could not be read. It is called right after we got the lock.
+func (ec *exclusiveWorker) takeOver() {
+	if ec.onElected == nil {
+		return
+	}
+	h, err := ec.readHandover()
+	if err != nil {
+		ec.logf("Could not read the handover: %s", err)
+	}
+	ec.onElected(h)
+}
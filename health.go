@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// healthReportInterval is how often ReportGRPCHealth checks the health of the worker
+const healthReportInterval = time.Second
+
+// Errors returned by Health, wrapped with what is wrong
+var (
+	// ErrDegraded is returned while the worker works but is at risk, e.g. its renewals are failing
+	ErrDegraded = errors.New("degraded")
+	// ErrUnhealthy is returned when what the worker believes does not add up, it should not be trusted
+	ErrUnhealthy = errors.New("unhealthy")
+)
+
+// Health tells if the worker is healthy: nil if it is, an error wrapping ErrDegraded
+// while the renewals are failing or consul answers badly, and one wrapping ErrUnhealthy
+// when the state of the leadership is inconsistent, e.g. we believe we are leader past
+// the end of the lease.
+func (ec *exclusiveWorker) Health() error {
+	select {
+	case <-ec.closed:
+		return fmt.Errorf("%w: %w", ErrUnhealthy, ErrClosed)
+	default:
+	}
+
+	ec.mu.Lock()
+	state, sessionID := ec.state, ec.sessionID
+	lastRenewal, ttl := ec.lastRenewal, ec.leaseTTL
+	readOnly := ec.isDegraded
+	ec.mu.Unlock()
+	if state == StateHeld {
+		if sessionID == "" {
+			return fmt.Errorf("%w: leader without a session", ErrUnhealthy)
+		}
+		if expired := ec.since(lastRenewal); ttl > 0 && !lastRenewal.IsZero() && expired > ttl {
+			return fmt.Errorf("%w: leader but the lease expired %s ago", ErrUnhealthy, expired-ttl)
+		}
+	}
+
+	stats := ec.RenewalStats()
+	switch {
+	case stats.Failing > 0:
+		return fmt.Errorf("%w: the last %d renewals failed", ErrDegraded, stats.Failing)
+	case ec.session != nil && state == StateHeld && !ec.session.healthy():
+		return fmt.Errorf("%w: the shared session is failing", ErrDegraded)
+	case readOnly:
+		return fmt.Errorf("%w: the leadership is read-only", ErrDegraded)
+	case ec.metrics.localFallback.Value() == 1:
+		return fmt.Errorf("%w: consul is unreachable, working with the local lock", ErrDegraded)
+	case ec.metrics.watchStale.Value() == 1:
+		return fmt.Errorf("%w: the blocking queries are in a brownout", ErrDegraded)
+	}
+	return nil
+}
+
+// HealthCheck is Health as a func(context.Context) error, the checker type most health
+// libraries take. Use Health for the func() error ones.
+func (ec *exclusiveWorker) HealthCheck(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ec.Health()
+}
+
+// grpcServingStatus maps the result of Health to a gRPC serving status. gRPC has no
+// degraded status: a degraded worker still works, so it is serving.
+func grpcServingStatus(err error) healthpb.HealthCheckResponse_ServingStatus {
+	if err == nil || errors.Is(err, ErrDegraded) {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
+
+// ReportGRPCHealth sets the status of service in srv from Health until ctx is done or
+// the worker is closed, logging the changes. The empty service is the whole server.
+func (ec *exclusiveWorker) ReportGRPCHealth(ctx context.Context, srv *health.Server, service string) {
+	var last error
+	first := true
+	for {
+		err := ec.Health()
+		if first || fmt.Sprint(err) != fmt.Sprint(last) {
+			if err != nil {
+				ec.logf("Health: %s", err)
+			} else if !first {
+				ec.logf("Health: healthy again")
+			}
+			srv.SetServingStatus(service, grpcServingStatus(err))
+		}
+		last, first = err, false
+
+		select {
+		case <-ec.clock.After(healthReportInterval):
+		case <-ec.closed:
+			srv.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serveGRPCHealth serves the gRPC health service on addr (-grpc-health) with the health
+// of the worker as the status of the whole server, see ReportGRPCHealth. Stop the
+// returned server when done.
+func serveGRPCHealth(addr string, ec *exclusiveWorker) (*grpc.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	hs := health.NewServer()
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go ec.ReportGRPCHealth(context.Background(), hs, "")
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			log.Printf("gRPC health endpoint stopped: %s", err)
+		}
+	}()
+	return srv, nil
+}
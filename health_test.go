@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// TestReportGRPCHealth checks the gRPC status follows the worker: serving while it
+// is healthy, not serving once it is closed
+func TestReportGRPCHealth(t *testing.T) {
+	_, client := newTestConsul(t)
+	ec := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:         client,
+		key:            "test/health",
+		sessionTimeout: "10s",
+		quiet:          true,
+	})
+	defer ec.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := ec.waitForLeadership(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := ec.HealthCheck(ctx); err != nil {
+		t.Fatalf("leader is not healthy: %s", err)
+	}
+
+	hs := health.NewServer()
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		ec.ReportGRPCHealth(ctx, hs, "")
+	}()
+	status := func() healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := hs.Check(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status
+	}
+	for status() != healthpb.HealthCheckResponse_SERVING {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("the status is %s", status())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	ec.Close()
+	<-reported
+	if s := status(); s != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("the status of a closed worker is %s", s)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ErrNoLeader is returned by ResolveLeader when nobody holds the key
+var ErrNoLeader = errors.New("no leader")
+
+// Holder is the metadata the leader writes into the lock value so followers
+// and other clients can find it
+type Holder struct {
+	SessionID string      `json:"session_id"`
+	Address   string      `json:"address,omitempty"` // Advertised host:port of the leader
+	Hostname  string      `json:"hostname,omitempty"`
+	Nomad     *NomadAlloc `json:"nomad,omitempty"` // Set when the leader runs in Nomad
+	Labels    Labels      `json:"labels,omitempty"`
+	// Generation is the deploy generation of the leader, see PreferGeneration
+	Generation string `json:"generation,omitempty"`
+	// Build is the binary of the leader, nil if written by an older version
+	Build *BuildInfo `json:"build,omitempty"`
+}
+
+// holderValue returns the lock value for our session
+func (ec *exclusiveWorker) holderValue(sessionID string) []byte {
+	hostname, _ := os.Hostname()
+	value, err := encodeValue(ec.codec, Holder{
+		SessionID:  sessionID,
+		Address:    ec.advertiseAddr,
+		Hostname:   hostname,
+		Nomad:      nomadAlloc(),
+		Labels:     ec.labels,
+		Generation: ec.generation,
+		Build:      currentBuild(),
+	})
+	if err == nil {
+		value, err = ec.cipher.seal(ec.key, value)
+	}
+	if err != nil {
+		// Can't happen with plain strings, but the session ID alone is still useful
+		return []byte(sessionID)
+	}
+	return value
+}
+
+// decodeHolder reads the lock value, decrypting it with c. Values written by older versions
+// that only contain the session ID are still understood. If the value can not be
+// decrypted only the session ID is known.
+func decodeHolder(pair *api.KVPair, c *Cipher) *Holder {
+	value, err := c.open(pair.Key, pair.Value)
+	if err != nil {
+		return &Holder{SessionID: pair.Session}
+	}
+	var h Holder
+	if err := decodeValue(value, &h); err != nil || h.SessionID == "" {
+		h = Holder{SessionID: string(value)}
+	}
+	return &h
+}
+
+// ResolveLeader returns who holds key, so followers and external clients
+// can redirect traffic to the leader. It returns ErrNoLeader if the key is free.
+// c decrypts the value if the leader encrypts it, it can be nil.
+func ResolveLeader(client *api.Client, key string, c *Cipher) (*Holder, error) {
+	pair, _, err := client.KV().Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil || pair.Session == "" {
+		return nil, ErrNoLeader
+	}
+	h := decodeHolder(pair, c)
+	// The session is the source of truth, the value could be stale
+	h.SessionID = pair.Session
+	return h, nil
+}
+
+// detectAdvertiseAddr completes an advertise address like ":8080" with the
+// address of the node as known by the local consul agent
+func detectAdvertiseAddr(client *api.Client, addr string) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid advertise address %q: %s", addr, err)
+	}
+	if host != "" {
+		return addr, nil
+	}
+
+	self, err := client.Agent().Self()
+	if err != nil {
+		return "", fmt.Errorf("cannot detect advertise address: %s", err)
+	}
+	if member, ok := self["Member"]; ok {
+		if nodeAddr, ok := member["Addr"].(string); ok && nodeAddr != "" {
+			return net.JoinHostPort(nodeAddr, port), nil
+		}
+	}
+	return "", fmt.Errorf("cannot detect advertise address: agent did not report its address")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// hookTimeout is how long a hook command can run before it is killed
+const hookTimeout = time.Minute
+
+// hooks are shell commands run when the leadership changes, like consul-template's exec.
+// Empty commands are not run. The details are passed in MUTEX_* environment variables.
+type hooks struct {
+	key          string
+	acquire      string     // Run when we get the lock
+	renewFailure string     // Run when a renewal fails
+	lost         string     // Run when the leadership is lost
+	release      string     // Run when we give the lock back
+	mu           sync.Mutex // Protects the commands, which a reload can change
+	wg           sync.WaitGroup
+}
+
+// onTransition runs the hook of a state transition, if any
+func (h *hooks) onTransition(t Transition) {
+	var name, command string
+	h.mu.Lock()
+	switch t.To {
+	case StateHeld:
+		name, command = "acquire", h.acquire
+	case StateLost:
+		name, command = "lost", h.lost
+	case StateReleased:
+		name, command = "release", h.release
+	}
+	h.mu.Unlock()
+	h.run(name, command, t.LeadershipID, t.At,
+		"MUTEX_FROM_STATE="+t.From.String(),
+		"MUTEX_TO_STATE="+t.To.String(),
+		"MUTEX_LOSS_REASON="+string(t.Reason),
+	)
+}
+
+// onEvent runs the hook of an event, if any
+func (h *hooks) onEvent(e Event) {
+	if e.Kind == EventRenewFailure {
+		h.mu.Lock()
+		command := h.renewFailure
+		h.mu.Unlock()
+		h.run("renew-failure", command, e.LeadershipID, e.At, "MUTEX_DETAIL="+e.Detail)
+	}
+}
+
+// run starts command in the background so a slow hook does not hold up the worker
+func (h *hooks) run(name, command, leadershipID string, at time.Time, env ...string) {
+	if command == "" {
+		return
+	}
+	env = append(env,
+		"MUTEX_HOOK="+name,
+		"MUTEX_KEY="+h.key,
+		"MUTEX_LEADERSHIP_ID="+leadershipID,
+		"MUTEX_AT="+at.Format(time.RFC3339Nano),
+	)
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		defer cancel()
+
+		args := append(append([]string{}, hookShell[1:]...), command)
+		cmd := exec.CommandContext(ctx, hookShell[0], args...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			logWithID(h.key, leadershipID, "%s hook failed: %s", name, err)
+		}
+	}()
+}
+
+// wait waits for the running hooks, so the release hook is not lost when we exit
+func (h *hooks) wait() {
+	h.wg.Wait()
+}
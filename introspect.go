@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Lease is what a worker tells co-located processes about its leadership
+type Lease struct {
+	Key          string     `json:"key"`
+	Held         bool       `json:"held"`
+	State        string     `json:"state"`
+	LeadershipID string     `json:"leadership_id,omitempty"`
+	Until        time.Time  `json:"until,omitempty"` // We are certain to hold the key until then, if Held
+	TTL          string     `json:"ttl"`             // TTL of our session
+	Labels       Labels     `json:"labels,omitempty"`
+	Build        *BuildInfo `json:"build,omitempty"` // Of this process
+}
+
+// Lease returns whether we hold the key and until when we are certain to,
+// which is the deadline of the work contexts
+func (ec *exclusiveWorker) Lease() Lease {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	l := Lease{
+		Key:    ec.key,
+		Held:   ec.state == StateHeld,
+		State:  ec.state.String(),
+		TTL:    ec.sessionTimeout,
+		Labels: ec.labels,
+		Build:  currentBuild(),
+	}
+	if l.Held {
+		l.LeadershipID = ec.leadershipID
+		l.Until = ec.leaseDeadline(ec.lastRenewal)
+	}
+	return l
+}
+
+// serveIntrospection serves the leases of the workers on a local endpoint, so sidecars
+// can gate their behavior on our leadership without talking to consul:
+//
+//	GET /v1/leases          every lease
+//	GET /v1/lease?key=<key> the lease of one key, 404 if we don't contend for it
+//	POST /v1/ttl?key=<key>&ttl=<duration>
+//	POST /v1/ttl?key=<key>&scale=up|down
+//	                        set, double or halve the session TTL of a key (see SetTTL)
+//	                        and return its lease, to tune the failover speed live
+//	POST /v1/shared?key=<key>&name=<name>
+//	                        publish the JSON body as the shared state name of a key we
+//	                        lead (see Publish), 409 if we don't
+//	GET /v1/health          the health of every worker (see Health), 503 if one is unhealthy
+//	GET /debug/vars         the expvar metrics of the workers (see lockVars)
+//	GET /metrics            the prometheus metrics, with those exported only while
+//	                        leader (see ExportWhileLeader)
+//
+// addr is a unix socket path (the default, readable by the owner and group only)
+// or tcp:host:port. With a debugToken the debug endpoints are served too, see mountDebug.
+func serveIntrospection(addr, debugToken string, workers ...*exclusiveWorker) error {
+	network, address := "unix", addr
+	if strings.HasPrefix(addr, "tcp:") {
+		network, address = "tcp", strings.TrimPrefix(addr, "tcp:")
+	}
+	if network == "unix" {
+		// Left over by a previous run
+		os.Remove(address)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if err := os.Chmod(address, 0o660); err != nil {
+			l.Close()
+			return err
+		}
+	}
+
+	byKey := map[string]*exclusiveWorker{}
+	for _, w := range workers {
+		byKey[w.key] = w
+		if err := w.ExportWhileLeader(leaderSinceCollector(w)); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/leases", func(rw http.ResponseWriter, r *http.Request) {
+		leases := make([]Lease, 0, len(workers))
+		for _, w := range workers {
+			leases = append(leases, w.Lease())
+		}
+		writeJSON(rw, http.StatusOK, leases)
+	})
+	mux.HandleFunc("/v1/lease", func(rw http.ResponseWriter, r *http.Request) {
+		w, ok := byKey[r.URL.Query().Get("key")]
+		if !ok {
+			writeJSON(rw, http.StatusNotFound, map[string]string{"error": "unknown key"})
+			return
+		}
+		writeJSON(rw, http.StatusOK, w.Lease())
+	})
+	mux.HandleFunc("/v1/shared", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(rw, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+			return
+		}
+		q := r.URL.Query()
+		w, ok := byKey[q.Get("key")]
+		if !ok {
+			writeJSON(rw, http.StatusNotFound, map[string]string{"error": "unknown key"})
+			return
+		}
+		if q.Get("name") == "" {
+			writeJSON(rw, http.StatusBadRequest, map[string]string{"error": "set name"})
+			return
+		}
+		var v json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			writeJSON(rw, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := w.Publish(q.Get("name"), v); err != nil {
+			writeJSON(rw, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(rw, http.StatusOK, w.Lease())
+	})
+	mux.HandleFunc("/v1/health", func(rw http.ResponseWriter, r *http.Request) {
+		status, health := http.StatusOK, map[string]string{}
+		for _, w := range workers {
+			health[w.key] = "healthy"
+			if err := w.HealthCheck(r.Context()); err != nil {
+				health[w.key] = err.Error()
+				if !errors.Is(err, ErrDegraded) {
+					status = http.StatusServiceUnavailable
+				}
+			}
+		}
+		writeJSON(rw, status, health)
+	})
+	mux.HandleFunc("/v1/ttl", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(rw, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+			return
+		}
+		q := r.URL.Query()
+		w, ok := byKey[q.Get("key")]
+		if !ok {
+			writeJSON(rw, http.StatusNotFound, map[string]string{"error": "unknown key"})
+			return
+		}
+		ttl := q.Get("ttl")
+		switch scale := q.Get("scale"); {
+		case ttl != "":
+		case scale == "up" || scale == "down":
+			var err error
+			if ttl, err = scaleTTL(w.TTL(), scale == "up"); err != nil {
+				writeJSON(rw, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+		default:
+			writeJSON(rw, http.StatusBadRequest, map[string]string{"error": "set ttl or scale=up|down"})
+			return
+		}
+		if err := checkTTL(ttl); err != nil {
+			writeJSON(rw, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := w.SetTTL(ttl); err != nil {
+			writeJSON(rw, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(rw, http.StatusOK, w.Lease())
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", promhttp.Handler())
+	if debugToken != "" {
+		mountDebug(mux, debugToken, workers)
+	}
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("introspection endpoint stopped: %s", err)
+		}
+	}()
+	return nil
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
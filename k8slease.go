@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// LeaderElectionRecord is client-go's LeaderElectionRecord, the schema of the
+// control-plane.alpha.kubernetes.io/leader annotation, so dashboards and tools built
+// for Kubernetes leader election can read our locks. Times have second precision
+// like metav1.Time.
+type LeaderElectionRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+	LeaderTransitions    int       `json:"leaderTransitions"`
+}
+
+// leaderElectionKey is where the leader of a key keeps its LeaderElectionRecord
+func leaderElectionKey(key string) string {
+	return key + "/leader-election"
+}
+
+// leaderElectionOnTransition keeps the LeaderElectionRecord up to date while we are
+// leader. It is written in plain text even with an encryption key, for other tools to read.
+func (ec *exclusiveWorker) leaderElectionOnTransition(t Transition) {
+	if t.To == StateHeld {
+		go ec.leaderElectionLoop(t.LeadershipID)
+	}
+}
+
+// leaderElectionLoop writes the record when we got the lock and after every renewal,
+// until the leadership leadershipID is over. Like client-go it counts a transition when
+// the holder identity changes.
+func (ec *exclusiveWorker) leaderElectionLoop(leadershipID string) {
+	key := leaderElectionKey(ec.key)
+	hostname, _ := os.Hostname()
+	var record LeaderElectionRecord
+	if pair, _, err := ec.client.KV().Get(key, nil); err == nil && pair != nil {
+		var previous LeaderElectionRecord
+		if json.Unmarshal(pair.Value, &previous) == nil {
+			record.LeaderTransitions = previous.LeaderTransitions + 1
+		}
+	}
+
+	var written time.Time
+	for {
+		ec.mu.Lock()
+		held := ec.state == StateHeld && ec.leadershipID == leadershipID
+		sessionID, renewal, ttl := ec.sessionID, ec.lastRenewal, ec.leaseTTL
+		ec.mu.Unlock()
+		if !held {
+			return
+		}
+		if ttl <= 0 {
+			ttl, _ = time.ParseDuration(ec.TTL())
+		}
+
+		if renewal.After(written) {
+			record.HolderIdentity = hostname + "_" + sessionID
+			record.LeaseDurationSeconds = int(ttl / time.Second)
+			record.RenewTime = renewal.UTC().Truncate(time.Second)
+			if record.AcquireTime.IsZero() {
+				// The first renewal is the acquisition
+				record.AcquireTime = record.RenewTime
+			}
+			value, err := json.Marshal(record)
+			if err == nil {
+				err = ec.KVPutIfHeld(key, value)
+			}
+			if err != nil {
+				ec.logf("Could not write the leader election record: %s", err)
+			}
+			written = renewal
+		}
+
+		// Renewals happen every TTL/2 at most, checking twice as often keeps up with them
+		select {
+		case <-ec.clock.After(ttl / 4):
+		case <-ec.closed:
+			return
+		}
+	}
+}
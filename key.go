@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultKeyTemplate follows the convention service/<TASK_NAME>/leader
+const defaultKeyTemplate = "service/{{.Service}}/leader"
+
+// keyData holds the values a key template can use, e.g. service/{{.Service}}/{{.Env}}/leader
+type keyData struct {
+	Service  string // Service or task name
+	Env      string // Environment (prod, staging...)
+	Hostname string // Host the worker runs on
+}
+
+// renderKey renders a key template and checks the result is a valid consul KV key
+func renderKey(tmpl string, data keyData) (string, error) {
+	t, err := template.New("key").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid key template %q: %s", tmpl, err)
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("cannot render key template %q: %s", tmpl, err)
+	}
+
+	key := b.String()
+	if err := validateKey(key); err != nil {
+		return "", fmt.Errorf("key template %q rendered an invalid key: %s", tmpl, err)
+	}
+	return key, nil
+}
+
+// validateKey checks a key is a legal consul KV path we can put a lock on.
+// Empty segments usually mean a template value was missing (service//leader).
+func validateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("key is empty")
+	}
+	if !utf8.ValidString(key) {
+		return fmt.Errorf("key %q is not valid UTF-8", key)
+	}
+	if strings.HasPrefix(key, "/") {
+		return fmt.Errorf("key %q must not start with /", key)
+	}
+	if strings.HasSuffix(key, "/") {
+		return fmt.Errorf("key %q must not end with /, that is a folder", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" {
+			return fmt.Errorf("key %q has an empty path segment", key)
+		}
+		if segment == "." || segment == ".." {
+			return fmt.Errorf("key %q has a relative path segment %q", key, segment)
+		}
+	}
+	for _, r := range key {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("key %q contains whitespace or control characters", key)
+		}
+	}
+	return nil
+}
+
+// envOr returns the value of an environment variable or def if it is not set
+func envOr(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+// Namespace scopes every key used by the workers under a root prefix, so
+// teams sharing one consul cluster can not step on each other's locks.
+// Everything a worker writes (contenders, audit records, etc.) lives under
+// its lock key, so namespacing the lock key namespaces all of it.
+type Namespace struct {
+	root string
+}
+
+// newNamespace creates a namespace rooted at root. An empty root means no namespace
+func newNamespace(root string) (Namespace, error) {
+	root = strings.Trim(root, "/")
+	if root == "" {
+		return Namespace{}, nil
+	}
+	if err := validateKey(root); err != nil {
+		return Namespace{}, fmt.Errorf("invalid namespace: %s", err)
+	}
+	return Namespace{root: root}, nil
+}
+
+// Root returns the root prefix of the namespace
+func (n Namespace) Root() string {
+	return n.root
+}
+
+// Key returns the full key of name inside the namespace
+func (n Namespace) Key(name string) string {
+	if n.root == "" {
+		return name
+	}
+	return n.root + "/" + name
+}
+
+// lockKey renders the key template and puts it in the namespace
+func lockKey(keyTemplate, service, env, namespace string) (string, error) {
+	ns, err := newNamespace(namespace)
+	if err != nil {
+		return "", err
+	}
+	hostname, _ := os.Hostname()
+	key, err := renderKey(keyTemplate, keyData{Service: service, Env: env, Hostname: hostname})
+	if err != nil {
+		return "", err
+	}
+	return ns.Key(key), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Labels are arbitrary key=value pairs attached to a worker (team, service,
+// environment...). They are added to its logs, metrics, events, event log records,
+// status file and lock value so multi-tenant deployments can slice them.
+type Labels map[string]string
+
+// parseLabels parses a comma separated list of name=value labels
+func parseLabels(spec string) (Labels, error) {
+	labels := Labels{}
+	for _, part := range strings.Split(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " []") {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", part)
+		}
+		labels[name] = strings.TrimSpace(value)
+	}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return labels, nil
+}
+
+// String returns the labels as name=value separated by spaces, sorted by name
+func (l Labels) String() string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + l[name]
+	}
+	return strings.Join(names, " ")
+}
+
+// keyLabels are the labels of the workers of the process by lock key, for logWithID.
+// Everything logging about a key goes through it, so its lines get the labels too.
+var keyLabels sync.Map
+
+// setKeyLabels registers the labels of the worker of key
+func setKeyLabels(key string, labels Labels) {
+	if len(labels) > 0 {
+		keyLabels.Store(key, labels)
+	} else {
+		keyLabels.Delete(key)
+	}
+}
+
+// labelsOf returns the labels of the worker of key, nil if it has none
+func labelsOf(key string) Labels {
+	labels, _ := keyLabels.Load(key)
+	l, _ := labels.(Labels)
+	return l
+}
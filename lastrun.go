@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ErrFresh is returned when we skip the work because it last ran fine less than
+// skipIfFresh ago
+var ErrFresh = errors.New("the last run is fresh")
+
+// RunRecord is the last run of the work that finished fine while leader, written
+// to <key>/last-run so the next runs (and people) know when the job last did its job
+type RunRecord struct {
+	At           time.Time     `json:"at"` // When the work returned
+	Duration     time.Duration `json:"duration"`
+	LeadershipID string        `json:"leadership_id"`
+	Hostname     string        `json:"hostname,omitempty"`
+	Summary      string        `json:"summary,omitempty"` // Set by the work with SetRunSummary
+}
+
+// lastRunKey is where the leader of a key records its last successful run
+func lastRunKey(key string) string {
+	return key + "/last-run"
+}
+
+// runSummaryKey is the context key for the summary of the current run
+type runSummaryKey struct{}
+
+type runSummary struct {
+	mu      sync.Mutex
+	summary string
+}
+
+// SetRunSummary sets the summary recorded with the run if the work returns fine,
+// e.g. "42 invoices sent". It does nothing outside a work context.
+func SetRunSummary(ctx context.Context, summary string) {
+	if s, ok := ctx.Value(runSummaryKey{}).(*runSummary); ok {
+		s.mu.Lock()
+		s.summary = summary
+		s.mu.Unlock()
+	}
+}
+
+// recordingRuns wraps fn so every run that returns nil while we are still leader
+// is recorded in <key>/last-run
+func (ec *exclusiveWorker) recordingRuns(fn func(ctx context.Context) error) func(ctx context.Context) error {
+	if !ec.recordLastRun {
+		return fn
+	}
+
+	return func(ctx context.Context) error {
+		s := &runSummary{}
+		start := ec.clock.Now()
+		err := fn(context.WithValue(ctx, runSummaryKey{}, s))
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		summary := s.summary
+		s.mu.Unlock()
+		hostname, _ := os.Hostname()
+		ec.mu.Lock()
+		record := RunRecord{
+			At:           ec.clock.Now(),
+			Duration:     ec.since(start),
+			LeadershipID: ec.leadershipID,
+			Hostname:     hostname,
+			Summary:      summary,
+		}
+		ec.mu.Unlock()
+
+		key := lastRunKey(ec.key)
+		value, err := json.Marshal(record)
+		if err == nil {
+			value, err = ec.cipher.seal(key, value)
+		}
+		if err == nil {
+			err = ec.KVPutIfHeld(key, value)
+		}
+		if err != nil {
+			ec.logf("Could not record the last run: %s", err)
+		}
+		return nil
+	}
+}
+
+// LastRun returns the last successful run of the work under key, nil if it never
+// ran fine. c decrypts the record if the leaders encrypt it, it can be nil.
+func LastRun(client *api.Client, key string, c *Cipher) (*RunRecord, error) {
+	pair, _, err := client.KV().Get(lastRunKey(key), &api.QueryOptions{RequireConsistent: true})
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	value, err := c.open(pair.Key, pair.Value)
+	if err != nil {
+		return nil, err
+	}
+	var r RunRecord
+	if err := json.Unmarshal(value, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// checkFresh returns ErrFresh if the last successful run is newer than skipIfFresh.
+// If it can not be read we run the work, skipping it is the worse mistake.
+func (ec *exclusiveWorker) checkFresh() error {
+	if ec.skipIfFresh <= 0 {
+		return nil
+	}
+	last, err := LastRun(ec.client, ec.key, ec.cipher)
+	if err != nil {
+		ec.logf("Could not read the last run: %s", err)
+		return nil
+	}
+	if last != nil && ec.since(last.At) < ec.skipIfFresh {
+		ec.logf("Last run %s ago by %s, skipping", ec.since(last.At).Round(time.Second), last.LeadershipID)
+		return ErrFresh
+	}
+	return nil
+}
+
+// runLastRun shows when the work under a key last ran fine:
+//
+//	mutual-exclusion-consul last-run -key service/bobruner/leader
+//
+// It exits with 3 if it never ran, or if it ran longer than -max-age ago, so it
+// can be used as a check.
+func runLastRun(args []string) int {
+	fs := flag.NewFlagSet("last-run", flag.ExitOnError)
+	key := fs.String("key", envOr("MUTEX_KEY", ""), "lock key")
+	encryptionKey := fs.String("encryption-key", envOr("MUTEX_ENCRYPTION_KEY", ""), "base64 AES key the workers encrypt the records with")
+	maxAge := fs.Duration("max-age", 0, "exit with 3 if the last run is older than this, 0 disables the check")
+	fs.Parse(args)
+	if *key == "" {
+		log.Println("-key is required")
+		return 2
+	}
+	cipher, err := newCipher(*encryptionKey)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	client, err := api.NewClient(&api.Config{Address: consulAddress})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	last, err := LastRun(client, *key, cipher)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	fmt.Println("key:", *key)
+	if last == nil {
+		fmt.Println("last run: never")
+		return 3
+	}
+	age := time.Since(last.At).Round(time.Second)
+	fmt.Printf("last run: %s (%s ago), took %s\n", last.At.Format(time.RFC3339), age, last.Duration.Round(time.Millisecond))
+	fmt.Println("leadership:", last.LeadershipID)
+	if last.Hostname != "" {
+		fmt.Println("host:", last.Hostname)
+	}
+	if last.Summary != "" {
+		fmt.Println("summary:", last.Summary)
+	}
+	if *maxAge > 0 && age > *maxAge {
+		return 3
+	}
+	return 0
+}
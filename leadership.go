@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/consul/api"
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+// leadershipIDKey is the context key for the leadership ID
+type leadershipIDKey struct{}
+
+// newLeadershipID creates the correlation ID of one leadership: the epoch followed by a random UUID.
+// The epoch is the LockIndex of the key, which consul increments every time the key is acquired,
+// so IDs of different leaders of the same key sort by when they got the lock.
+func newLeadershipID(epoch uint64) (string, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s", epoch, id), nil
+}
+
+// LockInfo is the metadata of the key as it was right after we acquired it.
+// ModifyIndex can be used for CAS operations on the key and LockIndex as a fencing token
+type LockInfo struct {
+	Key         string
+	Session     string
+	CreateIndex uint64
+	ModifyIndex uint64
+	LockIndex   uint64
+}
+
+// readLockInfo does a consistent read of the key to get its metadata
+func (ec *exclusiveWorker) readLockInfo() (LockInfo, error) {
+	pair, _, err := ec.client.KV().Get(ec.key, &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return LockInfo{}, err
+	}
+	if pair == nil {
+		return LockInfo{}, fmt.Errorf("key %s not found after acquire", ec.key)
+	}
+	return LockInfo{
+		Key:         pair.Key,
+		Session:     pair.Session,
+		CreateIndex: pair.CreateIndex,
+		ModifyIndex: pair.ModifyIndex,
+		LockIndex:   pair.LockIndex,
+	}, nil
+}
+
+// LockInfo returns the metadata of the key read after the last acquire.
+// It returns false if we do not hold the lock or the key could not be read.
+func (ec *exclusiveWorker) LockInfo() (LockInfo, bool) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.state != StateHeld || ec.lockInfo.Key == "" {
+		return LockInfo{}, false
+	}
+	return ec.lockInfo, true
+}
+
+// LeadershipID returns the correlation ID of the current leadership.
+// It is empty if the worker never held the lock.
+func (ec *exclusiveWorker) LeadershipID() string {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.leadershipID
+}
+
+// WorkContext returns a context for the work to be done while leader,
+// carrying the leadership ID. Use LeadershipIDFromContext to get it back.
+// While we hold the lock its deadline is the end of the window we are certain
+// to be leader, and it moves forward with every renewal (see leaseContext).
+func (ec *exclusiveWorker) WorkContext(parent context.Context) context.Context {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	ctx := context.WithValue(parent, leadershipIDKey{}, ec.leadershipID)
+	if ec.state != StateHeld {
+		return ctx
+	}
+	if ec.degraded == degradedReadOnly {
+		ctx = context.WithValue(ctx, degradedKey{}, ec.degradedCh)
+	}
+
+	lease := newLeaseContext(ctx, ec.clock, ec.leaseDeadline(ec.lastRenewal))
+	ec.leases[lease] = struct{}{}
+	go func() {
+		<-lease.Done()
+		ec.mu.Lock()
+		delete(ec.leases, lease)
+		ec.mu.Unlock()
+	}()
+	return lease
+}
+
+// LeadershipIDFromContext returns the leadership ID stored in a work context
+func LeadershipIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(leadershipIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// logf logs a message tagged with the worker key and the leadership ID (if any)
+// so logs from different leaders of the same key can be told apart.
+func (ec *exclusiveWorker) logf(format string, args ...interface{}) {
+	ec.mu.Lock()
+	id := ec.leadershipID
+	ec.mu.Unlock()
+	logWithID(ec.key, id, format, args...)
+}
+
+func logWithID(key, leadershipID string, format string, args ...interface{}) {
+	prefix := key
+	if leadershipID != "" {
+		prefix += " " + leadershipID
+	}
+	if labels := labelsOf(key); len(labels) > 0 {
+		prefix += " " + labels.String()
+	}
+	log.Printf("["+prefix+"] "+format, args...)
+}
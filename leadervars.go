@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// leaderExports are the prometheus collectors a worker registers only while leader.
+// A cluster-wide singleton gauge (queue depth, last run) is then exported by exactly
+// one process, and moves with the leadership.
+type leaderExports struct {
+	mu         sync.Mutex
+	registerer prometheus.Registerer
+	collectors []prometheus.Collector
+	registered bool // The collectors are registered, we are leader
+}
+
+// newLeaderExports returns the exports of a worker, registered with r (the default
+// registry if nil)
+func newLeaderExports(r prometheus.Registerer, collectors []prometheus.Collector) *leaderExports {
+	if r == nil {
+		r = prometheus.DefaultRegisterer
+	}
+	return &leaderExports{registerer: r, collectors: collectors}
+}
+
+// ExportWhileLeader adds collectors registered while we hold the lock and unregistered
+// when we give it back or lose it. If we are leader they are registered right away,
+// and an error is returned if that fails.
+func (ec *exclusiveWorker) ExportWhileLeader(collectors ...prometheus.Collector) error {
+	e := ec.exports
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.collectors = append(e.collectors, collectors...)
+	if !e.registered {
+		return nil
+	}
+	for _, c := range collectors {
+		if err := e.registerer.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportOnTransition registers the leader collectors when we get the lock and
+// unregisters them as soon as we stop holding it
+func (ec *exclusiveWorker) exportOnTransition(t Transition) {
+	e := ec.exports
+	e.mu.Lock()
+	var failed []error
+	switch {
+	case t.To == StateHeld && !e.registered:
+		e.registered = true
+		for _, c := range e.collectors {
+			if err := e.registerer.Register(c); err != nil {
+				failed = append(failed, err)
+			}
+		}
+	case t.From == StateHeld && e.registered:
+		e.registered = false
+		for _, c := range e.collectors {
+			e.registerer.Unregister(c)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, err := range failed {
+		ec.logf("Could not export a leader metric: %s", err)
+	}
+}
+
+// leaderSinceCollector exports when the current leadership of the worker started, as
+// mutual_exclusion_leader_since_timestamp_seconds. Registered with ExportWhileLeader
+// it tells which process leads and since when.
+func leaderSinceCollector(ec *exclusiveWorker) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "mutual_exclusion_leader_since_timestamp_seconds",
+		Help:        "When the leadership of the key held by this process started.",
+		ConstLabels: prometheus.Labels{"key": ec.key},
+	}, func() float64 {
+		ec.mu.Lock()
+		defer ec.mu.Unlock()
+		return float64(ec.heldSince.UnixNano()) / 1e9
+	})
+}
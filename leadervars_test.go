@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestExportWhileLeader checks the leader collectors are registered only while we
+// hold the lock
+func TestExportWhileLeader(t *testing.T) {
+	_, client := newTestConsul(t)
+	registry := prometheus.NewRegistry()
+	depth := prometheus.NewGauge(prometheus.GaugeOpts{Name: "queue_depth", Help: "Jobs waiting."})
+	ec := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:           client,
+		key:              "test/leader-metrics",
+		sessionTimeout:   "10s",
+		quiet:            true,
+		leaderCollectors: []prometheus.Collector{depth},
+		registerer:       registry,
+	})
+	defer ec.Close()
+	exported := func() []string {
+		t.Helper()
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range families {
+			names = append(names, f.GetName())
+		}
+		return names
+	}
+	if names := exported(); len(names) != 0 {
+		t.Fatalf("exported before the election: %v", names)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := ec.waitForLeadership(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := ec.ExportWhileLeader(leaderSinceCollector(ec)); err != nil {
+		t.Fatal(err)
+	}
+	if names := exported(); len(names) != 2 {
+		t.Fatalf("exported while leader: %v", names)
+	}
+
+	if err := ec.destroySession(); err != nil {
+		t.Fatal(err)
+	}
+	if names := exported(); len(names) != 0 {
+		t.Fatalf("exported after the leadership: %v", names)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// leaseContext is a context whose deadline is the end of the window we are certain
+// to be leader: last renewal + TTL - safety margin. The deadline moves forward every
+// time the session is renewed, so downstream calls that look at Deadline() respect
+// how long we are certain to hold the lock. If no renewal happens in time the
+// context is cancelled with context.DeadlineExceeded.
+type leaseContext struct {
+	context.Context // Parent, for values
+
+	mu       sync.Mutex
+	deadline time.Time
+	clock    Clock
+	timer    Timer
+	done     chan struct{}
+	err      error
+}
+
+func newLeaseContext(parent context.Context, clock Clock, deadline time.Time) *leaseContext {
+	c := &leaseContext{
+		Context:  parent,
+		clock:    clock,
+		deadline: deadline,
+		done:     make(chan struct{}),
+	}
+	c.timer = clock.AfterFunc(deadline.Sub(clock.Now()), func() {
+		c.cancel(context.DeadlineExceeded)
+	})
+	go func() {
+		select {
+		case <-parent.Done():
+			c.cancel(parent.Err())
+		case <-c.done:
+		}
+	}()
+	return c
+}
+
+// Deadline is the end of the lease, or the deadline of the parent if it is earlier:
+// the context is done by then anyway
+func (c *leaseContext) Deadline() (time.Time, bool) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	if parent, ok := c.Context.Deadline(); ok && parent.Before(deadline) {
+		return parent, true
+	}
+	return deadline, true
+}
+
+func (c *leaseContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *leaseContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// extend moves the deadline forward. Deadlines in the past are ignored
+func (c *leaseContext) extend(deadline time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || !deadline.After(c.deadline) {
+		return
+	}
+	c.deadline = deadline
+	c.timer.Reset(deadline.Sub(c.clock.Now()))
+}
+
+// reset moves the deadline, earlier too: the lease follows a new session whose TTL
+// may be shorter
+func (c *leaseContext) reset(deadline time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.deadline = deadline
+	c.timer.Reset(deadline.Sub(c.clock.Now()))
+}
+
+func (c *leaseContext) cancel(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.timer.Stop()
+	close(c.done)
+}
+
+// leaseDeadline returns until when we are certain to hold the lock if the
+// session was renewed at renewedAt. It must be called with ec.mu held.
+func (ec *exclusiveWorker) leaseDeadline(renewedAt time.Time) time.Time {
+	margin := ec.leaseMargin
+	if margin == 0 {
+		margin = ec.leaseTTL / 10
+	}
+	return renewedAt.Add(ec.leaseTTL - margin)
+}
+
+// renewed records a successful renewal (or acquisition) that started at renewedAt
+// with the TTL returned by consul, and moves the deadline of the work contexts.
+func (ec *exclusiveWorker) renewed(renewedAt time.Time, ttl time.Duration) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.renewedLocked(renewedAt, ttl)
+}
+
+// renewedLocked is renewed for callers holding ec.mu
+func (ec *exclusiveWorker) renewedLocked(renewedAt time.Time, ttl time.Duration) {
+	if renewedAt.Before(ec.lastRenewal) {
+		return
+	}
+	ec.lastRenewal = renewedAt
+	ec.leaseTTL = ttl
+	deadline := ec.leaseDeadline(renewedAt)
+	for c := range ec.leases {
+		c.extend(deadline)
+	}
+}
+
+// resetLeaseLocked is renewedLocked for a new session, see SetTTL: its deadline
+// replaces the one of the old session even if it is earlier, a lower TTL must not
+// leave the work believing it leads past the expiry of the new session.
+// It must be called with ec.mu held.
+func (ec *exclusiveWorker) resetLeaseLocked(renewedAt time.Time, ttl time.Duration) {
+	ec.lastRenewal = renewedAt
+	ec.leaseTTL = ttl
+	deadline := ec.leaseDeadline(renewedAt)
+	for c := range ec.leases {
+		c.reset(deadline)
+	}
+}
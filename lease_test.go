@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestLeaseContextDeadline checks the deadline is the earliest of the lease and
+// of the parent
+func TestLeaseContextDeadline(t *testing.T) {
+	clock := newFakeClock()
+	lease := clock.Now().Add(10 * time.Second)
+	for _, tc := range []struct {
+		name   string
+		parent time.Duration // Deadline of the parent after the lease, 0 for none
+		want   time.Time
+	}{
+		{name: "no parent deadline", want: lease},
+		{name: "parent after the lease", parent: time.Second, want: lease},
+		{name: "parent before the lease", parent: -time.Second, want: lease.Add(-time.Second)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parent := context.Background()
+			if tc.parent != 0 {
+				var cancel context.CancelFunc
+				parent, cancel = context.WithDeadline(parent, lease.Add(tc.parent))
+				defer cancel()
+			}
+			c := newLeaseContext(parent, clock, lease)
+			defer c.cancel(context.Canceled)
+			if deadline, ok := c.Deadline(); !ok || !deadline.Equal(tc.want) {
+				t.Errorf("deadline %s, want %s", deadline, tc.want)
+			}
+		})
+	}
+}
+
+// TestQuorumContextDeadline checks the work context of a quorum ends at the earliest
+// expiry among the majority of leases that expire last, and once the majority is lost
+func TestQuorumContextDeadline(t *testing.T) {
+	clock := newFakeClock()
+	q := &quorum{clock: clock}
+	for _, ttl := range []string{"10s", "20s", "30s"} {
+		_, client := newTestConsul(t)
+		w := newExclusiveWorker(&exclusiveWorkerConfig{
+			client:         client,
+			key:            "test/quorum",
+			sessionTimeout: ttl,
+			leaseMargin:    time.Second,
+			clock:          clock,
+			quiet:          true,
+		})
+		defer w.Close()
+		if err := w.createSession(); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := w.acquireSession(); !ok {
+			t.Fatalf("not acquired: %v", err)
+		}
+		q.workers = append(q.workers, w)
+	}
+	ctx, cancel := q.workContext(context.Background(), q.workers)
+	defer cancel()
+
+	start := clock.Now()
+	if d, _ := ctx.Deadline(); !d.Equal(start.Add(19 * time.Second)) {
+		t.Fatalf("deadline in %s, want the 20s lease", d.Sub(start))
+	}
+	// The 30s cluster is gone, the 10s one is now in the majority
+	if err := q.workers[2].destroySession(); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := ctx.Deadline(); !d.Equal(start.Add(9 * time.Second)) {
+		t.Fatalf("deadline in %s once a cluster is gone, want the 10s lease", d.Sub(start))
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the work stopped with a majority left")
+	}
+	if err := q.workers[1].destroySession(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the work goes on without a majority")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// LeaseHint is what the leader of a key publishes about its session next to the lock,
+// so observers, who can not see the renewals, can tell how fresh the leader is.
+// Consul invalidates a session between TTL and twice the TTL after its last renewal,
+// ExpiresAt is the earliest.
+type LeaseHint struct {
+	SessionID    string    `json:"session_id"`
+	LeadershipID string    `json:"leadership_id"`
+	TTL          string    `json:"ttl"`
+	RenewedAt    time.Time `json:"renewed_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// leaseHintKey is where the leader of a key keeps its LeaseHint
+func leaseHintKey(key string) string {
+	return key + "/lease"
+}
+
+// leaseHintOnTransition keeps the LeaseHint up to date while we are leader
+func (ec *exclusiveWorker) leaseHintOnTransition(t Transition) {
+	if t.To == StateHeld {
+		go ec.leaseHintLoop(t.LeadershipID)
+	}
+}
+
+// leaseHintLoop writes the hint when we got the lock and after every renewal, until
+// the leadership leadershipID is over. It is written in plain text even with an
+// encryption key, for dashboards to read.
+func (ec *exclusiveWorker) leaseHintLoop(leadershipID string) {
+	key := leaseHintKey(ec.key)
+	var written time.Time
+	for {
+		ec.mu.Lock()
+		held := ec.state == StateHeld && ec.leadershipID == leadershipID
+		sessionID, renewal, ttl := ec.sessionID, ec.lastRenewal, ec.leaseTTL
+		ec.mu.Unlock()
+		if !held {
+			return
+		}
+		if ttl <= 0 {
+			ttl, _ = time.ParseDuration(ec.TTL())
+		}
+
+		if renewal.After(written) {
+			value, err := json.Marshal(LeaseHint{
+				SessionID:    sessionID,
+				LeadershipID: leadershipID,
+				TTL:          ttl.String(),
+				RenewedAt:    renewal.UTC(),
+				ExpiresAt:    renewal.Add(ttl).UTC(),
+			})
+			if err == nil {
+				err = ec.KVPutIfHeld(key, value)
+			}
+			if err != nil {
+				ec.logf("Could not write the lease hint: %s", err)
+			}
+			written = renewal
+		}
+
+		// Renewals happen every TTL/2 at most, checking twice as often keeps up with them
+		select {
+		case <-ec.clock.After(ttl / 4):
+		case <-ec.closed:
+			return
+		}
+	}
+}
+
+// ReadLeaseHint returns the LeaseHint of key, nil if none was published. It may be
+// left over by a previous leader, compare its SessionID with the one holding the lock.
+func ReadLeaseHint(client *api.Client, key string) (*LeaseHint, error) {
+	pair, _, err := client.KV().Get(leaseHintKey(key), nil)
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	return decodeLeaseHint(pair)
+}
+
+func decodeLeaseHint(pair *api.KVPair) (*LeaseHint, error) {
+	var h LeaseHint
+	if err := json.Unmarshal(pair.Value, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// Describe tells how fresh the lease is at now, for the status command
+func (h *LeaseHint) Describe(now time.Time) string {
+	s := fmt.Sprintf("ttl %s, renewed %s ago", h.TTL, now.Sub(h.RenewedAt).Truncate(time.Second))
+	left := h.ExpiresAt.Sub(now)
+	if left > 0 {
+		return s + fmt.Sprintf(", expires in %s", left.Truncate(time.Second))
+	}
+	return s + fmt.Sprintf(", overdue by %s", (-left).Truncate(time.Second))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// ConcurrencyLimit caps how much work the workers sharing it do at the same time, in
+// slots of a semaphore: a host contending for many different jobs can lead some but
+// only run what it can afford. Each worker takes a weight of slots while it leads,
+// heavy jobs can take more. A worker only contends while its slots look free and
+// takes them right after getting the lock, with the preconditions: if other workers
+// took them meanwhile it gives the lock back, for a host with capacity to take it.
+type ConcurrencyLimit struct {
+	size int64
+	sem  *semaphore.Weighted
+	mu   sync.Mutex
+	held map[*exclusiveWorker]int64 // Slots taken by each leader
+}
+
+// NewConcurrencyLimit returns a limit of size slots
+func NewConcurrencyLimit(size int64) *ConcurrencyLimit {
+	return &ConcurrencyLimit{
+		size: size,
+		sem:  semaphore.NewWeighted(size),
+		held: map[*exclusiveWorker]int64{},
+	}
+}
+
+// checkWeight checks a worker can ever fit in the limit
+func (l *ConcurrencyLimit) checkWeight(weight int64) error {
+	if weight < 1 || weight > l.size {
+		return fmt.Errorf("weight %d must be between 1 and the concurrency limit %d", weight, l.size)
+	}
+	return nil
+}
+
+// take is the check of the limit for ec: before the lock is held it only looks for
+// free slots, once it is held it takes them until the leadership ends
+func (l *ConcurrencyLimit) take(ec *exclusiveWorker, weight int64, held bool) error {
+	if !l.sem.TryAcquire(weight) {
+		return fmt.Errorf("no %d free slots in the concurrency limit of %d", weight, l.size)
+	}
+	if !held {
+		l.sem.Release(weight)
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held[ec] = weight
+	return nil
+}
+
+// release gives back the slots ec took, if any
+func (l *ConcurrencyLimit) release(ec *exclusiveWorker) {
+	l.mu.Lock()
+	weight, ok := l.held[ec]
+	delete(l.held, ec)
+	l.mu.Unlock()
+	if ok {
+		l.sem.Release(weight)
+	}
+}
+
+// releaseSlotsOnTransition gives back the slots of the limit once the leadership is over
+func (ec *exclusiveWorker) releaseSlotsOnTransition(t Transition) {
+	if t.To == StateReleased || t.To == StateLost {
+		ec.limit.release(ec)
+	}
+}
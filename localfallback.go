@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultLocalFallbackAfter is how long consul must be unreachable before we lead
+// with the local lock alone
+const defaultLocalFallbackAfter = 30 * time.Second
+
+// errConsulUnreachable is returned by waitForLeadership when consul was unreachable
+// for localFallbackAfter and the local fallback is enabled
+var errConsulUnreachable = errors.New("consul is unreachable")
+
+// errNoLocalLock is returned on the platforms without flock
+var errNoLocalLock = errors.New("the local fallback lock is not supported on this platform")
+
+// localFallbackKey is the context key set on the work context of a local fallback
+type localFallbackKey struct{}
+
+// LocalFallbackFromContext tells if the work runs under the local fallback: consul is
+// unreachable and we only hold the file lock, so no other process of this host works
+// but processes on other hosts may.
+func LocalFallbackFromContext(ctx context.Context) bool {
+	local, _ := ctx.Value(localFallbackKey{}).(bool)
+	return local
+}
+
+// checkLocalFallback checks the file of -local-fallback can be locked
+func checkLocalFallback(path string) error {
+	if path == "" {
+		return nil
+	}
+	if !localLockSupported {
+		return errNoLocalLock
+	}
+	l, err := openLocalLock(path)
+	if err != nil {
+		return err
+	}
+	return l.close()
+}
+
+// localLockFile returns the file lock of the local fallback, opening it the first time
+func (ec *exclusiveWorker) localLockFile() (*localLock, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.localLock == nil {
+		l, err := openLocalLock(ec.localFallback)
+		if err != nil {
+			return nil, err
+		}
+		ec.localLock = l
+	}
+	return ec.localLock, nil
+}
+
+// holdLocal waits until we hold the file lock. The leader holds it while it works
+// too, so the processes of the host never work at the same time, whether they hold
+// the consul lock or fell back to the local one.
+// done, if not nil, stops the waiting early and holdLocal then returns false.
+func (ec *exclusiveWorker) holdLocal(ctx context.Context, done func() bool) (bool, error) {
+	l, err := ec.localLockFile()
+	if err != nil {
+		return false, err
+	}
+	for {
+		locked, err := l.tryLock()
+		if err != nil || locked {
+			return locked, err
+		}
+		if done != nil && done() {
+			return false, nil
+		}
+		if err := ec.sleep(ctx, retryInterval); err != nil {
+			return false, err
+		}
+	}
+}
+
+// releaseLocal releases the file lock
+func (ec *exclusiveWorker) releaseLocal() {
+	ec.mu.Lock()
+	l := ec.localLock
+	ec.mu.Unlock()
+	if err := l.unlock(); err != nil {
+		ec.logf("Could not release the local lock %s: %s", l.path, err)
+	}
+}
+
+// consulReachable tells if consul answers and has a leader
+func (ec *exclusiveWorker) consulReachable() bool {
+	leader, err := ec.client.Status().Leader()
+	return err == nil && leader != ""
+}
+
+// holdingLocal wraps the work of a leader to hold the file lock of localFallback
+// while it runs, if there is one. The session is renewed meanwhile, and a process of the
+// host working under the local fallback stops within retryInterval now that consul is
+// reachable.
+func (ec *exclusiveWorker) holdingLocal(fn func(ctx context.Context) error) func(ctx context.Context) error {
+	if ec.localFallback == "" {
+		return fn
+	}
+	return func(ctx context.Context) error {
+		if _, err := ec.holdLocal(ctx, nil); err != nil {
+			return err
+		}
+		defer ec.releaseLocal()
+		return fn(ctx)
+	}
+}
+
+// runLocalFallback runs fn holding only the file lock, while consul is unreachable.
+// Only the processes of this host are kept out: there is no exclusion with other
+// hosts, which is why it is loud about it. The work context is cancelled as soon as
+// consul is reachable again, and we go back to contending for the consul lock.
+func (ec *exclusiveWorker) runLocalFallback(ctx context.Context, fn func(ctx context.Context) error) error {
+	locked, err := ec.holdLocal(ctx, ec.consulReachable)
+	if err != nil || !locked {
+		return err
+	}
+	defer ec.releaseLocal()
+
+	ec.emit(EventLocalFallback, fmt.Sprintf("consul is unreachable, working with the local lock %s: other hosts are NOT kept out", ec.localFallback))
+	ec.metrics.localFallback.Set(1)
+	defer ec.metrics.localFallback.Set(0)
+
+	workCtx, cancel := context.WithCancel(context.WithValue(ctx, localFallbackKey{}, true))
+	defer cancel()
+	go func() {
+		for !ec.consulReachable() {
+			if ec.sleep(workCtx, retryInterval) != nil {
+				return
+			}
+		}
+		ec.emit(EventLocalFallback, "consul is reachable again, stopping the work to contend for the consul lock")
+		cancel()
+	}()
+	if err := fn(workCtx); err != nil {
+		ec.logf("Work failed under the local fallback: %s", err)
+	}
+	return ctx.Err()
+}
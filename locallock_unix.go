@@ -0,0 +1,43 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// localLockSupported tells if -local-fallback can be used
+const localLockSupported = true
+
+// localLock is an advisory lock (flock) on a file, shared by the processes of the host
+type localLock struct {
+	path string
+	f    *os.File
+}
+
+func openLocalLock(path string) (*localLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &localLock{path: path, f: f}, nil
+}
+
+// tryLock takes the lock if no other process of the host holds it
+func (l *localLock) tryLock() (bool, error) {
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *localLock) unlock() error {
+	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+}
+
+func (l *localLock) close() error {
+	return l.f.Close()
+}
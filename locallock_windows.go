@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+// localLockSupported is false because the local fallback uses flock
+const localLockSupported = false
+
+type localLock struct {
+	path string
+}
+
+func openLocalLock(path string) (*localLock, error) {
+	return nil, errNoLocalLock
+}
+
+func (l *localLock) tryLock() (bool, error) {
+	return false, errNoLocalLock
+}
+
+func (l *localLock) unlock() error {
+	return errNoLocalLock
+}
+
+func (l *localLock) close() error {
+	return nil
+}
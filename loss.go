@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// LossReason tells why a leadership ended
+type LossReason string
+
+const (
+	LossTTLExpired        LossReason = "ttl-expired"                  // No renewal went through within the TTL
+	LossSessionDestroyed  LossReason = "session-destroyed-externally" // Someone destroyed our session, e.g. an operator
+	LossNodeCheckFailed   LossReason = "node-check-failed"            // A health check of our node went critical, consul invalidated the session
+	LossKeyTaken          LossReason = "key-taken"                    // The session is alive but another one holds the key
+	LossConsulUnreachable LossReason = "consul-unreachable-too-long"  // The renewals kept failing, we can not tell what consul did meanwhile
+	LossResigned          LossReason = "resigned"                     // We gave the lock back ourselves
+)
+
+// lossRecordRetryTimeout is how long we try to write the LossRecord after a loss
+const lossRecordRetryTimeout = 5 * time.Minute
+
+// LossRecord is how the last leadership of a key ended, written to <key>/last-loss
+// by its leader once it is over, for the status command
+type LossRecord struct {
+	At           time.Time  `json:"at"`
+	LeadershipID string     `json:"leadership_id"`
+	Reason       LossReason `json:"reason"`
+	Detail       string     `json:"detail,omitempty"`
+	Hostname     string     `json:"hostname,omitempty"`
+	Build        *BuildInfo `json:"build,omitempty"` // Of the leader
+}
+
+// lastLossKey is where the leaders of a key record how their leadership ended
+func lastLossKey(key string) string {
+	return key + "/last-loss"
+}
+
+// classifyLoss tells why the renewals of sessionID stopped with err. It asks consul
+// what happened to the session, so it must not be called with ec.mu held.
+func (ec *exclusiveWorker) classifyLoss(sessionID string, err error) LossReason {
+	switch {
+	case errors.Is(err, ErrSplitBrain):
+		if entry, _, infoErr := ec.client.Session().Info(sessionID, nil); infoErr == nil && entry != nil {
+			return LossKeyTaken
+		}
+	case !errors.Is(err, api.ErrSessionExpired):
+		// The renewals failed, not consul saying the session is gone
+		return LossConsulUnreachable
+	}
+
+	ec.mu.Lock()
+	ttl, deadline := ec.leaseTTL, ec.lastRenewal.Add(ec.leaseTTL)
+	ec.mu.Unlock()
+	if ttl > 0 && !ec.clock.Now().Before(deadline) {
+		return LossTTLExpired
+	}
+	if ec.nodeCheckFailed() {
+		return LossNodeCheckFailed
+	}
+	return LossSessionDestroyed
+}
+
+// nodeCheckFailed tells if a health check of the node of our sessions is critical,
+// which invalidates the sessions bound to it
+func (ec *exclusiveWorker) nodeCheckFailed() bool {
+	node := ec.sessionNode
+	if node == "" {
+		var err error
+		if node, err = ec.client.Agent().NodeName(); err != nil {
+			return false
+		}
+	}
+	checks, _, err := ec.client.Health().Node(node, nil)
+	if err != nil {
+		return false
+	}
+	return checks.AggregatedStatus() == api.HealthCritical
+}
+
+// recordLossOnTransition counts the ends of the leaderships by reason and records
+// the last one in <key>/last-loss. It is written right away, so a process exiting after
+// giving the lock back records it too, and if consul is unreachable (as it may be right
+// after a loss) it is retried in the background for lossRecordRetryTimeout.
+func (ec *exclusiveWorker) recordLossOnTransition(t Transition) {
+	if t.Reason == "" {
+		return
+	}
+	ec.metrics.losses.Add(string(t.Reason), 1)
+
+	hostname, _ := os.Hostname()
+	record := LossRecord{At: t.At, LeadershipID: t.LeadershipID, Reason: t.Reason, Detail: t.Detail, Hostname: hostname, Build: currentBuild()}
+	key := lastLossKey(ec.key)
+	value, err := json.Marshal(record)
+	if err == nil {
+		value, err = ec.cipher.seal(key, value)
+	}
+	if err != nil {
+		logWithID(ec.key, t.LeadershipID, "Could not record the loss: %s", err)
+		return
+	}
+	pair := &api.KVPair{Key: key, Value: value}
+	if _, err := ec.client.KV().Put(pair, nil); err == nil {
+		return
+	}
+	go func() {
+		deadline := ec.clock.Now().Add(lossRecordRetryTimeout)
+		for {
+			select {
+			case <-ec.clock.After(retryInterval):
+			case <-ec.closed:
+				return
+			}
+			_, err := ec.client.KV().Put(pair, nil)
+			if err == nil {
+				return
+			}
+			if ec.clock.Now().After(deadline) {
+				logWithID(ec.key, t.LeadershipID, "Could not record the loss: %s", err)
+				return
+			}
+		}
+	}()
+}
+
+// LastLoss returns how the last leadership of key ended, nil if none was recorded.
+// c decrypts the record if the leaders encrypt it, it can be nil.
+func LastLoss(client *api.Client, key string, c *Cipher) (*LossRecord, error) {
+	pair, _, err := client.KV().Get(lastLossKey(key), nil)
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	return decodeLossRecord(pair, c)
+}
+
+// decodeLossRecord reads a LossRecord, decrypting it with c
+func decodeLossRecord(pair *api.KVPair, c *Cipher) (*LossRecord, error) {
+	value, err := c.open(pair.Key, pair.Value)
+	if err != nil {
+		return nil, err
+	}
+	var r LossRecord
+	if err := json.Unmarshal(value, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// String describes the record for the status command
+func (r *LossRecord) String() string {
+	s := fmt.Sprintf("%s at %s, leadership %s", r.Reason, r.At.Format(time.RFC3339), r.LeadershipID)
+	if r.Hostname != "" {
+		s += " on " + r.Hostname
+	}
+	if r.Build != nil {
+		s += " running " + r.Build.String()
+	}
+	if r.Detail != "" {
+		s += ": " + r.Detail
+	}
+	return s
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // exclusiveWorkerConfig holds the configuration to create a new Exclusive Worker
@@ -16,148 +20,1434 @@ type exclusiveWorkerConfig struct {
 	client         *api.Client // Consul client
 	key            string      // Worker Key (in other words taskID)
 	sessionTimeout string      // Session timeout
+	// onTransition is called every time the worker changes state. Can be nil
+	onTransition func(Transition)
+	// adaptiveRenewal renews more often than TTL/2 when renewals are slow or failing
+	adaptiveRenewal bool
+	// onEvent is called for events that are not state transitions. Can be nil
+	onEvent func(Event)
+	// lostCooldown is how long RunElected waits before contending again after losing
+	// (not resigning) the leadership, so a flapping node does not yo-yo the cluster
+	lostCooldown time.Duration
+	// verifyInterval is how often the leader reads the key to check it still owns it. 0 disables it
+	verifyInterval time.Duration
+	// advertiseAddr is the host:port published in the lock value so others can find the leader
+	advertiseAddr string
+	// serviceID is the ID of our service in the local agent. If set the leader tags it with "leader"
+	serviceID string
+	// strategy decides when RunElected tries to acquire. Defaults to the simple strategy
+	strategy Strategy
+	// fireEvents fires a leader-changed:<key> consul user event when we acquire or release the lock
+	fireEvents bool
+	// window is when we are allowed to hold the lock. Can be nil
+	window *Window
+	// verifyAcquire reads the key back (consistently) after acquiring it and checks our
+	// session holds it. Without it the epoch of the leadership is unknown
+	verifyAcquire bool
+	// preflight checks the consul token can create sessions and write the key before the first session
+	preflight bool
+	// statusFile is written with the Status of the worker on every state change. Can be empty
+	statusFile string
+	// cipher encrypts the holder metadata and the shared state. Can be nil
+	cipher *Cipher
+	// codec encodes the holder metadata, the shared state, the handover and the work
+	// results. Nil is plain JSON
+	codec Codec
+	// chunkShared lets Publish write values larger than the consul limit in chunks
+	chunkShared bool
+	// sessionNode is the node of the sessions, the agent's node if empty.
+	// Sessions in another DC must use a node of that DC
+	sessionNode string
+	// afterWork is what RunElected and RunOnce do when the work returns while we are still
+	// leader. Defaults to afterWorkRelease
+	afterWork afterWorkPolicy
+	// rerunInterval is how long afterWorkRerun waits before running the work again
+	rerunInterval time.Duration
+	// degraded is what the leader does when renewals fail but the session may still be
+	// alive. Defaults to degradedGrace
+	degraded degradedPolicy
+	// exitIfIdle makes RunElected return ErrIdle when we are a follower for that long,
+	// so standby capacity can be reclaimed. 0 waits forever
+	exitIfIdle time.Duration
+	// announce registers every session under the contender prefix, even when the
+	// strategy does not need it, so the status command can show who is waiting for the key
+	announce bool
+	// keepSession gives the key back with a KV release instead of destroying the session,
+	// which is reused by the next leadership. For sessions with other uses than this lock
+	keepSession bool
+	// session, if set, is a session shared with other workers that backs our lock instead
+	// of one of our own. Its TTL replaces sessionTimeout
+	session *sharedSession
+	// eventLog, if set, gets every transition and event, for the replay command
+	eventLog *eventLog
+	// watchControl makes the leader watch <key>/control and step down when asked to
+	watchControl bool
+	// maintenanceKey is the maintenance flag of our namespace (see maintenanceKeyIn): while
+	// it is set we don't contend, and with "resign" leaders resign too. Empty disables it
+	maintenanceKey string
+	// generation is the deploy generation of the worker (e.g. blue or green). While a
+	// deployment controller prefers another one (see PreferGeneration) we don't contend
+	// and resign if we are leader. Empty always contends
+	generation string
+	// clock is the time source. Defaults to the system clock
+	clock Clock
+	// retryBudget, if set, limits how often we retry after consul errors. Share one
+	// between the workers that use the same client
+	retryBudget *retryBudget
+	// snapshot, if set, is called when the work returned while we still hold the lock.
+	// What it returns is written as JSON to <key>/handover for the next leader
+	snapshot func() (interface{}, error)
+	// onElected, if set, is called right after we got the lock with the handover of the
+	// previous leaders, nil if there is none
+	onElected func(*Handover)
+	// recordLastRun records every run that returned fine while leader in <key>/last-run
+	recordLastRun bool
+	// skipIfFresh makes RunOnce return ErrFresh without working when the last recorded
+	// run is newer than that. 0 always runs
+	skipIfFresh time.Duration
+	// publishResults gives the work the result of the previous run with PreviousResult
+	// and publishes the one it sets with SetResult under <key>/results/
+	publishResults bool
+	// preconditions must pass before we contend and right after we get the lock,
+	// see Precondition
+	preconditions []Precondition
+	// leaderElectionRecord keeps a Kubernetes LeaderElectionRecord in <key>/leader-election
+	// while we are leader, see LeaderElectionRecord
+	leaderElectionRecord bool
+	// leaseHint keeps a LeaseHint in <key>/lease while we are leader, so observers can
+	// tell when the lease of the leader expires
+	leaseHint bool
+	// lockDelay is the lock-delay of our sessions: how long consul keeps the key from
+	// being acquired after our session was invalidated. 0 keeps the consul default (15s)
+	lockDelay time.Duration
+	// labels are added to the logs, metrics, events and lock value of the worker
+	labels Labels
+	// policy, if set, is a script deciding whether to contend and to resign and what
+	// metadata to publish, see Policy. It wraps strategy
+	policy *Policy
+	// localFallback is a file locked (flock) while we work, so the processes of the host
+	// never work at the same time. When consul is unreachable for localFallbackAfter,
+	// RunElected works with it alone, see runLocalFallback
+	localFallback      string
+	localFallbackAfter time.Duration
+	// limit, if set, is shared with other workers to cap how much work they do at the
+	// same time, this worker taking limitWeight slots while it leads. See ConcurrencyLimit
+	limit       *ConcurrencyLimit
+	limitWeight int64
+	// engine is engineSession (the default) or engineAPILock to delegate the election
+	// of RunElected and RunOnce to consul's api.Lock, see runAPILock
+	engine string
+	// flapThreshold, if set, audits the leadership changes of the key in
+	// <key>/audit/leaderships: past flapThreshold changes in flapWindow the leadership
+	// flaps, the cooldowns of RunElected are extended and with flapFreeze contention is
+	// frozen until an operator deletes <key>/audit/frozen, which starts a new audit.
+	// See setFlapping
+	flapThreshold int
+	flapWindow    time.Duration
+	flapFreeze    bool
+	// leaseMargin is subtracted from last renewal + TTL to get the deadline of the work context.
+	// Defaults to TTL/10
+	leaseMargin time.Duration
+	// quiet does not print the ID of every new session on stdout, for programs
+	// embedding the worker
+	quiet bool
+	// leaderCollectors are registered with registerer (the default prometheus registry
+	// if nil) only while we are leader, see ExportWhileLeader
+	leaderCollectors []prometheus.Collector
+	registerer       prometheus.Registerer
+	// renewClient, if set, renews the sessions on connections of its own, so the
+	// blocking queries of client can not delay them. See newRenewalClient
+	renewClient *api.Client
 }
 
 // exclusiveWorker is the struct that hold the worker (or Leader)
+// It is safe to use from multiple goroutines. Only one renewal loop can
+// run at a time, calling renewSession while one is running returns ErrAlreadyRenewing.
 type exclusiveWorker struct {
-	client         *api.Client // Consul client
-	key            string      // Worker Key (in other words taskID)
-	sessionID      string      // Id of session created in consul
-	sessionTimeout string      // Session timeout
+	client          *api.Client // Consul client
+	renewClient     *api.Client // Consul client of the session renewals, client if not set
+	key             string      // Worker Key (in other words taskID)
+	sessionTimeout  string      // Session timeout
+	onTransition    func(Transition)
+	adaptiveRenewal bool // Adjust the renewal cadence to the observed latency
+	onEvent         func(Event)
+	verifyInterval  time.Duration
+	advertiseAddr   string
+	serviceID       string
+	strategy        Strategy
+	leaseMargin     time.Duration
+	fireEvents      bool
+	window          *Window
+	preflight       bool
+	verifyAcquire   bool
+	statusFile      string
+	cipher          *Cipher
+	codec           Codec
+	chunkShared     bool
+	sessionNode     string
+	afterWork       afterWorkPolicy
+	degraded        degradedPolicy
+	rerunInterval   time.Duration
+	exitIfIdle      time.Duration
+	announce        bool
+	quiet           bool
+	keepSession     bool
+	session         *sharedSession
+	eventLog        *eventLog
+	watchControl    bool
+	maintenanceKey  string
+	maintenance     *watchedKey // The maintenance flag, see waitForMaintenance
+	generation      string
+	preferredGen    *watchedKey // The generation key, see waitForGeneration
+	clock           Clock
+	retryBudget     *retryBudget
+	snapshot        func() (interface{}, error)
+	onElected       func(*Handover)
+	recordLastRun   bool
+	skipIfFresh     time.Duration
+	publishResults  bool
+	lockDelay       time.Duration
+	leaderElection  bool
+	leaseHint       bool
+	localFallback   string
+	fallbackAfter   time.Duration
+	limit           *ConcurrencyLimit
+	limitWeight     int64
+	engine          string
+	flapThreshold   int
+	flapWindow      time.Duration
+	flapFreeze      bool
+	policy          *Policy
+	control         *Follower        // Watches the control key while we are leader, only used by watchControlOnTransition
+	stats           *renewalStats    // Renewal round trip times and errors
+	metrics         *lockMetrics     // Contention metrics
+	watchHealth     *brownout        // Blocking queries of the elector, only used by its goroutine
+	history         *eventHistory    // Last events and transitions, for the debug endpoint
+	exports         *leaderExports   // Collectors registered while we are leader
+	tally           *leadershipTally // For the ShutdownReport
+
+	closed     chan struct{}  // Closed by Close() to stop the renewal loop
+	closeOnce  sync.Once      // Makes Close() idempotent
+	closeErr   error          // Result of the first Close()
+	wg         sync.WaitGroup // Tracks the renewal loop so Close() can wait for it
+	ttlChanged chan struct{}  // Signalled by SetTTL so the renewal loop follows the new session
+	ttlMu      sync.Mutex     // Serializes SetTTL, which moves the lock without holding mu
+
+	mu            sync.Mutex                 // Protects the fields below
+	sessionID     string                     // Id of session created in consul
+	movingTo      string                     // Session SetTTL is moving the lock to
+	state         State                      // Current leadership state
+	renewing      bool                       // True while the renewal loop is running
+	contendAt     time.Time                  // When we started contending for the lock
+	leadershipID  string                     // Correlation ID of the current (or last) leadership
+	resignCh      chan struct{}              // Closed by Resign() to stop the current leadership
+	releaseOnly   bool                       // Release() was called: release the key but keep the session
+	handover      *pendingHandover           // Written with the release of the key, see writeHandover
+	degradedCh    chan struct{}              // Closed when renewals fail under degradedReadOnly, see DegradedFromContext
+	isDegraded    bool                       // degradedCh was closed
+	lastRenewal   time.Time                  // When the last successful renewal (or the acquisition) started
+	leaseTTL      time.Duration              // TTL of the session as returned by consul
+	leases        map[*leaseContext]struct{} // Work contexts whose deadline follows the renewals
+	lockInfo      LockInfo                   // Metadata of the key read after the last acquire
+	preflightDone bool                       // The permissions were checked
+	lossReason    LossReason                 // Why the leadership is being lost, for the transition to Lost
+	lossDetail    string                     // The error that ended it
+	labels        Labels                     // Changed by SetLabels on reload
+	lostCooldown  time.Duration              // Changed by SetLostCooldown on reload
+	preconditions []Precondition             // Changed by SetPreconditions on reload
+	heldSince     time.Time                  // When we last got the lock
+	localLock     *localLock                 // File lock of localFallback, opened on first use
+	stepDownIndex uint64                     // ModifyIndex of the step-down command we are carrying out
+	steppedDown   bool                       // The last leadership ended by stepping down
+	flapping      bool                       // The leadership flaps, see setFlapping
+	flapCooldown  time.Duration              // Cooldown after a leadership while it flaps
+	pending       []Transition               // Transitions not yet sent to onTransition
+	watchers      []*transitionWatcher       // Extra transition callbacks added with watchTransitions
 }
 
 // newExclusiveWorker creates new exclusive worker
 func newExclusiveWorker(ewc *exclusiveWorkerConfig) *exclusiveWorker {
 	ew := &exclusiveWorker{
-		client:         ewc.client,
-		key:            ewc.key,
-		sessionTimeout: ewc.sessionTimeout,
+		client:          ewc.client,
+		renewClient:     ewc.renewClient,
+		key:             ewc.key,
+		sessionTimeout:  ewc.sessionTimeout,
+		state:           StateIdle,
+		onTransition:    ewc.onTransition,
+		adaptiveRenewal: ewc.adaptiveRenewal,
+		onEvent:         ewc.onEvent,
+		lostCooldown:    ewc.lostCooldown,
+		verifyInterval:  ewc.verifyInterval,
+		advertiseAddr:   ewc.advertiseAddr,
+		serviceID:       ewc.serviceID,
+		strategy:        ewc.strategy,
+		leaseMargin:     ewc.leaseMargin,
+		fireEvents:      ewc.fireEvents,
+		window:          ewc.window,
+		preflight:       ewc.preflight,
+		verifyAcquire:   ewc.verifyAcquire,
+		statusFile:      ewc.statusFile,
+		cipher:          ewc.cipher,
+		codec:           ewc.codec,
+		chunkShared:     ewc.chunkShared,
+		sessionNode:     ewc.sessionNode,
+		afterWork:       ewc.afterWork,
+		degraded:        ewc.degraded,
+		rerunInterval:   ewc.rerunInterval,
+		exitIfIdle:      ewc.exitIfIdle,
+		announce:        ewc.announce,
+		quiet:           ewc.quiet,
+		keepSession:     ewc.keepSession,
+		session:         ewc.session,
+		eventLog:        ewc.eventLog,
+		watchControl:    ewc.watchControl,
+		maintenanceKey:  ewc.maintenanceKey,
+		generation:      ewc.generation,
+		clock:           ewc.clock,
+		retryBudget:     ewc.retryBudget,
+		snapshot:        ewc.snapshot,
+		onElected:       ewc.onElected,
+		recordLastRun:   ewc.recordLastRun,
+		skipIfFresh:     ewc.skipIfFresh,
+		publishResults:  ewc.publishResults,
+		labels:          ewc.labels,
+		lockDelay:       ewc.lockDelay,
+		preconditions:   ewc.preconditions,
+		leaderElection:  ewc.leaderElectionRecord,
+		leaseHint:       ewc.leaseHint,
+		localFallback:   ewc.localFallback,
+		fallbackAfter:   ewc.localFallbackAfter,
+		limit:           ewc.limit,
+		limitWeight:     ewc.limitWeight,
+		engine:          ewc.engine,
+		flapThreshold:   ewc.flapThreshold,
+		flapWindow:      ewc.flapWindow,
+		flapFreeze:      ewc.flapFreeze,
+		policy:          ewc.policy,
+		leases:          map[*leaseContext]struct{}{},
+		stats:           &renewalStats{},
+		metrics:         newLockMetrics(ewc.key),
+		watchHealth:     newBrownout(),
+		history:         &eventHistory{},
+		exports:         newLeaderExports(ewc.registerer, ewc.leaderCollectors),
+		closed:          make(chan struct{}),
+		ttlChanged:      make(chan struct{}, 1),
+	}
+	if ew.strategy == nil {
+		ew.strategy = simpleStrategy{}
+	}
+	if ew.policy != nil {
+		ew.strategy = policyStrategy{Strategy: ew.strategy, policy: ew.policy}
+		ew.watchTransitions(ew.policyOnTransition)
+	}
+	if ew.fallbackAfter <= 0 {
+		ew.fallbackAfter = defaultLocalFallbackAfter
+	}
+	if ew.limit != nil {
+		if ew.limitWeight <= 0 {
+			ew.limitWeight = 1
+		}
+		ew.watchTransitions(ew.releaseSlotsOnTransition)
+	}
+	if ew.clock == nil {
+		ew.clock = systemClock{}
+	}
+	ew.maintenance = newWatchedKey(ew.maintenanceKey, "maintenance flag", ew.onMaintenance)
+	ew.preferredGen = newWatchedKey(generationKey(ew.key), "preferred generation", ew.onPreferredGeneration)
+	if ew.renewClient == nil {
+		ew.renewClient = ew.client
+	}
+	if ew.session != nil {
+		ew.sessionTimeout = ew.session.ttl
+	}
+	setKeyLabels(ew.key, ew.labels)
+	if len(ew.labels) > 0 {
+		ew.metrics.vars.Set("labels", expvar.Func(func() interface{} { return ew.Labels() }))
+	}
+	ew.tally = &leadershipTally{startedAt: ew.clock.Now()}
+	ew.watchTransitions(ew.recordTransition)
+	ew.watchTransitions(ew.tallyOnTransition)
+	if ew.eventLog != nil {
+		ew.watchTransitions(ew.logTransitionOnTransition)
+	}
+	if ew.leaderElection {
+		ew.watchTransitions(ew.leaderElectionOnTransition)
+	}
+	if ew.leaseHint {
+		ew.watchTransitions(ew.leaseHintOnTransition)
+	}
+	if ew.serviceID != "" {
+		ew.watchTransitions(ew.tagLeaderOnTransition)
+	}
+	if ew.fireEvents {
+		ew.watchTransitions(ew.fireLeaderEventOnTransition)
+	}
+	if ew.window != nil {
+		ew.watchTransitions(ew.resignAtWindowClose)
+	}
+	if ew.statusFile != "" {
+		ew.watchTransitions(ew.writeStatusOnTransition)
+	}
+	ew.watchTransitions(ew.recordLossOnTransition)
+	ew.watchTransitions(ew.exportOnTransition)
+	if ew.flapThreshold > 0 {
+		ew.watchTransitions(ew.auditOnTransition)
+	}
+	if ew.watchControl {
+		ew.watchTransitions(ew.watchControlOnTransition)
 	}
 	return ew
 }
 
+// State returns the current leadership state of the worker
+func (ec *exclusiveWorker) State() State {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.state
+}
+
+// transition moves the worker to a new state. It fails if the transition
+// is not allowed, that way methods can not be called in the wrong order.
+// It must be called with ec.mu held.
+func (ec *exclusiveWorker) transition(to State) error {
+	from := ec.state
+	if !canTransition(from, to) {
+		return &TransitionError{From: from, To: to}
+	}
+	ec.state = to
+	if to == StateHeld {
+		ec.heldSince = ec.clock.Now()
+	}
+	if to == StateLost || to == StateReleased {
+		// We are not leader anymore, the work contexts are over
+		for c := range ec.leases {
+			c.cancel(context.Canceled)
+		}
+	}
+	t := Transition{From: from, To: to, At: ec.clock.Now(), LeadershipID: ec.leadershipID}
+	if (from == StateHeld || from == StateDraining) && (to == StateLost || to == StateReleased) {
+		t.Reason, t.Detail = ec.lossReason, ec.lossDetail
+		if to == StateReleased {
+			t.Reason = LossResigned
+		}
+		ec.lossReason, ec.lossDetail = "", ""
+	}
+	ec.pending = append(ec.pending, t)
+	return nil
+}
+
+// unlock releases ec.mu and then sends the pending transitions to onTransition
+// and the watchers. The callbacks are never called with the mutex held so they can
+// call back into the worker.
+func (ec *exclusiveWorker) unlock() {
+	pending := ec.pending
+	ec.pending = nil
+	watchers := ec.watchers
+	ec.mu.Unlock()
+
+	for _, t := range pending {
+		if ec.onTransition != nil {
+			ec.onTransition(t)
+		}
+		for _, w := range watchers {
+			w.fn(t)
+		}
+	}
+}
+
+// transitionWatcher is a callback added with watchTransitions. Funcs can not be
+// compared, its pointer identifies it to remove it
+type transitionWatcher struct {
+	fn func(Transition)
+}
+
+// watchTransitions adds a callback called on every state transition, after onTransition.
+// The returned func removes it, for callbacks that only live as long as a leadership.
+func (ec *exclusiveWorker) watchTransitions(fn func(Transition)) (unwatch func()) {
+	w := &transitionWatcher{fn: fn}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.watchers = append(ec.watchers, w)
+	return func() {
+		ec.mu.Lock()
+		defer ec.mu.Unlock()
+		// A new slice, unlock may be iterating over the old one
+		watchers := make([]*transitionWatcher, 0, len(ec.watchers))
+		for _, other := range ec.watchers {
+			if other != w {
+				watchers = append(watchers, other)
+			}
+		}
+		ec.watchers = watchers
+	}
+}
+
 // Step1: Create session
 // createSession creates a session in consul with especified TTL and behavior set to delete
+// The consul calls are made without ec.mu, so State() and the like do not wait for
+// them: if the worker was closed or gave up contending meanwhile, the new session
+// is destroyed.
 func (ec *exclusiveWorker) createSession() error {
 	// You can call session.Destroy on the old session ID
 	// that has acquired the Key. This will cause the session behavior to trigger - e.g.
 	// if the behavior is set to delete the key will be deleted.
 	// This is the same as the session expiring normally.
+	ec.mu.Lock()
+	select {
+	case <-ec.closed:
+		ec.unlock()
+		return ErrClosed
+	default:
+	}
+	preflight := ec.preflight && !ec.preflightDone
+	ec.unlock()
+	// Fail fast on a token without the permissions we need, before contending
+	if preflight {
+		if err := checkPermissions(ec.client, ec.key); err != nil {
+			return err
+		}
+	}
+
+	ec.mu.Lock()
+	if preflight {
+		ec.preflightDone = true
+	}
+	if err := ec.transition(StateAcquiring); err != nil {
+		ec.unlock()
+		return err
+	}
+	ec.contendAt = ec.clock.Now()
+	ec.leadershipID = ""
+	ec.lockInfo = LockInfo{}
+	shared, kept := ec.session, ec.sessionID
 	sessinConf := &api.SessionEntry{
-		TTL:      ec.sessionTimeout,
-		Behavior: "delete",
+		TTL:       ec.sessionTimeout,
+		Behavior:  "delete",
+		Node:      ec.sessionNode,
+		LockDelay: ec.lockDelay,
 	}
+	ec.unlock()
 
-	sessionID, _, err := ec.client.Session().Create(sessinConf, nil)
+	var sessionID string
+	var err error
+	switch {
+	case shared != nil:
+		sessionID, err = shared.get()
+	case kept != "":
+		// Kept by a release, reuse it if it is still alive
+		if entry, _, err := ec.client.Session().Info(kept, nil); err == nil && entry != nil {
+			sessionID = kept
+		}
+	}
+	created := false
+	if shared == nil && sessionID == "" {
+		start := ec.clock.Now()
+		sessionID, _, err = ec.client.Session().Create(sessinConf, nil)
+		ec.metrics.observeConsul(opSessionCreate, ec.since(start), err)
+		created = err == nil
+	}
+
+	ec.mu.Lock()
+	closed := false
+	select {
+	case <-ec.closed:
+		closed = true
+	default:
+	}
+	if closed || ec.state != StateAcquiring {
+		// Closed, or the contention was given up while we waited for consul
+		state := ec.state
+		ec.unlock()
+		if created {
+			ec.destroyWithRetries(sessionID, "")
+		}
+		if closed {
+			return ErrClosed
+		}
+		return &StateError{Op: "create session", State: state}
+	}
 	if err != nil {
+		ec.sessionID = ""
+		ec.transition(StateLost)
+		ec.unlock()
 		return err
 	}
-
-	fmt.Println("sessionID:", sessionID)
 	ec.sessionID = sessionID
+	ec.unlock()
+
+	if created && !ec.quiet {
+		fmt.Println("sessionID:", sessionID)
+	}
+	// A kept session left the queue with its last leadership, see leaveQueue
+	if ec.announce && (created || kept != "" && sessionID == kept) {
+		// fair-queue and priority register again, with their priority
+		if err := ec.registerContender(sessionID, contenderInfo{}); err != nil {
+			logWithID(ec.key, "", "Could not register as contender: %s", err)
+		}
+	}
 	return nil
 }
 
 // step2: Acquire Session
 // acquireSession basically creates the mutual exclusion lock
+// Like createSession it does not hold ec.mu while talking to consul. A key acquired
+// while the session was destroyed or released meanwhile is given back.
 func (ec *exclusiveWorker) acquireSession() (bool, error) {
+	ec.mu.Lock()
+	if ec.sessionID == "" {
+		ec.unlock()
+		return false, ErrNoSession
+	}
+	if ec.state != StateAcquiring {
+		state := ec.state
+		ec.unlock()
+		return false, &StateError{Op: "acquire", State: state}
+	}
+	if !ec.window.open(ec.clock.Now()) {
+		ec.unlock()
+		return false, ErrOutsideWindow
+	}
+	sessionID := ec.sessionID
 	KVpair := &api.KVPair{
 		Key:     ec.key,
-		Value:   []byte(ec.sessionID),
-		Session: ec.sessionID,
+		Value:   ec.holderValue(sessionID),
+		Session: sessionID,
+	}
+	ec.unlock()
+	if err := checkValueSize(ec.key, KVpair.Value); err != nil {
+		return false, err
 	}
 
+	acquireStart := ec.clock.Now()
 	aquired, _, err := ec.client.KV().Acquire(KVpair, nil)
-	return aquired, err
+	ec.metrics.observeConsul(opAcquire, ec.since(acquireStart), err)
+	if err != nil {
+		ec.metrics.errors.Add(1)
+		return false, err
+	}
+	if !aquired {
+		ec.metrics.contended.Add(1)
+		return false, nil
+	}
+
+	var info LockInfo
+	if ec.verifyAcquire {
+		info, err = ec.readLockInfo()
+		if err != nil {
+			logWithID(ec.key, "", "could not read epoch: %s", err)
+		} else if info.Session != sessionID {
+			// Consul said yes but the key is not ours, don't trust either answer
+			ec.metrics.acquireMismatch.Add(1)
+			ec.metrics.errors.Add(1)
+			return false, fmt.Errorf("%w: acquired key %s but it is held by session %q, we are %q", ErrSplitBrain, ec.key, info.Session, sessionID)
+		}
+	}
+
+	ec.mu.Lock()
+	if ec.state != StateAcquiring || ec.sessionID != sessionID {
+		// Given up while we acquired, a shared or kept session would keep the key
+		state := ec.state
+		ec.unlock()
+		ec.client.KV().Release(&api.KVPair{Key: ec.key, Session: sessionID}, nil)
+		return false, &StateError{Op: "acquire", State: state}
+	}
+	defer ec.unlock()
+	ec.metrics.acquired.Add(1)
+	ec.metrics.acquireWait.observe(ec.since(ec.contendAt))
+
+	// We are leaders. Tag this leadership so its logs and events can be correlated
+	ec.lockInfo = info
+	ec.leadershipID, err = newLeadershipID(ec.lockInfo.LockIndex)
+	if err != nil {
+		return true, err
+	}
+	ec.resignCh = make(chan struct{})
+	ec.degradedCh, ec.isDegraded = make(chan struct{}), false
+	if ttl, err := time.ParseDuration(ec.sessionTimeout); err == nil {
+		ec.renewedLocked(acquireStart, ttl)
+	}
+	return true, ec.transition(StateHeld)
 }
 
 // We need to renew the session because the TTL will destroy
 // the session if its not renewed and the task is taking too long
-// RenewPeriodic renews the session each sessionTimeout/2 as indicated in the code of the client.
+// renewLoop renews the session each sessionTimeout/2 like RenewPeriodic in the code of the client,
+// or faster if adaptiveRenewal is set and consul is slow.
 // https://github.com/hashicorp/consul/blob/e3cabb3a261d9583393aec99ef50bbfc666128b9/api/session.go#L148
 // renewSession takes a channel that we later use (by closing it) to signal that no more renewals are necessary
+// doneChan can be nil, Close() also stops the renewals.
+// If the renewal fails the session is gone and so is our lock, so the worker moves to Lost.
 func (ec *exclusiveWorker) renewSession(doneChan <-chan struct{}) error {
-	err := ec.client.Session().RenewPeriodic(ec.sessionTimeout, ec.sessionID, nil, doneChan)
+	ec.mu.Lock()
+	if ec.sessionID == "" {
+		ec.unlock()
+		return ErrNoSession
+	}
+	if ec.state != StateHeld {
+		state := ec.state
+		ec.unlock()
+		return &StateError{Op: "renew", State: state}
+	}
+	if ec.renewing {
+		ec.unlock()
+		return ErrAlreadyRenewing
+	}
+	if ec.resignCh == nil {
+		// Resign was called before the renewals started
+		ec.unlock()
+		return nil
+	}
+	select {
+	case <-ec.closed:
+		// Close may already be waiting for the renewals, do not start one
+		ec.unlock()
+		return ErrClosed
+	default:
+	}
+	ec.renewing = true
+	ec.wg.Add(1)
+	defer ec.wg.Done()
+	sessionID := ec.sessionID
+	resignCh := ec.resignCh
+	ec.unlock()
+
+	// Stop renewing when the caller closes doneChan, we resign or the worker is closed
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-doneChan:
+		case <-resignCh:
+		case <-ec.closed:
+		case <-finished:
+		}
+		close(stop)
+	}()
+
+	// The lock is not held while renewing, renewLoop blocks until stop is closed
+	err := ec.renewLoop(sessionID, stop)
+	var reason LossReason
+	if err != nil {
+		reason = ec.classifyLoss(ec.currentSession(), err)
+	}
+
+	ec.mu.Lock()
+	defer ec.unlock()
+	ec.renewing = false
 	if err != nil {
+		ec.lossReason, ec.lossDetail = reason, err.Error()
+		ec.transition(StateLost)
 		return err
 	}
 	return nil
 }
 
 // destroySession destroys the session by triggering the behavior. So it will delete de Key as well
+// If we were holding the lock we go through Draining before Released. If the lock
+// was already lost we still try to destroy the session but stay in Lost.
+// Consul errors are retried for up to destroyTimeout (see destroyWithRetries).
+// With keepSession (or after Release) the key is released instead and the session
+// kept for the next leadership; a kept session is destroyed by the next call.
+// A shared session is never destroyed, the key is released. A handover taken by
+// writeHandover is written in the transaction that releases the key.
+// The transitions are made under ec.mu, the consul calls after releasing it.
 func (ec *exclusiveWorker) destroySession() error {
-	_, err := ec.client.Session().Destroy(ec.sessionID, nil)
+	ec.mu.Lock()
+	keep := (ec.keepSession || ec.releaseOnly || ec.session != nil) && ec.state == StateHeld
+	ec.releaseOnly = false
+	var handover *api.KVTxnOp
+	if h := ec.handover; h != nil && h.leadershipID == ec.leadershipID && ec.state == StateHeld {
+		handover = h.op
+	}
+	ec.handover = nil
+	sessionID, leadershipID, shared := ec.sessionID, ec.leadershipID, ec.session != nil
+	if ec.state == StateReleased {
+		ec.unlock()
+		if sessionID == "" {
+			return ErrSessionDestroyed
+		}
+		// Kept by a release, nobody needs it anymore. A shared session is not ours to destroy
+		if !shared {
+			if err := ec.destroyWithRetries(sessionID, leadershipID); err != nil {
+				return err
+			}
+		}
+		ec.forgetSession(sessionID)
+		return nil
+	}
+	if sessionID == "" {
+		ec.unlock()
+		return ErrNoSession
+	}
+	if ec.state == StateHeld {
+		if err := ec.transition(StateDraining); err != nil {
+			ec.unlock()
+			return err
+		}
+	}
+	if ec.state != StateLost {
+		if err := ec.transition(StateReleased); err != nil {
+			ec.unlock()
+			return err
+		}
+	}
+	var value []byte
+	if handover != nil {
+		value = ec.holderValue(sessionID)
+	}
+	ec.unlock()
+
+	if handover != nil {
+		// A graceful release: the handover and the release in one transaction
+		err := ec.releaseWithHandover(sessionID, value, handover)
+		switch {
+		case err == nil && keep:
+			ec.leaveQueue(sessionID, leadershipID)
+			return nil
+		case err == nil, errors.Is(err, ErrNotHeld):
+			// Released (or lost), the session has nothing left to delete
+		default:
+			logWithID(ec.key, leadershipID, "Could not release with the handover, it is lost: %s", err)
+			if keep {
+				return ec.releaseKept(sessionID, leadershipID)
+			}
+		}
+	} else if keep {
+		return ec.releaseKept(sessionID, leadershipID)
+	}
+	if shared {
+		// Lost, the shared session is gone or not ours to destroy
+		ec.forgetSession(sessionID)
+		return nil
+	}
+
+	err := ec.destroyWithRetries(sessionID, leadershipID)
 	if err != nil {
 		erroMsg := fmt.Sprintf("ERROR cannot delete key %s: %s", ec.key, err)
 		return errors.New(erroMsg)
 	}
 
+	ec.forgetSession(sessionID)
 	return nil
 }
 
+// forgetSession clears the session ID once it is destroyed, unless a new session
+// replaced it meanwhile
+func (ec *exclusiveWorker) forgetSession(sessionID string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.sessionID == sessionID {
+		ec.sessionID = ""
+	}
+}
+
+// Resign gives up the leadership without closing the worker: the renewal loop stops,
+// which cancels the work context, and the caller (RunElected or main) destroys the session.
+// It does nothing if we are not leader.
+func (ec *exclusiveWorker) Resign() {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.state == StateHeld && ec.resignCh != nil {
+		close(ec.resignCh)
+		ec.resignCh = nil
+	}
+}
+
+// Release gives up the leadership like Resign, but the key is given back with a KV
+// release instead of destroying the session, as if keepSession was set for this
+// leadership. It does nothing if we are not leader.
+func (ec *exclusiveWorker) Release() {
+	ec.mu.Lock()
+	if ec.state == StateHeld {
+		ec.releaseOnly = true
+	}
+	ec.mu.Unlock()
+	ec.Resign()
+}
+
+// Close stops the renewal loop and destroys the session, a kept one too. It is safe
+// to call multiple times and from multiple goroutines, only the first call does the
+// cleanup and the others return the same result. This makes exclusiveWorker an io.Closer
+// so it can simply be deferred.
+func (ec *exclusiveWorker) Close() error {
+	ec.closeOnce.Do(func() {
+		// Closed under the lock, so nothing joins ec.wg once we wait for it
+		ec.mu.Lock()
+		close(ec.closed)
+		ec.mu.Unlock()
+		ec.wg.Wait()
+
+		err := ec.destroySession()
+		if err == nil && ec.currentSession() != "" {
+			// A session kept by keepSession (or Release) was only released, nobody
+			// reuses it once we are closed
+			err = ec.destroySession()
+		}
+		if errors.Is(err, ErrNoSession) || errors.Is(err, ErrSessionDestroyed) {
+			// Nothing to clean up
+			err = nil
+		}
+		ec.closeErr = err
+	})
+	return ec.closeErr
+}
+
+// consulAddress is the address of the local consul agent
+const consulAddress = "localhost:8500"
+
+// exitIdle is the exit code with -exit-if-idle, so schedulers can tell it from a failure
+const exitIdle = 3
+
 func main() {
+	args := os.Args[1:]
+	// daemon supervises many jobs described in a file, see runDaemon
+	if len(args) > 0 && args[0] == "daemon" {
+		os.Exit(runDaemon(args[1:]))
+	}
+	// status shows who holds a key and who is waiting for it, see runStatus
+	if len(args) > 0 && args[0] == "status" {
+		os.Exit(runStatus(args[1:]))
+	}
+	// last-run tells when the work under a key last ran fine, see runLastRun
+	if len(args) > 0 && args[0] == "last-run" {
+		os.Exit(runLastRun(args[1:]))
+	}
+	// monitor alerts when nobody holds a key for too long, see runMonitor
+	if len(args) > 0 && args[0] == "monitor" {
+		os.Exit(runMonitor(args[1:]))
+	}
+	// bench measures the failover latency, see runBench
+	if len(args) > 0 && args[0] == "bench" {
+		os.Exit(runBench(args[1:]))
+	}
+	// doctor diagnoses the environment of the workers of a key, see runDoctor
+	if len(args) > 0 && args[0] == "doctor" {
+		os.Exit(runDoctor(args[1:]))
+	}
+	// generation makes the leadership follow a deploy, see runGeneration
+	if len(args) > 0 && args[0] == "generation" {
+		os.Exit(runGeneration(args[1:]))
+	}
+	// shards spreads the shards of a prefix over the instances running it, see runShards
+	if len(args) > 0 && args[0] == "shards" {
+		os.Exit(runShards(args[1:]))
+	}
+	// shared prints the shared state published by the leaders of a key, see runShared
+	if len(args) > 0 && args[0] == "shared" {
+		os.Exit(runShared(args[1:]))
+	}
+	// replay tells what the workers believed from their event logs, see runReplay
+	if len(args) > 0 && args[0] == "replay" {
+		os.Exit(runReplay(args[1:]))
+	}
+	os.Exit(run(args))
+}
+
+// run is the worker command: it contends for the key and works while leader, and
+// returns the exit code. Only main exits, so the deferred cleanups (pidfile, hooks,
+// event log, webhooks, output) run whatever the outcome.
+func run(args []string) int {
+	// validate checks the configuration and exits, for CI before deploying:
+	//   mutual-exclusion-consul validate -config prod.env
+	validate := len(args) > 0 && args[0] == "validate"
+	if validate {
+		args = args[1:]
+	}
 
-	client, err := api.NewClient(&api.Config{Address: "localhost:8500"})
+	// The key can be built from a template so many similar jobs don't need hand-built keys.
+	// Every value can come from a flag, the environment or a file, see loadConfig.
+	configFile := flag.String("config", "", "file of MUTEX_*=value lines, flags and the environment win over it")
+	watchConfig := flag.Bool("watch-config", false, "reload the configuration when the -config file changes, like the reload signals do")
+	keyTemplate := flag.String("key-template", defaultKeyTemplate, "template of the lock key")
+	// Inside Nomad the job name and the timeout in the job meta are used by default
+	defaultService, defaultTTL := "bobruner", "15s"
+	if name := nomadJobName(); name != "" {
+		defaultService = name
+	}
+	if ttl := nomadTTL(); ttl != "" {
+		defaultTTL = ttl
+	}
+	service := flag.String("service", defaultService, "service name used in the key template as {{.Service}}")
+	env := flag.String("env", "", "environment used in the key template as {{.Env}}")
+	namespace := flag.String("namespace", "", "root prefix for all the keys")
+	// Run-command mode: anything after the flags is the command to run while leader
+	//   mutual-exclusion-consul -notify=signal -- ./nightly-job.sh
+	notify := flag.String("notify", notifyNone, "how to tell the command about leadership: fd or signal")
+	signalInterval := flag.Duration("signal-interval", 5*time.Second, "how often SIGUSR1 is sent to the command with -notify=signal")
+	killGrace := flag.Duration("kill-grace", 10*time.Second, "how long the command has to stop after leadership is lost")
+	captureOutput := flag.Bool("capture-output", false, "timestamp the lines of the command and tag them with the leadership ID")
+	outputFile := flag.String("output-file", "", "also write the captured output of the command to this file, rotated at -output-max-size")
+	outputMaxSize := flag.Int64("output-max-size", 100, "size in MB at which -output-file is rotated, 0 disables the rotation")
+	outputSyslog := flag.Bool("output-syslog", false, "also send the captured output of the command to syslog")
+	elect := flag.Bool("elect", false, "keep contending for the lock forever instead of giving up when someone else has it")
+	advertise := flag.String("advertise", "", "host:port published as the leader address, use :port to detect the host")
+	serviceID := flag.String("service-id", "", "ID of our service in the local consul agent, the leader tags it with \"leader\"")
+	strategyName := flag.String("strategy", "simple", "with -elect, election strategy: simple, fair-queue, priority or sticky")
+	priority := flag.Int("priority", 0, "priority of this contender with -strategy=priority, the highest wins")
+	identity := flag.String("identity", "", "stable identity of this contender with -strategy=sticky (default hostname)")
+	headStart := flag.Duration("head-start", 30*time.Second, "how long the previous leader has to reclaim the lock with -strategy=sticky")
+	verifyInterval := flag.Duration("verify-interval", 0, "how often the leader checks in consul that it still owns the key, 0 disables it")
+	exitSignals := flag.String("exit-signals", defaultExitSignals, "signals that resign and exit")
+	resignSignals := flag.String("resign-signals", defaultResignSignals, "signals that resign without exiting")
+	reloadSignals := flag.String("reload-signals", defaultReloadSignals, "signals that reload the configuration")
+	degraded := flag.String("degraded", string(degradedGrace), "what the leader does when renewals fail but the session may still be alive: fail-fast (stop the work), grace (keep working until the lease deadline) or read-only (like grace, the work is told to stop writing)")
+	afterWork := flag.String("after-work", string(afterWorkRelease), "what to do when the work finishes while we are leader: release, hold (until we exit or lose the lock) or rerun")
+	rerunInterval := flag.Duration("rerun-interval", time.Minute, "with -after-work=rerun, how long to wait before running the work again")
+	exitIfIdle := flag.Duration("exit-if-idle", 0, fmt.Sprintf("with -elect, exit with code %d if we are not leader for that long, e.g. to give back spot instances", exitIdle))
+	lostCooldown := flag.Duration("lost-cooldown", 0, "with -elect, how long to wait before contending again after losing the leadership")
+	onAcquire := flag.String("on-acquire", "", "shell command run when we get the lock")
+	onRenewFailure := flag.String("on-renew-failure", "", "shell command run when a renewal fails")
+	onLost := flag.String("on-lost", "", "shell command run when the leadership is lost")
+	onRelease := flag.String("on-release", "", "shell command run when we give the lock back")
+	windowSpec := flag.String("window", "", "daily HH:MM-HH:MM window (local time) outside of which we do not contend and resign")
+	fireEvents := flag.Bool("fire-events", false, "fire a leader-changed:<key> consul user event when we acquire or release the lock")
+	webhooks := flag.String("webhooks", "", "comma separated URLs notified when the leadership moves (Slack incoming webhooks work)")
+	pidfilePath := flag.String("pidfile", "", "file with our pid while we hold the lock, another instance with the same pidfile refuses to start")
+	encryptionKey := flag.String("encryption-key", "", "base64 AES key (16, 24 or 32 bytes) to encrypt the values we write to the KV")
+	codecName := flag.String("codec", codecJSON, "encoding of the holder metadata, shared state, handover and results: json, msgpack or protobuf. The readers detect it")
+	globalDC := flag.String("global-dc", "", "with -elect, DC of the global lock for multi-DC failover: we only work while holding the local and the global lock")
+	globalKey := flag.String("global-key", "", "key of the global lock in -global-dc (default <key>/global)")
+	quorumAddrs := flag.String("quorum", "", "with -elect, comma separated addresses of 3 or more independent consul clusters: we are leader while holding the key in a majority")
+	quorumBudget := flag.Duration("quorum-budget", 5*time.Second, "how long acquiring a majority of -quorum can take")
+	introspect := flag.String("introspect", "", "unix socket (or tcp:host:port) where co-located processes can ask if we hold the key and until when")
+	debugToken := flag.String("debug-token", "", "with -introspect, serve pprof and the internal state on it to requests with this bearer token")
+	grpcHealth := flag.String("grpc-health", "", "host:port where the gRPC health service reports the health of the worker")
+	proxy := flag.String("proxy", "", "host:port where the requests are served by -proxy-upstream while we are leader and forwarded to the -advertise address of the leader otherwise")
+	proxyUpstream := flag.String("proxy-upstream", "", "with -proxy, URL of the server of the command, e.g. http://127.0.0.1:8081")
+	statusFile := flag.String("status-file", "", "JSON file replaced with the worker status on every state change")
+	preflight := flag.Bool("preflight", true, "check the consul token permissions before contending")
+	verifyAcquire := flag.Bool("verify-acquire", true, "read the key back after acquiring it and check our session holds it. Disable it to save a round trip, the epoch is then unknown")
+	maintenanceKey := flag.String("maintenance-key", defaultMaintenanceKey, "key, inside -namespace, that pauses contending while set, with the value resign leaders resign too. Empty disables it")
+	generation := flag.String("generation", "", "deploy generation of this worker (e.g. blue or green, a release): while the generation command prefers another one we don't contend, and resign after draining if leader")
+	watchControl := flag.Bool("control", false, "step down when step-down is written to <key>/control")
+	registerContender := flag.Bool("register-contender", true, "register under <key>/contenders/ while contending, for the status command")
+	eventLogPath := flag.String("event-log", "", "file where every transition and event is appended as JSON, for the replay command")
+	keepSession := flag.Bool("keep-session", false, "give the key back with a KV release instead of destroying the session, and reuse the session for the next leadership")
+	recordLastRun := flag.Bool("record-last-run", false, "record in <key>/last-run when the work last returned fine, for the last-run command")
+	skipIfFresh := flag.Duration("skip-if-fresh", 0, "without -elect, do not work if the last recorded run is newer than this, e.g. when many nodes run the same cron. Implies -record-last-run")
+	publishResult := flag.Bool("publish-result", false, "give the command the result of the previous run in MUTEX_PREVIOUS_RESULT and publish what it writes to the file in MUTEX_RESULT_FILE under <key>/results/, e.g. the offset to resume from")
+	labelSpec := flag.String("labels", "", "comma separated name=value labels (team, service...) added to the logs, metrics, events and lock value")
+	lockDelay := flag.Duration("lock-delay", 0, "how long consul keeps the key from being acquired after our session was lost, 0 keeps the consul default (15s). Measure it with the bench command")
+	precondition := flag.String("precondition", "", "shell command that must exit with 0 before we contend and right after we get the lock, or we give it back (e.g. pg_isready)")
+	policyFile := flag.String("policy", "", "Starlark script deciding whether to contend and to resign and what metadata to publish, with the cluster state as input")
+	k8sRecord := flag.Bool("k8s-record", false, "keep a Kubernetes LeaderElectionRecord in <key>/leader-election while leader, for tools built for Kubernetes leader election")
+	leaseHint := flag.Bool("lease-hint", false, "keep the TTL and last renewal of our session in <key>/lease while leader, so observers can tell when the lease expires")
+	localFallback := flag.String("local-fallback", "", "file locked while working, so the processes of this host never work at the same time, even when consul is unreachable: with -elect one of them then works holding only this lock. Other hosts are NOT kept out")
+	localFallbackAfter := flag.Duration("local-fallback-after", defaultLocalFallbackAfter, "how long consul must be unreachable before -local-fallback kicks in")
+	reportFile := flag.String("report-file", "", "file where a JSON summary of the run (leadership time, renewals, exit reason...) is written on exit, it is always printed on stderr")
+	engine := flag.String("engine", engineSession, "session, or api-lock to be elected by consul's api.Lock (its session, renewals and monitor) instead of our own sessions. api-lock only does the election, every contender of a key must use the same engine")
+	flapThreshold := flag.Int("flap-threshold", 0, "with -elect, more leadership changes than this in -flap-window is flapping: the cooldowns are extended and a flapping event is raised. 0 disables it")
+	flapWindow := flag.Duration("flap-window", defaultFlapWindow, "how far back the leadership changes are counted for -flap-threshold")
+	flapFreeze := flag.Bool("flap-freeze", false, "when the leadership flaps, freeze contention until an operator deletes <key>/audit/frozen. The leader keeps working")
+	backend := flag.String("backend", backendConsul, "consul, or memory to simulate consul in the process (sessions, locks, events...), to try the leadership behavior without a consul binary")
+	ttl := flag.String("ttl", defaultTTL, "TTL of the session, between 10s and 24h")
+	adaptiveRenewal := flag.Bool("adaptive-renewal", true, "renew more often than every TTL/2 while the renewals are slow or failing. Disable it to renew like the consul client")
+	renewTimeout := flag.Duration("renew-timeout", defaultRenewTimeout, "timeout of the session renewals, made on connections of their own so slow blocking queries or a saturated pool can not delay them. It must be under half the TTL. 0 renews over the connections of the other requests")
+	// completion writes the shell completions, it needs the flags above, see runCompletion
+	if len(args) > 0 && args[0] == "completion" {
+		return runCompletion(args[1:], flag.CommandLine)
+	}
+	cfg, err := loadConfig(flag.CommandLine, args, configFile)
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return 1
 	}
 
-	workerConf := &exclusiveWorkerConfig{
-		client:         client,
-		key:            "service/bobruner/leader",
-		sessionTimeout: "15s",
+	if *identity == "" {
+		*identity, _ = os.Hostname()
+	}
+	strategy, strategyErr := newStrategy(strategyConfig{
+		name:      *strategyName,
+		priority:  *priority,
+		identity:  *identity,
+		headStart: *headStart,
+	})
+	window, windowErr := parseWindow(*windowSpec)
+	cipher, cipherErr := newCipher(*encryptionKey)
+	valueCodec, codecErr := lookupCodec(*codecName)
+	labels, labelsErr := parseLabels(*labelSpec)
+	var policy *Policy
+	var policyErr error
+	if *policyFile != "" {
+		policy, policyErr = LoadPolicy(*policyFile)
+	}
+	var watchConfigErr error
+	if *watchConfig && *configFile == "" {
+		watchConfigErr = errors.New("there is no config file to watch")
+	}
+	signals := signalConfig{}
+	var signalsErr error
+	// Not a map keyed by the flags: two flags with the same signals would be one entry,
+	// and add would never see the conflict
+	for _, s := range []struct {
+		names  string
+		action signalAction
+	}{{*exitSignals, actionExit}, {*resignSignals, actionResign}, {*reloadSignals, actionReload}} {
+		if err := signals.add(s.names, s.action); err != nil && signalsErr == nil {
+			signalsErr = err
+		}
+	}
+	checks := []configCheck{
+		{setting: "ttl", what: "TTL " + *ttl, err: checkTTL(*ttl), hint: "set -ttl (MUTEX_TTL) to a duration like 15s"},
+		{setting: "renew-timeout", what: "renew timeout " + renewTimeout.String(), err: checkRenewTimeout(*renewTimeout, *ttl), hint: "set -renew-timeout to a few seconds, or 0 to renew over the main connections"},
+		{setting: "notify", what: fmt.Sprintf("notify mode %q", *notify), err: checkNotify(*notify), hint: "use -notify=fd or -notify=signal"},
+		{setting: "strategy", what: "election strategy " + *strategyName, err: strategyErr, hint: "use simple, fair-queue, priority or sticky"},
+		{setting: "window", what: fmt.Sprintf("window %q", *windowSpec), err: windowErr, hint: "use HH:MM-HH:MM, e.g. 02:00-03:00"},
+		{setting: "degraded", what: fmt.Sprintf("degraded policy %q", *degraded), err: checkDegraded(*degraded), hint: "use fail-fast, grace or read-only"},
+		{setting: "after-work", what: fmt.Sprintf("after-work policy %q", *afterWork), err: checkAfterWork(*afterWork), hint: "use release, hold or rerun"},
+		{setting: "labels", what: fmt.Sprintf("labels %q", *labelSpec), err: labelsErr, hint: "use name=value pairs, e.g. team=payments,env=prod"},
+		{setting: "policy", what: "policy " + *policyFile, err: policyErr, hint: "define should_contend, should_resign or metadata, each taking the state dict"},
+		{setting: "watch-config", what: "config watch", err: watchConfigErr, hint: "set -config (MUTEX_CONFIG) to the file to watch"},
+		{setting: "engine", what: "engine " + *engine, err: checkEngine(*engine), hint: "use session or api-lock"},
+		{setting: "flap-threshold", what: "flap damping", err: checkFlapDamping(*flapThreshold, *flapWindow, *flapFreeze), hint: "set -flap-threshold to the leadership changes allowed in -flap-window, e.g. 5 in 10m"},
+		{setting: "backend", what: "backend " + *backend, err: checkBackend(*backend), hint: "use consul or memory"},
+		{setting: "proxy", what: "leader proxy", err: checkLeaderProxy(*proxy, *proxyUpstream, *advertise), hint: "set -proxy-upstream to the server of the command and -advertise to the -proxy address the others reach us at"},
+		{setting: "local-fallback", what: "local fallback lock " + *localFallback, err: checkLocalFallback(*localFallback), hint: "use a writable file on a local filesystem, e.g. /run/lock/mutex"},
+		{what: "signals", err: signalsErr, hint: "use signal names like INT,TERM"},
+		{setting: "encryption-key", what: "encryption key", err: cipherErr, hint: "generate one with: head -c 32 /dev/urandom | base64"},
+		{setting: "codec", what: "codec " + *codecName, err: codecErr, hint: "use json, msgpack or protobuf"},
+	}
+	address := consulAddress
+	if *backend == backendMemory {
+		if address, err = serveMemoryConsul(); err != nil {
+			log.Println(err)
+			return 1
+		}
+		log.Printf("Simulating consul in memory on %s", address)
+	}
+	if validate {
+		cfg.dump(true)
+		return validateFlags(address, *keyTemplate, *service, *env, *namespace, checks)
+	}
+	for _, c := range checks {
+		if c.err != nil {
+			log.Println(cfg.checkError(c))
+			return 1
+		}
 	}
+	cfg.dump(false)
 
-	w := newExclusiveWorker(workerConf)
-	w.createSession()
+	key, err := lockKey(*keyTemplate, *service, *env, *namespace)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	maintenance, err := maintenanceKeyIn(*maintenanceKey, *namespace)
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return 1
 	}
-	defer w.destroySession()
+	pid, err := checkPidfile(*pidfilePath, key)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer pid.remove()
 
-	canWork, err := w.acquireSession()
+	consulConf := &api.Config{Address: address}
+	client, err := api.NewClient(consulConf)
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return 1
+	}
+	renewClient := client
+	if *renewTimeout > 0 {
+		if renewClient, err = newRenewalClient(*consulConf, *renewTimeout); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	advertiseAddr, err := detectAdvertiseAddr(client, *advertise)
+	if err != nil {
+		log.Println(err)
+		return 1
 	}
 
-	// We handle the signal interrupt in case the job is interrupted  by
-	// doing a Ctrl+C  in the terminal.
-	// This can also be seen on how to stop the task which was not implemented
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		<-c
-		log.Println("Job interrupted. Cleaning up")
-		err := w.destroySession()
+	hookCmds := &hooks{
+		key:          key,
+		acquire:      *onAcquire,
+		renewFailure: *onRenewFailure,
+		lost:         *onLost,
+		release:      *onRelease,
+	}
+	defer hookCmds.wait()
+	notifier := newWebhookNotifier(key, notifierHolder(advertiseAddr), *webhooks)
+	defer notifier.close()
+	var events *eventLog
+	if *eventLogPath != "" {
+		if events, err = openEventLog(*eventLogPath); err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer events.Close()
+	}
+
+	workerConf := &exclusiveWorkerConfig{
+		client:               client,
+		renewClient:          renewClient,
+		key:                  key,
+		sessionTimeout:       *ttl,
+		adaptiveRenewal:      *adaptiveRenewal,
+		lostCooldown:         *lostCooldown,
+		verifyInterval:       *verifyInterval,
+		advertiseAddr:        advertiseAddr,
+		serviceID:            *serviceID,
+		strategy:             strategy,
+		fireEvents:           *fireEvents,
+		window:               window,
+		preflight:            *preflight,
+		verifyAcquire:        *verifyAcquire,
+		statusFile:           *statusFile,
+		cipher:               cipher,
+		codec:                valueCodec,
+		afterWork:            afterWorkPolicy(*afterWork),
+		degraded:             degradedPolicy(*degraded),
+		rerunInterval:        *rerunInterval,
+		exitIfIdle:           *exitIfIdle,
+		announce:             *registerContender,
+		keepSession:          *keepSession,
+		eventLog:             events,
+		watchControl:         *watchControl,
+		maintenanceKey:       maintenance,
+		generation:           *generation,
+		recordLastRun:        *recordLastRun || *skipIfFresh > 0,
+		skipIfFresh:          *skipIfFresh,
+		publishResults:       *publishResult,
+		labels:               labels,
+		lockDelay:            *lockDelay,
+		leaderElectionRecord: *k8sRecord,
+		leaseHint:            *leaseHint,
+		engine:               *engine,
+		flapThreshold:        *flapThreshold,
+		flapWindow:           *flapWindow,
+		flapFreeze:           *flapFreeze,
+		localFallback:        *localFallback,
+		localFallbackAfter:   *localFallbackAfter,
+		policy:               policy,
+		onTransition: func(t Transition) {
+			if t.Reason != "" {
+				fmt.Printf("state: %s -> %s (leadership %s, %s)\n", t.From, t.To, t.LeadershipID, t.Reason)
+			} else {
+				fmt.Printf("state: %s -> %s (leadership %s)\n", t.From, t.To, t.LeadershipID)
+			}
+			hookCmds.onTransition(t)
+			notifier.onTransition(t)
+			pid.onTransition(t)
+		},
+		onEvent: func(e Event) {
+			fmt.Printf("event: %s %s\n", e.Kind, e.Detail)
+			hookCmds.onEvent(e)
+		},
+	}
+
+	if *precondition != "" {
+		workerConf.preconditions = []Precondition{CommandPrecondition(*precondition)}
+	}
+
+	w := newExclusiveWorker(workerConf)
+	defer w.Close()
+	if *introspect != "" {
+		if err := serveIntrospection(*introspect, *debugToken, w); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	if *grpcHealth != "" {
+		srv, err := serveGRPCHealth(*grpcHealth, w)
 		if err != nil {
-			log.Println("Could not destroy session")
+			log.Println(err)
+			return 1
 		}
-		os.Exit(0)
-	}()
+		defer srv.Stop()
+	}
+	if *proxy != "" {
+		p, err := serveLeaderProxy(w, *proxy, *proxyUpstream)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer p.Close()
+	}
 
-	// If we were able to lock the session that means we are leaders so we can start
-	// doing some work
-	if canWork {
-		fmt.Println("I can work. YAY!!!")
+	output, err := newOutputSink(key, *captureOutput, *outputFile, *outputMaxSize*1024*1024, *outputSyslog)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer output.Close()
 
-		doneChan := make(chan struct{})
-		go w.renewSession(doneChan) // We send renewSession() to its own go routine
+	reloader, err := newConfigReloader(flag.CommandLine, args, *configFile)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	// Only the settings that need no new session are reloaded, see reloadable
+	reload := func() {
+		reloader.reload(w, func(setting, value string) error {
+			switch setting {
+			case "labels":
+				labels, err := parseLabels(value)
+				if err != nil {
+					return err
+				}
+				w.SetLabels(labels)
+			case "lost-cooldown":
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					return err
+				}
+				w.SetLostCooldown(d)
+			case "precondition":
+				var preconditions []Precondition
+				if value != "" {
+					preconditions = []Precondition{CommandPrecondition(value)}
+				}
+				w.SetPreconditions(preconditions)
+			case "webhooks":
+				if notifier == nil {
+					return errors.New("there were no webhooks at startup, restart to add them")
+				}
+				return notifier.setURLs(value)
+			default:
+				return hookCmds.reload(setting, value)
+			}
+			return nil
+		})
+	}
+
+	// Everything runs under Run: the signal handling, the config watch and the elector
+	// (with the renewal and the work under it). It returns once all of them have, with
+	// the first error. We handle signals in case the job is interrupted by doing a Ctrl+C
+	// in the terminal (or by a process manager). By default SIGINT and SIGTERM resign
+	// and exit, SIGUSR1 resigns but keeps running and SIGHUP reloads the configuration.
+	// The handler outlives the elector so a second exit signal can still exit right away
+	tasks := []func(ctx context.Context, stop func()) error{
+		func(ctx context.Context, stop func()) error {
+			return handleSignals(ctx, w, signals, stop, reload)
+		},
+	}
+	if *watchConfig && *configFile != "" {
+		tasks = append(tasks, func(ctx context.Context, _ func()) error {
+			watchConfigFile(ctx, *configFile, func() {
+				w.logf("%s changed. Reloading", *configFile)
+				reload()
+			})
+			return nil
+		})
+	}
+
+	// work is what we do while we are leaders. ctx is cancelled if we lose the leadership.
+	// Anything called with ctx can get the leadership ID with LeadershipIDFromContext
+	work := func(ctx context.Context) error {
+		id, _ := LeadershipIDFromContext(ctx)
+		fmt.Println("Starting to work, leadership", id)
+		defer fmt.Println("Work done")
+
+		if args := flag.Args(); len(args) > 0 {
+			cc := &commandConfig{
+				args:           args,
+				notify:         *notify,
+				signalInterval: *signalInterval,
+				killGrace:      *killGrace,
+				output:         output,
+			}
+			return runCommand(ctx, w, cc)
+		}
 
 		// Here we simulate the long running task
-		fmt.Println("Starting to work")
-		time.Sleep(30 * time.Second)
-		close(doneChan)
-		fmt.Println("Work done")
-
-		// Note: Due to lock-delay (default 15s) you will not be able to get
-		//       the lock right after destroying the session
-		//       https://www.consul.io/docs/internals/sessions.html
-		err := w.destroySession()
+		select {
+		case <-time.After(30 * time.Second):
+		case <-ctx.Done():
+		}
+		return nil
+	}
+
+	// Why the run ended when it was not an error, for the ShutdownReport
+	exitReason := "work done"
+	elector := func(ctx context.Context) error {
+		// In elect mode we keep contending forever, working every time we become leaders
+		if *elect {
+			var err error
+			if *quorumAddrs != "" {
+				q, qerr := newQuorum(*quorumAddrs, workerConf, *quorumBudget)
+				if qerr != nil {
+					return qerr
+				}
+				defer q.Close()
+				err = q.RunElected(ctx, work)
+			} else if *globalDC != "" {
+				if *globalKey == "" {
+					*globalKey = key + "/global"
+				}
+				global, gerr := newGlobalWorker(w, consulConf, *globalDC, *globalKey)
+				if gerr != nil {
+					return gerr
+				}
+				defer global.Close()
+				err = runMultiDC(ctx, w, global, work)
+			} else {
+				err = w.RunElected(ctx, work)
+			}
+			if errors.Is(err, ErrClosed) || errors.Is(err, context.Canceled) {
+				exitReason = "exit signal"
+				return nil
+			}
+			return err
+		}
+
+		// If we were able to lock the session that means we are leaders so we do the work,
+		// the renewal runs next to it until it returns
+		announced := false
+		canWork, err := w.RunOnce(ctx, func(ctx context.Context) error {
+			// With -after-work=rerun we are called again while still leader
+			if !announced {
+				fmt.Println("I can work. YAY!!!")
+				announced = true
+			}
+			return work(ctx)
+		})
+		if ctx.Err() != nil {
+			exitReason = "exit signal"
+		}
+		if errors.Is(err, ErrOutsideWindow) {
+			fmt.Println("Outside of the window", window)
+			exitReason = "outside of the window"
+			return nil
+		}
+		if errors.Is(err, ErrFresh) {
+			fmt.Println("The last run is fresh, nothing to do")
+			exitReason = "the last run is fresh"
+			return nil
+		}
 		if err != nil {
-			log.Println("Could not destroy session")
+			return err
+		}
+		if !canWork {
+			exitReason = "not leader"
+			fmt.Println("I can NOT work. YAY!!!")
+			if leader, err := ResolveLeader(client, key, cipher); err == nil && leader.Address != "" {
+				fmt.Println("The leader is at", leader.Address)
+			}
 		}
-		return
+		return nil
 	}
 
-	fmt.Println("I can NOT work. YAY!!!")
+	err = Run(context.Background(), elector, tasks...)
+	if errors.Is(err, ErrIdle) {
+		w.logf("Not leader for %s, exiting", *exitIfIdle)
+		w.Close()
+		writeShutdownReport(w.ShutdownReport(exitIdle, fmt.Sprintf("not leader for %s", *exitIfIdle)), *reportFile)
+		return exitIdle
+	}
+	if err != nil {
+		w.Close()
+		writeShutdownReport(w.ShutdownReport(1, err.Error()), *reportFile)
+		log.Println(err)
+		return 1
+	}
+	w.Close()
+	writeShutdownReport(w.ShutdownReport(0, exitReason), *reportFile)
+	return 0
 }
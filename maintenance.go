@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+)
+
+// defaultMaintenanceKey is the maintenance flag shared by all the workers of a namespace
+const defaultMaintenanceKey = "mutual-exclusion-consul/maintenance"
+
+// maintenanceKeyIn puts the maintenance flag in the namespace, like the lock key, so
+// workers of different namespaces do not pause each other. Empty disables the flag.
+func maintenanceKeyIn(name, namespace string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	ns, err := newNamespace(namespace)
+	if err != nil {
+		return "", err
+	}
+	return ns.Key(name), nil
+}
+
+// maintenanceMode is what the workers do while the maintenance flag is set
+type maintenanceMode string
+
+const (
+	maintenanceOff    maintenanceMode = ""       // The flag is not set
+	maintenancePause  maintenanceMode = "pause"  // Nobody contends, leaders keep working
+	maintenanceResign maintenanceMode = "resign" // Nobody contends and leaders resign after draining
+)
+
+// parseMaintenance reads the value of the maintenance key. Anything but resign
+// pauses, a typo should not make leaders keep contending during an upgrade
+func parseMaintenance(value string) maintenanceMode {
+	switch value {
+	case "":
+		return maintenanceOff
+	case string(maintenanceResign):
+		return maintenanceResign
+	}
+	return maintenancePause
+}
+
+// onMaintenance is called when the value of the maintenance key changes, it resigns
+// if the mode asks leaders to
+func (ec *exclusiveWorker) onMaintenance(old, value string) {
+	mode := parseMaintenance(value)
+	if mode == parseMaintenance(old) {
+		return
+	}
+	if mode == maintenanceOff {
+		ec.emit(EventMaintenance, "flag cleared, contending again")
+		return
+	}
+	ec.emit(EventMaintenance, "flag set to "+string(mode)+", not contending")
+	if mode == maintenanceResign && ec.State() == StateHeld {
+		ec.logf("Maintenance, resigning")
+		ec.Resign()
+	}
+}
+
+// waitForMaintenance blocks while the maintenance flag is set, see waitForKey
+func (ec *exclusiveWorker) waitForMaintenance(ctx context.Context) error {
+	if ec.maintenanceKey == "" {
+		return nil
+	}
+	return ec.waitForKey(ctx, ec.maintenance, func(value string) bool {
+		return parseMaintenance(value) == maintenanceOff
+	})
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-uuid"
+)
+
+// Backends of -backend
+const (
+	backendConsul = "consul" // The local consul agent
+	backendMemory = "memory" // memoryConsul, in the process
+)
+
+// memoryNode is the node name of memoryConsul
+const memoryNode = "memory"
+
+// memoryLockDelay is the lock-delay of the sessions that do not set one, like consul
+const memoryLockDelay = 15 * time.Second
+
+// memoryMaxWait caps the wait of the blocking queries, like consul
+const memoryMaxWait = 10 * time.Minute
+
+// checkBackend checks a -backend is known
+func checkBackend(backend string) error {
+	switch backend {
+	case backendConsul, backendMemory:
+		return nil
+	}
+	return fmt.Errorf("unknown -backend %q, use %s or %s", backend, backendConsul, backendMemory)
+}
+
+// memoryConsul stands in for consul with the part of its HTTP API we use, kept in
+// memory: sessions with their TTL and lock-delay, the KV store with locks, blocking
+// queries, transactions, events and the agent services. -backend=memory serves it
+// on a loopback port, so the whole CLI runs without a consul binary, e.g. to try the
+// leadership behavior locally or in the tests of wrapper scripts. It lives as long as
+// the process, on the address it logs. There are no ACLs, no health checks and a
+// single node.
+type memoryConsul struct {
+	mu         sync.Mutex
+	index      uint64
+	changed    chan struct{} // Closed and replaced when index moves, for the blocking queries
+	quiet      bool          // A transaction is being applied, see bump
+	kv         map[string]*api.KVPair
+	sessions   map[string]*memorySession
+	lockDelays map[string]time.Time // Keys that can not be acquired until then
+	services   map[string]*api.AgentService
+}
+
+type memorySession struct {
+	entry api.SessionEntry
+	timer *time.Timer // Invalidates the session when its TTL runs out
+}
+
+func newMemoryConsul() *memoryConsul {
+	return &memoryConsul{
+		index:      1,
+		changed:    make(chan struct{}),
+		kv:         map[string]*api.KVPair{},
+		sessions:   map[string]*memorySession{},
+		lockDelays: map[string]time.Time{},
+		services:   map[string]*api.AgentService{},
+	}
+}
+
+// serveMemoryConsul serves a new memoryConsul on a loopback port and returns its address
+func serveMemoryConsul() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go http.Serve(l, newMemoryConsul())
+	return l.Addr().String(), nil
+}
+
+// bump moves the index and wakes the blocking queries, m.mu must be held. During a
+// transaction they are woken once it is applied
+func (m *memoryConsul) bump() uint64 {
+	m.index++
+	if !m.quiet {
+		m.wake()
+	}
+	return m.index
+}
+
+// wake wakes the blocking queries, m.mu must be held
+func (m *memoryConsul) wake() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// invalidate destroys a session and applies its behavior to the keys it holds,
+// m.mu must be held
+func (m *memoryConsul) invalidate(id string) {
+	s, ok := m.sessions[id]
+	if !ok {
+		return
+	}
+	delete(m.sessions, id)
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	index := m.bump()
+	for key, pair := range m.kv {
+		if pair.Session != id {
+			continue
+		}
+		if s.entry.LockDelay > 0 {
+			m.lockDelays[key] = time.Now().Add(s.entry.LockDelay)
+		}
+		if s.entry.Behavior == api.SessionBehaviorDelete {
+			delete(m.kv, key)
+			continue
+		}
+		pair.Session = ""
+		pair.ModifyIndex = index
+	}
+}
+
+// expire invalidates the session id when its TTL ran out
+func (m *memoryConsul) expire(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.invalidate(id)
+}
+
+func (m *memoryConsul) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		m.block(r)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code, v := m.handle(r, body)
+	rw.Header().Set("X-Consul-Index", strconv.FormatUint(m.index, 10))
+	rw.Header().Set("X-Consul-Knownleader", "true")
+	rw.Header().Set("X-Consul-Lastcontact", "0")
+	if s, ok := v.(string); ok && code >= http.StatusBadRequest {
+		http.Error(rw, s, code)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	if v != nil {
+		json.NewEncoder(rw).Encode(v)
+	}
+}
+
+// block waits like a blocking query: until the index moves past the index of r, its
+// wait runs out or the client goes away
+func (m *memoryConsul) block(r *http.Request) {
+	q := r.URL.Query()
+	index, _ := strconv.ParseUint(q.Get("index"), 10, 64)
+	if index == 0 {
+		return
+	}
+	wait := 5 * time.Minute
+	if d, err := time.ParseDuration(q.Get("wait")); err == nil && d > 0 {
+		wait = min(d, memoryMaxWait)
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		m.mu.Lock()
+		current, changed := m.index, m.changed
+		m.mu.Unlock()
+		if current > index {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handle serves one request with m.mu held. It returns the status code and the value
+// to encode, a string for errors.
+func (m *memoryConsul) handle(r *http.Request, body []byte) (int, interface{}) {
+	path, q := r.URL.Path, r.URL.Query()
+	switch {
+	case strings.HasPrefix(path, "/v1/kv/"):
+		return m.handleKV(r.Method, strings.TrimPrefix(path, "/v1/kv/"), q, body)
+	case path == "/v1/txn":
+		return m.handleTxn(body)
+	case path == "/v1/session/create":
+		return m.createSession(body)
+	case strings.HasPrefix(path, "/v1/session/renew/"):
+		s, ok := m.sessions[strings.TrimPrefix(path, "/v1/session/renew/")]
+		if !ok {
+			return http.StatusNotFound, "session not found"
+		}
+		if s.timer != nil {
+			ttl, _ := time.ParseDuration(s.entry.TTL)
+			s.timer.Reset(ttl)
+		}
+		return http.StatusOK, []*api.SessionEntry{&s.entry}
+	case strings.HasPrefix(path, "/v1/session/destroy/"):
+		m.invalidate(strings.TrimPrefix(path, "/v1/session/destroy/"))
+		return http.StatusOK, true
+	case strings.HasPrefix(path, "/v1/session/info/"):
+		s, ok := m.sessions[strings.TrimPrefix(path, "/v1/session/info/")]
+		if !ok {
+			return http.StatusOK, []*api.SessionEntry{}
+		}
+		return http.StatusOK, []*api.SessionEntry{&s.entry}
+	case path == "/v1/session/list" || strings.HasPrefix(path, "/v1/session/node/"):
+		entries := []*api.SessionEntry{}
+		for _, s := range m.sessions {
+			entries = append(entries, &s.entry)
+		}
+		return http.StatusOK, entries
+	case strings.HasPrefix(path, "/v1/event/fire/"):
+		id, _ := uuid.GenerateUUID()
+		m.bump()
+		return http.StatusOK, &api.UserEvent{ID: id, Name: strings.TrimPrefix(path, "/v1/event/fire/"), Payload: body}
+	case path == "/v1/status/leader":
+		return http.StatusOK, "127.0.0.1:8300"
+	case path == "/v1/agent/self":
+		return http.StatusOK, map[string]map[string]interface{}{
+			"Config": {"NodeName": memoryNode, "Datacenter": "dc1", "Version": "memory"},
+			"Member": {"Addr": "127.0.0.1", "Name": memoryNode},
+		}
+	case strings.HasPrefix(path, "/v1/health/node/"):
+		return http.StatusOK, []*api.HealthCheck{}
+	case strings.HasPrefix(path, "/v1/catalog/service/"):
+		return http.StatusOK, []*api.CatalogService{{Node: memoryNode, Address: "127.0.0.1", ServiceName: strings.TrimPrefix(path, "/v1/catalog/service/")}}
+	case path == "/v1/agent/service/register":
+		var reg api.AgentServiceRegistration
+		if err := json.Unmarshal(body, &reg); err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		id := reg.ID
+		if id == "" {
+			id = reg.Name
+		}
+		m.services[id] = &api.AgentService{ID: id, Service: reg.Name, Tags: reg.Tags, Port: reg.Port, Address: reg.Address, Meta: reg.Meta}
+		m.bump()
+		return http.StatusOK, nil
+	case strings.HasPrefix(path, "/v1/agent/service/"):
+		svc, ok := m.services[strings.TrimPrefix(path, "/v1/agent/service/")]
+		if !ok {
+			return http.StatusNotFound, "unknown service"
+		}
+		return http.StatusOK, svc
+	}
+	return http.StatusNotFound, fmt.Sprintf("%s is not simulated by the memory backend", path)
+}
+
+// createSession creates a session from the body of /v1/session/create
+func (m *memoryConsul) createSession(body []byte) (int, interface{}) {
+	var req struct {
+		Name      string
+		TTL       string
+		Behavior  string
+		LockDelay string
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+	}
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	s := &memorySession{entry: api.SessionEntry{
+		ID:        id,
+		Name:      req.Name,
+		Node:      memoryNode,
+		TTL:       req.TTL,
+		Behavior:  req.Behavior,
+		LockDelay: memoryLockDelay,
+	}}
+	if s.entry.Behavior == "" {
+		s.entry.Behavior = api.SessionBehaviorRelease
+	}
+	if req.LockDelay != "" {
+		if s.entry.LockDelay, err = time.ParseDuration(req.LockDelay); err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		s.timer = time.AfterFunc(ttl, func() { m.expire(id) })
+	}
+	s.entry.CreateIndex = m.bump()
+	m.sessions[id] = s
+	return http.StatusOK, map[string]string{"ID": id}
+}
+
+// handleKV serves /v1/kv/<key>
+func (m *memoryConsul) handleKV(method, key string, q map[string][]string, body []byte) (int, interface{}) {
+	has := func(name string) bool { _, ok := q[name]; return ok }
+	get := func(name string) string {
+		if v := q[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	switch method {
+	case http.MethodGet:
+		switch {
+		case has("keys"):
+			separator := get("separator")
+			seen := map[string]bool{}
+			keys := []string{}
+			for k := range m.kv {
+				if !strings.HasPrefix(k, key) {
+					continue
+				}
+				if i := strings.Index(k[len(key):], separator); separator != "" && i >= 0 {
+					k = k[:len(key)+i+len(separator)]
+				}
+				if !seen[k] {
+					seen[k] = true
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			return http.StatusOK, keys
+		case has("recurse"):
+			pairs := api.KVPairs{}
+			for k, pair := range m.kv {
+				if strings.HasPrefix(k, key) {
+					pairs = append(pairs, pair)
+				}
+			}
+			if len(pairs) == 0 {
+				return http.StatusNotFound, nil
+			}
+			sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+			return http.StatusOK, pairs
+		}
+		pair, ok := m.kv[key]
+		if !ok {
+			return http.StatusNotFound, nil
+		}
+		return http.StatusOK, api.KVPairs{pair}
+
+	case http.MethodPut:
+		var flags uint64
+		if has("flags") {
+			var err error
+			if flags, err = strconv.ParseUint(get("flags"), 10, 64); err != nil {
+				return http.StatusBadRequest, err.Error()
+			}
+		}
+		switch {
+		case has("acquire"):
+			ok, err := m.lock(key, get("acquire"), body)
+			if err != nil {
+				return http.StatusInternalServerError, err.Error()
+			}
+			if ok {
+				m.kv[key].Flags = flags
+			}
+			return http.StatusOK, ok
+		case has("release"):
+			ok := m.unlock(key, get("release"), body)
+			if ok {
+				m.kv[key].Flags = flags
+			}
+			return http.StatusOK, ok
+		case has("cas"):
+			index, err := strconv.ParseUint(get("cas"), 10, 64)
+			if err != nil {
+				return http.StatusBadRequest, err.Error()
+			}
+			if !m.indexMatches(key, index) {
+				return http.StatusOK, false
+			}
+		}
+		m.set(key, body).Flags = flags
+		return http.StatusOK, true
+
+	case http.MethodDelete:
+		if has("cas") {
+			index, err := strconv.ParseUint(get("cas"), 10, 64)
+			if err != nil {
+				return http.StatusBadRequest, err.Error()
+			}
+			if !m.indexMatches(key, index) {
+				return http.StatusOK, false
+			}
+		}
+		if has("recurse") {
+			m.deleteTree(key)
+		} else {
+			delete(m.kv, key)
+			m.bump()
+		}
+		return http.StatusOK, true
+	}
+	return http.StatusMethodNotAllowed, "method not allowed"
+}
+
+// set writes the value of key, m.mu must be held like for the other KV operations
+func (m *memoryConsul) set(key string, value []byte) *api.KVPair {
+	index := m.bump()
+	pair, ok := m.kv[key]
+	if !ok {
+		pair = &api.KVPair{Key: key, CreateIndex: index}
+		m.kv[key] = pair
+	}
+	pair.Value, pair.ModifyIndex = value, index
+	return pair
+}
+
+// lock acquires key for session and writes value, false if another session holds it
+// or the lock-delay of the last holder is not over
+func (m *memoryConsul) lock(key, session string, value []byte) (bool, error) {
+	if _, ok := m.sessions[session]; !ok {
+		return false, fmt.Errorf("invalid session %q", session)
+	}
+	pair, ok := m.kv[key]
+	if ok && pair.Session != "" && pair.Session != session {
+		return false, nil
+	}
+	if time.Now().Before(m.lockDelays[key]) && (!ok || pair.Session != session) {
+		return false, nil
+	}
+	locked := ok && pair.Session == session
+	pair = m.set(key, value)
+	if !locked {
+		pair.LockIndex++
+	}
+	pair.Session = session
+	return true, nil
+}
+
+// unlock releases key if session holds it and writes value
+func (m *memoryConsul) unlock(key, session string, value []byte) bool {
+	pair, ok := m.kv[key]
+	if !ok || pair.Session != session {
+		return false
+	}
+	m.set(key, value)
+	pair.Session = ""
+	return true
+}
+
+// indexMatches is the check of a check-and-set: 0 for a key that does not exist
+func (m *memoryConsul) indexMatches(key string, index uint64) bool {
+	pair, ok := m.kv[key]
+	if index == 0 {
+		return !ok
+	}
+	return ok && pair.ModifyIndex == index
+}
+
+func (m *memoryConsul) deleteTree(prefix string) {
+	for k := range m.kv {
+		if strings.HasPrefix(k, prefix) {
+			delete(m.kv, k)
+		}
+	}
+	m.bump()
+}
+
+// handleTxn serves /v1/txn for KV operations: like the transactions of consul, the
+// operations are applied in order, each one seeing the writes of the ones before it,
+// and nothing is kept if one fails
+func (m *memoryConsul) handleTxn(body []byte) (int, interface{}) {
+	var ops api.TxnOps
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	// Applied on a copy of the KV store, which replaces it only if every operation succeeded
+	kv, index := m.kv, m.index
+	m.kv = make(map[string]*api.KVPair, len(kv))
+	for k, pair := range kv {
+		c := *pair
+		m.kv[k] = &c
+	}
+	m.quiet = true
+	resp, errs := m.applyTxn(ops)
+	m.quiet = false
+	if len(errs) > 0 {
+		m.kv, m.index = kv, index
+		return http.StatusConflict, &api.TxnResponse{Errors: errs}
+	}
+	if m.index != index {
+		m.wake()
+	}
+	return http.StatusOK, resp
+}
+
+// applyTxn applies the operations of a transaction in order, and carries on after
+// a failed one to report all the errors like consul. m.mu must be held
+func (m *memoryConsul) applyTxn(ops api.TxnOps) (*api.TxnResponse, api.TxnErrors) {
+	resp := &api.TxnResponse{}
+	var errs api.TxnErrors
+	for i, op := range ops {
+		if op.KV == nil {
+			errs = append(errs, &api.TxnError{OpIndex: i, What: "only KV operations are simulated by the memory backend"})
+			continue
+		}
+		kv := op.KV
+		pair, exists := m.kv[kv.Key]
+		var result *api.KVPair
+		what := ""
+		switch kv.Verb {
+		case api.KVSet:
+			result = m.set(kv.Key, kv.Value)
+			result.Flags = kv.Flags
+		case api.KVCAS, api.KVCheckIndex, api.KVDeleteCAS:
+			if !m.indexMatches(kv.Key, kv.Index) {
+				what = fmt.Sprintf("failed to %s %s: index is stale", kv.Verb, kv.Key)
+				break
+			}
+			switch kv.Verb {
+			case api.KVCAS:
+				result = m.set(kv.Key, kv.Value)
+				result.Flags = kv.Flags
+			case api.KVCheckIndex:
+				result = pair
+			default:
+				delete(m.kv, kv.Key)
+				m.bump()
+			}
+		case api.KVCheckSession:
+			if !exists || pair.Session != kv.Session {
+				what = fmt.Sprintf("failed session check for key %s, current session is not %s", kv.Key, kv.Session)
+			}
+			result = pair
+		case api.KVCheckNotExists:
+			if exists {
+				what = fmt.Sprintf("key %s exists", kv.Key)
+			}
+		case api.KVGet:
+			if !exists {
+				what = fmt.Sprintf("key %s does not exist", kv.Key)
+			}
+			result = pair
+		case api.KVLock:
+			if _, ok := m.sessions[kv.Session]; !ok {
+				what = fmt.Sprintf("invalid session %q", kv.Session)
+			} else if exists && pair.Session != "" && pair.Session != kv.Session {
+				what = fmt.Sprintf("failed to lock key %s, lock is already held", kv.Key)
+			} else if time.Now().Before(m.lockDelays[kv.Key]) && (!exists || pair.Session != kv.Session) {
+				what = fmt.Sprintf("failed to lock key %s, lock-delay is in effect", kv.Key)
+			} else {
+				m.lock(kv.Key, kv.Session, kv.Value)
+				result = m.kv[kv.Key]
+				result.Flags = kv.Flags
+			}
+		case api.KVUnlock:
+			if !m.unlock(kv.Key, kv.Session, kv.Value) {
+				what = fmt.Sprintf("failed to unlock key %s, lock isn't held or is held by another session", kv.Key)
+				break
+			}
+			result = m.kv[kv.Key]
+			result.Flags = kv.Flags
+		case api.KVGetTree:
+			for k, p := range m.kv {
+				if strings.HasPrefix(k, kv.Key) {
+					c := *p
+					resp.Results = append(resp.Results, &api.TxnResult{KV: &c})
+				}
+			}
+		case api.KVDelete:
+			delete(m.kv, kv.Key)
+			m.bump()
+		case api.KVDeleteTree:
+			m.deleteTree(kv.Key)
+		default:
+			what = fmt.Sprintf("unknown KV verb %q", kv.Verb)
+		}
+		if what != "" {
+			errs = append(errs, &api.TxnError{OpIndex: i, What: what})
+			continue
+		}
+		if result != nil {
+			// As it was after this operation, the next ones may change it
+			c := *result
+			resp.Results = append(resp.Results, &api.TxnResult{KV: &c})
+		}
+	}
+	return resp, errs
+}
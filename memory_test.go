@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// newTestConsul serves a memoryConsul on a loopback port for the duration of the test
+func newTestConsul(tb testing.TB) (*memoryConsul, *api.Client) {
+	tb.Helper()
+	m := newMemoryConsul()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	srv := &http.Server{Handler: m}
+	go srv.Serve(l)
+	// Close, unlike Shutdown, does not wait for the blocking queries
+	tb.Cleanup(func() { srv.Close() })
+	client, err := api.NewClient(&api.Config{Address: l.Addr().String()})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return m, client
+}
+
+// hasSession tells if the session id is alive in the memory backend
+func (m *memoryConsul) hasSession(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.sessions[id]
+	return ok
+}
+
+// holderOf returns the session holding key in the memory backend, empty if none
+func (m *memoryConsul) holderOf(key string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pair, ok := m.kv[key]; ok {
+		return pair.Session
+	}
+	return ""
+}
+
+// sessionCount returns how many sessions the memory backend has
+func (m *memoryConsul) sessionCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+// devConsul returns a client of the dev Consul at $MUTEX_TEST_CONSUL (e.g. one started
+// with consul agent -dev), and skips the test when it is not set
+func devConsul(tb testing.TB) *api.Client {
+	tb.Helper()
+	addr := os.Getenv("MUTEX_TEST_CONSUL")
+	if addr == "" {
+		tb.Skip("MUTEX_TEST_CONSUL is not set")
+	}
+	client, err := api.NewClient(&api.Config{Address: addr})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return client
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockVars holds the metrics of every worker in the process, keyed by lock key.
+// They are published with expvar and served under /debug/vars on the introspection endpoint.
+var lockVars = expvar.NewMap("locks")
+
+// waitBuckets are the upper bounds of the acquisition wait time histogram
+var waitBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+}
+
+// latencyBuckets are the upper bounds of the consul round trip histograms
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+}
+
+// Consul operations whose round trips are measured. Watches are blocking queries,
+// their round trip includes how long consul blocked them
+const (
+	opSessionCreate = "session_create"
+	opAcquire       = "acquire"
+	opRenew         = "renew"
+	opDestroy       = "destroy"
+	opRelease       = "release"
+	opWatch         = "watch"
+)
+
+// consulOps are the operations of the consul_latency metrics
+var consulOps = []string{opSessionCreate, opAcquire, opRenew, opDestroy, opRelease, opWatch}
+
+// histogram counts durations in fixed buckets. It implements expvar.Var
+type histogram struct {
+	mu     sync.Mutex
+	bounds []time.Duration
+	counts []int64 // One per bound plus +Inf
+	sum    time.Duration
+	count  int64
+}
+
+func newHistogram(bounds []time.Duration) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// observe adds a duration to the histogram
+func (h *histogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += d
+	h.count++
+}
+
+// String returns the histogram as JSON, cumulative like prometheus buckets
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString(`{"buckets":{`)
+	var cumulative int64
+	for i, c := range h.counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = h.bounds[i].String()
+		}
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%q:%d", le, cumulative)
+	}
+	fmt.Fprintf(&b, `},"count":%d,"sum_seconds":%f}`, h.count, h.sum.Seconds())
+	return b.String()
+}
+
+// lockMetrics are the contention metrics of one worker
+type lockMetrics struct {
+	acquireWait     *histogram            // How long it took from contending to holding the lock
+	acquired        expvar.Int            // Acquisitions that got the lock
+	contended       expvar.Int            // Acquisitions that failed because someone else holds the lock
+	errors          expvar.Int            // Acquisitions that failed because of an error
+	contenders      expvar.Int            // Contenders seen the last time the contender prefix was scanned
+	splitBrain      expvar.Int            // Times we believed to be leader but consul said otherwise
+	acquireMismatch expvar.Int            // Acquisitions that succeeded but the key read back was not ours
+	renewLate       expvar.Int            // Renewals that fired late enough to suspect a pause, see checkPause
+	watchErrors     expvar.Int            // Blocking queries on the key that failed
+	watchStale      expvar.Int            // 1 while the blocking queries are in a brownout, see brownout
+	localFallback   expvar.Int            // 1 while working with the local lock alone, see runLocalFallback
+	flapping        expvar.Int            // 1 while the leadership flaps, see setFlapping
+	losses          *expvar.Map           // Ends of the leaderships, by LossReason
+	latency         map[string]*opLatency // Consul round trips, by operation
+	vars            *expvar.Map           // All of the above
+}
+
+// opLatency are the round trip histograms of a consul operation, by result
+type opLatency struct {
+	ok     *histogram
+	failed *histogram
+}
+
+// newLockMetrics creates the metrics for a key and publishes them under lockVars
+func newLockMetrics(key string) *lockMetrics {
+	m := &lockMetrics{
+		acquireWait: newHistogram(waitBuckets),
+		losses:      new(expvar.Map),
+		vars:        new(expvar.Map),
+	}
+	m.vars.Set("acquire_wait", m.acquireWait)
+	m.vars.Set("acquire_success_total", &m.acquired)
+	m.vars.Set("acquire_contended_total", &m.contended)
+	m.vars.Set("acquire_errors_total", &m.errors)
+	m.vars.Set("contenders", &m.contenders)
+	m.vars.Set("split_brain_detected", &m.splitBrain)
+	m.vars.Set("acquire_verify_failed_total", &m.acquireMismatch)
+	m.vars.Set("renew_late_total", &m.renewLate)
+	m.vars.Set("watch_errors_total", &m.watchErrors)
+	m.vars.Set("watch_stale", &m.watchStale)
+	m.vars.Set("local_fallback", &m.localFallback)
+	m.vars.Set("flapping", &m.flapping)
+	m.vars.Set("leadership_ended_total", m.losses)
+	m.latency = map[string]*opLatency{}
+	latency := new(expvar.Map)
+	for _, op := range consulOps {
+		l := &opLatency{ok: newHistogram(latencyBuckets), failed: newHistogram(latencyBuckets)}
+		results := new(expvar.Map)
+		results.Set("ok", l.ok)
+		results.Set("error", l.failed)
+		latency.Set(op, results)
+		m.latency[op] = l
+	}
+	m.vars.Set("consul_latency", latency)
+	lockVars.Set(key, m.vars)
+	return m
+}
+
+// observeConsul records the round trip of a consul operation, labeled by its result
+func (m *lockMetrics) observeConsul(op string, rtt time.Duration, err error) {
+	l := m.latency[op]
+	if err != nil {
+		l.failed.observe(rtt)
+	} else {
+		l.ok.observe(rtt)
+	}
+}
+
+// contenderPrefix is where the contenders of a key register themselves
+func contenderPrefix(key string) string {
+	return key + "/contenders/"
+}
+
+// Contenders returns how many contenders are registered for the worker key
+func (ec *exclusiveWorker) Contenders() (int, error) {
+	keys, _, err := ec.client.KV().Keys(contenderPrefix(ec.key), "", nil)
+	if err != nil {
+		return 0, err
+	}
+	ec.metrics.contenders.Set(int64(len(keys)))
+	return len(keys), nil
+}
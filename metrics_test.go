@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestContendersGauge checks a follower waiting for the key keeps the contenders
+// gauge up to date
+func TestContendersGauge(t *testing.T) {
+	_, client := newTestConsul(t)
+	newContender := func() *exclusiveWorker {
+		ec := newExclusiveWorker(&exclusiveWorkerConfig{
+			client:         client,
+			key:            "test/contenders-gauge",
+			sessionTimeout: "10s",
+			announce:       true,
+			quiet:          true,
+		})
+		t.Cleanup(func() { ec.Close() })
+		return ec
+	}
+	leader, follower := newContender(), newContender()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := leader.waitForLeadership(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- follower.waitForLeadership(ctx) }()
+	for follower.metrics.contenders.Value() != 2 {
+		select {
+		case err := <-done:
+			t.Fatalf("the follower stopped waiting: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("the gauge is at %d contenders", follower.metrics.contenders.Value())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Multi-datacenter failover of a singleton is a two tier election:
+//
+//   - every DC elects a local leader with the local lock, as usual
+//   - the local leaders contend for the global lock, which lives in the global DC
+//     (usually the primary one, but any DC that survives the loss of the others)
+//
+// A node only works while it holds both: the work context is cancelled as soon as
+// either is lost. A standby DC takes the global lock only once it is free, and
+// because its sessions use Behavior=delete the key is only free once consul
+// invalidated the session of the previous holder (it expired or was destroyed):
+// not being able to reach it is not enough. The previous holder stops working
+// before its session can expire, its work context deadline is its last renewal
+// plus the TTL minus a margin, and consul waits at least the TTL plus lock-delay
+// before letting anybody else take the key.
+//
+// If the global DC is lost nobody can work until it is back or an operator points
+// -global-dc to another DC: availability is traded for never running twice.
+
+// newGlobalWorker creates the worker of the global lock. Its client talks to the
+// global DC and its sessions belong to one of the consul servers there, a session
+// can only use a node of its own DC.
+func newGlobalWorker(local *exclusiveWorker, conf *api.Config, globalDC, globalKey string) (*exclusiveWorker, error) {
+	globalConf := *conf
+	globalConf.Datacenter = globalDC
+	client, err := api.NewClient(&globalConf)
+	if err != nil {
+		return nil, err
+	}
+	servers, _, err := client.Catalog().Service("consul", "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the consul servers of %s: %s", globalDC, err)
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no consul servers in %s", globalDC)
+	}
+
+	return newExclusiveWorker(&exclusiveWorkerConfig{
+		client:          client,
+		key:             globalKey,
+		sessionTimeout:  local.sessionTimeout,
+		sessionNode:     servers[0].Node,
+		adaptiveRenewal: local.adaptiveRenewal,
+		verifyInterval:  local.verifyInterval,
+		advertiseAddr:   local.advertiseAddr,
+		cipher:          local.cipher,
+		preflight:       local.preflight,
+		verifyAcquire:   local.verifyAcquire,
+		afterWork:       local.afterWork,
+		degraded:        local.degraded,
+		rerunInterval:   local.rerunInterval,
+		labels:          local.labels,
+		lockDelay:       local.lockDelay,
+		onTransition: func(t Transition) {
+			logWithID(globalKey, t.LeadershipID, "global (%s): %s -> %s", globalDC, t.From, t.To)
+		},
+	}), nil
+}
+
+// runMultiDC is RunElected for the two tier election: the local leader contends for
+// the global lock and fn runs while we hold both. It returns when ctx is done or
+// one of the workers is closed.
+func runMultiDC(ctx context.Context, local, global *exclusiveWorker, fn func(ctx context.Context) error) error {
+	return local.RunElected(ctx, func(localCtx context.Context) error {
+		err := global.RunElected(localCtx, fn)
+		if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+			// We lost (or gave up) the local leadership, the global one was released
+			return nil
+		}
+		return err
+	})
+}
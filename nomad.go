@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// NomadAlloc is the Nomad allocation running the leader, published in the lock
+// value when we run inside Nomad so the leader can be traced back to its allocation
+type NomadAlloc struct {
+	AllocID   string `json:"alloc_id"`
+	JobID     string `json:"job_id,omitempty"`
+	Group     string `json:"group,omitempty"`
+	Task      string `json:"task,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Region    string `json:"region,omitempty"`
+	DC        string `json:"dc,omitempty"`
+}
+
+// nomadAlloc returns our allocation from the Nomad task environment, nil outside of Nomad
+func nomadAlloc() *NomadAlloc {
+	id := os.Getenv("NOMAD_ALLOC_ID")
+	if id == "" {
+		return nil
+	}
+	return &NomadAlloc{
+		AllocID:   id,
+		JobID:     os.Getenv("NOMAD_JOB_ID"),
+		Group:     os.Getenv("NOMAD_GROUP_NAME"),
+		Task:      os.Getenv("NOMAD_TASK_NAME"),
+		Namespace: os.Getenv("NOMAD_NAMESPACE"),
+		Region:    os.Getenv("NOMAD_REGION"),
+		DC:        os.Getenv("NOMAD_DC"),
+	}
+}
+
+// nomadJobName returns the name of the Nomad job to use as the service in the key.
+// Every run of a periodic job is a child job named <job>/periodic-<time>, the
+// parent is what must be mutually exclusive.
+func nomadJobName() string {
+	if parent := os.Getenv("NOMAD_JOB_PARENT_ID"); parent != "" {
+		return parent
+	}
+	name := os.Getenv("NOMAD_JOB_NAME")
+	if i := strings.Index(name, "/periodic-"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// nomadTTL returns the session TTL from the timeout in the job meta
+// (meta { timeout = "30m" }), so a crashed run holds the lock no longer than
+// the job was allowed to run. It is clamped to what consul accepts and empty
+// if there is no timeout.
+func nomadTTL() string {
+	timeout, err := time.ParseDuration(os.Getenv("NOMAD_META_timeout"))
+	if err != nil || timeout <= 0 {
+		return ""
+	}
+	if timeout < minSessionTTL {
+		timeout = minSessionTTL
+	}
+	if timeout > maxSessionTTL {
+		timeout = maxSessionTTL
+	}
+	return timeout.String()
+}
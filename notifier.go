@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhookRetries is how many times a notification is sent before giving up
+const webhookRetries = 5
+
+// Notification is the JSON body POSTed to the webhooks. Text makes it readable
+// as is by Slack (and compatible) incoming webhooks.
+type Notification struct {
+	Text         string    `json:"text"`
+	Key          string    `json:"key"`
+	From         string    `json:"from"`
+	To           string    `json:"to"`
+	Reason       string    `json:"reason"`
+	LossReason   string    `json:"loss_reason,omitempty"` // Why the leadership ended, see LossReason
+	Holder       string    `json:"holder"`                // Who we are, the old holder when we lose or release the lock and the new one when we get it
+	LeadershipID string    `json:"leadership_id"`
+	Labels       Labels    `json:"labels,omitempty"` // Of the worker of Key
+	At           time.Time `json:"at"`
+}
+
+// webhookNotifier POSTs the leadership changes to webhooks so on-call knows when
+// the job moved hosts. Notifications are sent in order by a single goroutine and
+// retried with backoff; if the queue is full they are dropped rather than
+// holding up the worker.
+type webhookNotifier struct {
+	key    string
+	holder string
+	mu     sync.Mutex
+	urls   []string // Guarded by mu, a reload can change them
+	client *http.Client
+	queue  chan Notification
+	done   chan struct{}
+}
+
+// newWebhookNotifier starts a notifier for a comma separated list of URLs.
+// It returns nil if there are none.
+func newWebhookNotifier(key, holder, urls string) *webhookNotifier {
+	list := parseWebhooks(urls)
+	if len(list) == 0 {
+		return nil
+	}
+
+	n := &webhookNotifier{
+		key:    key,
+		holder: holder,
+		urls:   list,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan Notification, 32),
+		done:   make(chan struct{}),
+	}
+	go n.loop()
+	return n
+}
+
+// onTransition queues a notification for the transitions that move the leadership
+func (n *webhookNotifier) onTransition(t Transition) {
+	if n == nil {
+		return
+	}
+	var reason string
+	switch t.To {
+	case StateHeld:
+		reason = "acquired"
+	case StateLost:
+		reason = "lost"
+	case StateReleased:
+		if t.From != StateDraining {
+			// We never held it
+			return
+		}
+		reason = "released"
+	default:
+		return
+	}
+
+	notification := Notification{
+		Text:         fmt.Sprintf("%s %s the leadership of %s", n.holder, reason, n.key),
+		Key:          n.key,
+		From:         t.From.String(),
+		To:           t.To.String(),
+		Reason:       reason,
+		LossReason:   string(t.Reason),
+		Holder:       n.holder,
+		LeadershipID: t.LeadershipID,
+		At:           t.At,
+	}
+	if t.Reason != "" {
+		notification.Text += fmt.Sprintf(" (%s)", t.Reason)
+	}
+	n.notify(notification)
+}
+
+// notify queues a notification, dropping it if the queue is full
+func (n *webhookNotifier) notify(notification Notification) {
+	if n == nil {
+		return
+	}
+	if notification.Labels == nil {
+		notification.Labels = labelsOf(notification.Key)
+	}
+	select {
+	case n.queue <- notification:
+	default:
+		logWithID(n.key, notification.LeadershipID, "webhook queue full, dropping %s notification", notification.Reason)
+	}
+}
+
+// close sends what is queued and stops the notifier
+func (n *webhookNotifier) close() {
+	if n == nil {
+		return
+	}
+	close(n.queue)
+	<-n.done
+}
+
+// parseWebhooks splits a comma separated list of URLs
+func parseWebhooks(urls string) []string {
+	var list []string
+	for _, u := range strings.Split(urls, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			list = append(list, u)
+		}
+	}
+	return list
+}
+
+// setURLs replaces the webhooks, from the next notification on
+func (n *webhookNotifier) setURLs(urls string) error {
+	list := parseWebhooks(urls)
+	if len(list) == 0 {
+		return errors.New("can not remove all the webhooks, restart without -webhooks")
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.urls = list
+	return nil
+}
+
+func (n *webhookNotifier) loop() {
+	defer close(n.done)
+	for notification := range n.queue {
+		body, err := json.Marshal(notification)
+		if err != nil {
+			continue
+		}
+		n.mu.Lock()
+		urls := n.urls
+		n.mu.Unlock()
+		for _, url := range urls {
+			if err := n.post(url, body); err != nil {
+				logWithID(n.key, notification.LeadershipID, "could not notify %s: %s", url, err)
+			}
+		}
+	}
+}
+
+// post sends body to url, retrying with exponential backoff
+func (n *webhookNotifier) post(url string, body []byte) error {
+	var err error
+	wait := time.Second
+	for attempt := 0; attempt < webhookRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		var resp *http.Response
+		resp, err = n.client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("status %s", resp.Status)
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			// Retrying will not help
+			return err
+		}
+	}
+	return err
+}
+
+// notifierHolder is how we present ourselves in notifications
+func notifierHolder(advertiseAddr string) string {
+	hostname, _ := os.Hostname()
+	if advertiseAddr != "" {
+		return fmt.Sprintf("%s (%s)", hostname, advertiseAddr)
+	}
+	return hostname
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// outputBackups is how many rotated output files we keep (path.1 is the newest)
+	outputBackups = 3
+	// maxLineLength is how much of a line without newline we buffer before writing it anyway
+	maxLineLength = 64 * 1024
+)
+
+// syslogSink is the part of *syslog.Writer we use, syslog is not available on every platform
+type syslogSink interface {
+	Info(m string) error
+	Err(m string) error
+	Close() error
+}
+
+// outputSink captures the output of the command: every line is timestamped, tagged with
+// the key and the leadership ID so output from different leaderships can be told apart,
+// and written to our stdout/stderr and optionally to a rotated file and to syslog.
+// It is shared by all the runs of the command.
+type outputSink struct {
+	key string
+
+	mu     sync.Mutex
+	file   *rotatingFile // Can be nil
+	syslog syslogSink    // Can be nil
+	failed bool          // A write failed already, we only log the first failure
+}
+
+// newOutputSink returns nil if the output is not captured: the command then writes
+// directly to our stdout and stderr
+func newOutputSink(key string, capture bool, path string, maxSize int64, useSyslog bool) (*outputSink, error) {
+	if !capture && path == "" && !useSyslog {
+		return nil, nil
+	}
+	s := &outputSink{key: key}
+	if path != "" {
+		f, err := openRotatingFile(path, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		s.file = f
+	}
+	if useSyslog {
+		sl, err := openSyslog("mutual-exclusion-consul")
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.syslog = sl
+	}
+	return s, nil
+}
+
+// writer returns the writer of one stream (stdout or stderr) of a run of the command
+func (s *outputSink) writer(stream, leadershipID string) *lineWriter {
+	return &lineWriter{sink: s, stream: stream, leadershipID: leadershipID}
+}
+
+// line writes one line of the command everywhere
+func (s *outputSink) line(stream, leadershipID string, at time.Time, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tagged := fmt.Sprintf("[%s %s] %s: %s", s.key, leadershipID, stream, text)
+	formatted := at.Format("2006-01-02T15:04:05.000Z07:00") + " " + tagged + "\n"
+	console := os.Stdout
+	if stream == "stderr" {
+		console = os.Stderr
+	}
+	console.WriteString(formatted)
+
+	var err error
+	if s.file != nil {
+		_, err = s.file.Write([]byte(formatted))
+	}
+	if s.syslog != nil {
+		// syslog has its own timestamps
+		var serr error
+		if stream == "stderr" {
+			serr = s.syslog.Err(tagged)
+		} else {
+			serr = s.syslog.Info(tagged)
+		}
+		if err == nil {
+			err = serr
+		}
+	}
+	if err != nil && !s.failed {
+		s.failed = true
+		log.Printf("could not ship the output of the command: %s", err)
+	}
+}
+
+// Close closes the file and syslog. It does nothing on a nil sink
+func (s *outputSink) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.file != nil {
+		err = s.file.Close()
+	}
+	if s.syslog != nil {
+		if serr := s.syslog.Close(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// lineWriter splits what the command writes to one stream in lines for the sink
+type lineWriter struct {
+	sink         *outputSink
+	stream       string
+	leadershipID string
+	buf          []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lw.sink.line(lw.stream, lw.leadershipID, time.Now(), string(bytes.TrimSuffix(lw.buf[:i], []byte("\r"))))
+		lw.buf = lw.buf[i+1:]
+	}
+	if len(lw.buf) >= maxLineLength {
+		lw.flush()
+	}
+	return len(p), nil
+}
+
+// flush writes what is left of the last line, once the command exited
+func (lw *lineWriter) flush() {
+	if len(lw.buf) > 0 {
+		lw.sink.line(lw.stream, lw.leadershipID, time.Now(), string(lw.buf))
+		lw.buf = nil
+	}
+}
+
+// rotatingFile is a file that is rotated to path.1, path.2... when it grows over maxSize
+type rotatingFile struct {
+	path    string
+	maxSize int64 // 0 disables the rotation
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rotatingFile{path: path, maxSize: maxSize, f: f, size: info.Size()}, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, and starts a new path
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	for i := outputBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	r.f, r.size = f, 0
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
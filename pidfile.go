@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pidfile is written while we hold the lock and removed when we give it back or
+// exit. Use one per key: it also stops a second local instance for the same key
+// from starting while the first one is alive.
+type pidfile struct {
+	path string
+	key  string
+}
+
+// checkPidfile fails if the pidfile belongs to another live process.
+// A stale pidfile (the process is gone) is removed.
+func checkPidfile(path, key string) (*pidfile, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &pidfile{path: path, key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err == nil && pid != os.Getpid() && processAlive(pid) {
+		return nil, fmt.Errorf("another instance holds %s with pid %d (pidfile %s)", key, pid, path)
+	}
+	// Stale or garbage
+	os.Remove(path)
+	return &pidfile{path: path, key: key}, nil
+}
+
+// onTransition writes the pidfile when we get the lock and removes it when we lose or release it
+func (p *pidfile) onTransition(t Transition) {
+	if p == nil {
+		return
+	}
+	switch t.To {
+	case StateHeld:
+		if err := writeFileAtomic(p.path, []byte(strconv.Itoa(os.Getpid())+"\n")); err != nil {
+			logWithID(p.key, t.LeadershipID, "could not write pidfile %s: %s", p.path, err)
+		}
+	case StateLost, StateReleased:
+		p.remove()
+	}
+}
+
+// remove deletes the pidfile if it is ours
+func (p *pidfile) remove() {
+	if p == nil {
+		return
+	}
+	data, err := os.ReadFile(p.path)
+	if err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(p.path)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// policyInterval is how often a leader asks its policy if it should resign and what
+// metadata to publish
+const policyInterval = 10 * time.Second
+
+// policyTimeout is how long a policy function can run before it is cancelled
+const policyTimeout = time.Second
+
+// policyMaxSteps bounds the work of a policy function, against runaway loops
+const policyMaxSteps = 1_000_000
+
+// Policy is a Starlark script that programs the election without recompiling. It can
+// define any of these functions, each called with the state of the cluster as a dict
+// (see policyState):
+//
+//	def should_contend(state): return True to try to take the lock
+//	def should_resign(state):  return True to give it up, asked every policyInterval while leader
+//	def metadata(state):       return a dict of strings, published as labels while leader
+//
+// log(msg) writes to the log of the worker.
+type Policy struct {
+	path          string
+	shouldContend starlark.Callable
+	shouldResign  starlark.Callable
+	metadata      starlark.Callable
+}
+
+// LoadPolicy runs the script at path and returns its policy functions
+func LoadPolicy(path string) (*Policy, error) {
+	thread := &starlark.Thread{Name: path}
+	thread.SetMaxExecutionSteps(policyMaxSteps)
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, path, nil, starlark.StringDict{
+		"log": starlark.NewBuiltin("log", policyLog),
+	})
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{path: path}
+	for name, fn := range map[string]*starlark.Callable{
+		"should_contend": &p.shouldContend,
+		"should_resign":  &p.shouldResign,
+		"metadata":       &p.metadata,
+	} {
+		v, ok := globals[name]
+		if !ok {
+			continue
+		}
+		if *fn, ok = v.(starlark.Callable); !ok {
+			return nil, fmt.Errorf("%s: %s is a %s, not a function", path, name, v.Type())
+		}
+	}
+	if p.shouldContend == nil && p.shouldResign == nil && p.metadata == nil {
+		return nil, fmt.Errorf("%s defines none of should_contend, should_resign or metadata", path)
+	}
+	return p, nil
+}
+
+// policyLog is the log builtin of the scripts, it logs through the worker of the thread
+func policyLog(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &msg); err != nil {
+		return nil, err
+	}
+	if ec, ok := thread.Local("worker").(*exclusiveWorker); ok {
+		ec.logf("policy: %s", msg)
+	}
+	return starlark.None, nil
+}
+
+// call calls fn with the state of the cluster, cancelling it after policyTimeout
+func (p *Policy) call(ec *exclusiveWorker, name string, fn starlark.Callable) (starlark.Value, error) {
+	state, err := ec.policyState()
+	if err != nil {
+		return nil, err
+	}
+	thread := &starlark.Thread{Name: p.path}
+	thread.SetLocal("worker", ec)
+	thread.SetMaxExecutionSteps(policyMaxSteps)
+	timer := time.AfterFunc(policyTimeout, func() { thread.Cancel("timed out") })
+	defer timer.Stop()
+	v, err := starlark.Call(thread, fn, starlark.Tuple{state}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", p.path, name, err)
+	}
+	return v, nil
+}
+
+// policyState is the input of the policy functions:
+//
+//	key, identity, state, leadership_id: strings
+//	is_leader: bool, held_for: seconds we have been leader
+//	leader: dict with session_id, hostname and address, None if nobody holds the key
+//	contenders: number of registered contenders, leader included
+//	renew_failures: failed renewals of the worker
+//	labels: dict of the labels of the worker
+//	now: unix time in seconds
+func (ec *exclusiveWorker) policyState() (*starlark.Dict, error) {
+	var leader starlark.Value = starlark.None
+	h, err := ResolveLeader(ec.client, ec.key, ec.cipher)
+	switch {
+	case err == nil:
+		leader = policyDict(map[string]starlark.Value{
+			"session_id": starlark.String(h.SessionID),
+			"hostname":   starlark.String(h.Hostname),
+			"address":    starlark.String(h.Address),
+		})
+	case !errors.Is(err, ErrNoLeader):
+		return nil, err
+	}
+	contenders, err := ListContenders(ec.client, ec.key)
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]starlark.Value{}
+	for name, value := range ec.Labels() {
+		labels[name] = starlark.String(value)
+	}
+	hostname, _ := os.Hostname()
+
+	ec.mu.Lock()
+	held := ec.state == StateHeld
+	var heldFor time.Duration
+	if held {
+		heldFor = ec.since(ec.heldSince)
+	}
+	state := map[string]starlark.Value{
+		"key":           starlark.String(ec.key),
+		"identity":      starlark.String(hostname),
+		"state":         starlark.String(ec.state.String()),
+		"leadership_id": starlark.String(ec.leadershipID),
+		"is_leader":     starlark.Bool(held),
+		"held_for":      starlark.Float(heldFor.Seconds()),
+		"leader":        leader,
+		"contenders":    starlark.MakeInt(len(contenders)),
+		"labels":        policyDict(labels),
+		"now":           starlark.MakeInt64(ec.clock.Now().Unix()),
+	}
+	ec.mu.Unlock()
+	state["renew_failures"] = starlark.MakeInt(ec.RenewalStats().Failures)
+	return policyDict(state), nil
+}
+
+// policyDict returns a frozen Starlark dict of values, keys sorted
+func policyDict(values map[string]starlark.Value) *starlark.Dict {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	d := starlark.NewDict(len(values))
+	for _, name := range names {
+		d.SetKey(starlark.String(name), values[name])
+	}
+	d.Freeze()
+	return d
+}
+
+// policyStrategy asks the policy before the strategy it wraps
+type policyStrategy struct {
+	Strategy
+	policy *Policy
+}
+
+func (s policyStrategy) Name() string { return s.Strategy.Name() + "+policy" }
+
+func (s policyStrategy) ShouldContend(ec *exclusiveWorker, sessionID string) (bool, error) {
+	if s.policy.shouldContend != nil {
+		v, err := s.policy.call(ec, "should_contend", s.policy.shouldContend)
+		if err != nil || !v.Truth() {
+			return false, err
+		}
+	}
+	return s.Strategy.ShouldContend(ec, sessionID)
+}
+
+// policyOnTransition asks the policy if we should resign and publishes its metadata
+// while we are leader
+func (ec *exclusiveWorker) policyOnTransition(t Transition) {
+	if t.To == StateHeld && (ec.policy.shouldResign != nil || ec.policy.metadata != nil) {
+		go ec.policyLoop(t.LeadershipID)
+	}
+}
+
+// policyLoop runs the leader side of the policy every policyInterval until the
+// leadership leadershipID is over. A failing should_resign does not resign: a broken
+// script should not take the service down with it.
+func (ec *exclusiveWorker) policyLoop(leadershipID string) {
+	base := ec.Labels()
+	defer ec.SetLabels(base)
+	for {
+		if ec.State() != StateHeld || ec.LeadershipID() != leadershipID {
+			return
+		}
+		if ec.policy.metadata != nil {
+			if err := ec.publishPolicyMetadata(base); err != nil {
+				ec.logf("Policy metadata failed: %s", err)
+			}
+		}
+		if ec.policy.shouldResign != nil {
+			v, err := ec.policy.call(ec, "should_resign", ec.policy.shouldResign)
+			if err != nil {
+				ec.logf("Policy failed, not resigning: %s", err)
+			} else if v.Truth() {
+				ec.emit(EventPolicy, "the policy asked to resign")
+				ec.Resign()
+				return
+			}
+		}
+		select {
+		case <-ec.clock.After(policyInterval):
+		case <-ec.closed:
+			return
+		}
+	}
+}
+
+// publishPolicyMetadata sets the labels of the worker to base and the metadata of the policy
+func (ec *exclusiveWorker) publishPolicyMetadata(base Labels) error {
+	v, err := ec.policy.call(ec, "metadata", ec.policy.metadata)
+	if err != nil {
+		return err
+	}
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return fmt.Errorf("metadata returned a %s, not a dict", v.Type())
+	}
+	labels := Labels{}
+	for name, value := range base {
+		labels[name] = value
+	}
+	for _, item := range d.Items() {
+		name, ok1 := starlark.AsString(item[0])
+		value, ok2 := starlark.AsString(item[1])
+		if !ok1 || !ok2 {
+			return fmt.Errorf("metadata must map strings to strings, not %s to %s", item[0].Type(), item[1].Type())
+		}
+		labels[name] = value
+	}
+	if maps.Equal(labels, ec.Labels()) {
+		return nil
+	}
+	ec.SetLabels(labels)
+	return ec.publishHolder()
+}
+
+// publishHolder writes the lock value again, with the current labels. Acquiring a key
+// we already hold only updates its value.
+func (ec *exclusiveWorker) publishHolder() error {
+	ec.mu.Lock()
+	if ec.state != StateHeld {
+		ec.mu.Unlock()
+		return nil
+	}
+	sessionID := ec.sessionID
+	value := ec.holderValue(sessionID)
+	ec.mu.Unlock()
+	if err := checkValueSize(ec.key, value); err != nil {
+		return err
+	}
+	held, _, err := ec.client.KV().Acquire(&api.KVPair{Key: ec.key, Session: sessionID, Value: value}, nil)
+	if err == nil && !held {
+		err = ErrNotHeld
+	}
+	return err
+}
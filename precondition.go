@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// preconditionTimeout is how long a precondition check can take before it fails
+const preconditionTimeout = 10 * time.Second
+
+// preconditionRetry is how long we wait before checking the preconditions again
+// after they failed
+const preconditionRetry = 5 * time.Second
+
+// Precondition is a check that must pass for us to lead, e.g. "the database is
+// reachable" or "the disk has space". It is run right before contending and again
+// right after getting the lock: if it fails then we give the lock back, so a healthy
+// node can take over.
+type Precondition func(ctx context.Context) error
+
+// CommandPrecondition is a Precondition that runs a shell command, which must exit with 0
+func CommandPrecondition(command string) Precondition {
+	return func(ctx context.Context) error {
+		args := append(append([]string{}, hookShell[1:]...), command)
+		cmd := exec.CommandContext(ctx, hookShell[0], args...)
+		var out bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &out, &out
+		cmd.Env = os.Environ()
+		if err := cmd.Run(); err != nil {
+			if msg := strings.TrimSpace(out.String()); msg != "" {
+				return fmt.Errorf("%q: %s: %s", command, err, msg)
+			}
+			return fmt.Errorf("%q: %s", command, err)
+		}
+		return nil
+	}
+}
+
+// checkPreconditions runs the preconditions in order and returns the first failure,
+// wrapped in ErrPrecondition. when says if we are about to contend or already hold the lock.
+// The concurrency limit, if any, is checked first, see ConcurrencyLimit.
+func (ec *exclusiveWorker) checkPreconditions(ctx context.Context, when string) error {
+	ec.mu.Lock()
+	preconditions, held := ec.preconditions, ec.state == StateHeld
+	ec.mu.Unlock()
+	if ec.limit != nil {
+		preconditions = append([]Precondition{func(context.Context) error {
+			return ec.limit.take(ec, ec.limitWeight, held)
+		}}, preconditions...)
+	}
+	for _, check := range preconditions {
+		checkCtx, cancel := context.WithTimeout(ctx, preconditionTimeout)
+		err := check(checkCtx)
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("%w %s: %w", ErrPrecondition, when, err)
+			ec.emit(EventPrecondition, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// giveBack releases the key right after we got it, with a KV release and not by
+// destroying the session, which would keep everyone out for the lock-delay. The
+// session is kept, the next createSession reuses it.
+func (ec *exclusiveWorker) giveBack() error {
+	ec.mu.Lock()
+	ec.releaseOnly = true
+	ec.mu.Unlock()
+	return ec.destroySession()
+}
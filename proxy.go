@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+)
+
+// proxiedHeader marks the requests forwarded by a LeaderProxy, so a request is never
+// forwarded twice when the leadership moves while it is in flight
+const proxiedHeader = "X-Mutex-Proxied"
+
+// proxyTargetKey is the context key for the leader address a request is forwarded to
+type proxyTargetKey struct{}
+
+// LeaderProxy is an http.Handler for services where only the leader can serve: the
+// leader serves the requests with local, the followers reverse proxy them over http to
+// the address the leader advertises in the lock value (see advertiseAddr). While there
+// is no leader, or it advertises no address, requests get a 503 with Retry-After.
+type LeaderProxy struct {
+	ec       *exclusiveWorker
+	local    http.Handler
+	proxy    *httputil.ReverseProxy
+	follower *Follower
+
+	mu     sync.Mutex
+	leader string // Advertised address of the leader, empty if there is none
+}
+
+// NewLeaderProxy returns a LeaderProxy serving with local while we are leader. It
+// watches the key to know where the leader is, Close stops it.
+func (ec *exclusiveWorker) NewLeaderProxy(local http.Handler) (*LeaderProxy, error) {
+	p := &LeaderProxy{ec: ec, local: local}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(&url.URL{Scheme: "http", Host: r.In.Context().Value(proxyTargetKey{}).(string)})
+			r.SetXForwarded()
+			r.Out.Header.Set(proxiedHeader, "1")
+		},
+		ErrorHandler: func(rw http.ResponseWriter, r *http.Request, err error) {
+			ec.logf("Could not proxy %s %s to the leader: %s", r.Method, r.URL.Path, err)
+			rw.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	p.follower = WatchLeader(ec.client, ec.key, ec.cipher, func(h *Holder) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.leader = ""
+		if h != nil {
+			p.leader = h.Address
+		}
+	})
+	if err := p.follower.Start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ServeHTTP serves r locally if we are leader and forwards it to the leader otherwise
+func (p *LeaderProxy) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if p.ec.State() == StateHeld {
+		p.local.ServeHTTP(rw, r)
+		return
+	}
+
+	p.mu.Lock()
+	leader := p.leader
+	p.mu.Unlock()
+	// Forwarding a forwarded request, or to ourselves, would loop: the leadership is moving
+	if leader == "" || leader == p.ec.advertiseAddr || r.Header.Get(proxiedHeader) != "" {
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, "no leader", http.StatusServiceUnavailable)
+		return
+	}
+	p.proxy.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), proxyTargetKey{}, leader)))
+}
+
+// Close stops watching the leader
+func (p *LeaderProxy) Close() {
+	p.follower.Stop()
+}
+
+// checkLeaderProxy checks the settings of -proxy. The followers forward to the
+// advertised address of the leader, which must be its proxy
+func checkLeaderProxy(proxy, upstream, advertise string) error {
+	if proxy == "" {
+		return nil
+	}
+	if upstream == "" || advertise == "" {
+		return errors.New("-proxy needs -proxy-upstream and -advertise")
+	}
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("-proxy-upstream %q is not an http URL", upstream)
+	}
+	return nil
+}
+
+// serveLeaderProxy serves a LeaderProxy on addr for the worker command: while we are
+// leader the requests go to upstream, the server of the command, otherwise to the leader
+func serveLeaderProxy(ec *exclusiveWorker, addr, upstream string) (*LeaderProxy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ec.NewLeaderProxy(httputil.NewSingleHostReverseProxy(u))
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	go func() {
+		if err := http.Serve(l, p); err != nil {
+			log.Printf("leader proxy stopped: %s", err)
+		}
+	}()
+	return p, nil
+}
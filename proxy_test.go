@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestLeaderProxy checks the leader serves the requests itself and a follower
+// forwards them to the address the leader advertises
+func TestLeaderProxy(t *testing.T) {
+	_, client := newTestConsul(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newWorker := func(advertiseAddr string) *exclusiveWorker {
+		ec := newExclusiveWorker(&exclusiveWorkerConfig{
+			client:         client,
+			key:            "test/proxy",
+			sessionTimeout: "10s",
+			quiet:          true,
+			advertiseAddr:  advertiseAddr,
+		})
+		t.Cleanup(func() { ec.Close() })
+		return ec
+	}
+	newProxy := func(ec *exclusiveWorker, name string) *LeaderProxy {
+		p, err := ec.NewLeaderProxy(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			io.WriteString(rw, name)
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(p.Close)
+		return p
+	}
+
+	leader := newWorker(l.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := leader.waitForLeadership(ctx); err != nil {
+		t.Fatal(err)
+	}
+	leaderSrv := &httptest.Server{Listener: l, Config: &http.Server{Handler: newProxy(leader, "leader")}}
+	leaderSrv.Start()
+	defer leaderSrv.Close()
+	followerSrv := httptest.NewServer(newProxy(newWorker("127.0.0.1:1"), "follower"))
+	defer followerSrv.Close()
+
+	get := func(url string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if code, body := get(leaderSrv.URL); code != http.StatusOK || body != "leader" {
+		t.Fatalf("the leader answered %d %q", code, body)
+	}
+	// The follower learns where the leader is from its watch
+	for {
+		code, body := get(followerSrv.URL)
+		if code == http.StatusOK && body == "leader" {
+			break
+		}
+		if code != http.StatusServiceUnavailable {
+			t.Fatalf("the follower answered %d %q", code, body)
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("the follower never forwarded to the leader")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// quorum is a RedLock style lock over independent consul clusters, for when a single
+// cluster can not be trusted to be available: we are leader while we hold the key in
+// a majority of them. Each cluster has its own worker (same key, its own client).
+type quorum struct {
+	workers []*exclusiveWorker
+	budget  time.Duration // Acquiring a majority must take less than this, or we release everything
+	clock   Clock         // The workers', for the budget and the retries
+}
+
+// newQuorum creates a worker per consul address, configured like conf
+func newQuorum(addrs string, conf *exclusiveWorkerConfig, budget time.Duration) (*quorum, error) {
+	q := &quorum{budget: budget}
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		client, err := api.NewClient(&api.Config{Address: addr})
+		if err != nil {
+			return nil, err
+		}
+		c := *conf
+		c.client = client
+		q.workers = append(q.workers, newExclusiveWorker(&c))
+	}
+	if len(q.workers) < 3 {
+		return nil, errors.New("a quorum needs at least 3 consul clusters")
+	}
+	q.clock = q.workers[0].clock
+	return q, nil
+}
+
+// majority is how many clusters we must hold the key in
+func (q *quorum) majority() int {
+	return len(q.workers)/2 + 1
+}
+
+// tryAcquire contends in every cluster in parallel. It returns the workers that got
+// the key if they are a majority and it took less than the budget. Otherwise it
+// releases whatever it got, including the clusters that answer after the budget.
+func (q *quorum) tryAcquire() ([]*exclusiveWorker, bool) {
+	start := q.clock.Now()
+	var mu sync.Mutex
+	var held []*exclusiveWorker
+	expired := false
+	results := make(chan struct{}, len(q.workers))
+
+	for _, w := range q.workers {
+		go func(w *exclusiveWorker) {
+			defer func() { results <- struct{}{} }()
+			acquired := false
+			err := w.createSession()
+			if err == nil {
+				acquired, err = w.acquireSession()
+			}
+			if err != nil {
+				w.logf("Could not acquire: %s", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if acquired && !expired {
+				held = append(held, w)
+				return
+			}
+			w.destroySession()
+		}(w)
+	}
+
+	timeout := q.clock.After(q.budget)
+wait:
+	for answered := 0; answered < len(q.workers); answered++ {
+		select {
+		case <-results:
+		case <-timeout:
+			break wait
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expired = true
+	if len(held) >= q.majority() && q.clock.Now().Sub(start) < q.budget {
+		return held, true
+	}
+	for _, w := range held {
+		w.destroySession()
+	}
+	return nil, false
+}
+
+// RunElected is exclusiveWorker.RunElected for the quorum: fn runs while we hold the key
+// in a majority of the clusters, and its ctx is cancelled when we lose enough of them.
+// It only returns when ctx is done.
+func (q *quorum) RunElected(ctx context.Context, fn func(ctx context.Context) error) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		held, ok := q.tryAcquire()
+		if !ok {
+			// Random delay so contenders don't keep splitting the clusters between them
+			select {
+			case <-q.clock.After(retryInterval + time.Duration(rand.Int63n(int64(retryInterval)))):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+		workCtx, cancel := q.workContext(ctx, held)
+		var wg sync.WaitGroup
+		for _, w := range held {
+			wg.Add(1)
+			go func(w *exclusiveWorker) {
+				defer wg.Done()
+				if err := w.renewSession(workCtx.Done()); err != nil {
+					w.logf("Lost the key in this cluster: %s", err)
+				}
+			}(w)
+		}
+
+		if err := held[0].keepLeading(fn)(workCtx); err != nil {
+			held[0].logf("Work failed: %s", err)
+		}
+		cancel()
+		wg.Wait()
+		for _, w := range held {
+			w.destroySession()
+		}
+	}
+}
+
+// quorumContext is the work context of the quorum. It follows the lease contexts of
+// the held workers: it is cancelled once fewer than a majority of them are alive, and
+// its deadline is the earliest expiry among the majority of leases that expire last,
+// i.e. when we stop being certain to hold a quorum.
+type quorumContext struct {
+	context.Context // Cancelled when the majority is lost
+	leases          []context.Context
+	majority        int
+}
+
+// workContext returns the work context of a leadership over held, and its cancel
+func (q *quorum) workContext(ctx context.Context, held []*exclusiveWorker) (context.Context, context.CancelFunc) {
+	base, cancel := context.WithCancel(context.WithValue(ctx, leadershipIDKey{}, held[0].LeadershipID()))
+	c := &quorumContext{Context: base, majority: q.majority()}
+	var mu sync.Mutex
+	alive := len(held)
+	for _, w := range held {
+		lease := w.WorkContext(base)
+		c.leases = append(c.leases, lease)
+		go func() {
+			<-lease.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			if alive--; alive < c.majority {
+				cancel()
+			}
+		}()
+	}
+	return c, cancel
+}
+
+// Deadline is the earliest expiry among the majority of leases that expire last
+func (c *quorumContext) Deadline() (time.Time, bool) {
+	var deadlines []time.Time
+	for _, lease := range c.leases {
+		if lease.Err() != nil {
+			continue
+		}
+		if d, ok := lease.Deadline(); ok {
+			deadlines = append(deadlines, d)
+		}
+	}
+	if len(deadlines) < c.majority {
+		// Over or about to be, the base context is cancelled
+		return c.Context.Deadline()
+	}
+	sort.Slice(deadlines, func(i, j int) bool { return deadlines[i].Before(deadlines[j]) })
+	return deadlines[len(deadlines)-c.majority], true
+}
+
+// Close closes the workers of every cluster
+func (q *quorum) Close() error {
+	var errs []error
+	for _, w := range q.workers {
+		if err := w.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
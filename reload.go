@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// configWatchInterval is how often -watch-config checks if the config file changed
+const configWatchInterval = 5 * time.Second
+
+// reloadable are the settings a reload applies to the running worker, without a new
+// session nor dropping the leadership. The others need a restart.
+var reloadable = map[string]bool{
+	"webhooks":         true,
+	"labels":           true,
+	"lost-cooldown":    true,
+	"precondition":     true,
+	"on-acquire":       true,
+	"on-renew-failure": true,
+	"on-lost":          true,
+	"on-release":       true,
+}
+
+// Labels returns the labels of the worker
+func (ec *exclusiveWorker) Labels() Labels {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.labels
+}
+
+// SetLabels replaces the labels of the worker. The logs, metrics and events use them
+// right away, the lock value from the next acquisition.
+func (ec *exclusiveWorker) SetLabels(labels Labels) {
+	ec.mu.Lock()
+	ec.labels = labels
+	ec.mu.Unlock()
+	setKeyLabels(ec.key, labels)
+	ec.metrics.vars.Set("labels", expvar.Func(func() interface{} { return ec.Labels() }))
+}
+
+// SetLostCooldown changes how long RunElected waits before contending again after
+// losing the leadership
+func (ec *exclusiveWorker) SetLostCooldown(d time.Duration) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.lostCooldown = d
+}
+
+// SetPreconditions replaces the preconditions, checked from the next contention on
+func (ec *exclusiveWorker) SetPreconditions(preconditions []Precondition) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.preconditions = preconditions
+}
+
+// reloadValue holds the raw value of a setting, to tell which settings a reload changes
+type reloadValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *reloadValue) String() string     { return v.value }
+func (v *reloadValue) Set(s string) error { v.value = s; return nil }
+func (v *reloadValue) IsBoolFlag() bool   { return v.isBool }
+
+// configReloader reads the settings of a flag set again from the same args, the
+// environment and the config file, with the precedence of loadConfig
+type configReloader struct {
+	fs   *flag.FlagSet
+	args []string
+	file string
+	raw  map[string]string // Raw values of the settings as last applied
+}
+
+// newConfigReloader reads the raw settings fs was loaded with
+func newConfigReloader(fs *flag.FlagSet, args []string, file string) (*configReloader, error) {
+	r := &configReloader{fs: fs, args: args, file: file}
+	raw, err := r.read()
+	r.raw = raw
+	return r, err
+}
+
+// read returns the raw value of every setting
+func (r *configReloader) read() (map[string]string, error) {
+	fresh := flag.NewFlagSet(r.fs.Name(), flag.ContinueOnError)
+	fresh.SetOutput(io.Discard)
+	r.fs.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		fresh.Var(&reloadValue{value: f.DefValue, isBool: ok && b.IsBoolFlag()}, f.Name, f.Usage)
+	})
+	if _, err := loadConfig(fresh, r.args, &r.file); err != nil {
+		return nil, err
+	}
+	raw := map[string]string{}
+	fresh.VisitAll(func(f *flag.Flag) {
+		raw[f.Name] = f.Value.String()
+	})
+	return raw, nil
+}
+
+// reload reads the settings again and applies the reloadable ones that changed with
+// apply, in order. The others are logged, they need a restart.
+func (r *configReloader) reload(w *exclusiveWorker, apply func(setting, value string) error) {
+	raw, err := r.read()
+	if err != nil {
+		w.logf("Could not reload the configuration: %s", err)
+		return
+	}
+	var names []string
+	for name, value := range raw {
+		if value != r.raw[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		w.logf("The configuration did not change")
+	}
+	for _, name := range names {
+		value := raw[name]
+		if !reloadable[name] {
+			w.logf("-%s changed, restart to apply it", name)
+			continue
+		}
+		if err := apply(name, value); err != nil {
+			w.logf("Could not reload -%s: %s", name, err)
+			continue
+		}
+		r.raw[name] = value
+		w.logf("Reloaded -%s", name)
+	}
+}
+
+// watchConfigFile calls onChange when the modification time of path changes, until
+// ctx is done
+func watchConfigFile(ctx context.Context, path string, onChange func()) {
+	last := time.Time{}
+	if info, err := os.Stat(path); err == nil {
+		last = info.ModTime()
+	}
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(last) {
+			continue
+		}
+		last = info.ModTime()
+		onChange()
+	}
+}
+
+// reload replaces the command of the hook of setting
+func (h *hooks) reload(setting, command string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch setting {
+	case "on-acquire":
+		h.acquire = command
+	case "on-renew-failure":
+		h.renewFailure = command
+	case "on-lost":
+		h.lost = command
+	case "on-release":
+		h.release = command
+	default:
+		return fmt.Errorf("unknown hook %s", setting)
+	}
+	return nil
+}
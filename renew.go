@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"golang.org/x/sync/errgroup"
+)
+
+// rttWindow is how many renewals we remember the round trip and the result of
+const rttWindow = 20
+
+// RenewalStats is a snapshot of how the session renewals are going
+type RenewalStats struct {
+	Attempts       int           // Number of renewals attempted
+	Failures       int           // Number of renewals that returned an error
+	Failing        int           // Number of renewals in a row that failed, up to now
+	LastRTT        time.Duration // Round trip time of the last renewal
+	MaxRTT         time.Duration // Highest round trip time in the last rttWindow renewals
+	Recent         int           // Renewals in the window, the last rttWindow ones
+	RecentFailures int           // Renewals in the window that returned an error
+}
+
+// ErrorRate returns the fraction of the last rttWindow renewals that failed. A
+// brownout long over does not weigh on the renewals of a process running for weeks.
+func (rs RenewalStats) ErrorRate() float64 {
+	if rs.Recent == 0 {
+		return 0
+	}
+	return float64(rs.RecentFailures) / float64(rs.Recent)
+}
+
+// renewalStats records renewal round trip times and errors
+type renewalStats struct {
+	mu       sync.Mutex
+	recent   []renewalSample // The last rttWindow renewals
+	attempts int
+	failures int
+	failing  int
+}
+
+// renewalSample is the result of one renewal
+type renewalSample struct {
+	rtt    time.Duration
+	failed bool
+}
+
+// observe records the result of one renewal
+func (rs *renewalStats) observe(rtt time.Duration, err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.attempts++
+	if err != nil {
+		rs.failures++
+		rs.failing++
+	} else {
+		rs.failing = 0
+	}
+	rs.recent = append(rs.recent, renewalSample{rtt: rtt, failed: err != nil})
+	if len(rs.recent) > rttWindow {
+		rs.recent = rs.recent[1:]
+	}
+}
+
+// snapshot returns a copy of the current stats
+func (rs *renewalStats) snapshot() RenewalStats {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	s := RenewalStats{Attempts: rs.attempts, Failures: rs.failures, Failing: rs.failing, Recent: len(rs.recent)}
+	for _, r := range rs.recent {
+		s.MaxRTT = max(s.MaxRTT, r.rtt)
+		if r.failed {
+			s.RecentFailures++
+		}
+	}
+	if len(rs.recent) > 0 {
+		s.LastRTT = rs.recent[len(rs.recent)-1].rtt
+	}
+	return s
+}
+
+// RenewalStats returns the renewal round trip times and error counts seen so far
+func (ec *exclusiveWorker) RenewalStats() RenewalStats {
+	return ec.stats.snapshot()
+}
+
+// renewInterval returns how long to wait before the next renewal.
+// By default it is ttl/2 like the consul client does. With adaptiveRenewal
+// we leave room for twice the slowest observed round trip and renew
+// more often when renewals are failing.
+func (ec *exclusiveWorker) renewInterval(ttl time.Duration) time.Duration {
+	wait := ttl / 2
+	if !ec.adaptiveRenewal {
+		return wait
+	}
+
+	stats := ec.stats.snapshot()
+	wait -= 2 * stats.MaxRTT
+	wait = time.Duration(float64(wait) * (1 - stats.ErrorRate()))
+	if floor := ttl / 10; wait < floor {
+		wait = floor
+	}
+	return wait
+}
+
+// warnIfSlow logs a warning when the renewals take too long compared to the TTL.
+// If a renewal takes more than a quarter of the TTL we are one slow request away from losing the lock.
+func (ec *exclusiveWorker) warnIfSlow(sessionID string, ttl time.Duration) {
+	stats := ec.stats.snapshot()
+	if stats.MaxRTT > ttl/4 {
+		ec.logf("WARNING session %s TTL %s is dangerously close to renewal latency %s", sessionID, ttl, stats.MaxRTT)
+	}
+}
+
+// pauseThreshold is how late a renewal can fire before we suspect the process was
+// paused (a stop-the-world GC, CPU starvation, a suspended VM) long enough for the
+// session to expire and someone else to take the key meanwhile
+func pauseThreshold(ttl time.Duration) time.Duration {
+	return ttl / 4
+}
+
+// checkPause is called when a renewal fires late by more than pauseThreshold. While we
+// were paused the work kept believing it was leader, so before renewing we check in
+// consul that the key is still ours. It returns ErrSplitBrain if it is not.
+func (ec *exclusiveWorker) checkPause(sessionID string, late time.Duration) error {
+	ec.metrics.renewLate.Add(1)
+	ec.emit(EventPaused, fmt.Sprintf("renewal fired %s late, verifying ownership", late))
+	if err := ec.verifyOwnership(sessionID); err != nil {
+		ec.metrics.splitBrain.Add(1)
+		ec.emit(EventSplitBrain, err.Error())
+		return err
+	}
+	return nil
+}
+
+// renewLoop renews the session until stop is closed or the session expires.
+// It works like api.Session.RenewPeriodic but records the round trip of every
+// renewal and lets renewInterval decide the cadence. Unlike RenewPeriodic it does
+// not destroy the session when stopped, destroySession() takes care of that.
+// If verifyInterval is set verifyLoop runs in an errgroup next to it: the loop stops
+// with the group's error as soon as verifyLoop sees we lost the key (or panics), and
+// verifyLoop has returned when renewLoop does.
+// SetTTL moves the lock to a new session, the loop then renews that one. A renewal
+// firing much later than planned is preceded by an ownership check, see checkPause.
+func (ec *exclusiveWorker) renewLoop(sessionID string, stop <-chan struct{}) error {
+	ttl, err := time.ParseDuration(ec.TTL())
+	if err != nil {
+		return err
+	}
+
+	var mismatch <-chan struct{}
+	verifyErr := func() error { return nil }
+	if ec.verifyInterval > 0 {
+		verifyCtx, stopVerify := context.WithCancel(context.Background())
+		g, groupCtx := errgroup.WithContext(verifyCtx)
+		g.Go(recovering(func() error { return ec.verifyLoop(groupCtx) }))
+		defer func() {
+			stopVerify()
+			g.Wait()
+		}()
+		mismatch, verifyErr = groupCtx.Done(), g.Wait
+	}
+	if ec.session != nil {
+		// The shared session renews itself, and moves our lease deadlines
+		return ec.session.follow(ec, sessionID, stop, mismatch, verifyErr)
+	}
+
+	wait := ec.renewInterval(ttl)
+	lastRenewTime := ec.clock.Now()
+	var lastErr error
+	for {
+		if ec.since(lastRenewTime) > ttl {
+			if lastErr == nil {
+				lastErr = api.ErrSessionExpired
+			}
+			return lastErr
+		}
+
+		due := ec.clock.Now().Add(wait)
+		select {
+		case <-ec.clock.After(wait):
+			if late := ec.since(due); late > pauseThreshold(ttl) {
+				if err := ec.checkPause(sessionID, late); err != nil {
+					return err
+				}
+			}
+			start := ec.clock.Now()
+			entry, _, err := ec.renewClient.Session().Renew(sessionID, nil)
+			ec.stats.observe(ec.since(start), err)
+			ec.metrics.observeConsul(opRenew, ec.since(start), err)
+			if ec.currentSession() != sessionID {
+				// SetTTL moved the lock to a new session meanwhile, this renewal is
+				// stale whatever its result. Wait for ttlChanged to tell us which session
+				// instead of renewing the old one again, up to the expiry of the old lease
+				wait = ttl - ec.since(lastRenewTime)
+				continue
+			}
+			if err != nil {
+				if ec.renewFailed(err) {
+					return err
+				}
+				wait = time.Second
+				lastErr = err
+				continue
+			}
+			if entry == nil {
+				return api.ErrSessionExpired
+			}
+
+			// Handle the server updating the TTL
+			if serverTTL, err := time.ParseDuration(entry.TTL); err == nil {
+				ttl = serverTTL
+			}
+			ec.warnIfSlow(sessionID, ttl)
+			ec.renewed(start, ttl)
+			wait = ec.renewInterval(ttl)
+			lastRenewTime = ec.clock.Now()
+
+		case <-ec.ttlChanged:
+			// SetTTL already renewed, with the new session
+			ec.mu.Lock()
+			sessionID, ttl = ec.sessionID, ec.leaseTTL
+			ec.mu.Unlock()
+			wait = ec.renewInterval(ttl)
+			lastRenewTime = ec.clock.Now()
+			lastErr = nil
+
+		case <-mismatch:
+			return verifyErr()
+
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// Extend renews the session right away instead of trusting the renewal loop's cadence,
+// e.g. before a long critical operation. It returns the new expiry deadline: the
+// session is guaranteed to be alive at least until then.
+func (ec *exclusiveWorker) Extend(ctx context.Context) (time.Time, error) {
+	ec.mu.Lock()
+	sessionID, state := ec.sessionID, ec.state
+	ec.mu.Unlock()
+	if sessionID == "" {
+		return time.Time{}, ErrNoSession
+	}
+	if state != StateHeld {
+		return time.Time{}, &StateError{Op: "extend", State: state}
+	}
+
+	// The deadline is counted from before the request, we don't know when consul renewed it
+	start := ec.clock.Now()
+	entry, _, err := ec.renewClient.Session().Renew(sessionID, (&api.WriteOptions{}).WithContext(ctx))
+	ec.stats.observe(ec.since(start), err)
+	ec.metrics.observeConsul(opRenew, ec.since(start), err)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if entry == nil {
+		return time.Time{}, api.ErrSessionExpired
+	}
+
+	ttl, err := time.ParseDuration(entry.TTL)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ec.renewed(start, ttl)
+	return start.Add(ttl), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestRenewalErrorRate checks the error rate only counts the last rttWindow
+// renewals, so failures long over stop shortening the renewal interval
+func TestRenewalErrorRate(t *testing.T) {
+	rs := &renewalStats{}
+	for i := 0; i < rttWindow; i++ {
+		rs.observe(time.Millisecond, errors.New("consul unavailable"))
+	}
+	if rate := rs.snapshot().ErrorRate(); rate != 1 {
+		t.Fatalf("error rate %v after %d failures", rate, rttWindow)
+	}
+	for i := 0; i < rttWindow/2; i++ {
+		rs.observe(time.Millisecond, nil)
+	}
+	if rate := rs.snapshot().ErrorRate(); rate != 0.5 {
+		t.Fatalf("error rate %v with half of the window failed", rate)
+	}
+	for i := 0; i < rttWindow/2; i++ {
+		rs.observe(time.Millisecond, nil)
+	}
+	s := rs.snapshot()
+	if rate := s.ErrorRate(); rate != 0 {
+		t.Fatalf("error rate %v once the failures left the window", rate)
+	}
+	if s.Attempts != 2*rttWindow || s.Failures != rttWindow {
+		t.Fatalf("%d failures out of %d renewals, the totals must be kept", s.Failures, s.Attempts)
+	}
+}
+
+// TestRenewLoopVerify checks the ownership checks stop the renewal with ErrSplitBrain
+// once the key is no longer ours
+func TestRenewLoopVerify(t *testing.T) {
+	_, client := newTestConsul(t)
+	ec := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:         client,
+		key:            "test/verify",
+		sessionTimeout: "10s",
+		verifyInterval: 10 * time.Millisecond,
+		quiet:          true,
+	})
+	defer ec.Close()
+	if err := ec.createSession(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := ec.acquireSession(); !ok {
+		t.Fatalf("not acquired: %v", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- ec.renewLoop(ec.currentSession(), make(chan struct{})) }()
+	if _, err := client.KV().Delete("test/verify", nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrSplitBrain) {
+			t.Fatalf("the renewal stopped with %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("the renewal went on without the key")
+	}
+}
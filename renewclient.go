@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// defaultRenewTimeout is how long a session renewal may take by default. It must be
+// well under TTL/2, the renewal cadence, for a failed renewal to be retried in time
+const defaultRenewTimeout = 3 * time.Second
+
+// newRenewalClient returns a consul client for the session renewals alone, with its
+// own connections and tight timeouts: blocking queries holding the connections of the
+// main client for minutes, or a saturated pool, can never delay a renewal until the
+// session expires. conf is the configuration of the main client.
+func newRenewalClient(conf api.Config, timeout time.Duration) (*api.Client, error) {
+	transport := cleanhttp.DefaultPooledTransport()
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+	// A renewal every TTL/2 per session, a few connections are plenty
+	transport.MaxIdleConnsPerHost = 2
+	conf.Transport = transport
+	conf.HttpClient = nil
+	return api.NewClient(&conf)
+}
+
+// checkRenewTimeout checks the renewals time out before the next one is due
+func checkRenewTimeout(timeout time.Duration, ttl string) error {
+	d, err := time.ParseDuration(ttl)
+	if err != nil || timeout <= 0 {
+		// Checked with the TTL, or no dedicated client
+		return nil
+	}
+	if timeout >= d/2 {
+		return fmt.Errorf("renew timeout %s must be shorter than half the TTL %s, the renewal cadence", timeout, d)
+	}
+	return nil
+}
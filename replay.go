@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// replayRecord is a record of an event log and the log it comes from
+type replayRecord struct {
+	logRecord
+	source string // File of the event log, one per process
+}
+
+// belief is what a worker believed at some moment
+type belief struct {
+	state        State
+	leadershipID string
+	sessionID    string
+}
+
+// runReplay replays event logs written with -event-log through the state machine and
+// prints what every worker believed after each record, to analyse incidents after
+// the fact. Give it the logs of every process involved: records are merged by time and
+// moments where two of them believed to hold the same key are flagged.
+//
+//	mutual-exclusion-consul replay [-key <key>] node1.log node2.log
+//
+// It returns the exit code: 1 if the logs could not be read, 2 if two leaders or an
+// illegal transition were found.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	key := fs.String("key", "", "only replay this key")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Println("replay: give the event logs to replay")
+		return 1
+	}
+
+	var records []replayRecord
+	for _, path := range fs.Args() {
+		rs, err := readEventLog(path)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		for _, r := range rs {
+			if *key == "" || r.Key == *key {
+				records = append(records, replayRecord{logRecord: r, source: path})
+			}
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].At.Before(records[j].At) })
+
+	beliefs := map[string]*belief{} // By source and key
+	anomalies := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "AT\tSOURCE\tKEY\tRECORD\tBELIEVED\tLEADERSHIP\tSESSION\tNOTE")
+	for _, r := range records {
+		b := beliefs[r.source+"\x00"+r.Key]
+		if b == nil {
+			b = &belief{state: StateIdle}
+			beliefs[r.source+"\x00"+r.Key] = b
+		}
+
+		var notes []string
+		what := string(r.Kind)
+		if r.Kind == eventTransition {
+			what = r.From + " -> " + r.To
+			from, fromOK := parseState(r.From)
+			to, toOK := parseState(r.To)
+			switch {
+			case !fromOK || !toOK:
+				notes = append(notes, "unknown state")
+			case from != b.state:
+				notes = append(notes, fmt.Sprintf("records missing, we believed %s", b.state))
+				fallthrough
+			default:
+				if !canTransition(from, to) {
+					notes = append(notes, "ILLEGAL TRANSITION")
+					anomalies++
+				}
+				b.state = to
+			}
+			b.leadershipID = r.LeadershipID
+			if holders := holdersOf(beliefs, r.Key); len(holders) > 1 {
+				notes = append(notes, "TWO LEADERS: "+strings.Join(holders, ", "))
+				anomalies++
+			}
+		}
+		if r.SessionID != "" {
+			b.sessionID = r.SessionID
+		}
+		if r.Detail != "" {
+			notes = append(notes, r.Detail)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.At.Format("15:04:05.000"), r.source, r.Key,
+			what, b.state, b.leadershipID, b.sessionID, strings.Join(notes, "; "))
+	}
+	tw.Flush()
+
+	if anomalies > 0 {
+		return 2
+	}
+	return 0
+}
+
+// readEventLog reads the records of an event log
+func readEventLog(path string) ([]logRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []logRecord
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var r logRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// parseState is the reverse of State.String
+func parseState(name string) (State, bool) {
+	for s, n := range stateNames {
+		if n == name {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// holdersOf returns the sources that believe to hold key, sorted
+func holdersOf(beliefs map[string]*belief, key string) []string {
+	var holders []string
+	for id, b := range beliefs {
+		source, k, _ := strings.Cut(id, "\x00")
+		if k == key && (b.state == StateHeld || b.state == StateDraining) {
+			holders = append(holders, source)
+		}
+	}
+	sort.Strings(holders)
+	return holders
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ShutdownReport sums up the life of a worker, printed as one JSON line when the
+// process exits, for the batch job systems that only see a process start and end
+type ShutdownReport struct {
+	Key                string     `json:"key"`
+	ExitCode           int        `json:"exit_code"`
+	ExitReason         string     `json:"exit_reason"`
+	StartedAt          time.Time  `json:"started_at"`
+	StoppedAt          time.Time  `json:"stopped_at"`
+	Leaderships        int        `json:"leaderships"`
+	LeadershipSeconds  float64    `json:"leadership_seconds"` // Total time we held the lock
+	Renewals           int        `json:"renewals"`
+	RenewalFailures    int        `json:"renewal_failures"`
+	LastEpoch          uint64     `json:"last_epoch,omitempty"` // LockIndex of the last leadership
+	LastLeadershipID   string     `json:"last_leadership_id,omitempty"`
+	LastLeadershipLoss LossReason `json:"last_leadership_loss,omitempty"` // Why the last leadership ended
+}
+
+// leadershipTally counts the leaderships of a worker from its transitions
+type leadershipTally struct {
+	mu          sync.Mutex
+	startedAt   time.Time
+	leaderships int
+	held        time.Duration // Of the leaderships that are over
+	heldSince   time.Time     // Zero when we are not leader
+	epoch       uint64
+	id          string
+	loss        LossReason
+}
+
+// tallyOnTransition counts the leaderships and the time we held the lock
+func (ec *exclusiveWorker) tallyOnTransition(t Transition) {
+	r := ec.tally
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case t.To == StateHeld:
+		r.leaderships++
+		r.heldSince, r.id, r.loss = t.At, t.LeadershipID, ""
+		if info, ok := ec.LockInfo(); ok {
+			r.epoch = info.LockIndex
+		}
+	case t.Reason != "" && !r.heldSince.IsZero():
+		r.held += t.At.Sub(r.heldSince)
+		r.heldSince, r.loss = time.Time{}, t.Reason
+	}
+}
+
+// ShutdownReport sums up the life of the worker, the leadership in progress included
+func (ec *exclusiveWorker) ShutdownReport(code int, reason string) ShutdownReport {
+	stats := ec.RenewalStats()
+	now := ec.clock.Now()
+	r := ec.tally
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	held := r.held
+	if !r.heldSince.IsZero() {
+		held += now.Sub(r.heldSince)
+	}
+	return ShutdownReport{
+		Key:                ec.key,
+		ExitCode:           code,
+		ExitReason:         reason,
+		StartedAt:          r.startedAt,
+		StoppedAt:          now,
+		Leaderships:        r.leaderships,
+		LeadershipSeconds:  held.Seconds(),
+		Renewals:           stats.Attempts,
+		RenewalFailures:    stats.Failures,
+		LastEpoch:          r.epoch,
+		LastLeadershipID:   r.id,
+		LastLeadershipLoss: r.loss,
+	}
+}
+
+// writeShutdownReport prints the report as a JSON line on stderr and, if path is
+// set, writes it to path too
+func writeShutdownReport(report ShutdownReport, path string) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(data))
+	if path == "" {
+		return
+	}
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write the shutdown report %s: %s\n", path, err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// WorkResult is what a run of the work returned, written to <key>/results/last so
+// the next run, on this leader or the next one, can resume from it (e.g. the offset
+// it stopped at). Unlike the Handover it is written as soon as the run returned, so
+// it survives a leader that is lost before draining.
+type WorkResult struct {
+	Epoch        uint64          `json:"epoch"` // LockIndex of the leadership that wrote it
+	LeadershipID string          `json:"leadership_id"`
+	At           time.Time       `json:"at"`
+	Data         json.RawMessage `json:"data"`
+}
+
+// resultsPrefix is where the leaders of a key publish the results of their work
+func resultsPrefix(key string) string {
+	return key + "/results/"
+}
+
+// lastResultKey is the result of the last run that published one
+func lastResultKey(key string) string {
+	return resultsPrefix(key) + "last"
+}
+
+// workResultKey is the context key for the results of the current run
+type workResultKey struct{}
+
+type workResult struct {
+	previous *WorkResult
+	mu       sync.Mutex
+	data     json.RawMessage // Set with SetResult
+}
+
+// PreviousResult returns the result published by the last run of the work, nil if
+// none did or outside a work context of a worker publishing its results
+func PreviousResult(ctx context.Context) *WorkResult {
+	if r, ok := ctx.Value(workResultKey{}).(*workResult); ok {
+		return r.previous
+	}
+	return nil
+}
+
+// SetResult sets the result published if the work returns fine, for the next run to
+// get with PreviousResult. v is encoded as JSON, a json.RawMessage is kept as is. It
+// does nothing outside a work context of a worker publishing its results.
+func SetResult(ctx context.Context, v interface{}) error {
+	r, ok := ctx.Value(workResultKey{}).(*workResult)
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.data = data
+	r.mu.Unlock()
+	return nil
+}
+
+// ReturningResult adapts work returning its result to the work of RunElected and
+// RunOnce, the result is published with SetResult. A nil result publishes nothing.
+func ReturningResult(fn func(ctx context.Context) (interface{}, error)) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		v, err := fn(ctx)
+		if err != nil || v == nil {
+			return err
+		}
+		return SetResult(ctx, v)
+	}
+}
+
+// publishingResults wraps fn so it gets the previous result with PreviousResult and
+// the result it sets is published when it returns nil while we are still leader.
+// The write is a check-and-set on the result fn got, guarded by our session: a
+// result can not overwrite one written after the run started. Under the local
+// fallback consul is out of reach, fn gets no previous result and publishes nothing.
+func (ec *exclusiveWorker) publishingResults(fn func(ctx context.Context) error) func(ctx context.Context) error {
+	if !ec.publishResults {
+		return fn
+	}
+
+	return func(ctx context.Context) error {
+		if LocalFallbackFromContext(ctx) {
+			return fn(ctx)
+		}
+		previous, index, err := ec.readResult()
+		if err != nil {
+			// Working from scratch is the job of incremental work anyway
+			ec.logf("Could not read the previous result: %s", err)
+		}
+		r := &workResult{previous: previous}
+		err = fn(context.WithValue(ctx, workResultKey{}, r))
+		r.mu.Lock()
+		data := r.data
+		r.mu.Unlock()
+		if err != nil || ctx.Err() != nil || data == nil {
+			return err
+		}
+
+		ec.mu.Lock()
+		result := WorkResult{
+			Epoch:        ec.lockInfo.LockIndex,
+			LeadershipID: ec.leadershipID,
+			At:           ec.clock.Now(),
+			Data:         data,
+		}
+		ec.mu.Unlock()
+
+		key := lastResultKey(ec.key)
+		value, err := encodeValue(ec.codec, result)
+		if err == nil {
+			value, err = ec.cipher.seal(key, value)
+		}
+		if err == nil {
+			err = ec.KVCASIfHeld(key, value, index)
+		}
+		if err != nil {
+			ec.logf("Could not publish the result: %s", err)
+		}
+		return nil
+	}
+}
+
+// readResult reads the last published result and the index to publish the next one
+// with, nil and 0 if there is none
+func (ec *exclusiveWorker) readResult() (*WorkResult, uint64, error) {
+	pair, _, err := ec.client.KV().Get(lastResultKey(ec.key), &api.QueryOptions{RequireConsistent: true})
+	if err != nil || pair == nil {
+		return nil, 0, err
+	}
+	r, err := decodeWorkResult(pair, ec.cipher)
+	// A result we can not read is replaced by the next one
+	return r, pair.ModifyIndex, err
+}
+
+// decodeWorkResult decodes a result published under the results prefix
+func decodeWorkResult(pair *api.KVPair, c *Cipher) (*WorkResult, error) {
+	value, err := c.open(pair.Key, pair.Value)
+	if err != nil {
+		return nil, err
+	}
+	var r WorkResult
+	if err := decodeValue(value, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// commandResult passes the results to a command: the previous one is in
+// MUTEX_PREVIOUS_RESULT and the command publishes its own by writing it to the file
+// in MUTEX_RESULT_FILE. It returns the environment to add, nothing if the worker
+// does not publish results, and collect, to call once the command exited: it sets
+// the result if the command exited fine and removes the file.
+func commandResult(ctx context.Context) (env []string, collect func(fine bool) error, err error) {
+	if _, ok := ctx.Value(workResultKey{}).(*workResult); !ok {
+		return nil, func(bool) error { return nil }, nil
+	}
+	if previous := PreviousResult(ctx); previous != nil {
+		env = append(env, "MUTEX_PREVIOUS_RESULT="+string(previous.Data))
+	}
+	f, err := os.CreateTemp("", "mutex-result-")
+	if err != nil {
+		return nil, nil, err
+	}
+	f.Close()
+	env = append(env, "MUTEX_RESULT_FILE="+f.Name())
+	collect = func(fine bool) error {
+		defer os.Remove(f.Name())
+		if !fine {
+			return nil
+		}
+		data, err := os.ReadFile(f.Name())
+		if err != nil {
+			return err
+		}
+		data = bytes.TrimSpace(data)
+		switch {
+		case len(data) == 0:
+			return nil
+		case json.Valid(data):
+			return SetResult(ctx, json.RawMessage(data))
+		}
+		// Not JSON, published as a string
+		return SetResult(ctx, string(data))
+	}
+	return env, collect, nil
+}
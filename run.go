@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// runHeld runs fn while we hold the lock with the session renewal next to it in
+// an errgroup: when one of them returns the other is stopped, and both have returned
+// when runHeld does, so nothing outlives the leadership. It returns fn's error, or
+// ErrLeadershipLost if the renewal failed first. The afterWork policy decides if
+// fn returning releases the lock, the runs that returned fine are recorded with
+// recordLastRun, their results are passed on with publishResults, and it holds the
+// file lock of localFallback. Once both returned the snapshot is handed over if we
+// still hold the lock. A panic of fn or of the renewal is returned as an error, the
+// leadership ending like for any other error.
+func (ec *exclusiveWorker) runHeld(ctx context.Context, fn func(ctx context.Context) error) error {
+	fn = ec.holdingLocal(ec.keepLeading(ec.recordingRuns(ec.publishingResults(fn))))
+	g, groupCtx := errgroup.WithContext(ec.WorkContext(ctx))
+	workCtx, cancel := context.WithCancel(groupCtx)
+	defer cancel()
+
+	g.Go(recovering(func() error {
+		if err := ec.renewSession(workCtx.Done()); err != nil {
+			return fmt.Errorf("%w: %w", ErrLeadershipLost, err)
+		}
+		// Stopped by Resign or Close, stop the work too
+		cancel()
+		return nil
+	}))
+	g.Go(recovering(func() error {
+		defer cancel()
+		return fn(workCtx)
+	}))
+	err := g.Wait()
+	ec.writeHandover()
+	return err
+}
+
+// Run runs elector in an errgroup with tasks next to it, like the signal handling or
+// the config watch, and returns the first error once every one of them returned, so
+// none outlives the run. The elector's context is cancelled when a task fails or calls
+// stop (an exit signal), the tasks' once the elector returned: they outlive stop, a
+// second exit signal is still handled.
+func Run(ctx context.Context, elector func(ctx context.Context) error, tasks ...func(ctx context.Context, stop func()) error) error {
+	g, groupCtx := errgroup.WithContext(ctx)
+	electorCtx, stop := context.WithCancel(groupCtx)
+	defer stop()
+	tasksCtx, stopTasks := context.WithCancel(groupCtx)
+	defer stopTasks()
+
+	for _, task := range tasks {
+		g.Go(recovering(func() error { return task(tasksCtx, stop) }))
+	}
+	g.Go(recovering(func() error {
+		defer stopTasks()
+		return elector(electorCtx)
+	}))
+	return g.Wait()
+}
+
+// recovering wraps fn so its panic is returned as an error. The goroutines of an
+// errgroup are not the caller's, a recover up the caller's stack does not see them.
+func recovering(fn func() error) func() error {
+	return func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return fn()
+	}
+}
+
+// RunOnce contends for the lock once and, if we get it, runs fn and releases the lock
+// when it returns. It returns whether we were leader and fn's error, ErrLeadershipLost
+// if the leadership was lost while working, ErrOutsideWindow outside of the window or
+// ErrFresh if the last run is newer than skipIfFresh, ErrPrecondition if a precondition
+// failed before contending or right after getting the lock. It waits while the maintenance
+// flag is set or another generation is preferred. With the api-lock engine consul's
+// api.Lock elects us instead, see runAPILock.
+func (ec *exclusiveWorker) RunOnce(ctx context.Context, fn func(ctx context.Context) error) (bool, error) {
+	if ec.engine == engineAPILock {
+		held, _, err := ec.runAPILock(ctx, fn, true)
+		return held, err
+	}
+	if err := ec.waitForMaintenance(ctx); err != nil {
+		return false, err
+	}
+	if err := ec.waitForGeneration(ctx); err != nil {
+		return false, err
+	}
+	if err := ec.checkFresh(); err != nil {
+		return false, err
+	}
+	if err := ec.checkPreconditions(ctx, "before contending"); err != nil {
+		return false, err
+	}
+	if err := ec.createSession(); err != nil {
+		return false, err
+	}
+	acquired, err := ec.acquireSession()
+	if err != nil || !acquired {
+		ec.destroySession()
+		return false, err
+	}
+	// The previous leader may have finished right before we got the lock
+	if err := ec.checkFresh(); err != nil {
+		ec.destroySession()
+		return false, err
+	}
+	if err := ec.checkPreconditions(ctx, "after acquiring"); err != nil {
+		// Released without lock-delay for a healthy node, then the kept session is destroyed
+		ec.giveBack()
+		ec.destroySession()
+		return false, err
+	}
+	ec.takeOver()
+
+	err = ec.runHeld(ctx, fn)
+
+	// Note: Due to lock-delay (default 15s) you will not be able to get
+	//       the lock right after destroying the session
+	//       https://www.consul.io/docs/internals/sessions.html
+	if derr := ec.destroySession(); derr != nil && !errors.Is(derr, ErrSessionDestroyed) && !errors.Is(derr, ErrNoSession) {
+		err = errors.Join(err, derr)
+	}
+	return true, err
+}
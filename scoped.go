@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// scopedVars are the metrics of the scoped locks of the process
+var scopedVars = expvar.NewMap("scoped")
+
+// scopedAcquireWait is how long AcquireScoped took, contention included
+var scopedAcquireWait = newHistogram(latencyBuckets)
+
+// scopedContended counts the AcquireScoped calls that had to wait for another holder
+var scopedContended = new(expvar.Int)
+
+// scopedBorrowed is how many scoped locks are held with a session of the pool
+var scopedBorrowed = new(expvar.Int)
+
+// scopedEvictions counts the sessions of the pool that were lost and replaced
+var scopedEvictions = new(expvar.Int)
+
+func init() {
+	scopedVars.Set("acquire_wait", scopedAcquireWait)
+	scopedVars.Set("acquire_contended_total", scopedContended)
+	scopedVars.Set("pool_borrowed", scopedBorrowed)
+	scopedVars.Set("pool_evictions_total", scopedEvictions)
+	scopedVars.Set("pool_sessions", expvar.Func(func() any { return scoped.warm() }))
+}
+
+// defaultScopedPoolSize is how many sessions a pool keeps by default: with more than
+// one, losing a session only loses part of the scoped locks
+const defaultScopedPoolSize = 2
+
+// scopedPool is what the scoped locks of the process share: a pool of warm sessions
+// per client and TTL, and the keys held in the process, which a session alone can not
+// tell apart since consul lets a session acquire a key it already holds.
+type scopedPool struct {
+	mu       sync.Mutex
+	size     int
+	sessions map[scopedSessionKey][]*pooledSession
+	held     map[string]chan struct{} // Closed when the key is released
+}
+
+type scopedSessionKey struct {
+	client *api.Client
+	ttl    string
+}
+
+// pooledSession is a session of the pool, kept created and renewed whether or not
+// scoped locks are held with it, so acquiring does not wait for a session create
+type pooledSession struct {
+	*sharedSession
+	borrowed int // Scoped locks held with it, guarded by the mutex of the pool
+}
+
+var scoped = &scopedPool{
+	size:     defaultScopedPoolSize,
+	sessions: map[scopedSessionKey][]*pooledSession{},
+	held:     map[string]chan struct{}{},
+}
+
+// SetScopedPoolSize sets how many sessions the pools of scoped locks keep per client
+// and TTL. Pools grow to the new size right away, they do not shrink: closing a session
+// would release the locks held with it.
+func SetScopedPoolSize(size int) error {
+	if size < 1 {
+		return fmt.Errorf("the scoped session pool needs at least one session, not %d", size)
+	}
+	scoped.mu.Lock()
+	defer scoped.mu.Unlock()
+	scoped.size = size
+	for k, sessions := range scoped.sessions {
+		scoped.sessions[k] = scoped.fill(k, sessions)
+	}
+	return nil
+}
+
+// WarmScoped creates the session pool of client and ttl ahead of the first
+// AcquireScoped, which then does not wait for a session either
+func WarmScoped(client *api.Client, ttl string) error {
+	if err := checkTTL(ttl); err != nil {
+		return err
+	}
+	scoped.pool(client, ttl)
+	return nil
+}
+
+// ScopedLock is a short-lived lock, e.g. for the duration of a request, as opposed to
+// the long leadership of a worker. It is held with a session borrowed from the pool
+// of the process, so acquiring it costs a single KV acquire when it is free.
+type ScopedLock struct {
+	client    *api.Client
+	key       string
+	sessionID string
+	session   *pooledSession
+	lost      <-chan struct{}
+	released  chan struct{}
+	waited    time.Duration
+	once      sync.Once
+}
+
+// AcquireScoped blocks until we hold key or ctx is done. ttl is the TTL of the pooled
+// sessions: how long the locks of a crashed process stay held. The pool is created by
+// the first call for a client and TTL (or by WarmScoped) and renewed in the background
+// from then on.
+func AcquireScoped(ctx context.Context, client *api.Client, key, ttl string) (*ScopedLock, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	if err := checkTTL(ttl); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	released, err := scoped.lockLocal(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	session := scoped.borrow(client, ttl)
+	l, err := acquireScoped(ctx, client, key, session.sharedSession)
+	if err != nil {
+		scoped.giveBack(session)
+		scoped.unlockLocal(key, released)
+		return nil, err
+	}
+	l.session, l.released, l.waited = session, released, time.Since(start)
+	scopedAcquireWait.observe(l.waited)
+	return l, nil
+}
+
+// acquireScoped acquires key with the shared session s, waiting with blocking
+// queries while someone else holds it
+func acquireScoped(ctx context.Context, client *api.Client, key string, s *sharedSession) (*ScopedLock, error) {
+	contended := false
+	var index uint64
+	for {
+		sessionID, err := s.get()
+		if err != nil {
+			return nil, err
+		}
+		acquired, _, err := client.KV().Acquire(&api.KVPair{Key: key, Session: sessionID}, (&api.WriteOptions{}).WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			return &ScopedLock{client: client, key: key, sessionID: sessionID, lost: s.lost(sessionID)}, nil
+		}
+		if !contended {
+			contended = true
+			scopedContended.Add(1)
+		}
+
+		pair, meta, err := client.KV().Get(key, (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		index = meta.LastIndex
+		if pair == nil || pair.Session == "" {
+			// Free, but the lock-delay of a lost holder may still keep us out
+			select {
+			case <-time.After(retryInterval):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+// Key returns the locked key
+func (l *ScopedLock) Key() string {
+	return l.key
+}
+
+// Waited returns how long AcquireScoped took
+func (l *ScopedLock) Waited() time.Duration {
+	return l.waited
+}
+
+// Lost is closed if the pooled session was lost while we held the lock: someone
+// else may hold it now
+func (l *ScopedLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release gives the key back. The session goes back to the pool for the next scoped locks.
+func (l *ScopedLock) Release() error {
+	var err error
+	l.once.Do(func() {
+		defer scoped.unlockLocal(l.key, l.released)
+		defer scoped.giveBack(l.session)
+		_, _, err = l.client.KV().Release(&api.KVPair{Key: l.key, Session: l.sessionID}, nil)
+	})
+	return err
+}
+
+// pool returns the sessions of client and ttl, creating the pool if needed
+func (p *scopedPool) pool(client *api.Client, ttl string) []*pooledSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	k := scopedSessionKey{client, ttl}
+	sessions := p.fill(k, p.sessions[k])
+	p.sessions[k] = sessions
+	return sessions
+}
+
+// fill adds sessions up to the size of the pool and keeps them warm. Call with mu held.
+func (p *scopedPool) fill(k scopedSessionKey, sessions []*pooledSession) []*pooledSession {
+	for len(sessions) < p.size {
+		s := &pooledSession{sharedSession: newSharedSession(k.client, k.ttl)}
+		sessions = append(sessions, s)
+		go s.keepWarm()
+	}
+	return sessions
+}
+
+// borrow returns the healthy session of the pool of client and ttl with the fewest
+// scoped locks held, or any of them if none is healthy: its get creates it again.
+func (p *scopedPool) borrow(client *api.Client, ttl string) *pooledSession {
+	sessions := p.pool(client, ttl)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *pooledSession
+	for _, s := range sessions {
+		if !s.healthy() {
+			continue
+		}
+		if best == nil || s.borrowed < best.borrowed {
+			best = s
+		}
+	}
+	if best == nil {
+		best = sessions[0]
+	}
+	best.borrowed++
+	scopedBorrowed.Add(1)
+	return best
+}
+
+// giveBack returns s to the pool
+func (p *scopedPool) giveBack(s *pooledSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.borrowed--
+	scopedBorrowed.Add(-1)
+}
+
+// warm returns how many sessions of the pools are healthy
+func (p *scopedPool) warm() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, sessions := range p.sessions {
+		for _, s := range sessions {
+			if s.healthy() {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// keepWarm creates the session and creates it again as soon as it is lost, so there
+// is always one ready to borrow. While its renewals fail it is not borrowed.
+func (s *pooledSession) keepWarm() {
+	for {
+		id, err := s.get()
+		if errors.Is(err, ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Could not create a session for the scoped locks: %s", err)
+			select {
+			case <-time.After(retryInterval):
+				continue
+			case <-s.stop:
+				return
+			}
+		}
+		select {
+		case <-s.lost(id):
+			scopedEvictions.Add(1)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// lockLocal waits until no scoped lock of the process holds key and marks it held.
+// It returns the channel to close when the key is released.
+func (p *scopedPool) lockLocal(ctx context.Context, key string) (chan struct{}, error) {
+	for {
+		p.mu.Lock()
+		held, ok := p.held[key]
+		if !ok {
+			released := make(chan struct{})
+			p.held[key] = released
+			p.mu.Unlock()
+			return released, nil
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-held:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// unlockLocal lets the next scoped lock of the process have key
+func (p *scopedPool) unlockLocal(key string, released chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.held[key] == released {
+		delete(p.held, key)
+	}
+	close(released)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ErrSharedSession is returned when changing the TTL of a worker whose session is shared
+var ErrSharedSession = errors.New("the session is shared with other locks")
+
+// sharedSession is one consul session backing the locks of several workers of the
+// process: one TTL and one renewal loop instead of one per key, which cuts the session
+// churn and the renewal traffic of a process holding many fine-grained locks.
+// The workers give their keys back with a KV release instead of destroying it, and
+// all of them lose their lock together if it expires. Close destroys it.
+type sharedSession struct {
+	client      *api.Client
+	renewClient *api.Client // Renews the session, client unless set after newSharedSession
+	ttl         string
+
+	mu       sync.Mutex
+	id       string                        // Empty until the first worker needs it, or after it was lost
+	done     chan struct{}                 // Closed when the session id is lost
+	err      error                         // Why it was lost
+	failing  bool                          // The last renewal failed
+	workers  map[*exclusiveWorker]struct{} // Holding a key, their leases follow the renewals
+	closed   bool
+	creating chan struct{} // Closed once get created the session or failed to, nil unless creating
+	stop     chan struct{} // Closed by Close
+}
+
+func newSharedSession(client *api.Client, ttl string) *sharedSession {
+	return &sharedSession{
+		client:      client,
+		renewClient: client,
+		ttl:         ttl,
+		workers:     map[*exclusiveWorker]struct{}{},
+		stop:        make(chan struct{}),
+	}
+}
+
+// get returns the ID of the session, creating it and starting its renewals if it
+// does not exist yet or was lost. The session is created without s.mu, so healthy()
+// and the renewals do not wait for consul; the other callers wait for that creation.
+func (s *sharedSession) get() (string, error) {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return "", ErrClosed
+		}
+		if s.id != "" {
+			id := s.id
+			s.mu.Unlock()
+			return id, nil
+		}
+		if creating := s.creating; creating != nil {
+			s.mu.Unlock()
+			<-creating
+			continue
+		}
+		creating := make(chan struct{})
+		s.creating = creating
+		s.mu.Unlock()
+
+		id, _, err := s.client.Session().Create(&api.SessionEntry{TTL: s.ttl, Behavior: "delete"}, nil)
+
+		s.mu.Lock()
+		s.creating = nil
+		close(creating)
+		if err != nil {
+			s.mu.Unlock()
+			return "", err
+		}
+		if s.closed {
+			// Closed meanwhile, Close did not know about it
+			s.mu.Unlock()
+			s.client.Session().Destroy(id, nil)
+			return "", ErrClosed
+		}
+		s.id, s.err, s.done = id, nil, make(chan struct{})
+		go s.renewLoop(id, s.done)
+		s.mu.Unlock()
+		return id, nil
+	}
+}
+
+// renewLoop renews the session every TTL/2, retrying failures every second until
+// the TTL is over, and moves the lease deadlines of the workers holding a key.
+// When the session is lost the workers holding a key are told through done.
+func (s *sharedSession) renewLoop(id string, done chan struct{}) {
+	ttl, _ := time.ParseDuration(s.ttl)
+	wait := ttl / 2
+	lastRenewTime := time.Now()
+	var lastErr error
+	for {
+		select {
+		case <-time.After(wait):
+		case <-s.stop:
+			return
+		}
+
+		start := time.Now()
+		entry, _, err := s.renewClient.Session().Renew(id, nil)
+		if err == nil && entry == nil {
+			err = api.ErrSessionExpired
+		}
+		if err == nil {
+			if serverTTL, err := time.ParseDuration(entry.TTL); err == nil {
+				ttl = serverTTL
+			}
+			wait, lastRenewTime, lastErr = ttl/2, time.Now(), nil
+			s.setFailing(false)
+			for _, w := range s.following() {
+				w.renewed(start, ttl)
+			}
+			continue
+		}
+
+		for _, w := range s.following() {
+			w.emit(EventRenewFailure, err.Error())
+		}
+		s.setFailing(true)
+		wait, lastErr = time.Second, err
+		if errors.Is(err, api.ErrSessionExpired) || time.Since(lastRenewTime) > ttl {
+			s.mu.Lock()
+			s.id, s.err, s.failing = "", lastErr, false
+			s.mu.Unlock()
+			close(done)
+			return
+		}
+	}
+}
+
+func (s *sharedSession) setFailing(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+// healthy says if the session exists and its last renewal went through
+func (s *sharedSession) healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id != "" && !s.failing && !s.closed
+}
+
+// lost returns a channel closed when the session id is lost, already closed if it is
+func (s *sharedSession) lost(id string) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.id != id {
+		lost := make(chan struct{})
+		close(lost)
+		return lost
+	}
+	return s.done
+}
+
+// following returns the workers whose leases follow the renewals
+func (s *sharedSession) following() []*exclusiveWorker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	workers := make([]*exclusiveWorker, 0, len(s.workers))
+	for w := range s.workers {
+		workers = append(workers, w)
+	}
+	return workers
+}
+
+// follow is the renewal loop of a worker holding a key with the session: its leases
+// follow the renewals of the session until stop is closed, mismatch is closed (the
+// error is then verifyErr's) or the session sessionID is lost.
+func (s *sharedSession) follow(ec *exclusiveWorker, sessionID string, stop, mismatch <-chan struct{}, verifyErr func() error) error {
+	s.mu.Lock()
+	if s.id != sessionID {
+		s.mu.Unlock()
+		return api.ErrSessionExpired
+	}
+	done := s.done
+	s.workers[ec] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.workers, ec)
+		s.mu.Unlock()
+	}()
+	select {
+	case <-done:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.err
+	case <-mismatch:
+		return verifyErr()
+	case <-stop:
+		return nil
+	}
+}
+
+// Close stops the renewals and destroys the session, which releases the keys still
+// held with it. Close the workers first.
+func (s *sharedSession) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	id := s.id
+	s.id = ""
+	s.mu.Unlock()
+
+	if id == "" {
+		return nil
+	}
+	_, err := s.client.Session().Destroy(id, nil)
+	return err
+}
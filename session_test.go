@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// slowCreates serves a memoryConsul whose session creations wait until release is called
+func slowCreates(t *testing.T) (*memoryConsul, *api.Client, *atomic.Int32, func()) {
+	m := newMemoryConsul()
+	released := make(chan struct{})
+	var once sync.Once
+	release := func() { once.Do(func() { close(released) }) }
+	creates := &atomic.Int32{}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/session/create" {
+			creates.Add(1)
+			<-released
+		}
+		m.ServeHTTP(rw, r)
+	}))
+	t.Cleanup(srv.Close)
+	// Runs before srv.Close, which waits for the requests, if the test fails early
+	t.Cleanup(release)
+	client, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, client, creates, release
+}
+
+// waitForCreate waits until a session creation is waiting for release
+func waitForCreate(t *testing.T, creates *atomic.Int32) {
+	deadline := time.Now().Add(5 * time.Second)
+	for creates.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the session is not being created")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// within fails if fn does not return within a second
+func within(t *testing.T, what string, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s waits for the creation of the session", what)
+	}
+}
+
+// TestSharedSessionCreate checks the session is created once for concurrent callers,
+// without blocking healthy() and the pool meanwhile
+func TestSharedSessionCreate(t *testing.T) {
+	m, client, creates, release := slowCreates(t)
+	s := newSharedSession(client, "10s")
+
+	ids := make([]string, 3)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := s.get()
+			if err != nil {
+				t.Error(err)
+			}
+			ids[i] = id
+		}()
+	}
+	waitForCreate(t, creates)
+	within(t, "healthy", func() {
+		if s.healthy() {
+			t.Error("healthy before the session exists")
+		}
+	})
+	pool := &scopedPool{size: 1, sessions: map[scopedSessionKey][]*pooledSession{}}
+	pool.sessions[scopedSessionKey{client, "10s"}] = []*pooledSession{{sharedSession: s}}
+	within(t, "warm", func() { pool.warm() })
+	release()
+	wg.Wait()
+
+	if n := creates.Load(); n != 1 {
+		t.Errorf("%d sessions created", n)
+	}
+	if ids[0] == "" || ids[1] != ids[0] || ids[2] != ids[0] {
+		t.Errorf("the callers got the sessions %q", ids)
+	}
+	if !s.healthy() {
+		t.Error("not healthy once created")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.sessionCount(); n != 0 {
+		t.Errorf("%d sessions left after Close", n)
+	}
+}
+
+// TestSharedSessionCloseWhileCreating checks Close does not wait for a creation and
+// the session created meanwhile is destroyed
+func TestSharedSessionCloseWhileCreating(t *testing.T) {
+	m, client, creates, release := slowCreates(t)
+	s := newSharedSession(client, "10s")
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.get()
+		errc <- err
+	}()
+	waitForCreate(t, creates)
+	within(t, "Close", func() { s.Close() })
+	release()
+	if err := <-errc; !errors.Is(err, ErrClosed) {
+		t.Fatalf("get returned %v", err)
+	}
+	if n := m.sessionCount(); n != 0 {
+		t.Errorf("%d sessions left after Close", n)
+	}
+}
+
+// TestCloseKeptSession checks Close destroys a session kept by keepSession instead
+// of only releasing the key
+func TestCloseKeptSession(t *testing.T) {
+	m, client := newTestConsul(t)
+	ec := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:         client,
+		key:            "test/close-kept",
+		sessionTimeout: "10s",
+		quiet:          true,
+		keepSession:    true,
+	})
+	if err := ec.createSession(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := ec.acquireSession(); !ok {
+		t.Fatalf("not acquired: %v", err)
+	}
+	session := ec.currentSession()
+	if err := ec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if m.hasSession(session) {
+		t.Fatal("the kept session outlived Close")
+	}
+	if holder := m.holderOf("test/close-kept"); holder != "" {
+		t.Fatalf("%s still holds the key", holder)
+	}
+}
+
+// TestAcquireFencingToken checks a handle has a fencing token without verifyAcquire:
+// the key is then read back by Acquire
+func TestAcquireFencingToken(t *testing.T) {
+	_, client := newTestConsul(t)
+	ec := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:         client,
+		key:            "test/fencing",
+		sessionTimeout: "10s",
+		quiet:          true,
+	})
+	defer ec.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l, err := ec.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Release()
+	info, ok := ec.LockInfo()
+	if !ok {
+		t.Fatal("no LockInfo while holding the lock")
+	}
+	if l.Epoch() == 0 || l.FencingToken() != info.LockIndex {
+		t.Fatalf("epoch %d and fencing token %d, the key is at LockIndex %d", l.Epoch(), l.FencingToken(), info.LockIndex)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// rebalanceInterval is how often a ShardedLock recounts the members and adjusts the shards it holds
+const rebalanceInterval = 10 * time.Second
+
+// ShardedLock partitions work in shards, each one a lock under a prefix, so it spreads
+// over the fleet instead of going through a single leader:
+//
+//	<prefix>/shards/<n>         the lock of shard n
+//	<prefix>/members/<session>  one per running instance, gone with its session
+//
+// Every instance holds its fair share, shards/members, plus one for the first
+// shards%members members in the order of their keys, and takes more while shards
+// are free. When an instance joins the others give back the shards above
+// their share, when one leaves its shards are free for the others to take.
+// All the shards of an instance are backed by one shared session.
+//
+// Every instance watches the prefix and rebalances as soon as a member or a shard
+// changes, besides every rebalanceInterval: holders shed the shards above their share
+// as soon as they see a new member, which takes them as soon as it sees them free, so
+// ownership converges within a few consul round trips (rebalanceInterval if the watch fails).
+type ShardedLock struct {
+	client  *api.Client
+	prefix  string
+	session *sharedSession
+	workers []*exclusiveWorker // One per shard
+
+	mu   sync.Mutex
+	held map[int]bool
+}
+
+// NewShardedLock creates the locks of shards shards under prefix, with sessions of ttl
+func NewShardedLock(client *api.Client, prefix string, shards int, ttl string) (*ShardedLock, error) {
+	if err := validateKey(prefix); err != nil {
+		return nil, err
+	}
+	if shards < 1 {
+		return nil, fmt.Errorf("invalid number of shards %d", shards)
+	}
+	if err := checkTTL(ttl); err != nil {
+		return nil, err
+	}
+
+	s := &ShardedLock{
+		client:  client,
+		prefix:  prefix,
+		session: newSharedSession(client, ttl),
+		held:    map[int]bool{},
+	}
+	for i := 0; i < shards; i++ {
+		s.workers = append(s.workers, newExclusiveWorker(&exclusiveWorkerConfig{
+			client:  client,
+			key:     shardKey(prefix, i),
+			session: s.session,
+		}))
+	}
+	return s, nil
+}
+
+// shardKey is the lock of a shard
+func shardKey(prefix string, shard int) string {
+	return fmt.Sprintf("%s/shards/%d", prefix, shard)
+}
+
+// membersPrefix is where the instances sharing the shards of prefix register
+func membersPrefix(prefix string) string {
+	return prefix + "/members/"
+}
+
+// Run runs fn for every shard we hold, with a context cancelled when we give the shard
+// back or lose it, and rebalances every rebalanceInterval. It blocks until ctx is done,
+// then releases every shard and destroys the session.
+func (s *ShardedLock) Run(ctx context.Context, fn func(ctx context.Context, shard int) error) error {
+	var wg sync.WaitGroup
+	defer func() {
+		for _, w := range s.workers {
+			w.Close()
+		}
+		wg.Wait()
+		s.session.Close()
+	}()
+
+	changed := make(chan struct{}, 1)
+	f := newFollower(s.client, map[string]interface{}{"type": "keyprefix", "prefix": s.prefix + "/"}, func(uint64, interface{}) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	if err := f.Start(); err != nil {
+		return err
+	}
+	defer f.Stop()
+
+	ticker := time.NewTicker(rebalanceInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.rebalance(ctx, &wg, fn); err != nil && ctx.Err() == nil {
+			log.Printf("[%s] Could not rebalance the shards: %s", s.prefix, err)
+		}
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Held returns the shards we hold
+func (s *ShardedLock) Held() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var shards []int
+	for i := range s.workers {
+		if s.held[i] {
+			shards = append(shards, i)
+		}
+	}
+	return shards
+}
+
+// rebalance registers us as a member, gives back the shards above our share
+// and tries to take free shards until we have it
+func (s *ShardedLock) rebalance(ctx context.Context, wg *sync.WaitGroup, fn func(ctx context.Context, shard int) error) error {
+	sessionID, err := s.session.get()
+	if err != nil {
+		return err
+	}
+	members, _, err := s.client.KV().Keys(membersPrefix(s.prefix), "", nil)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(members, membersPrefix(s.prefix)+sessionID) {
+		// Only write when we are missing, every write wakes up the watch of every member
+		member := &api.KVPair{Key: membersPrefix(s.prefix) + sessionID, Session: sessionID}
+		if _, _, err := s.client.KV().Acquire(member, nil); err != nil {
+			return err
+		}
+		members = append(members, member.Key)
+		slices.Sort(members)
+	}
+	share := shardShare(len(s.workers), members, membersPrefix(s.prefix)+sessionID)
+
+	held := s.Held()
+	if len(held) > share {
+		for _, i := range held[share:] {
+			s.workers[i].Resign()
+		}
+		held = held[:share]
+	}
+
+	// Start at a random shard so new members don't all race for the same ones
+	offset := rand.Intn(len(s.workers))
+	for n := 0; n < len(s.workers) && len(held) < share; n++ {
+		i := (offset + n) % len(s.workers)
+		s.mu.Lock()
+		running := s.held[i]
+		s.mu.Unlock()
+		if running {
+			continue
+		}
+		if s.take(ctx, wg, i, fn) {
+			held = append(held, i)
+		}
+	}
+	return nil
+}
+
+// shardShare is how many of shards the member should hold: every member gets
+// shards/len(members) and the first shards%len(members) one more, so the shares add
+// up to shards. Rounding up instead could leave a member with nothing, e.g. 4 shards
+// over 3 members would be 2, 2 and 0. members must be sorted.
+func shardShare(shards int, members []string, member string) int {
+	share := shards / len(members)
+	if i, _ := slices.BinarySearch(members, member); i < shards%len(members) {
+		share++
+	}
+	return share
+}
+
+// take tries to acquire shard i once and, if we got it, runs fn for it in the background
+func (s *ShardedLock) take(ctx context.Context, wg *sync.WaitGroup, i int, fn func(ctx context.Context, shard int) error) bool {
+	acquired := make(chan bool, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ok, err := s.workers[i].RunOnce(ctx, func(ctx context.Context) error {
+			s.setHeld(i, true)
+			defer s.setHeld(i, false)
+			acquired <- true
+			return fn(ctx, i)
+		})
+		if !ok {
+			acquired <- false
+		}
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, ErrClosed) {
+			s.workers[i].logf("shard %d: %s", i, err)
+		}
+	}()
+	return <-acquired
+}
+
+func (s *ShardedLock) setHeld(i int, held bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held[i] = held
+}
+
+// runShards runs a command for every shard we hold of the shards shared by the
+// instances running it with the same prefix, see ShardedLock:
+//
+//	mutual-exclusion-consul shards -prefix crawler -shards 16 -- crawl.sh
+//
+// The command of a shard gets MUTEX_SHARD and MUTEX_SHARDS in its environment, besides
+// what it gets in the run-command mode (MUTEX_KEY is the lock of the shard), and is
+// stopped like there when we give the shard back. If it exits the shard is given back
+// too, and taken again by whoever rebalances first. It runs until interrupted.
+func runShards(args []string) int {
+	fs := flag.NewFlagSet("shards", flag.ExitOnError)
+	prefix := fs.String("prefix", envOr("MUTEX_PREFIX", ""), "prefix of the shard locks and of the members")
+	shards := fs.Int("shards", 0, "number of shards")
+	ttl := fs.String("ttl", envOr("MUTEX_TTL", "15s"), "TTL of the session backing every shard we hold")
+	killGrace := fs.Duration("kill-grace", 10*time.Second, "how long the command of a shard has to exit after we give the shard back before being killed")
+	fs.Parse(args)
+	if *prefix == "" || fs.NArg() == 0 {
+		log.Println("-prefix and a command are required")
+		return 2
+	}
+	client, err := api.NewClient(&api.Config{Address: consulAddress})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	s, err := NewShardedLock(client, *prefix, *shards, *ttl)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	signals := signalConfig{}
+	signals.add(defaultExitSignals, actionExit)
+	interrupted := make(chan os.Signal, 1)
+	for sig := range signals {
+		signal.Notify(interrupted, sig)
+	}
+	go func() {
+		sig := <-interrupted
+		log.Printf("Got %s. Giving the shards back", sig)
+		stop()
+	}()
+
+	err = s.Run(ctx, func(ctx context.Context, shard int) error {
+		err := runCommand(ctx, s.workers[shard], &commandConfig{
+			args:      fs.Args(),
+			killGrace: *killGrace,
+			env:       []string{"MUTEX_SHARD=" + strconv.Itoa(shard), "MUTEX_SHARDS=" + strconv.Itoa(*shards)},
+		})
+		if ctx.Err() != nil {
+			// Stopped because we gave the shard back
+			return nil
+		}
+		return err
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestShardShare checks the shares of the members add up to the shards and differ by one at most
+func TestShardShare(t *testing.T) {
+	for shards := 1; shards <= 12; shards++ {
+		for n := 1; n <= 8; n++ {
+			var members []string
+			for i := 0; i < n; i++ {
+				members = append(members, fmt.Sprintf("shards/members/%02d", i))
+			}
+			total, low, high := 0, shards, 0
+			for _, m := range members {
+				share := shardShare(shards, members, m)
+				total += share
+				low, high = min(low, share), max(high, share)
+			}
+			if total != shards || high-low > 1 {
+				t.Errorf("%d shards over %d members: %d in total, between %d and %d each", shards, n, total, low, high)
+			}
+		}
+	}
+}
+
+// TestShardedLockRebalance checks a second member gets its share: the first one
+// gives back the shards above its share as soon as it sees it, and it takes them
+func TestShardedLockRebalance(t *testing.T) {
+	_, client := newTestConsul(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	start := func() *ShardedLock {
+		s, err := NewShardedLock(client, "test/shards", 4, "10s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Run(ctx, func(ctx context.Context, shard int) error {
+				<-ctx.Done()
+				return nil
+			})
+		}()
+		return s
+	}
+	converge := func(what string, members ...*ShardedLock) {
+		t.Helper()
+		for {
+			held := make([]int, len(members))
+			seen := map[int]bool{}
+			for i, s := range members {
+				for _, shard := range s.Held() {
+					seen[shard] = true
+					held[i]++
+				}
+			}
+			if len(seen) == 4 && slices.Min(held) == 4/len(members) && slices.Max(held) == 4/len(members) {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("%s: the members hold %v shards", what, held)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	first := start()
+	converge("alone", first)
+	second := start()
+	converge("after a member joined", first, second)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// SharedValue is a piece of state published by the leader for its followers.
+// Epoch is the LockIndex of the leadership that wrote it, so a value from an
+// older leader is never taken over one from a newer leader.
+type SharedValue struct {
+	Name         string          `json:"name"`
+	Epoch        uint64          `json:"epoch"`
+	LeadershipID string          `json:"leadership_id"`
+	Data         json.RawMessage `json:"data"`
+	Chunks       *chunkRef       `json:"chunks,omitempty"` // Set while Data is in chunks, followers get the reassembled Data
+}
+
+// sharedPrefix is where the leader of a key publishes its shared state
+func sharedPrefix(key string) string {
+	return key + "/shared/"
+}
+
+// Publish stores v as JSON under name for the followers to watch. It is refused
+// (ErrNotHeld or a *StateError) when we are not the leader. Values larger than
+// consul accepts fail with ErrValueTooLarge, or are written in chunks if chunkShared is set.
+func (ec *exclusiveWorker) Publish(name string, v interface{}) error {
+	if name == "" || strings.HasPrefix(name, "/") {
+		return fmt.Errorf("invalid shared state name %q", name)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	ec.mu.Lock()
+	sv := SharedValue{
+		Name:         name,
+		Epoch:        ec.lockInfo.LockIndex,
+		LeadershipID: ec.leadershipID,
+		Data:         data,
+	}
+	ec.mu.Unlock()
+
+	key := sharedPrefix(ec.key) + name
+	if !ec.chunkShared {
+		return ec.putShared(key, sv)
+	}
+	value, err := encodeValue(ec.codec, sv)
+	if err == nil {
+		value, err = ec.cipher.seal(key, value)
+	}
+	if err != nil {
+		return err
+	}
+	if len(value) <= maxValueSize {
+		return ec.KVPutIfHeld(key, value)
+	}
+	return ec.publishChunked(key, sv, value)
+}
+
+// putShared writes a shared value in a single entry
+func (ec *exclusiveWorker) putShared(key string, sv SharedValue) error {
+	value, err := encodeValue(ec.codec, sv)
+	if err == nil {
+		value, err = ec.cipher.seal(key, value)
+	}
+	if err != nil {
+		return err
+	}
+	return ec.KVPutIfHeld(key, value)
+}
+
+// WatchShared calls fn with every new value published by the leaders of key,
+// in the order they were written. It blocks until ctx is done.
+// c decrypts the values, it can be nil.
+func WatchShared(ctx context.Context, client *api.Client, key string, c *Cipher, fn func(SharedValue)) error {
+	f := SharedFollower(client, key, c, fn)
+	if err := f.Start(); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	f.Stop()
+	return ctx.Err()
+}
+
+// SharedFollower returns a follower that calls fn with every new value published
+// by the leaders of key, in the order they were written. c decrypts the values,
+// it can be nil. It must be started.
+func SharedFollower(client *api.Client, key string, c *Cipher, fn func(SharedValue)) *Follower {
+	seen := map[string]uint64{}   // ModifyIndex of every name already delivered
+	epochs := map[string]uint64{} // Newest epoch delivered for every name
+
+	params := map[string]interface{}{"type": "keyprefix", "prefix": sharedPrefix(key)}
+	return newFollower(client, params, func(_ uint64, raw interface{}) {
+		pairs, _ := raw.(api.KVPairs)
+
+		// Deliver in write order
+		var changed api.KVPairs
+		for _, pair := range pairs {
+			if seen[pair.Key] != pair.ModifyIndex {
+				changed = append(changed, pair)
+			}
+		}
+		sort.Slice(changed, func(i, j int) bool { return changed[i].ModifyIndex < changed[j].ModifyIndex })
+		for _, pair := range changed {
+			seen[pair.Key] = pair.ModifyIndex
+			value, err := c.open(pair.Key, pair.Value)
+			if err != nil {
+				logWithID(key, "", "ignoring shared state %s: %s", pair.Key, err)
+				continue
+			}
+			var sv SharedValue
+			if err := decodeValue(value, &sv); err != nil {
+				logWithID(key, "", "ignoring invalid shared state %s: %s", pair.Key, err)
+				continue
+			}
+			if sv.Chunks != nil {
+				if sv, err = readShared(client, key, pair.Key, c, sv); err != nil {
+					logWithID(key, "", "ignoring shared state %s: %s", pair.Key, err)
+					continue
+				}
+			}
+			if sv.Epoch < epochs[sv.Name] {
+				continue
+			}
+			epochs[sv.Name] = sv.Epoch
+			fn(sv)
+		}
+	})
+}
+
+// readShared reads the chunks of a chunked shared value and decodes it
+func readShared(client *api.Client, key, sharedKey string, c *Cipher, index SharedValue) (SharedValue, error) {
+	value, err := readChunks(client, key, index.Name, index.Chunks)
+	if err == nil {
+		value, err = c.open(sharedKey, value)
+	}
+	if err != nil {
+		return SharedValue{}, err
+	}
+	var sv SharedValue
+	err = decodeValue(value, &sv)
+	return sv, err
+}
+
+// runShared prints the shared state published by the leaders of a key, one JSON
+// SharedValue per line, as it is published until interrupted:
+//
+//	mutual-exclusion-consul shared -key service/bobruner/leader
+//
+// The leader publishes with Publish, or from its command with POST /v1/shared on the
+// introspection endpoint.
+func runShared(args []string) int {
+	fs := flag.NewFlagSet("shared", flag.ExitOnError)
+	key := fs.String("key", envOr("MUTEX_KEY", ""), "lock key")
+	encryptionKey := fs.String("encryption-key", envOr("MUTEX_ENCRYPTION_KEY", ""), "base64 AES key the workers encrypt the shared state with")
+	fs.Parse(args)
+	if *key == "" {
+		log.Println("-key is required")
+		return 2
+	}
+	cipher, err := newCipher(*encryptionKey)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	client, err := api.NewClient(&api.Config{Address: consulAddress})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	signals := signalConfig{}
+	signals.add(defaultExitSignals, actionExit)
+	interrupted := make(chan os.Signal, 1)
+	for sig := range signals {
+		signal.Notify(interrupted, sig)
+	}
+	go func() {
+		<-interrupted
+		stop()
+	}()
+
+	enc := json.NewEncoder(os.Stdout)
+	err = WatchShared(ctx, client, *key, cipher, func(sv SharedValue) {
+		enc.Encode(sv)
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestWatchShared checks the followers see what the leader publishes, and that
+// a follower can not publish
+func TestWatchShared(t *testing.T) {
+	_, client := newTestConsul(t)
+	newWorker := func() *exclusiveWorker {
+		ec := newExclusiveWorker(&exclusiveWorkerConfig{
+			client:         client,
+			key:            "test/shared",
+			sessionTimeout: "10s",
+			quiet:          true,
+		})
+		t.Cleanup(func() { ec.Close() })
+		return ec
+	}
+	leader, follower := newWorker(), newWorker()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := leader.waitForLeadership(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var stateErr *StateError
+	if err := follower.Publish("config", 1); !errors.As(err, &stateErr) {
+		t.Fatalf("a follower published: %v", err)
+	}
+
+	values := make(chan SharedValue, 2)
+	watched := make(chan error, 1)
+	go func() {
+		watched <- WatchShared(ctx, client, "test/shared", nil, func(sv SharedValue) { values <- sv })
+	}()
+	for i, batch := range []string{"1", "2"} {
+		if err := leader.Publish("batch", i+1); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case sv := <-values:
+			if sv.Name != "batch" || string(sv.Data) != batch || sv.LeadershipID != leader.LeadershipID() {
+				t.Fatalf("watched %+v", sv)
+			}
+		case <-ctx.Done():
+			t.Fatalf("batch %s was not watched", batch)
+		}
+	}
+	cancel()
+	if err := <-watched; !errors.Is(err, context.Canceled) {
+		t.Fatalf("WatchShared returned %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// signalAction is what we do when we receive a signal
+type signalAction string
+
+const (
+	actionExit   signalAction = "exit"   // Resign and exit
+	actionResign signalAction = "resign" // Resign but keep running, with -elect we contend again
+	actionReload signalAction = "reload" // Reload the configuration
+)
+
+// signalConfig maps each handled signal to its action
+type signalConfig map[os.Signal]signalAction
+
+// add parses a comma separated list of signal names (e.g. "INT,TERM") and maps them to action
+func (sc signalConfig) add(names string, action signalAction) error {
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToUpper(strings.TrimPrefix(strings.TrimSpace(name), "SIG"))
+		if name == "" {
+			continue
+		}
+		sig, ok := signalsByName[name]
+		if !ok {
+			return fmt.Errorf("unknown or unsupported signal %q", name)
+		}
+		if other, ok := sc[sig]; ok && other != action {
+			return fmt.Errorf("signal %s is configured for both %s and %s", name, other, action)
+		}
+		sc[sig] = action
+	}
+	return nil
+}
+
+// handleSignals runs the action of each configured signal until ctx is done.
+// The first exit signal calls exit, which should stop the work (and the wrapped command)
+// and let main clean up. A second one closes the worker and exits right away.
+// onReload is called for reload signals.
+func handleSignals(ctx context.Context, w *exclusiveWorker, sc signalConfig, exit func(), onReload func()) error {
+	c := make(chan os.Signal, 1)
+	for sig := range sc {
+		signal.Notify(c, sig)
+	}
+	defer signal.Stop(c)
+
+	exiting := false
+	for {
+		var sig os.Signal
+		select {
+		case sig = <-c:
+		case <-ctx.Done():
+			return nil
+		}
+		switch sc[sig] {
+		case actionExit:
+			if !exiting {
+				exiting = true
+				w.logf("Got %s. Cleaning up", sig)
+				exit()
+				continue
+			}
+			w.logf("Got %s again. Exiting now", sig)
+			err := w.Close()
+			if err != nil {
+				w.logf("Could not destroy session")
+			}
+			os.Exit(1)
+		case actionResign:
+			w.logf("Got %s. Resigning", sig)
+			w.Resign()
+		case actionReload:
+			w.logf("Got %s. Reloading", sig)
+			onReload()
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalsByName are the signals that can be configured, without the SIG prefix
+var signalsByName = map[string]os.Signal{
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+	"HUP":  syscall.SIGHUP,
+	"QUIT": syscall.SIGQUIT,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// Default signals for each action
+const (
+	defaultExitSignals   = "INT,TERM"
+	defaultResignSignals = "USR1"
+	defaultReloadSignals = "HUP"
+)
@@ -0,0 +1,22 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalsByName are the signals that can be configured. On windows INT is
+// Ctrl+C or CTRL_BREAK and TERM is the console being closed, logoff or shutdown
+var signalsByName = map[string]os.Signal{
+	"INT":  os.Interrupt,
+	"TERM": syscall.SIGTERM,
+}
+
+// Default signals for each action
+const (
+	defaultExitSignals   = "INT,TERM"
+	defaultResignSignals = ""
+	defaultReloadSignals = ""
+)
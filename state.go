@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// State is the leadership state of an exclusiveWorker
+type State int
+
+// The worker goes through these states:
+//
+//	Idle -> Acquiring -> Held -> Draining -> Released
+//	                       \          \
+//	                        +----------+--> Lost
+//
+// Released and Lost are final for the current session but the worker
+// can go back to Acquiring to contend again with a new session.
+const (
+	StateIdle      State = iota // Nothing has been done yet
+	StateAcquiring              // Session created, trying to get the lock
+	StateHeld                   // We own the lock. We are leaders
+	StateDraining               // Work is finishing, we still own the lock
+	StateReleased               // We gave the lock back ourselves
+	StateLost                   // The lock was taken from us (TTL, session invalidated, etc.)
+)
+
+var stateNames = map[State]string{
+	StateIdle:      "idle",
+	StateAcquiring: "acquiring",
+	StateHeld:      "held",
+	StateDraining:  "draining",
+	StateReleased:  "released",
+	StateLost:      "lost",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// allowedTransitions lists for each state the states we can move to.
+// Anything not in here is an illegal transition (e.g. renew before acquire)
+var allowedTransitions = map[State][]State{
+	StateIdle:      {StateAcquiring},
+	StateAcquiring: {StateHeld, StateReleased, StateLost},
+	StateHeld:      {StateDraining, StateLost},
+	StateDraining:  {StateReleased, StateLost},
+	StateReleased:  {StateAcquiring},
+	StateLost:      {StateAcquiring},
+}
+
+// canTransition reports if going from one state to another is legal
+func canTransition(from, to State) bool {
+	for _, s := range allowedTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition is the event emitted every time the worker changes state
+type Transition struct {
+	From         State
+	To           State
+	At           time.Time
+	LeadershipID string     // Correlation ID of the leadership, empty before the first acquisition
+	Reason       LossReason // Why the leadership ended, set when leaving Held or Draining for Lost or Released
+	Detail       string     // The error that ended it, if any
+}
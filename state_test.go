@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+var allStates = []State{StateIdle, StateAcquiring, StateHeld, StateDraining, StateReleased, StateLost}
+
+// TestTransitionTable checks the properties of allowedTransitions the worker relies
+// on: the lock is only held after contending, nothing goes back to Idle and from any
+// state the worker can contend again
+func TestTransitionTable(t *testing.T) {
+	for _, from := range allStates {
+		for _, to := range allStates {
+			if got, want := canTransition(from, to), slices.Contains(allowedTransitions[from], to); got != want {
+				t.Errorf("canTransition(%s, %s) = %t, the table says %t", from, to, got, want)
+			}
+		}
+		if canTransition(from, from) {
+			t.Errorf("%s -> %s is allowed", from, from)
+		}
+		if canTransition(from, StateIdle) {
+			t.Errorf("%s -> idle is allowed", from)
+		}
+		if canTransition(from, StateHeld) && from != StateAcquiring {
+			t.Errorf("%s -> held is allowed without contending", from)
+		}
+		if !reachable(from, StateAcquiring) {
+			t.Errorf("the worker can not contend again from %s", from)
+		}
+	}
+	if got := State(42).String(); got != "state(42)" {
+		t.Errorf("unknown state is %q", got)
+	}
+}
+
+// reachable tells if to can be reached from from in one transition or more
+func reachable(from, to State) bool {
+	seen := map[State]bool{}
+	next := []State{from}
+	for len(next) > 0 {
+		s := next[0]
+		next = next[1:]
+		for _, n := range allowedTransitions[s] {
+			if n == to {
+				return true
+			}
+			if !seen[n] {
+				seen[n] = true
+				next = append(next, n)
+			}
+		}
+	}
+	return false
+}
+
+// checkTransitions checks the transitions reported by a worker: each one starts
+// where the previous one ended, is allowed, and every leadership ends exactly once,
+// with a reason, before the worker contends again
+func checkTransitions(t *testing.T, transitions []Transition) {
+	t.Helper()
+	from, id := StateIdle, ""
+	held, ends := false, 0
+	for i, tr := range transitions {
+		if tr.From != from {
+			t.Fatalf("transition %d: %s -> %s, the worker was %s", i, tr.From, tr.To, from)
+		}
+		if !canTransition(tr.From, tr.To) {
+			t.Fatalf("transition %d: %s -> %s is not allowed", i, tr.From, tr.To)
+		}
+		ending := (tr.From == StateHeld || tr.From == StateDraining) && (tr.To == StateLost || tr.To == StateReleased)
+		if ending != (tr.Reason != "") {
+			t.Fatalf("transition %d: %s -> %s with reason %q", i, tr.From, tr.To, tr.Reason)
+		}
+		if ending && tr.To == StateReleased && tr.Reason != LossResigned {
+			t.Fatalf("transition %d: released with reason %q", i, tr.Reason)
+		}
+		if held && tr.To != StateAcquiring && tr.LeadershipID != id {
+			t.Fatalf("transition %d: leadership %s became %s while held", i, id, tr.LeadershipID)
+		}
+		switch {
+		case tr.To == StateHeld:
+			held, ends, id = true, 0, tr.LeadershipID
+		case ending:
+			ends++
+		case tr.To == StateAcquiring && held:
+			if ends != 1 {
+				t.Fatalf("transition %d: leadership %s ended %d times", i, id, ends)
+			}
+			held = false
+		}
+		from = tr.To
+	}
+}
+
+// FuzzTransitions feeds random transitions to a worker, some of them in the same
+// critical section, and checks the illegal ones are refused, onTransition then the
+// watchers get the others in order without the lock held, and the work contexts end
+// with the leadership. Each byte is one or (high bit set) two transitions.
+func FuzzTransitions(f *testing.F) {
+	f.Add([]byte{1, 154, 4, 1, 170, 1, 2, 3, 5})
+	f.Add([]byte{1, 2, 163, 1, 1, 2, 4, 0, 3})
+	f.Add([]byte{0, 2, 1, 5, 1, 2, 5, 3, 1, 4})
+	f.Fuzz(func(t *testing.T, steps []byte) {
+		_, client := newTestConsul(t)
+		var reported, watched []Transition
+		ec := newExclusiveWorker(&exclusiveWorkerConfig{
+			client:         client,
+			key:            "test/transitions",
+			sessionTimeout: "10s",
+			onTransition:   func(tr Transition) { reported = append(reported, tr) },
+		})
+		defer ec.Close()
+		ec.watchTransitions(func(tr Transition) {
+			if len(reported) != len(watched)+1 || reported[len(watched)] != tr {
+				t.Errorf("watcher got %s -> %s before onTransition", tr.From, tr.To)
+			}
+			// Would deadlock if the callbacks were called with ec.mu held
+			ec.State()
+			watched = append(watched, tr)
+		})
+
+		state := StateIdle
+		var works []context.Context
+		for i, b := range steps {
+			targets := []State{State(b & 7 % 6)}
+			if b&128 != 0 {
+				targets = append(targets, State(b>>3&7%6))
+			}
+			failure := ""
+			ec.mu.Lock()
+			for _, to := range targets {
+				allowed := canTransition(state, to)
+				switch {
+				case !allowed:
+				case to == StateAcquiring:
+					ec.leadershipID = fmt.Sprintf("leadership-%d", i)
+				case to == StateLost:
+					ec.lossReason = LossTTLExpired
+				}
+				err := ec.transition(to)
+				if (err == nil) != allowed {
+					failure = fmt.Sprintf("%s -> %s: allowed %t, transition returned %v", state, to, allowed, err)
+					break
+				}
+				if err == nil {
+					state = to
+					if to == StateHeld {
+						ec.renewedLocked(ec.clock.Now(), time.Minute)
+					}
+				}
+			}
+			ec.unlock()
+			if failure != "" {
+				t.Fatal(failure)
+			}
+
+			if got := ec.State(); got != state {
+				t.Fatalf("worker is %s, expected %s", got, state)
+			}
+			switch state {
+			case StateHeld:
+				works = append(works, ec.WorkContext(context.Background()))
+			case StateReleased, StateLost:
+				for _, w := range works {
+					if w.Err() == nil {
+						t.Fatalf("a work context of the leadership still runs in %s", state)
+					}
+				}
+				works = nil
+			}
+		}
+		if !slices.Equal(reported, watched) {
+			t.Fatalf("onTransition got %d transitions, the watcher %d", len(reported), len(watched))
+		}
+		checkTransitions(t, reported)
+	})
+}
+
+// FuzzElection runs a worker against the memory backend through random sequences of
+// contentions, acquisitions, renewals, invalidations of its session by consul and
+// resignations like the signals do. It checks the worker never believes it holds the
+// lock without a live session holding the key, except until the next renewal after
+// consul invalidated it, and that everything is cleaned up exactly once.
+func FuzzElection(f *testing.F) {
+	f.Add([]byte{0, 1, 2, 2, 4, 0, 1, 3, 2, 0, 1, 5, 0, 1, 2, 4})
+	f.Add([]byte{0, 1, 3, 3, 2, 0, 0, 1, 1, 2, 5, 5, 0, 0, 1, 4})
+	f.Add([]byte{1, 2, 4, 0, 3, 1, 0, 1, 5, 3, 0, 1, 2, 2, 3})
+	f.Fuzz(func(t *testing.T, steps []byte) {
+		const key = "test/election"
+		m, client := newTestConsul(t)
+		clock := newFakeClock()
+		var mu sync.Mutex
+		var transitions []Transition
+		ec := newExclusiveWorker(&exclusiveWorkerConfig{
+			client:         client,
+			key:            key,
+			sessionTimeout: "10s",
+			lockDelay:      time.Millisecond,
+			clock:          clock,
+			onTransition: func(tr Transition) {
+				// Also called by the renewal loop
+				mu.Lock()
+				defer mu.Unlock()
+				transitions = append(transitions, tr)
+			},
+		})
+
+		// The renewal loop of the current leadership, like RunElected runs it
+		var renewDone chan struct{}
+		renewing := func() bool {
+			if renewDone == nil {
+				return false
+			}
+			select {
+			case <-renewDone:
+				return false
+			default:
+				return true
+			}
+		}
+		stopRenewals := func() {
+			if !renewing() {
+				return
+			}
+			ec.Resign()
+			select {
+			case <-renewDone:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the renewal loop did not stop")
+			}
+		}
+
+		expired := false // Consul invalidated the session of our leadership
+		for _, b := range steps {
+			switch op := b % 6; op {
+			case 0:
+				ec.createSession()
+			case 1:
+				if ok, _ := ec.acquireSession(); ok {
+					done := make(chan struct{})
+					renewDone = done
+					go func() {
+						defer close(done)
+						ec.renewSession(nil)
+					}()
+				}
+			case 2:
+				if !renewing() || !clock.awaitAfter(t, renewDone) {
+					continue
+				}
+				wait, _ := clock.nextAfter()
+				clock.Advance(wait)
+				// Renewed and waiting for the next renewal, or stopped
+				clock.awaitAfter(t, renewDone)
+				if expired && ec.State() != StateLost {
+					t.Fatalf("still %s after renewing a session consul invalidated", ec.State())
+				}
+				expired = false
+			case 3:
+				if id := ec.currentSession(); id != "" {
+					expired = expired || ec.State() == StateHeld
+					m.expire(id)
+				}
+			case 4, 5:
+				if op == 5 {
+					ec.Release()
+				}
+				stopRenewals()
+				ec.destroySession()
+				expired = false
+			}
+
+			if ec.State() == StateHeld && !expired {
+				id := ec.currentSession()
+				if !m.hasSession(id) {
+					t.Fatalf("held with session %s, which consul does not know", id)
+				}
+				if holder := m.holderOf(key); holder != id {
+					t.Fatalf("held with session %s, consul says %q holds the key", id, holder)
+				}
+			}
+		}
+
+		stopRenewals()
+		if err := ec.Close(); err != nil {
+			t.Logf("close: %s", err)
+		}
+		if n := m.sessionCount(); n != 0 {
+			t.Fatalf("%d sessions left after Close", n)
+		}
+		if holder := m.holderOf(key); holder != "" {
+			t.Fatalf("session %s still holds the key after Close", holder)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		checkTransitions(t, transitions)
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Status is the content of the status file, for watchdogs and node-exporter
+// textfile collectors that can not talk to the worker
+type Status struct {
+	State        string    `json:"state"`
+	Key          string    `json:"key"`
+	SessionID    string    `json:"session_id,omitempty"`
+	Epoch        uint64    `json:"epoch,omitempty"` // LockIndex of the key when we got it
+	LeadershipID string    `json:"leadership_id,omitempty"`
+	Holder       Holder    `json:"holder"`
+	Since        time.Time `json:"since"`                 // When we entered State
+	LastRenewal  time.Time `json:"last_renewal"`          // Of this leadership, zero if we never held the lock
+	LossReason   string    `json:"loss_reason,omitempty"` // Why the leadership ended, in Lost and Released
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// writeStatusOnTransition writes the status file every time the state changes
+func (ec *exclusiveWorker) writeStatusOnTransition(t Transition) {
+	hostname, _ := os.Hostname()
+	ec.mu.Lock()
+	status := Status{
+		State:        t.To.String(),
+		Key:          ec.key,
+		SessionID:    ec.sessionID,
+		Epoch:        ec.lockInfo.LockIndex,
+		LeadershipID: t.LeadershipID,
+		Holder:       Holder{SessionID: ec.lockInfo.Session, Address: ec.advertiseAddr, Hostname: hostname, Labels: ec.labels, Generation: ec.generation, Build: currentBuild()},
+		Since:        t.At,
+		LossReason:   string(t.Reason),
+		UpdatedAt:    time.Now(),
+	}
+	if t.LeadershipID != "" {
+		status.LastRenewal = ec.lastRenewal
+	}
+	ec.mu.Unlock()
+
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(ec.statusFile, append(data, '\n'))
+	}
+	if err != nil {
+		ec.logf("Could not write status file %s: %s", ec.statusFile, err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path, so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// KeyStatus is the status of one lock, see StatusAll
+type KeyStatus struct {
+	Key      string      `json:"key"`
+	Holder   *Holder     `json:"holder,omitempty"`    // Nil if the key is free
+	TTL      string      `json:"ttl,omitempty"`       // TTL of the session of the holder
+	Epoch    uint64      `json:"epoch"`               // How many times the key was acquired
+	Lease    *LeaseHint  `json:"lease,omitempty"`     // Published by holders with -lease-hint
+	LastLoss *LossRecord `json:"last_loss,omitempty"` // How the last leadership ended, if recorded
+}
+
+// StatusAll returns the status of every lock under prefix in two round trips, a KV
+// list and a session list, whatever the number of keys: for dashboards watching
+// hundreds of locks. c decrypts the values if the leaders encrypt them, it can be nil.
+func StatusAll(client *api.Client, prefix string, c *Cipher) ([]KeyStatus, error) {
+	pairs, _, err := client.KV().List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	sessions, _, err := client.Session().List(nil)
+	if err != nil {
+		return nil, err
+	}
+	ttls := make(map[string]string, len(sessions))
+	for _, s := range sessions {
+		ttls[s.ID] = s.TTL
+	}
+	byKey := make(map[string]*api.KVPair, len(pairs))
+	for _, pair := range pairs {
+		byKey[pair.Key] = pair
+	}
+
+	var statuses []KeyStatus
+	for _, pair := range pairs {
+		if !isLockKey(pair) {
+			continue
+		}
+		s := KeyStatus{Key: pair.Key, Epoch: pair.LockIndex}
+		if pair.Session != "" {
+			s.Holder = decodeHolder(pair, c)
+			s.Holder.SessionID = pair.Session
+			s.TTL = ttls[pair.Session]
+		}
+		if hint, ok := byKey[leaseHintKey(pair.Key)]; ok && s.Holder != nil {
+			if h, err := decodeLeaseHint(hint); err == nil && h.SessionID == s.Holder.SessionID {
+				s.Lease = h
+			}
+		}
+		if loss, ok := byKey[lastLossKey(pair.Key)]; ok {
+			s.LastLoss, _ = decodeLossRecord(loss, c)
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Key < statuses[j].Key })
+	return statuses, nil
+}
+
+// isLockKey tells if pair is a lock rather than one of the keys we keep next to it:
+// it was acquired at least once and is not a registration (contenders, shard members)
+// named after its session
+func isLockKey(pair *api.KVPair) bool {
+	if pair.LockIndex == 0 || strings.Contains(pair.Key, "/contenders/") {
+		return false
+	}
+	return pair.Session == "" || path.Base(pair.Key) != pair.Session
+}
+
+// String is a one line description of the lock for the status command
+func (s KeyStatus) String() string {
+	line := s.Key + ": free"
+	if s.Holder != nil {
+		line = s.Key + ": held by " + describe(s.Holder.SessionID, s.Holder.Hostname, s.Holder.Address)
+		if s.Holder.Build != nil {
+			line += ", running " + s.Holder.Build.String()
+		}
+		switch {
+		case s.Lease != nil:
+			line += ", " + s.Lease.Describe(time.Now())
+		case s.TTL != "":
+			line += ", ttl " + s.TTL
+		}
+	}
+	line += fmt.Sprintf(", epoch %d", s.Epoch)
+	if s.Holder == nil && s.LastLoss != nil {
+		line += ", last loss " + s.LastLoss.String()
+	}
+	return line
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+//go:generate mockgen -source strategy.go -destination strategy_mock.go -package main
+
+// Strategy decides when a contender in RunElected tries to take the lock,
+// so different contention algorithms can share the same worker.
+type Strategy interface {
+	// Name is how the strategy is selected in the configuration
+	Name() string
+	// Prepare is called every time a new session is created, before contending with it
+	Prepare(ec *exclusiveWorker, sessionID string) error
+	// ShouldContend is called before every acquire attempt. If it returns false we
+	// wait for the key to change and ask again
+	ShouldContend(ec *exclusiveWorker, sessionID string) (bool, error)
+	// Elected is called once we got the lock
+	Elected(ec *exclusiveWorker, sessionID string) error
+}
+
+// strategyConfig holds what the different strategies need
+type strategyConfig struct {
+	name      string
+	priority  int           // Priority of this contender for the priority strategy
+	identity  string        // Stable identity of this contender for the sticky strategy
+	headStart time.Duration // How long the previous leader has to reclaim the lock with the sticky strategy
+}
+
+// newStrategy returns the configured strategy
+func newStrategy(sc strategyConfig) (Strategy, error) {
+	switch sc.name {
+	case "", "simple":
+		return simpleStrategy{}, nil
+	case "fair-queue":
+		return fairQueueStrategy{}, nil
+	case "priority":
+		return priorityStrategy{priority: sc.priority}, nil
+	case "sticky":
+		if sc.identity == "" {
+			return nil, fmt.Errorf("the sticky strategy needs an identity")
+		}
+		return &stickyStrategy{identity: sc.identity, headStart: sc.headStart}, nil
+	}
+	return nil, fmt.Errorf("unknown election strategy %q", sc.name)
+}
+
+// simpleStrategy always tries to acquire, whoever is faster wins
+type simpleStrategy struct{}
+
+func (simpleStrategy) Name() string                                         { return "simple" }
+func (simpleStrategy) Prepare(*exclusiveWorker, string) error               { return nil }
+func (simpleStrategy) ShouldContend(*exclusiveWorker, string) (bool, error) { return true, nil }
+func (simpleStrategy) Elected(*exclusiveWorker, string) error               { return nil }
+
+// fairQueueStrategy only lets the oldest contender try to acquire, so
+// contenders get the lock in the order they started waiting
+type fairQueueStrategy struct{}
+
+func (fairQueueStrategy) Name() string { return "fair-queue" }
+
+func (fairQueueStrategy) Prepare(ec *exclusiveWorker, sessionID string) error {
+	return ec.registerContender(sessionID, contenderInfo{})
+}
+
+func (fairQueueStrategy) ShouldContend(ec *exclusiveWorker, sessionID string) (bool, error) {
+	contenders, err := ec.listContenders()
+	if err != nil {
+		return false, err
+	}
+	var first *api.KVPair
+	for _, pair := range contenders {
+		if first == nil || pair.CreateIndex < first.CreateIndex {
+			first = pair
+		}
+	}
+	// If we are not registered for some reason, contend like the simple strategy
+	return first == nil || first.Session == sessionID || !hasContender(contenders, sessionID), nil
+}
+
+func (fairQueueStrategy) Elected(*exclusiveWorker, string) error { return nil }
+
+// priorityStrategy only lets the contenders with the highest priority try to acquire
+type priorityStrategy struct {
+	priority int
+}
+
+func (priorityStrategy) Name() string { return "priority" }
+
+func (s priorityStrategy) Prepare(ec *exclusiveWorker, sessionID string) error {
+	return ec.registerContender(sessionID, contenderInfo{Priority: s.priority})
+}
+
+func (s priorityStrategy) ShouldContend(ec *exclusiveWorker, sessionID string) (bool, error) {
+	contenders, err := ec.listContenders()
+	if err != nil {
+		return false, err
+	}
+	for _, pair := range contenders {
+		var info contenderInfo
+		if err := json.Unmarshal(pair.Value, &info); err != nil {
+			continue
+		}
+		if info.Priority > s.priority {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (priorityStrategy) Elected(*exclusiveWorker, string) error { return nil }
+
+// stickyStrategy gives the previous leader a head start to reclaim the lock after
+// a restart before the others contend, to avoid failovers during rolling restarts.
+// The leader is recognised by its identity, which is stored under the lock key.
+type stickyStrategy struct {
+	identity  string
+	headStart time.Duration
+	freeSince time.Time // When we first saw the key free, only used by ShouldContend
+}
+
+func (s *stickyStrategy) Name() string { return "sticky" }
+
+func (s *stickyStrategy) Prepare(*exclusiveWorker, string) error { return nil }
+
+func (s *stickyStrategy) ShouldContend(ec *exclusiveWorker, sessionID string) (bool, error) {
+	last, _, err := ec.client.KV().Get(lastLeaderKey(ec.key), nil)
+	if err != nil {
+		return false, err
+	}
+	if last == nil || string(last.Value) == s.identity {
+		// No previous leader or it was us
+		return true, nil
+	}
+
+	lock, _, err := ec.client.KV().Get(ec.key, nil)
+	if err != nil {
+		return false, err
+	}
+	if lock != nil && lock.Session != "" {
+		// Somebody holds it, we will wait for it to be released anyway
+		s.freeSince = time.Time{}
+		return true, nil
+	}
+	if s.freeSince.IsZero() {
+		s.freeSince = ec.clock.Now()
+	}
+	return ec.since(s.freeSince) >= s.headStart, nil
+}
+
+// Elected remembers us as the last leader
+func (s *stickyStrategy) Elected(ec *exclusiveWorker, sessionID string) error {
+	s.freeSince = time.Time{}
+	_, err := ec.client.KV().Put(&api.KVPair{Key: lastLeaderKey(ec.key), Value: []byte(s.identity)}, nil)
+	return err
+}
+
+// lastLeaderKey is where the sticky strategy stores the identity of the last leader
+func lastLeaderKey(key string) string {
+	return key + "/last-leader"
+}
+
+// contenderInfo is the value of a contender entry
+type contenderInfo struct {
+	Hostname string    `json:"hostname,omitempty"`
+	Address  string    `json:"address,omitempty"` // Advertised host:port
+	Priority int       `json:"priority,omitempty"`
+	Since    time.Time `json:"since"` // When the contender registered
+}
+
+// registerContender writes our contender entry under the contender prefix. It is
+// locked with our session so it goes away with it
+func (ec *exclusiveWorker) registerContender(sessionID string, info contenderInfo) error {
+	info.Hostname, _ = os.Hostname()
+	info.Address = ec.advertiseAddr
+	info.Since = ec.clock.Now()
+	value, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	pair := &api.KVPair{
+		Key:     contenderPrefix(ec.key) + sessionID,
+		Value:   value,
+		Session: sessionID,
+	}
+	ok, _, err := ec.client.KV().Acquire(pair, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("cannot register contender %s", pair.Key)
+	}
+	return nil
+}
+
+// listContenders returns the live contender entries of the key
+func (ec *exclusiveWorker) listContenders() (api.KVPairs, error) {
+	pairs, _, err := ec.client.KV().List(contenderPrefix(ec.key), &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return nil, err
+	}
+	live := pairs[:0]
+	for _, pair := range pairs {
+		if pair.Session != "" {
+			live = append(live, pair)
+		}
+	}
+	return live, nil
+}
+
+func hasContender(contenders api.KVPairs, sessionID string) bool {
+	for _, pair := range contenders {
+		if pair.Session == sessionID {
+			return true
+		}
+	}
+	return false
+}
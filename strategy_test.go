@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/mock/gomock"
+)
+
+// TestMocksUpToDate runs the mockgen lines of go:generate on copies of their sources
+// and fails if a shipped mock differs, i.e. an interface changed without go generate.
+// It needs mockgen on the PATH.
+func TestMocksUpToDate(t *testing.T) {
+	mockgen, err := exec.LookPath("mockgen")
+	if err != nil {
+		t.Skip("mockgen is not installed: go install go.uber.org/mock/mockgen@latest")
+	}
+	sources, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// mockgen finds the import path of the package from its module
+	dir := t.TempDir()
+	if b, err := os.ReadFile("go.mod"); err == nil {
+		if err := os.WriteFile(filepath.Join(dir, "go.mod"), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, source := range sources {
+		if strings.HasSuffix(source, "_test.go") {
+			continue
+		}
+		b, err := os.ReadFile(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			args, ok := strings.CutPrefix(line, "//go:generate mockgen ")
+			if !ok {
+				continue
+			}
+			if err := os.WriteFile(filepath.Join(dir, source), b, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command(mockgen, strings.Fields(args)...)
+			cmd.Dir = dir
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("%s: mockgen %s: %s\n%s", source, args, err, out)
+			}
+		}
+	}
+	generated, err := filepath.Glob(filepath.Join(dir, "*_mock.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) == 0 {
+		t.Fatal("no mock was generated")
+	}
+	for _, g := range generated {
+		want, err := os.ReadFile(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shipped, err := os.ReadFile(filepath.Base(g))
+		if err != nil || !bytes.Equal(want, shipped) {
+			t.Errorf("%s is out of date, run go generate", filepath.Base(g))
+		}
+	}
+}
+
+// TestStrategyContract checks how waitForLeadership drives a strategy: Prepare once
+// per session, ShouldContend before every attempt and Elected once we hold the lock,
+// all with the session we contend with
+func TestStrategyContract(t *testing.T) {
+	m, client := newTestConsul(t)
+	strategy := NewMockStrategy(gomock.NewController(t))
+	ec := newExclusiveWorker(&exclusiveWorkerConfig{
+		client:         client,
+		key:            "test/strategy",
+		sessionTimeout: "10s",
+		strategy:       strategy,
+	})
+	defer ec.Close()
+
+	var sessions []string
+	record := func(_ *exclusiveWorker, sessionID string) { sessions = append(sessions, sessionID) }
+	strategy.EXPECT().Name().Return("mock").AnyTimes()
+	gomock.InOrder(
+		strategy.EXPECT().Prepare(ec, gomock.Any()).Do(record).Return(nil),
+		// Decline once, the key being free we try again after retryInterval
+		strategy.EXPECT().ShouldContend(ec, gomock.Any()).Do(record).Return(false, nil),
+		strategy.EXPECT().ShouldContend(ec, gomock.Any()).Do(record).Return(true, nil),
+		strategy.EXPECT().Elected(ec, gomock.Any()).Do(record).Return(nil),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := ec.waitForLeadership(ctx); err != nil {
+		t.Fatal(err)
+	}
+	session := ec.currentSession()
+	if holder := m.holderOf("test/strategy"); holder != session {
+		t.Fatalf("elected with session %s, %q holds the key", session, holder)
+	}
+	for i, s := range sessions {
+		if s != session {
+			t.Errorf("call %d with session %s, elected with %s", i, s, session)
+		}
+	}
+	if s := ec.State(); s != StateHeld {
+		t.Errorf("worker is %s after the election", s)
+	}
+}
+
+// TestFairQueueKeptSession checks a session kept by -keep-session goes to the end of
+// the queue when its leadership ends, instead of keeping its place from its first
+// contention
+func TestFairQueueKeptSession(t *testing.T) {
+	_, client := newTestConsul(t)
+	newContender := func(keep bool) *exclusiveWorker {
+		ec := newExclusiveWorker(&exclusiveWorkerConfig{
+			client:         client,
+			key:            "test/fair-queue",
+			sessionTimeout: "10s",
+			strategy:       fairQueueStrategy{},
+			keepSession:    keep,
+		})
+		t.Cleanup(func() { ec.Close() })
+		return ec
+	}
+	contend := func(ec *exclusiveWorker) bool {
+		t.Helper()
+		if err := ec.createSession(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ec.strategy.Prepare(ec, ec.currentSession()); err != nil {
+			t.Fatal(err)
+		}
+		ok, err := ec.strategy.ShouldContend(ec, ec.currentSession())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	leader, follower := newContender(true), newContender(false)
+	if !contend(leader) {
+		t.Fatal("the first contender is not first in the queue")
+	}
+	if ok, err := leader.acquireSession(); !ok {
+		t.Fatalf("not acquired: %v", err)
+	}
+	if contend(follower) {
+		t.Fatal("the second contender is first in the queue")
+	}
+	kept := leader.currentSession()
+	if err := leader.destroySession(); err != nil {
+		t.Fatal(err)
+	}
+	if contend(leader) {
+		t.Fatal("the kept session kept its place in the queue")
+	}
+	if leader.currentSession() != kept {
+		t.Fatal("the session was not kept")
+	}
+	if ok, err := follower.strategy.ShouldContend(follower, follower.currentSession()); err != nil || !ok {
+		t.Fatalf("the second contender is not first in the queue after the leadership: %v", err)
+	}
+}
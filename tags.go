@@ -0,0 +1,79 @@
+package main
+
+import "github.com/hashicorp/consul/api"
+
+// leaderTag is added to the leader's service so leader.<service>.service.consul resolves to it
+const leaderTag = "leader"
+
+// setLeaderTag adds or removes the leader tag on the service registered in the local
+// agent with ec.serviceID. The service is re-registered with the same definition,
+// the agent keeps its existing checks.
+func (ec *exclusiveWorker) setLeaderTag(leader bool) error {
+	svc, _, err := ec.client.Agent().Service(ec.serviceID, nil)
+	if err != nil {
+		return err
+	}
+
+	tags := make([]string, 0, len(svc.Tags)+1)
+	for _, t := range svc.Tags {
+		if t != leaderTag {
+			tags = append(tags, t)
+		}
+	}
+	if leader {
+		tags = append(tags, leaderTag)
+	}
+	if len(tags) == len(svc.Tags) && leader == hasTag(svc.Tags, leaderTag) {
+		// Nothing to change
+		return nil
+	}
+
+	weights := svc.Weights
+	return ec.client.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		Kind:              svc.Kind,
+		ID:                svc.ID,
+		Name:              svc.Service,
+		Tags:              tags,
+		Port:              svc.Port,
+		Address:           svc.Address,
+		SocketPath:        svc.SocketPath,
+		TaggedAddresses:   svc.TaggedAddresses,
+		EnableTagOverride: svc.EnableTagOverride,
+		Meta:              svc.Meta,
+		Weights:           &weights,
+		Proxy:             svc.Proxy,
+		Connect:           svc.Connect,
+		Namespace:         svc.Namespace,
+		Partition:         svc.Partition,
+	})
+}
+
+// tagLeaderOnTransition keeps the leader tag in sync with the state.
+// During a failover DNS can briefly return both nodes: the old leader removes
+// its tag as soon as it stops being Held (Draining or Lost) but if it crashed its
+// tag stays until it restarts, which is why a stale tag is removed before we
+// contend for the first time. Clients that must not talk to a stale leader
+// should double check with ResolveLeader.
+func (ec *exclusiveWorker) tagLeaderOnTransition(t Transition) {
+	var err error
+	switch {
+	case t.To == StateHeld:
+		err = ec.setLeaderTag(true)
+	case t.From == StateIdle, t.To == StateDraining, t.To == StateLost:
+		err = ec.setLeaderTag(false)
+	default:
+		return
+	}
+	if err != nil {
+		ec.logf("Could not update leader tag of service %s: %s", ec.serviceID, err)
+	}
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// SetTTL changes the TTL of our session, e.g. to tune the failover speed live.
+// Consul can not change the TTL of a session so when we hold the key we create a
+// session with the new TTL and move the lock to it in a transaction that checks we
+// still hold it, then destroy the old one: the key is never free. The leadership ID
+// stays the same but the LockIndex (and so the fencing tokens) moves forward.
+// When we don't hold the key the next session uses the new TTL.
+func (ec *exclusiveWorker) SetTTL(ttl string) error {
+	if err := checkTTL(ttl); err != nil {
+		return err
+	}
+	if ec.session != nil {
+		return ErrSharedSession
+	}
+	d, _ := time.ParseDuration(ttl)
+
+	// ec.mu is only held between the consul calls, ttlMu keeps two moves apart
+	ec.ttlMu.Lock()
+	defer ec.ttlMu.Unlock()
+	ec.mu.Lock()
+	if ec.state != StateHeld {
+		ec.sessionTimeout = ttl
+		ec.mu.Unlock()
+		return nil
+	}
+	oldID, leadershipID := ec.sessionID, ec.leadershipID
+	ec.mu.Unlock()
+
+	start := ec.clock.Now()
+	newID, _, err := ec.client.Session().Create(&api.SessionEntry{
+		TTL:       ttl,
+		Behavior:  "delete",
+		Node:      ec.sessionNode,
+		LockDelay: ec.lockDelay,
+	}, nil)
+	ec.metrics.observeConsul(opSessionCreate, ec.since(start), err)
+	if err != nil {
+		return err
+	}
+	ec.mu.Lock()
+	value := ec.holderValue(newID)
+	// verifyOwnership may see the key held by the new session before we switch to it
+	ec.movingTo = newID
+	ec.mu.Unlock()
+	if err := checkValueSize(ec.key, value); err != nil {
+		ec.abandonSession(newID)
+		return err
+	}
+
+	ok, resp, _, err := ec.client.Txn().Txn(api.TxnOps{
+		{KV: &api.KVTxnOp{Verb: api.KVCheckSession, Key: ec.key, Session: oldID}},
+		{KV: &api.KVTxnOp{Verb: api.KVUnlock, Key: ec.key, Session: oldID, Value: value}},
+		{KV: &api.KVTxnOp{Verb: api.KVLock, Key: ec.key, Session: newID, Value: value}},
+	}, nil)
+	if err == nil && !ok {
+		err = ErrNotHeld
+		if len(resp.Errors) > 0 && resp.Errors[0].OpIndex != 0 {
+			err = fmt.Errorf("could not move the lock to the new session: %s", resp.Errors[0].What)
+		}
+	}
+	if err != nil {
+		ec.abandonSession(newID)
+		return err
+	}
+
+	ec.mu.Lock()
+	ec.movingTo = ""
+	if ec.state != StateHeld || ec.sessionID != oldID {
+		// Released or lost while the lock moved. The new session holds the key, its
+		// destruction gives it back like the release would have
+		ec.mu.Unlock()
+		ec.client.Session().Destroy(newID, nil)
+		return ErrNotHeld
+	}
+	ec.sessionID = newID
+	ec.sessionTimeout = ttl
+	if n := len(resp.Results); n > 0 && resp.Results[n-1].KV != nil {
+		kv := resp.Results[n-1].KV
+		ec.lockInfo = LockInfo{Key: kv.Key, Session: kv.Session, CreateIndex: kv.CreateIndex, ModifyIndex: kv.ModifyIndex, LockIndex: kv.LockIndex}
+	}
+	// The lease now follows the new session, even if its TTL is shorter
+	ec.resetLeaseLocked(start, d)
+	ec.mu.Unlock()
+
+	// The old session holds nothing anymore, destroying it does not touch the key
+	if _, err := ec.client.Session().Destroy(oldID, nil); err != nil {
+		logWithID(ec.key, leadershipID, "Could not destroy the old session %s: %s", oldID, err)
+	}
+	// The contender entry went away with the old session
+	if ec.announce {
+		if err := ec.registerContender(newID, contenderInfo{}); err != nil {
+			logWithID(ec.key, leadershipID, "Could not register as contender: %s", err)
+		}
+	}
+	if err := ec.strategy.Prepare(ec, newID); err != nil {
+		logWithID(ec.key, leadershipID, "Election strategy %s failed: %s", ec.strategy.Name(), err)
+	}
+	logWithID(ec.key, leadershipID, "Session TTL changed to %s, new session %s", ttl, newID)
+
+	// Wake up the renewal loop so it follows the new session and cadence
+	select {
+	case ec.ttlChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// abandonSession destroys the session SetTTL failed to move the lock to
+func (ec *exclusiveWorker) abandonSession(sessionID string) {
+	ec.mu.Lock()
+	ec.movingTo = ""
+	ec.mu.Unlock()
+	ec.client.Session().Destroy(sessionID, nil)
+}
+
+// ownSession tells if sessionID is ours: the current session or the one SetTTL is
+// moving the lock to
+func (ec *exclusiveWorker) ownSession(sessionID string) bool {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return sessionID != "" && (sessionID == ec.sessionID || sessionID == ec.movingTo)
+}
+
+// scaleTTL doubles (up) or halves the TTL, within the limits of consul
+func scaleTTL(ttl string, up bool) (string, error) {
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return "", err
+	}
+	if up {
+		d *= 2
+	} else {
+		d /= 2
+	}
+	if d < minSessionTTL {
+		d = minSessionTTL
+	}
+	if d > maxSessionTTL {
+		d = maxSessionTTL
+	}
+	return d.String(), nil
+}
+
+// TTL returns the TTL of our session
+func (ec *exclusiveWorker) TTL() string {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.sessionTimeout
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ErrNotHeld is returned by the *IfHeld helpers when the write was refused
+// because our session does not hold the lock anymore
+var ErrNotHeld = errors.New("lock not held")
+
+// KVPutIfHeld sets key to value only if our session still holds the lock.
+// The ownership check and the write are done in the same consul transaction,
+// so the write can not land after the leadership was lost.
+func (ec *exclusiveWorker) KVPutIfHeld(key string, value []byte) error {
+	return ec.txnIfHeld(&api.KVTxnOp{Verb: api.KVSet, Key: key, Value: value})
+}
+
+// KVCASIfHeld is KVPutIfHeld with a check-and-set on the ModifyIndex of key.
+// An index of 0 only writes the key if it does not exist.
+func (ec *exclusiveWorker) KVCASIfHeld(key string, value []byte, index uint64) error {
+	return ec.txnIfHeld(&api.KVTxnOp{Verb: api.KVCAS, Key: key, Value: value, Index: index})
+}
+
+// KVDeleteIfHeld deletes key only if our session still holds the lock
+func (ec *exclusiveWorker) KVDeleteIfHeld(key string) error {
+	return ec.txnIfHeld(&api.KVTxnOp{Verb: api.KVDelete, Key: key})
+}
+
+// txnIfHeld runs op in a transaction guarded by a check-session of the lock key
+func (ec *exclusiveWorker) txnIfHeld(op *api.KVTxnOp) error {
+	ec.mu.Lock()
+	sessionID, state := ec.sessionID, ec.state
+	ec.mu.Unlock()
+	if state != StateHeld {
+		return &StateError{Op: "write", State: state}
+	}
+	if err := checkValueSize(op.Key, op.Value); err != nil {
+		return err
+	}
+
+	ops := api.TxnOps{
+		{KV: &api.KVTxnOp{Verb: api.KVCheckSession, Key: ec.key, Session: sessionID}},
+		{KV: op},
+	}
+	ok, resp, _, err := ec.client.Txn().Txn(ops, nil)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+
+	var reasons []string
+	for _, e := range resp.Errors {
+		if e.OpIndex == 0 {
+			return fmt.Errorf("%w: %s", ErrNotHeld, e.What)
+		}
+		reasons = append(reasons, e.What)
+	}
+	return fmt.Errorf("transaction on %s rolled back: %s", op.Key, strings.Join(reasons, ", "))
+}
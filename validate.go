@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Session TTLs consul accepts
+const (
+	minSessionTTL = 10 * time.Second
+	maxSessionTTL = 24 * time.Hour
+)
+
+// checkTTL checks a session TTL is one consul accepts
+func checkTTL(ttl string) error {
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return fmt.Errorf("invalid TTL %q: %s", ttl, err)
+	}
+	if d < minSessionTTL || d > maxSessionTTL {
+		return fmt.Errorf("TTL %s is out of the %s-%s range consul accepts", d, minSessionTTL, maxSessionTTL)
+	}
+	return nil
+}
+
+// configCheck is the result of checking one setting
+type configCheck struct {
+	setting string // Flag checked, empty if the check covers several
+	what    string
+	err     error
+	hint    string // How to fix it
+}
+
+// validation collects the results of the validate command
+type validation struct {
+	failed bool
+}
+
+// check prints the result of one check, with a hint on how to fix it if it failed
+func (v *validation) check(what string, err error, hint string) bool {
+	if err == nil {
+		fmt.Printf("OK    %s\n", what)
+		return true
+	}
+	v.failed = true
+	fmt.Printf("FAIL  %s: %s\n", what, err)
+	if hint != "" {
+		fmt.Printf("      %s\n", hint)
+	}
+	return false
+}
+
+// warn prints something worth knowing that does not fail the checks
+func (v *validation) warn(what string, err error, hint string) {
+	fmt.Printf("WARN  %s: %s\n", what, err)
+	if hint != "" {
+		fmt.Printf("      %s\n", hint)
+	}
+}
+
+// validateConfig checks what main would do with the configuration, including that
+// consul is reachable and the token has the permissions we need, without contending.
+// It returns the exit code.
+func validateConfig(client *api.Client, key string, keyErr error, checks []configCheck) int {
+	v := &validation{}
+	for _, c := range checks {
+		v.check(c.what, c.err, c.hint)
+	}
+	if !v.check("lock key "+key, keyErr, "check -key-template, -service, -env and -namespace (MUTEX_KEY_TEMPLATE...)") {
+		return 1
+	}
+
+	_, err := client.Status().Leader()
+	if !v.check("consul reachable", err, "is the local consul agent running and listening on "+consulAddress+"?") {
+		return 1
+	}
+	v.check("ACL permissions on "+key, checkPermissions(client, key), "set CONSUL_HTTP_TOKEN to a token with session:write and key:write on the lock key")
+
+	if v.failed {
+		return 1
+	}
+	return 0
+}
+
+// validateFlags is validateConfig for the flags of main
+func validateFlags(address, keyTemplate, service, env, namespace string, checks []configCheck) int {
+	key, keyErr := lockKey(keyTemplate, service, env, namespace)
+	client, err := api.NewClient(&api.Config{Address: address})
+	if err != nil {
+		fmt.Println("FAIL  consul client:", err)
+		return 1
+	}
+	return validateConfig(client, key, keyErr, checks)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// verifyOwnership does a consistent read of the key and checks it is still held by our session.
+// It returns ErrSplitBrain if someone else (or nobody) holds it.
+func (ec *exclusiveWorker) verifyOwnership(sessionID string) error {
+	pair, _, err := ec.client.KV().Get(ec.key, &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		// We can not tell, the renewals will decide if the session is still alive
+		return nil
+	}
+	owner := ""
+	if pair != nil {
+		owner = pair.Session
+	}
+	// SetTTL may have moved the lock to a new session since sessionID was read
+	if owner != sessionID && !ec.ownSession(owner) {
+		return fmt.Errorf("%w: key %s is held by session %q, we are %q", ErrSplitBrain, ec.key, owner, sessionID)
+	}
+	return nil
+}
+
+// verifyLoop checks every verifyInterval that we still own the key. This is belt and
+// braces against renewals succeeding for a session that no longer owns the key.
+// A mismatch ends the loop and is returned, it returns nil once ctx is done.
+func (ec *exclusiveWorker) verifyLoop(ctx context.Context) error {
+	ticker := ec.clock.NewTicker(ec.verifyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if err := ec.verifyOwnership(ec.currentSession()); err != nil {
+				ec.metrics.splitBrain.Add(1)
+				ec.emit(EventSplitBrain, err.Error())
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// Set at build time, they take precedence over what the go toolchain recorded:
+//
+//	go build -ldflags "-X main.version=v1.4.0 -X main.gitCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+var (
+	version   string
+	gitCommit string
+	buildTime string
+)
+
+// BuildInfo tells which binary a worker runs, published in the holder metadata, the
+// status file and endpoint and the audit records, to know which version leads a key
+type BuildInfo struct {
+	Version  string `json:"version,omitempty"`  // Module version or the one set with -ldflags
+	Revision string `json:"revision,omitempty"` // Git commit
+	Time     string `json:"time,omitempty"`     // Build time, or the time of the commit
+	Modified bool   `json:"modified,omitempty"` // Built from a tree with uncommitted changes
+}
+
+// currentBuild is the BuildInfo of this binary, from -ldflags and completed with
+// debug.ReadBuildInfo. Nil if nothing is known, e.g. built with go run outside git
+var currentBuild = sync.OnceValue(func() *BuildInfo {
+	b := &BuildInfo{Version: version, Revision: gitCommit, Time: buildTime}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		info = &debug.BuildInfo{}
+	}
+	if b.Version == "" && info.Main.Version != "(devel)" {
+		b.Version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && b.Revision == "":
+			b.Revision = s.Value
+		case s.Key == "vcs.time" && b.Time == "":
+			b.Time = s.Value
+		case s.Key == "vcs.modified":
+			b.Modified = s.Value == "true"
+		}
+	}
+	if *b == (BuildInfo{}) {
+		return nil
+	}
+	return b
+})
+
+// String describes the build for the status command, e.g. v1.4.0 (3f2a9c1, 2026-01-12T10:00:00Z)
+func (b *BuildInfo) String() string {
+	s := b.Version
+	if s == "" {
+		s = "unknown version"
+	}
+	var details []string
+	if b.Revision != "" {
+		rev := b.Revision
+		if len(rev) > 7 {
+			rev = rev[:7]
+		}
+		if b.Modified {
+			rev += "+dirty"
+		}
+		details = append(details, rev)
+	}
+	if b.Time != "" {
+		details = append(details, b.Time)
+	}
+	if len(details) > 0 {
+		s += " (" + strings.Join(details, ", ") + ")"
+	}
+	return s
+}
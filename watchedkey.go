@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// watchedKey is a KV key deciding whether the worker contends, like the maintenance
+// flag or the preferred generation. The first waitForKey reads it and starts watching
+// it, every change of its value wakes up the waiters and is passed to onChange.
+type watchedKey struct {
+	key      string
+	what     string                // Names the key in the logs, e.g. "maintenance flag"
+	onChange func(old, new string) // Called with the trimmed values when the value changes
+
+	once    sync.Once // Starts watching the key
+	mu      sync.Mutex
+	value   string        // Last trimmed value, empty if the key does not exist
+	changed chan struct{} // Closed and replaced when value changes
+}
+
+func newWatchedKey(key, what string, onChange func(old, new string)) *watchedKey {
+	return &watchedKey{key: key, what: what, onChange: onChange, changed: make(chan struct{})}
+}
+
+// get returns the last value of the key and a channel closed when it changes
+func (w *watchedKey) get() (string, <-chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.value, w.changed
+}
+
+// set records the value of the key, wakes up the waiters and calls onChange if it changed
+func (w *watchedKey) set(pair *api.KVPair) {
+	value := ""
+	if pair != nil {
+		value = strings.TrimSpace(string(pair.Value))
+	}
+	w.mu.Lock()
+	old := w.value
+	if value == old {
+		w.mu.Unlock()
+		return
+	}
+	w.value = value
+	close(w.changed)
+	w.changed = make(chan struct{})
+	w.mu.Unlock()
+
+	if w.onChange != nil {
+		w.onChange(old, value)
+	}
+}
+
+// watchKey reads w and starts watching it until the worker is closed. It is done
+// once, the first time we are about to contend.
+func (ec *exclusiveWorker) watchKey(w *watchedKey) {
+	w.once.Do(func() {
+		pair, _, err := ec.client.KV().Get(w.key, nil)
+		if err != nil {
+			ec.logf("Could not read the %s %s: %s", w.what, w.key, err)
+		}
+		w.set(pair)
+
+		f := newFollower(ec.client, map[string]interface{}{"type": "key", "key": w.key}, func(_ uint64, raw interface{}) {
+			pair, _ := raw.(*api.KVPair)
+			w.set(pair)
+		})
+		f.OnError = func(err error) {
+			ec.logf("Could not watch the %s %s: %s", w.what, w.key, err)
+		}
+		if err := f.Start(); err != nil {
+			ec.logf("Could not watch the %s %s: %s", w.what, w.key, err)
+			return
+		}
+		go func() {
+			<-ec.closed
+			f.Stop()
+		}()
+	})
+}
+
+// waitForKey blocks until contend accepts the value of w. A session we were
+// contending with is destroyed, it would expire while we wait anyway.
+func (ec *exclusiveWorker) waitForKey(ctx context.Context, w *watchedKey, contend func(value string) bool) error {
+	ec.watchKey(w)
+	for {
+		value, changed := w.get()
+		if contend(value) {
+			return nil
+		}
+		if ec.State() == StateAcquiring {
+			ec.destroySession()
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ec.closed:
+			return ErrClosed
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a daily time window, like 02:00-03:00, outside of which we do not
+// contend for the lock and the running work is resigned. It can cross midnight
+// (22:00-02:00). Times are in the local time zone.
+type Window struct {
+	start time.Duration // Since midnight
+	end   time.Duration // Since midnight
+}
+
+// parseWindow parses "HH:MM-HH:MM". An empty spec means no window
+func parseWindow(spec string) (*Window, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	parts := strings.Split(strings.ReplaceAll(spec, "–", "-"), "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", spec)
+	}
+	var w Window
+	for i, out := range []*time.Duration{&w.start, &w.end} {
+		t, err := time.Parse("15:04", strings.TrimSpace(parts[i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %q: %s", spec, err)
+		}
+		*out = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid window %q, it is empty", spec)
+	}
+	return &w, nil
+}
+
+func (w *Window) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return format(w.start) + "-" + format(w.end)
+}
+
+// open returns if t is inside the window
+func (w *Window) open(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	now := sinceMidnight(t)
+	if w.start < w.end {
+		return now >= w.start && now < w.end
+	}
+	// Crosses midnight
+	return now >= w.start || now < w.end
+}
+
+// nextOpen returns when the window opens next after t (t itself if it is open)
+func (w *Window) nextOpen(t time.Time) time.Time {
+	if w.open(t) {
+		return t
+	}
+	return nextTimeOfDay(t, w.start)
+}
+
+// closesAt returns when the window that is open at t closes
+func (w *Window) closesAt(t time.Time) time.Time {
+	return nextTimeOfDay(t, w.end)
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	y, m, d := t.Date()
+	return t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+}
+
+// nextTimeOfDay returns the first time after t that is tod past midnight
+func nextTimeOfDay(t time.Time, tod time.Duration) time.Time {
+	y, m, d := t.Date()
+	next := time.Date(y, m, d, 0, 0, 0, 0, t.Location()).Add(tod)
+	if !next.After(t) {
+		next = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location()).Add(tod)
+	}
+	return next
+}
+
+// waitForWindow blocks until the window is open. A session created outside
+// of the window is destroyed, there is no point keeping it alive until then
+func (ec *exclusiveWorker) waitForWindow(ctx context.Context) error {
+	now := ec.clock.Now()
+	if ec.window.open(now) {
+		return nil
+	}
+	if ec.State() == StateAcquiring {
+		ec.destroySession()
+	}
+	opens := ec.window.nextOpen(now)
+	ec.logf("Outside of the window %s, waiting until %s", ec.window, opens.Format(time.RFC3339))
+	return ec.sleep(ctx, ec.until(opens))
+}
+
+// resignAtWindowClose resigns when the window closes, so work that started late
+// does not run outside of it
+func (ec *exclusiveWorker) resignAtWindowClose(t Transition) {
+	if t.To != StateHeld {
+		return
+	}
+	ec.clock.AfterFunc(ec.until(ec.window.closesAt(t.At)), func() {
+		if ec.LeadershipID() != t.LeadershipID || ec.State() != StateHeld {
+			// That leadership is already over
+			return
+		}
+		ec.logf("The window %s closed, resigning", ec.window)
+		ec.Resign()
+	})
+}